@@ -0,0 +1,95 @@
+package winfsp
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/winfsp/go-winfsp/internal/callstack"
+)
+
+// dirBufferRecord is the first use of a tracked DirBuffer.
+type dirBufferRecord struct {
+	seq   uint64
+	stack []uintptr
+}
+
+var (
+	trackDirBuffers   atomic.Bool
+	dirBuffersMtx     sync.Mutex
+	dirBufferSeq      uint64
+	trackedDirBuffers = make(map[*DirBuffer]dirBufferRecord)
+)
+
+// DebugTrackDirBuffers enables or disables recording the
+// stack where each DirBuffer is first filled, so that the
+// ones not deleted yet can be reported by DirBufferLeaks.
+// Disabling the tracking forgets the buffers recorded so
+// far.
+//
+// The tracking is meant for debugging and testing only,
+// e.g. asserting that the file system deletes the buffer
+// of every directory handle once it is closed.
+func DebugTrackDirBuffers(enable bool) {
+	trackDirBuffers.Store(enable)
+	if !enable {
+		dirBuffersMtx.Lock()
+		defer dirBuffersMtx.Unlock()
+		clear(trackedDirBuffers)
+	}
+}
+
+// trackDirBuffer records the first use of buf if tracking.
+func trackDirBuffer(buf *DirBuffer) {
+	if !trackDirBuffers.Load() {
+		return
+	}
+	dirBuffersMtx.Lock()
+	_, ok := trackedDirBuffers[buf]
+	dirBuffersMtx.Unlock()
+	if ok {
+		return
+	}
+	stack := callstack.Capture(0)
+	dirBuffersMtx.Lock()
+	defer dirBuffersMtx.Unlock()
+	if _, ok := trackedDirBuffers[buf]; ok {
+		return
+	}
+	dirBufferSeq++
+	trackedDirBuffers[buf] = dirBufferRecord{
+		seq:   dirBufferSeq,
+		stack: stack,
+	}
+}
+
+// untrackDirBuffer forgets buf once it has been deleted.
+func untrackDirBuffer(buf *DirBuffer) {
+	if !trackDirBuffers.Load() {
+		return
+	}
+	dirBuffersMtx.Lock()
+	defer dirBuffersMtx.Unlock()
+	delete(trackedDirBuffers, buf)
+}
+
+// DirBufferLeaks returns the formatted stacks where the
+// DirBuffers not yet deleted are first filled, which are
+// recorded since DebugTrackDirBuffers is enabled, in the
+// order of their first use.
+func DirBufferLeaks() []string {
+	dirBuffersMtx.Lock()
+	records := make([]dirBufferRecord, 0, len(trackedDirBuffers))
+	for _, record := range trackedDirBuffers {
+		records = append(records, record)
+	}
+	dirBuffersMtx.Unlock()
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].seq < records[j].seq
+	})
+	result := make([]string, 0, len(records))
+	for _, record := range records {
+		result = append(result, callstack.Format(record.stack))
+	}
+	return result
+}
@@ -0,0 +1,68 @@
+package winfsp
+
+import (
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Detached is a file system whose behaviours are wired
+// into the operations as Mount does, but without loading
+// WinFSP or creating a volume, so that the operations
+// could be invoked through the FSP_FILE_SYSTEM_INTERFACE
+// in place of the WinFSP dispatcher.
+//
+// It is meant for testing the wiring of the callbacks,
+// see the mocktransact package. The behaviours calling
+// into WinFSP, e.g. through DirBuffer, still require the
+// WinFSP DLL to be installed.
+type Detached struct {
+	FileSystemRef
+	fileSystem FSP_FILE_SYSTEM
+	attributes uint32
+}
+
+// NewDetached validates the file system and the options,
+// and wires the behaviours of the file system. The result
+// must be closed after use.
+func NewDetached(fs BehaviourBase, opts ...Option) (*Detached, error) {
+	if err := Validate(fs, opts...); err != nil {
+		return nil, err
+	}
+	option := resolveOption(fs, opts)
+	result := &Detached{}
+	fileSystemRef := &result.FileSystemRef
+	fileSystemAddr := uintptr(unsafe.Pointer(fileSystemRef))
+	_, loaded := refMap.LoadOrStore(fileSystemAddr, fileSystemRef)
+	if loaded {
+		return nil, errors.New("out of memory")
+	}
+	fileSystemOps, attributes := wireBehaviours(fs, option, fileSystemRef)
+	result.attributes = attributes
+	result.fileSystem.UserContext = fileSystemAddr
+	result.fileSystem.Interface = fileSystemOps
+	if attributes&FspFSAttributeUmFileContextIsFullContext != 0 {
+		result.fileSystem.UmFileContextIsFullContext = 1
+	} else {
+		result.fileSystem.UmFileContextIsUserContext2 = 1
+	}
+	return result, nil
+}
+
+// FileSystem returns the FSP_FILE_SYSTEM to be passed to
+// the operations, whose Interface holds the operations.
+func (d *Detached) FileSystem() *FSP_FILE_SYSTEM {
+	return &d.fileSystem
+}
+
+// Attributes returns the FspFSAttribute* flags which the
+// volume would be created with by Mount.
+func (d *Detached) Attributes() uint32 {
+	return d.attributes
+}
+
+// Close releases the file system, after which the
+// operations must no longer be invoked.
+func (d *Detached) Close() {
+	refMap.Delete(uintptr(unsafe.Pointer(&d.FileSystemRef)))
+}
@@ -0,0 +1,58 @@
+package winfsp
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// The createOptions passed to BehaviourCreate and
+// BehaviourBase.Open carries the disposition in its
+// high 8 bits and the create flags in the low 24 bits,
+// just as NtCreateFile's CreateDisposition and
+// CreateOptions being packed together.
+const (
+	CreateDispositionShift = 24
+	CreateDispositionMask  = 0xff
+	CreateFlagsMask        = 1<<CreateDispositionShift - 1
+)
+
+// CreateDisposition extracts the disposition, e.g.
+// windows.FILE_OPEN_IF, from the createOptions.
+func CreateDisposition(createOptions uint32) uint32 {
+	return (createOptions >> CreateDispositionShift) & CreateDispositionMask
+}
+
+// CreateFlags extracts the create flags, e.g.
+// windows.FILE_DIRECTORY_FILE, from the createOptions.
+func CreateFlags(createOptions uint32) uint32 {
+	return createOptions & CreateFlagsMask
+}
+
+// IsSupersede tells whether the disposition is FILE_SUPERSEDE.
+func IsSupersede(createOptions uint32) bool {
+	return CreateDisposition(createOptions) == windows.FILE_SUPERSEDE
+}
+
+// IsOpen tells whether the disposition is FILE_OPEN.
+func IsOpen(createOptions uint32) bool {
+	return CreateDisposition(createOptions) == windows.FILE_OPEN
+}
+
+// IsCreate tells whether the disposition is FILE_CREATE.
+func IsCreate(createOptions uint32) bool {
+	return CreateDisposition(createOptions) == windows.FILE_CREATE
+}
+
+// IsOpenIf tells whether the disposition is FILE_OPEN_IF.
+func IsOpenIf(createOptions uint32) bool {
+	return CreateDisposition(createOptions) == windows.FILE_OPEN_IF
+}
+
+// IsOverwrite tells whether the disposition is FILE_OVERWRITE.
+func IsOverwrite(createOptions uint32) bool {
+	return CreateDisposition(createOptions) == windows.FILE_OVERWRITE
+}
+
+// IsOverwriteIf tells whether the disposition is FILE_OVERWRITE_IF.
+func IsOverwriteIf(createOptions uint32) bool {
+	return CreateDisposition(createOptions) == windows.FILE_OVERWRITE_IF
+}
@@ -0,0 +1,42 @@
+package winfsp_test
+
+import (
+	"testing"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+func TestCreateDisposition(t *testing.T) {
+	const flags = windows.FILE_DIRECTORY_FILE | windows.FILE_DELETE_ON_CLOSE
+	for _, tt := range []struct {
+		disposition uint32
+		predicate   func(uint32) bool
+	}{
+		{windows.FILE_SUPERSEDE, winfsp.IsSupersede},
+		{windows.FILE_OPEN, winfsp.IsOpen},
+		{windows.FILE_CREATE, winfsp.IsCreate},
+		{windows.FILE_OPEN_IF, winfsp.IsOpenIf},
+		{windows.FILE_OVERWRITE, winfsp.IsOverwrite},
+		{windows.FILE_OVERWRITE_IF, winfsp.IsOverwriteIf},
+	} {
+		createOptions := tt.disposition<<24 | flags
+		if got := winfsp.CreateDisposition(createOptions); got != tt.disposition {
+			t.Errorf("CreateDisposition(%#x) = %d; want %d",
+				createOptions, got, tt.disposition)
+		}
+		if got := winfsp.CreateFlags(createOptions); got != flags {
+			t.Errorf("CreateFlags(%#x) = %#x; want %#x",
+				createOptions, got, flags)
+		}
+		if !tt.predicate(createOptions) {
+			t.Errorf("predicate of disposition %d rejects %#x",
+				tt.disposition, createOptions)
+		}
+		if tt.predicate(flags) && tt.disposition != windows.FILE_SUPERSEDE {
+			t.Errorf("predicate of disposition %d accepts %#x",
+				tt.disposition, uint32(flags))
+		}
+	}
+}
@@ -37,14 +37,25 @@ func BinPath() (string, error) {
 	if err != nil {
 		return "", findInstallError(err)
 	}
-	var pathBuf [syscall.MAX_PATH]uint16
+	// The installation directory might be a long path
+	// exceeding MAX_PATH, in which case the buffer is
+	// grown to the size reported by the registry.
+	pathBuf := make([]uint16, syscall.MAX_PATH)
 	var valueType, valueSize uint32
-	valueSize = uint32(len(pathBuf)) * SIZEOF_WCHAR
-	if err := syscall.RegQueryValueEx(
-		keyReg, valueName, nil, &valueType,
-		(*byte)(unsafe.Pointer(&pathBuf)), &valueSize,
-	); err != nil {
-		return "", findInstallError(err)
+	for {
+		valueSize = uint32(len(pathBuf)) * SIZEOF_WCHAR
+		err := syscall.RegQueryValueEx(
+			keyReg, valueName, nil, &valueType,
+			(*byte)(unsafe.Pointer(&pathBuf[0])), &valueSize,
+		)
+		if err == syscall.ERROR_MORE_DATA {
+			pathBuf = make([]uint16, (valueSize+SIZEOF_WCHAR-1)/SIZEOF_WCHAR)
+			continue
+		}
+		if err != nil {
+			return "", findInstallError(err)
+		}
+		break
 	}
 	if valueType != syscall.REG_SZ {
 		return "", findInstallError(syscall.ERROR_MOD_NOT_FOUND)
@@ -169,6 +180,40 @@ func loadWinFSPDLL() (*syscall.DLL, error) {
 // return values. See dllProc.Call below for details.
 type dllProc struct {
 	proc *syscall.Proc
+
+	// optional is set for the procs registered by
+	// registerOptionalProc, which are resolved upon
+	// their first call instead.
+	optional *optionalProc
+}
+
+// ErrNotSupported is returned by the functions relying
+// on the procs which are not exported by the loaded
+// WinFSP DLL, since they were added in later versions.
+var ErrNotSupported = errors.New("winfsp does not support the operation")
+
+// optionalProc is the proc resolved upon its first call,
+// whose absence only fails the calls to it.
+type optionalProc struct {
+	name string
+	once sync.Once
+	proc *syscall.Proc
+	err  error
+}
+
+// find resolves the proc from the DLL once, reporting
+// ErrNotSupported if the DLL does not export it.
+func (p *optionalProc) find(dll *syscall.DLL) (*syscall.Proc, error) {
+	p.once.Do(func() {
+		proc, err := dll.FindProc(p.name)
+		if err != nil {
+			p.err = errors.Wrapf(ErrNotSupported,
+				"winfsp cannot find proc %q", p.name)
+			return
+		}
+		p.proc = proc
+	})
+	return p.proc, p.err
 }
 
 // ntStatusPtr is a sentinel value used by dllProc.Call to indicate an argument
@@ -190,7 +235,7 @@ load error there.
 	// This is actually an assertion error, since it
 	// must have been registered by registerProc, then
 	// tryLoadWinFSP will load it.
-	if p.proc == nil {
+	if p.proc == nil && p.optional == nil {
 		panic("dllProc not registered for initialization")
 	}
 }
@@ -205,15 +250,20 @@ load error there.
 // and return it as an error if it's not STATUS_SUCCESS.
 //
 // When the error is non-nil, it's always of type syscall.Errno, like
-// syscall.Proc.Call.
+// syscall.Proc.Call, unless the optional proc is missing, in which
+// case ErrNotSupported is returned without calling it.
 func (p dllProc) Call(args ...uintptr) (uintptr, error) {
 	p.EnsureInitialized()
+	proc, err := p.resolve()
+	if err != nil {
+		return 0, err
+	}
 	var ntStatus windows.NTStatus
 	statusIdx := slices.Index(args, ntStatusPtr)
 	if statusIdx != -1 {
 		args[statusIdx] = uintptr(unsafe.Pointer(&ntStatus))
 	}
-	res1, _, err := p.proc.Call(args...)
+	res1, _, err := proc.Call(args...)
 	if err == syscall.Errno(0) {
 		err = nil
 	}
@@ -223,6 +273,25 @@ func (p dllProc) Call(args ...uintptr) (uintptr, error) {
 	return res1, err
 }
 
+// resolve returns the proc to call, resolving the
+// optional proc upon its first call.
+func (p dllProc) resolve() (*syscall.Proc, error) {
+	if p.optional != nil {
+		return p.optional.find(winFSPDLL)
+	}
+	return p.proc, nil
+}
+
+// Addr returns the address of the proc, which must have
+// been called successfully if it is optional.
+func (p dllProc) Addr() uintptr {
+	proc, err := p.resolve()
+	if err != nil {
+		return 0
+	}
+	return proc.Addr()
+}
+
 // CallStatus is like syscall.Proc.Call1 but is used for procedures that return a
 // NTSTATUS status code in the first return value, which if non-STATUS_SUCCESS,
 // is returned as an error.
@@ -267,6 +336,17 @@ func registerProc(name string, target *dllProc) {
 	})
 }
 
+// registerOptionalProc registers a dllProc which is not
+// exported by the older versions of WinFSP. It is only
+// resolved when it is first called, so that its absence
+// fails the calls to it with ErrNotSupported rather than
+// loading winFSPDLL.
+//
+// Must only be called from a init() function.
+func registerOptionalProc(name string, target *dllProc) {
+	target.optional = &optionalProc{name: name}
+}
+
 func initWinFSP() error {
 	dll, err := loadWinFSPDLL()
 	if err != nil {
@@ -312,3 +392,28 @@ func LoadWinFSPWithDLL(dll *syscall.DLL) error {
 func LoadWinFSP() error {
 	return LoadWinFSPWithDLL(nil)
 }
+
+var fspVersion dllProc
+
+func init() {
+	registerOptionalProc("FspVersion", &fspVersion)
+}
+
+// Version returns the version of the loaded WinFSP DLL,
+// loading it if it has not been loaded.
+//
+// FspVersion is only exported since WinFSP 2019.3
+// (version 1.5), so ErrNotSupported is returned by the
+// older versions.
+func Version() (major, minor uint16, err error) {
+	if err := tryLoadWinFSP(); err != nil {
+		return 0, 0, err
+	}
+	var version uint32
+	if err := fspVersion.CallStatus(
+		uintptr(unsafe.Pointer(&version)),
+	); err != nil {
+		return 0, 0, errors.Wrap(err, "FspVersion")
+	}
+	return uint16(version >> 16), uint16(version), nil
+}
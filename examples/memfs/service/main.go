@@ -0,0 +1,39 @@
+//go:build windows
+
+// Command service runs the In-Memory WinFSP filesystem
+// as a windows service, which could be registered and
+// started by:
+//
+//	sc create memfs binPath= "C:\path\to\service.exe"
+//	sc start memfs X:
+//
+// Or run directly from the console for debugging, where
+// the arguments are taken from the command line.
+package main
+
+import (
+	"log"
+
+	"github.com/winfsp/go-winfsp"
+	"github.com/winfsp/go-winfsp/gofs"
+	"github.com/winfsp/go-winfsp/memfs"
+	"github.com/winfsp/go-winfsp/service"
+)
+
+func start(args []string) ([]*winfsp.FileSystem, error) {
+	mountpoint := "X:"
+	if len(args) > 1 {
+		mountpoint = args[1]
+	}
+	fs, err := winfsp.Mount(gofs.New(memfs.New()), mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	return []*winfsp.FileSystem{fs}, nil
+}
+
+func main() {
+	if err := service.RunAsService("memfs", start); err != nil {
+		log.Fatal(err)
+	}
+}
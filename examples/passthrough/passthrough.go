@@ -5,6 +5,10 @@ package passthrough
 import (
 	"os"
 	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
 
 	"github.com/winfsp/go-winfsp/gofs"
 )
@@ -33,4 +37,111 @@ func (ptfs *Passthrough) Stat(name string) (os.FileInfo, error) {
 	return os.Stat(filepath.Join(ptfs.Dir, name))
 }
 
-var _ gofs.FileSystem = (*Passthrough)(nil)
+// watchNotifyFilter is the changes of the host directory
+// reported by Watch.
+const watchNotifyFilter = windows.FILE_NOTIFY_CHANGE_FILE_NAME |
+	windows.FILE_NOTIFY_CHANGE_DIR_NAME |
+	windows.FILE_NOTIFY_CHANGE_LAST_WRITE |
+	windows.FILE_NOTIFY_CHANGE_SIZE
+
+// Watch watches the host directory with ReadDirectoryChangesW,
+// so that the changes made by other processes are propagated
+// to the volume.
+func (ptfs *Passthrough) Watch(name string) (<-chan gofs.ChangeEvent, func(), error) {
+	path, err := windows.UTF16PtrFromString(filepath.Join(ptfs.Dir, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	handle, err := windows.CreateFile(
+		path, windows.FILE_LIST_DIRECTORY,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OVERLAPPED, 0,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	ioEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		_ = windows.CloseHandle(handle)
+		return nil, nil, err
+	}
+	stopEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		_ = windows.CloseHandle(ioEvent)
+		_ = windows.CloseHandle(handle)
+		return nil, nil, err
+	}
+	events := make(chan gofs.ChangeEvent)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(events)
+		defer func() { _ = windows.CloseHandle(stopEvent) }()
+		defer func() { _ = windows.CloseHandle(ioEvent) }()
+		defer func() { _ = windows.CloseHandle(handle) }()
+		watchDirectory(handle, ioEvent, stopEvent, name, events, stopped)
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(stopped)
+			_ = windows.SetEvent(stopEvent)
+		})
+	}
+	return events, stop, nil
+}
+
+func watchDirectory(
+	handle, ioEvent, stopEvent windows.Handle, name string,
+	events chan<- gofs.ChangeEvent, stopped <-chan struct{},
+) {
+	// The buffer is made of uint32 for the DWORD alignment
+	// required by ReadDirectoryChangesW.
+	buf := make([]uint32, 16384)
+	bufLen := uint32(len(buf) * 4)
+	for {
+		overlapped := &windows.Overlapped{HEvent: ioEvent}
+		if err := windows.ReadDirectoryChanges(
+			handle, (*byte)(unsafe.Pointer(&buf[0])), bufLen,
+			false, watchNotifyFilter, nil, overlapped, 0,
+		); err != nil {
+			return
+		}
+		var n uint32
+		index, err := windows.WaitForMultipleObjects(
+			[]windows.Handle{ioEvent, stopEvent}, false, windows.INFINITE)
+		if err != nil || index != windows.WAIT_OBJECT_0 {
+			_ = windows.CancelIoEx(handle, overlapped)
+			_ = windows.GetOverlappedResult(handle, overlapped, &n, true)
+			return
+		}
+		if err := windows.GetOverlappedResult(
+			handle, overlapped, &n, false); err != nil {
+			return
+		}
+
+		// Zero bytes are returned when the changes overflow
+		// the buffer, in which case they are lost.
+		offset := uint32(0)
+		for n > 0 {
+			info := (*windows.FileNotifyInformation)(
+				unsafe.Add(unsafe.Pointer(&buf[0]), offset))
+			entry := windows.UTF16ToString(unsafe.Slice(
+				&info.FileName, info.FileNameLength/2))
+			select {
+			case events <- gofs.ChangeEvent{
+				Name:   filepath.Join(name, entry),
+				Action: info.Action,
+			}:
+			case <-stopped:
+				return
+			}
+			if info.NextEntryOffset == 0 {
+				break
+			}
+			offset += info.NextEntryOffset
+		}
+	}
+}
+
+var _ gofs.FileSystemWatch = (*Passthrough)(nil)
@@ -0,0 +1,61 @@
+package winfsp
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// AttributesFromFileMode converts the mode of a file into
+// its Windows attributes, the same way gofs does with the
+// default AttribReadOnlyWindows mode when nothing beyond
+// the mode is known about the file:
+//
+//   - A directory is FILE_ATTRIBUTE_DIRECTORY.
+//   - A regular file without the write permission of its
+//     owner is FILE_ATTRIBUTE_READONLY.
+//   - A symbolic link, named pipe, socket or device is
+//     FILE_ATTRIBUTE_REPARSE_POINT, as WSL represents them.
+//   - A file of unknown type is FILE_ATTRIBUTE_SYSTEM.
+//   - Any other file is FILE_ATTRIBUTE_NORMAL.
+func AttributesFromFileMode(mode os.FileMode) uint32 {
+	var attributes uint32
+	switch {
+	case mode.IsDir():
+		attributes |= windows.FILE_ATTRIBUTE_DIRECTORY
+	case mode.IsRegular():
+		if mode.Perm()&0o200 == 0 {
+			attributes |= windows.FILE_ATTRIBUTE_READONLY
+		}
+	case mode&os.ModeIrregular != 0:
+		attributes |= windows.FILE_ATTRIBUTE_SYSTEM
+	}
+	if mode&(os.ModeSymlink|os.ModeNamedPipe|
+		os.ModeSocket|os.ModeDevice) != 0 {
+		attributes |= windows.FILE_ATTRIBUTE_REPARSE_POINT
+	}
+	if attributes == 0 {
+		attributes = windows.FILE_ATTRIBUTE_NORMAL
+	}
+	return attributes
+}
+
+// FileModeFromAttributes converts the Windows attributes
+// of a file into its mode, the same way the os package
+// does on Windows: the file is readable by everyone and
+// writable unless it is FILE_ATTRIBUTE_READONLY, while a
+// directory is also executable. A reparse point is taken
+// as a symbolic link, since its tag is not known.
+func FileModeFromAttributes(attributes uint32) os.FileMode {
+	mode := os.FileMode(0o666)
+	if attributes&windows.FILE_ATTRIBUTE_READONLY != 0 {
+		mode = 0o444
+	}
+	if attributes&windows.FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		return mode | os.ModeSymlink
+	}
+	if attributes&windows.FILE_ATTRIBUTE_DIRECTORY != 0 {
+		return mode | os.ModeDir | 0o111
+	}
+	return mode
+}
@@ -0,0 +1,36 @@
+package winfsp_test
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+func TestFileModeAttributes(t *testing.T) {
+	for _, tt := range []struct {
+		mode       os.FileMode
+		attributes uint32
+		roundTrip  os.FileMode
+	}{
+		{os.ModeDir | 0o755, windows.FILE_ATTRIBUTE_DIRECTORY, os.ModeDir | 0o777},
+		{os.ModeDir | 0o555, windows.FILE_ATTRIBUTE_DIRECTORY, os.ModeDir | 0o777},
+		{0o644, windows.FILE_ATTRIBUTE_NORMAL, 0o666},
+		{0o444, windows.FILE_ATTRIBUTE_READONLY, 0o444},
+		{os.ModeSymlink | 0o777, windows.FILE_ATTRIBUTE_REPARSE_POINT, os.ModeSymlink | 0o666},
+		{os.ModeNamedPipe | 0o644, windows.FILE_ATTRIBUTE_REPARSE_POINT, os.ModeSymlink | 0o666},
+		{os.ModeIrregular | 0o644, windows.FILE_ATTRIBUTE_SYSTEM, 0o666},
+	} {
+		attributes := winfsp.AttributesFromFileMode(tt.mode)
+		if attributes != tt.attributes {
+			t.Errorf("AttributesFromFileMode(%v) = %#x; want %#x",
+				tt.mode, attributes, tt.attributes)
+		}
+		if mode := winfsp.FileModeFromAttributes(attributes); mode != tt.roundTrip {
+			t.Errorf("FileModeFromAttributes(%#x) = %v; want %v",
+				attributes, mode, tt.roundTrip)
+		}
+	}
+}
@@ -1,18 +1,26 @@
 package winfsp
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"math"
 	"os"
 	"reflect"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf16"
 	"unsafe"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp/log"
 )
 
 // FileSystemRef is the reference for the file system,
@@ -22,6 +30,7 @@ type FileSystemRef struct {
 	fileSystemOps         *FSP_FILE_SYSTEM_INTERFACE
 	fileSystem            *FSP_FILE_SYSTEM
 	base                  BehaviourBase
+	closeWithInfo         BehaviourCloseWithInfo
 	getVolumeInfo         BehaviourGetVolumeInfo
 	setVolumeLabel        BehaviourSetVolumeLabel
 	getSecurityByName     BehaviourGetSecurityByName
@@ -40,12 +49,111 @@ type FileSystemRef struct {
 	setSecurity           BehaviourSetSecurity
 	readDirRaw            BehaviourReadDirectoryRaw
 	getDirInfoByName      BehaviourGetDirInfoByName
-	deviceIoControl       BehaviourDeviceIoControl
+	deviceIoControl       BehaviourDeviceIoControlEx
 	createEx              BehaviourCreateEx
+	getEa                 BehaviourGetEa
+	setEa                 BehaviourSetEa
 	deleteReparsePoint    BehaviourDeleteReparsePoint
 	getReparsePoint       BehaviourGetReparsePoint
 	getReparsePointByName BehaviourGetReparsePointByName
 	setReparsePoint       BehaviourSetReparsePoint
+
+	name            string
+	mountPoint      string
+	sectorSize      uint32
+	allocationUnit  uint32
+	maxTransferSize uint32
+	maxComponent    uint16
+	batchDirFills   bool
+	fullContext     bool
+	poisonWrites    bool
+	irpTimeout      time.Duration
+	logger          log.Log
+
+	// mounted points to the owning file system while
+	// it is mounted, and is cleared by Unmount.
+	mounted atomic.Pointer[FileSystem]
+
+	// operations and pending count the operations
+	// dispatched so far and being dispatched, which
+	// are maintained by traceCall and traceReturn.
+	operations atomic.Uint64
+	pending    atomic.Int64
+}
+
+// Name returns the identifier of the file system specified
+// by the WithName option upon mounting, which might be
+// empty if unspecified.
+//
+// It is intended for telling apart multiple mounted file
+// systems in the same process.
+func (fileSystem *FileSystemRef) Name() string {
+	return fileSystem.name
+}
+
+// Base returns the file system passed to Mount, so that
+// the helpers given only the reference may call back into
+// it, e.g. by asserting it to other behaviours.
+func (fileSystem *FileSystemRef) Base() BehaviourBase {
+	return fileSystem.base
+}
+
+// Logger returns the logger specified by the WithLogger
+// option upon mounting, which might be nil.
+func (fileSystem *FileSystemRef) Logger() log.Log {
+	return fileSystem.logger
+}
+
+// MountPoint returns the mount point of the file system,
+// which is the drive letter chosen by Mount when it is
+// mounted at "*".
+func (fileSystem *FileSystemRef) MountPoint() string {
+	return fileSystem.mountPoint
+}
+
+// SectorSize returns the size of sector in bytes
+// specified by the SectorSize option upon mounting.
+func (fileSystem *FileSystemRef) SectorSize() uint32 {
+	return fileSystem.sectorSize
+}
+
+// AllocationUnit returns the size of allocation unit in
+// bytes specified by the SectorSize option upon mounting.
+func (fileSystem *FileSystemRef) AllocationUnit() uint32 {
+	return fileSystem.allocationUnit
+}
+
+// MaxComponentLength returns the maximum length of each
+// name component in UTF-16 code units, which is specified
+// by the MaxComponentLength option upon mounting.
+func (fileSystem *FileSystemRef) MaxComponentLength() uint16 {
+	if fileSystem.maxComponent == 0 {
+		return defaultMaxComponentLength
+	}
+	return fileSystem.maxComponent
+}
+
+// OperationContext returns a context whose deadline is
+// derived from the IrpTimeout option, after which WinFSP
+// cancels the pending request, so that the file system
+// may stop working on an operation nobody waits for.
+//
+// The deadline is relative to the time of calling, so it
+// should be called at the beginning of an operation by the
+// goroutine dispatching it. The request has been pending
+// for a while before that, so WinFSP might still cancel it
+// a bit earlier. The context belongs to that single
+// operation, and must be cancelled once the operation is
+// done. When IrpTimeout is unspecified, the context has no
+// deadline.
+func (fileSystem *FileSystemRef) OperationContext() (
+	context.Context, context.CancelFunc,
+) {
+	if fileSystem.irpTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(
+		context.Background(), fileSystem.irpTimeout)
 }
 
 // ntStatusNoRef is returned when user context to inner
@@ -63,6 +171,31 @@ func loadFileSystemRef(fileSystem uintptr) *FileSystemRef {
 	return value.(*FileSystemRef)
 }
 
+// loadFile interprets the file context passed by WinFSP
+// into the file handle returned by Open or Create, see
+// FullContextMode.
+func (ref *FileSystemRef) loadFile(file uintptr) uintptr {
+	if !ref.fullContext || file == 0 {
+		return file
+	}
+	fullContext := (*FSP_FSCTL_TRANSACT_FULL_CONTEXT)(
+		unsafe.Pointer(file))
+	return uintptr(fullContext.UserContext2)
+}
+
+// storeFile stores the file handle returned by Open or
+// Create into the file context, see FullContextMode.
+func (ref *FileSystemRef) storeFile(file *uintptr, handle uintptr) {
+	if !ref.fullContext {
+		*file = handle
+		return
+	}
+	fullContext := (*FSP_FSCTL_TRANSACT_FULL_CONTEXT)(
+		unsafe.Pointer(file))
+	fullContext.UserContext = 0
+	fullContext.UserContext2 = uint64(handle)
+}
+
 var syscallNTStatusMap = map[syscall.Errno]windows.NTStatus{
 	syscall.Errno(0): windows.STATUS_SUCCESS,
 
@@ -70,7 +203,7 @@ var syscallNTStatusMap = map[syscall.Errno]windows.NTStatus{
 	syscall.ENOENT:  windows.STATUS_OBJECT_NAME_NOT_FOUND,
 	syscall.EEXIST:  windows.STATUS_OBJECT_NAME_COLLISION,
 	syscall.EPERM:   windows.STATUS_ACCESS_DENIED,
-	syscall.ENOTDIR: windows.STATUS_NOT_A_DIRECTORY,
+	syscall.ENOTDIR: windows.STATUS_OBJECT_PATH_NOT_FOUND,
 	syscall.EISDIR:  windows.STATUS_FILE_IS_A_DIRECTORY,
 	syscall.EINVAL:  windows.STATUS_INVALID_PARAMETER,
 
@@ -85,10 +218,60 @@ var syscallNTStatusMap = map[syscall.Errno]windows.NTStatus{
 	syscall.ERROR_DIR_NOT_EMPTY:   windows.STATUS_DIRECTORY_NOT_EMPTY,
 }
 
+// ErrPathNotFound is returned by the behaviours when an
+// intermediate directory of the path does not exist, which
+// is converted to windows.STATUS_OBJECT_PATH_NOT_FOUND,
+// while a missing final component is converted to the
+// windows.STATUS_OBJECT_NAME_NOT_FOUND instead.
+//
+// It is the Win32 error ERROR_PATH_NOT_FOUND, which is also
+// syscall.ENOTDIR, so that it still satisfies os.IsNotExist
+// and os.ErrNotExist.
+var ErrPathNotFound error = windows.ERROR_PATH_NOT_FOUND
+
+// ReparseStatus is the error returned by the behaviours to
+// signal that a reparse point is encountered while resolving
+// the name, which is converted to windows.STATUS_REPARSE.
+//
+// Index is the reparse point index, which is the offset in
+// WCHARs of the path component being the reparse point, as
+// is reported by FileSystemRef.FindReparsePoint.
+type ReparseStatus struct {
+	Index uint32
+}
+
+func (s ReparseStatus) Error() string {
+	return fmt.Sprintf("reparse point at index %d", s.Index)
+}
+
+// OpError is the failure of an operation on a path, which
+// is reported as the status to WithLogger for the failed
+// operations taking a file name, e.g. Open and Rename.
+//
+// It unwraps to the NTSTATUS, so the behaviours may also
+// return it, which is converted to the Status.
+type OpError struct {
+	Op     string
+	Path   string
+	Status windows.NTStatus
+}
+
+func (e *OpError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Status.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Status
+}
+
 func convertNTStatus(err error) windows.NTStatus {
 	if err == nil {
 		return windows.STATUS_SUCCESS
 	}
+	var reparse ReparseStatus
+	if errors.As(err, &reparse) {
+		return windows.STATUS_REPARSE
+	}
 	var status windows.NTStatus
 	if errors.As(err, &status) {
 		return status
@@ -114,9 +297,39 @@ func convertNTStatus(err error) windows.NTStatus {
 	return windows.STATUS_INTERNAL_ERROR
 }
 
+// maxPathLen is FSP_FSCTL_TRANSACT_PATH_SIZEMAX in UTF-16
+// code units, which bounds the file names, patterns and
+// markers passed by WinFSP.
+const maxPathLen = 1024
+
+// utf16PtrToString converts the file name or the other
+// string passed by WinFSP, see utf16PtrToStringN.
 func utf16PtrToString(ptr uintptr) string {
+	return utf16PtrToStringN(ptr, maxPathLen)
+}
+
+// utf16PtrToStringN converts the NUL terminated UTF-16
+// string, reading at most maxLen code units, so that a
+// string which is not terminated in time is truncated
+// instead of being scanned beyond its buffer.
+func utf16PtrToStringN(ptr uintptr, maxLen int) string {
+	if ptr == 0 {
+		return ""
+	}
 	utf16Ptr := (*uint16)(unsafe.Pointer(ptr))
-	return windows.UTF16PtrToString(utf16Ptr)
+	return windows.UTF16ToString(
+		unsafe.Slice(utf16Ptr, utf16PtrLenN(utf16Ptr, maxLen)))
+}
+
+// utf16PtrLenN returns the length of the NUL terminated
+// UTF-16 string in code units, which is at most maxLen.
+func utf16PtrLenN(ptr *uint16, maxLen int) int {
+	n := 0
+	for n < maxLen &&
+		*(*uint16)(unsafe.Add(unsafe.Pointer(ptr), n*SIZEOF_WCHAR)) != 0 {
+		n++
+	}
+	return n
 }
 
 func enforceBytePtr(ptr uintptr, size int) []byte {
@@ -131,6 +344,10 @@ func enforceBytePtr(ptr uintptr, size int) []byte {
 // when there's no reference to it.
 type FileSystem struct {
 	FileSystemRef
+
+	// unmountMtx defers deleting the FSP_FILE_SYSTEM in
+	// Unmount until Statistics finishes reading it.
+	unmountMtx sync.RWMutex
 }
 
 // BehaviourBase defines the mandatory methods.
@@ -167,7 +384,7 @@ func delegateOpen(
 	if err != nil {
 		return convertNTStatus(err)
 	}
-	*file = result
+	ref.storeFile(file, result)
 	return windows.STATUS_SUCCESS
 }
 
@@ -176,25 +393,56 @@ var go_delegateOpen = syscall.NewCallbackCDecl(func(
 	createOptions, grantedAccess uint32,
 	file *uintptr, fileInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateOpen(
+	ref := traceCall(fileSystem, "Open")
+	status := delegateOpen(
 		fileSystem, fileName,
 		createOptions, grantedAccess,
 		file, fileInfoAddr,
-	))
+	)
+	traceReturnPath(ref, "Open", fileName, status)
+	return uintptr(status)
 })
 
-func delegateClose(fileSystem, file uintptr) {
+// BehaviourCloseWithInfo closes an open file like
+// BehaviourBase.Close, and is called instead of it when
+// implemented, for the file systems which finalize the
+// file only when it is closed, e.g. computing the final
+// size or hash of a compressed or content addressed file.
+//
+// The Cleanup of the last handle, which updates the times
+// and sizes requested by the cleanup flags, is always
+// dispatched before Close, so the file is expected to be
+// settled by then and finalized here.
+//
+// WinFSP's Close reports nothing back to the driver, so
+// the returned file info is currently discarded, and the
+// error is only reported as the status to WithLogger.
+type BehaviourCloseWithInfo interface {
+	CloseWithInfo(
+		fs *FileSystemRef, file uintptr,
+	) (*FSP_FSCTL_FILE_INFO, error)
+}
+
+func delegateClose(fileSystem, file uintptr) windows.NTStatus {
 	ref := loadFileSystemRef(fileSystem)
 	if ref == nil {
-		return
+		return ntStatusNoRef
+	}
+	file = ref.loadFile(file)
+	if ref.closeWithInfo != nil {
+		_, err := ref.closeWithInfo.CloseWithInfo(ref, file)
+		return convertNTStatus(err)
 	}
 	ref.base.Close(ref, file)
+	return windows.STATUS_SUCCESS
 }
 
 var go_delegateClose = syscall.NewCallbackCDecl(func(
 	fileSystem, file uintptr,
 ) uintptr {
-	delegateClose(fileSystem, file)
+	ref := traceCall(fileSystem, "Close")
+	status := delegateClose(fileSystem, file)
+	traceReturn(ref, "Close", status)
 	return uintptr(windows.STATUS_SUCCESS)
 })
 
@@ -221,9 +469,12 @@ func delegateGetVolumeInfo(
 var go_delegateGetVolumeInfo = syscall.NewCallbackCDecl(func(
 	fileSystem, volumeInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateGetVolumeInfo(
+	ref := traceCall(fileSystem, "GetVolumeInfo")
+	status := delegateGetVolumeInfo(
 		fileSystem, volumeInfoAddr,
-	))
+	)
+	traceReturn(ref, "GetVolumeInfo", status)
+	return uintptr(status)
 })
 
 // BehaviourSetVolumeLabel sets volume label.
@@ -251,9 +502,12 @@ func delegateSetVolumeLabel(
 var go_delegateSetVolumeLabel = syscall.NewCallbackCDecl(func(
 	fileSystem, labelAddr, volumeInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateSetVolumeLabel(
+	ref := traceCall(fileSystem, "SetVolumeLabel")
+	status := delegateSetVolumeLabel(
 		fileSystem, labelAddr, volumeInfoAddr,
-	))
+	)
+	traceReturn(ref, "SetVolumeLabel", status)
+	return uintptr(status)
 })
 
 // GetSecurityByNameFlags indicates the content that the
@@ -271,8 +525,9 @@ const (
 // BehaviourGetSecurityByName retrieves file attributes and
 // security descriptor by file name.
 //
-// The file attribute can also be a reparse point index when
-// windows.STATUS_REPARSE is returned.
+// A ReparseStatus error could be returned when a reparse
+// point is encountered while resolving the name, whose
+// index is then reported in place of the file attributes.
 type BehaviourGetSecurityByName interface {
 	GetSecurityByName(
 		fs *FileSystemRef, name string,
@@ -303,6 +558,13 @@ func delegateGetSecurityByName(
 	}
 	attr, sd, err := ref.getSecurityByName.GetSecurityByName(
 		ref, utf16PtrToString(fileName), flags)
+	var reparse ReparseStatus
+	if errors.As(err, &reparse) {
+		if attributes != nil {
+			*attributes = reparse.Index
+		}
+		return windows.STATUS_REPARSE
+	}
 	if err != nil {
 		return convertNTStatus(err)
 	}
@@ -325,10 +587,13 @@ var go_delegateGetSecurityByName = syscall.NewCallbackCDecl(func(
 	fileSystem, fileName, attributesAddr uintptr,
 	securityDescAddr, securityDescSizeAddr uintptr,
 ) uintptr {
-	return uintptr(delegateGetSecurityByName(
+	ref := traceCall(fileSystem, "GetSecurityByName")
+	status := delegateGetSecurityByName(
 		fileSystem, fileName, attributesAddr,
 		securityDescAddr, securityDescSizeAddr,
-	))
+	)
+	traceReturnPath(ref, "GetSecurityByName", fileName, status)
+	return uintptr(status)
 })
 
 // BehaviourCreate creates a new file or directory.
@@ -362,7 +627,7 @@ func delegateCreate(
 	if err != nil {
 		return convertNTStatus(err)
 	}
-	*file = result
+	ref.storeFile(file, result)
 	return windows.STATUS_SUCCESS
 }
 
@@ -372,12 +637,15 @@ var go_delegateCreate = syscall.NewCallbackCDecl(func(
 	securityDescriptor uintptr, allocationSize uint64,
 	file *uintptr, fileInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateCreate(
+	ref := traceCall(fileSystem, "Create")
+	status := delegateCreate(
 		fileSystem, fileName,
 		createOptions, grantedAccess, fileAttributes,
 		securityDescriptor, allocationSize,
 		file, fileInfoAddr,
-	))
+	)
+	traceReturnPath(ref, "Create", fileName, status)
+	return uintptr(status)
 })
 
 // BehaviourOverwrite overwrites a file's attribute.
@@ -399,6 +667,7 @@ func delegateOverwrite(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	file = ref.loadFile(file)
 	return convertNTStatus(ref.overwrite.Overwrite(
 		ref, file, attributes, replaceAttributes != 0,
 		allocationSize, (*FSP_FSCTL_FILE_INFO)(
@@ -411,11 +680,14 @@ var go_delegateOverwrite = syscall.NewCallbackCDecl(func(
 	attributes uint32, replaceAttributes uint8,
 	allocationSize uint64, fileInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateOverwrite(
+	ref := traceCall(fileSystem, "Overwrite")
+	status := delegateOverwrite(
 		fileSystem, file,
 		attributes, replaceAttributes,
 		allocationSize, fileInfoAddr,
-	))
+	)
+	traceReturn(ref, "Overwrite", status)
+	return uintptr(status)
 })
 
 // BehaviourCleanup performs the cleanup behaviour.
@@ -434,6 +706,7 @@ func delegateCleanup(
 	if ref == nil {
 		return
 	}
+	fileContext = ref.loadFile(fileContext)
 	ref.cleanup.Cleanup(
 		ref, fileContext, utf16PtrToString(filename),
 		cleanupFlags,
@@ -444,14 +717,33 @@ var go_delegateCleanup = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, filename uintptr,
 	cleanupFlags uint32,
 ) uintptr {
+	ref := traceCall(fileSystem, "Cleanup")
 	delegateCleanup(
 		fileSystem, fileContext, filename,
 		cleanupFlags,
 	)
+	traceReturn(ref, "Cleanup", windows.STATUS_SUCCESS)
 	return uintptr(windows.STATUS_SUCCESS)
 })
 
 // BehaviourRead read an open file.
+//
+// The result is reported to WinFSP by the following policy,
+// regardless of how the file system signals the end of file:
+//
+//   - A read returning any bytes succeeds with the number of
+//     bytes read, even if io.EOF is returned alongside, e.g.
+//     a read across the end of file.
+//   - A read of non-zero length returning no bytes and either
+//     nil or io.EOF fails with STATUS_END_OF_FILE, e.g. a read
+//     at or after the end of file.
+//   - A read of zero length succeeds at any offset, without
+//     being passed to the file system.
+//   - Other errors are converted as usual.
+//
+// The buf aliases the buffer of WinFSP without copying, so
+// it is only valid during the call and must not be retained
+// after the call returns.
 type BehaviourRead interface {
 	Read(
 		fs *FileSystemRef, file uintptr,
@@ -459,6 +751,39 @@ type BehaviourRead interface {
 	) (int, error)
 }
 
+// BehaviourReadDirect read an open file into a slice
+// returned by the file system, instead of filling the
+// buffer provided by WinFSP.
+//
+// It is suitable for file systems that cannot fill the
+// caller's buffer, e.g. those fetching data from other
+// libraries which allocate the result. The returned slice
+// is still copied into the WinFSP buffer at the boundary,
+// so BehaviourRead should be preferred whenever possible,
+// and it takes precedence when both are implemented.
+//
+// The returned slice must not exceed length bytes, and
+// io.EOF should be returned at the end of file.
+type BehaviourReadDirect interface {
+	ReadDirect(
+		fs *FileSystemRef, file uintptr,
+		offset uint64, length uint32,
+	) ([]byte, error)
+}
+
+type behaviourReadDirect struct {
+	readDirect BehaviourReadDirect
+}
+
+func (d *behaviourReadDirect) Read(
+	fs *FileSystemRef, file uintptr,
+	buf []byte, offset uint64,
+) (int, error) {
+	data, err := d.readDirect.ReadDirect(
+		fs, file, offset, uint32(len(buf)))
+	return copy(buf, data), err
+}
+
 func delegateRead(
 	fileSystem, fileContext, buffer uintptr,
 	offset uint64, length uint32, bytesRead *uint32,
@@ -468,28 +793,84 @@ func delegateRead(
 	if ref == nil {
 		return ntStatusNoRef
 	}
-	n, err := ref.read.Read(ref, fileContext,
-		enforceBytePtr(buffer, int(length)), offset)
+	if length == 0 {
+		return windows.STATUS_SUCCESS
+	}
+	fileContext = ref.loadFile(fileContext)
+	buf := enforceBytePtr(buffer, int(length))
+	n, err := transferChunks(buf, ref.maxTransferSize,
+		func(chunk []byte, done int) (int, error) {
+			return ref.read.Read(ref, fileContext,
+				chunk, offset+uint64(done))
+		})
 	*bytesRead = uint32(n)
-	// XXX: this is required otherwise windows kernel render
-	// it as nothing read from the file instead.
-	if n > 0 && err == io.EOF {
-		err = nil
+	return readStatus(n, length, err)
+}
+
+// transferChunks splits the transfer of buf into chunks of
+// at most maxSize bytes, see MaxTransferSize, and stops at
+// the first error or short transfer. The error is dropped
+// if some bytes have been transferred, so that they are
+// reported and the error is hit again by the next request.
+func transferChunks(
+	buf []byte, maxSize uint32,
+	transfer func(chunk []byte, done int) (int, error),
+) (int, error) {
+	if maxSize == 0 || len(buf) <= int(maxSize) {
+		return transfer(buf, 0)
+	}
+	done := 0
+	for done < len(buf) {
+		chunk := buf[done:min(done+int(maxSize), len(buf))]
+		n, err := transfer(chunk, done)
+		done += n
+		if err != nil {
+			if done > 0 && !errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return done, err
+		}
+		if n < len(chunk) {
+			break
+		}
 	}
-	return convertNTStatus(err)
+	return done, nil
+}
+
+// readStatus maps the result of BehaviourRead to the
+// status by the policy documented there.
+func readStatus(n int, length uint32, err error) windows.NTStatus {
+	if err != nil && !errors.Is(err, io.EOF) {
+		return convertNTStatus(err)
+	}
+	if n == 0 && length > 0 {
+		return windows.STATUS_END_OF_FILE
+	}
+	return windows.STATUS_SUCCESS
 }
 
 var go_delegateRead = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, buffer uintptr,
 	offset uint64, length uint32, bytesRead *uint32,
 ) uintptr {
-	return uintptr(delegateRead(
+	ref := traceCall(fileSystem, "Read")
+	status := delegateRead(
 		fileSystem, fileContext, buffer,
 		offset, length, bytesRead,
-	))
+	)
+	traceReturn(ref, "Read", status)
+	return uintptr(status)
 })
 
 // BehaviourWrite writes an open file.
+//
+// A write of zero length is still passed to the file
+// system, so that it fills the info of the file, and must
+// succeed without changing the file at any offset.
+//
+// The buf aliases the buffer of WinFSP without copying, so
+// it is only valid during the call and must not be retained
+// after the call returns, see PoisonWriteBuffers.
 type BehaviourWrite interface {
 	Write(
 		fs *FileSystemRef, file uintptr,
@@ -510,28 +891,53 @@ func delegateWrite(
 	if ref == nil {
 		return ntStatusNoRef
 	}
-	n, err := ref.write.Write(ref, fileContext,
-		enforceBytePtr(buffer, int(length)), offset,
-		writeToEndOfFile != 0, constrainedIo != 0,
-		(*FSP_FSCTL_FILE_INFO)(
-			unsafe.Pointer(fileInfoAddr)),
-	)
+	fileContext = ref.loadFile(fileContext)
+	buf := enforceBytePtr(buffer, int(length))
+	if ref.poisonWrites {
+		// The buffer of WinFSP is left intact, the copy
+		// passed to Write is poisoned instead.
+		buf = slices.Clone(buf)
+		defer poisonBuffer(buf)
+	}
+	n, err := transferChunks(buf, ref.maxTransferSize,
+		func(chunk []byte, done int) (int, error) {
+			return ref.write.Write(ref, fileContext,
+				chunk, offset+uint64(done),
+				writeToEndOfFile != 0, constrainedIo != 0,
+				(*FSP_FSCTL_FILE_INFO)(
+					unsafe.Pointer(fileInfoAddr)),
+			)
+		})
 	*bytesWritten = uint32(n)
 	return convertNTStatus(err)
 }
 
+// poisonByte is what PoisonWriteBuffers fills the write
+// buffers with, which is unlikely to be written by tests.
+const poisonByte = 0xdd
+
+// poisonBuffer overwrites the buffer with poisonByte.
+func poisonBuffer(buf []byte) {
+	for i := range buf {
+		buf[i] = poisonByte
+	}
+}
+
 var go_delegateWrite = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, buffer uintptr,
 	offset uint64, length uint32,
 	writeToEndOfFile, constrainedIo uint8,
 	bytesWritten *uint32, fileInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateWrite(
+	ref := traceCall(fileSystem, "Write")
+	status := delegateWrite(
 		fileSystem, fileContext, buffer,
 		offset, length,
 		writeToEndOfFile, constrainedIo,
 		bytesWritten, fileInfoAddr,
-	))
+	)
+	traceReturn(ref, "Write", status)
+	return uintptr(status)
 })
 
 // BehaviourFlush flushes a file or volume.
@@ -552,6 +958,7 @@ func delegateFlush(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	return convertNTStatus(ref.flush.Flush(
 		ref, fileContext, (*FSP_FSCTL_FILE_INFO)(
 			unsafe.Pointer(infoAddr)),
@@ -561,9 +968,12 @@ func delegateFlush(
 var go_delegateFlush = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, infoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateFlush(
+	ref := traceCall(fileSystem, "Flush")
+	status := delegateFlush(
 		fileSystem, fileContext, infoAddr,
-	))
+	)
+	traceReturn(ref, "Flush", status)
+	return uintptr(status)
 })
 
 // BehaviourGetFileInfo retrieves stat of file or directory.
@@ -581,6 +991,7 @@ func delegateGetFileInfo(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	return convertNTStatus(ref.getFileInfo.GetFileInfo(
 		ref, fileContext, (*FSP_FSCTL_FILE_INFO)(
 			unsafe.Pointer(infoAddr)),
@@ -590,9 +1001,12 @@ func delegateGetFileInfo(
 var go_delegateGetFileInfo = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, infoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateGetFileInfo(
+	ref := traceCall(fileSystem, "GetFileInfo")
+	status := delegateGetFileInfo(
 		fileSystem, fileContext, infoAddr,
-	))
+	)
+	traceReturn(ref, "GetFileInfo", status)
+	return uintptr(status)
 })
 
 // SetBasicInfoFlags specifies a set of modified values
@@ -627,6 +1041,7 @@ func delegateSetBasicInfo(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	var flags SetBasicInfoFlags
 	if attributes != windows.INVALID_FILE_ATTRIBUTES {
 		flags |= SetBasicInfoAttributes
@@ -656,11 +1071,14 @@ var go_delegateSetBasicInfo = syscall.NewCallbackCDecl(func(
 	creationTime, lastAccessTime, lastWriteTime, changeTime uint64,
 	fileInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateSetBasicInfo(
+	ref := traceCall(fileSystem, "SetBasicInfo")
+	status := delegateSetBasicInfo(
 		fileSystem, fileContext, attributes,
 		creationTime, lastAccessTime, lastWriteTime, changeTime,
 		fileInfoAddr,
-	))
+	)
+	traceReturn(ref, "SetBasicInfo", status)
+	return uintptr(status)
 })
 
 // BehaviourSetFileSize sets file's size or allocation size.
@@ -681,6 +1099,7 @@ func delegateSetFileSize(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	return convertNTStatus(ref.setFileSize.SetFileSize(
 		ref, fileContext, newSize, setAllocationSize != 0,
 		(*FSP_FSCTL_FILE_INFO)(unsafe.Pointer(fileInfoAddr)),
@@ -692,11 +1111,14 @@ var go_delegateSetFileSize = syscall.NewCallbackCDecl(func(
 	newSize uint64, setAllocationSize uint8,
 	fileInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateSetFileSize(
+	ref := traceCall(fileSystem, "SetFileSize")
+	status := delegateSetFileSize(
 		fileSystem, fileContext,
 		newSize, setAllocationSize,
 		fileInfoAddr,
-	))
+	)
+	traceReturn(ref, "SetFileSize", status)
+	return uintptr(status)
 })
 
 // BehaviourCanDelete detects whether the file can be deleted.
@@ -713,6 +1135,7 @@ func delegateCanDelete(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	return convertNTStatus(ref.canDelete.CanDelete(
 		ref, fileContext, utf16PtrToString(filename),
 	))
@@ -721,9 +1144,12 @@ func delegateCanDelete(
 var go_delegateCanDelete = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, filename uintptr,
 ) uintptr {
-	return uintptr(delegateCanDelete(
+	ref := traceCall(fileSystem, "CanDelete")
+	status := delegateCanDelete(
 		fileSystem, fileContext, filename,
-	))
+	)
+	traceReturnPath(ref, "CanDelete", filename, status)
+	return uintptr(status)
 })
 
 // BehaviourRename renames a file or directory.
@@ -742,6 +1168,7 @@ func delegateRename(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	return convertNTStatus(ref.rename.Rename(
 		ref, fileContext,
 		utf16PtrToString(source), utf16PtrToString(target),
@@ -753,10 +1180,13 @@ var go_delegateRename = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext uintptr,
 	source, target uintptr, replaceIfExists uint8,
 ) uintptr {
-	return uintptr(delegateRename(
+	ref := traceCall(fileSystem, "Rename")
+	status := delegateRename(
 		fileSystem, fileContext,
 		source, target, replaceIfExists,
-	))
+	)
+	traceReturnPath(ref, "Rename", source, status)
+	return uintptr(status)
 })
 
 // BehaviourGetSecurity retrieves security descriptor by file.
@@ -780,6 +1210,7 @@ func delegateGetSecurity(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	sd, err := ref.getSecurity.GetSecurity(ref, fileContext)
 	if err != nil {
 		return convertNTStatus(err)
@@ -803,10 +1234,13 @@ var go_delegateGetSecurity = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext uintptr,
 	securityDescAddr, securityDescSizeAddr uintptr,
 ) uintptr {
-	return uintptr(delegateGetSecurity(
+	ref := traceCall(fileSystem, "GetSecurity")
+	status := delegateGetSecurity(
 		fileSystem, fileContext,
 		securityDescAddr, securityDescSizeAddr,
-	))
+	)
+	traceReturn(ref, "GetSecurity", status)
+	return uintptr(status)
 })
 
 // BehaviourSetSecurity sets security descriptor by file.
@@ -826,6 +1260,7 @@ func delegateSetSecurity(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	return convertNTStatus(ref.setSecurity.SetSecurity(
 		ref, fileContext, info,
 		(*windows.SECURITY_DESCRIPTOR)(unsafe.Pointer(
@@ -836,10 +1271,13 @@ var go_delegateSetSecurity = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext uintptr,
 	info windows.SECURITY_INFORMATION, securityDescSizeAddr uintptr,
 ) uintptr {
-	return uintptr(delegateSetSecurity(
+	ref := traceCall(fileSystem, "SetSecurity")
+	status := delegateSetSecurity(
 		fileSystem, fileContext,
 		info, securityDescSizeAddr,
-	))
+	)
+	traceReturn(ref, "SetSecurity", status)
+	return uintptr(status)
 })
 
 var (
@@ -866,12 +1304,105 @@ func init() {
 // remaining content, or the user tells it to flush and reset.
 type DirBuffer struct {
 	ptr uintptr
+
+	// filled is set once the enumeration is cached in the
+	// buffer by ReadDirectory, so that the reads resumed
+	// from a marker are served from the buffer, and is
+	// cleared by the rewinding read.
+	filled atomic.Bool
+
+	// entries is the enumeration buffered in Go sorted by
+	// name when the fills are batched, which is guarded by
+	// entriesMtx, see BatchDirectoryFills.
+	entriesMtx sync.RWMutex
+	entries    []dirBufferEntry
+}
+
+// dirBufferEntry is an entry buffered in Go, whose key
+// is the UTF-16 encoded name to sort and search by.
+type dirBufferEntry struct {
+	name string
+	key  []uint16
+	info FSP_FSCTL_FILE_INFO
 }
 
 // Delete the directory buffer.
 func (buf *DirBuffer) Delete() {
+	untrackDirBuffer(buf)
 	_, _ = deleteDirectoryBuffer.Call(
 		uintptr(unsafe.Pointer(&buf.ptr)))
+	buf.entriesMtx.Lock()
+	defer buf.entriesMtx.Unlock()
+	buf.entries = nil
+}
+
+// fillBatched enumerates the directory by readDir into
+// the entries buffered in Go, sorting them by name in
+// the order of FspFileSystemReleaseDirectoryBuffer.
+func (buf *DirBuffer) fillBatched(
+	maxNameLen uint16,
+	readDir func(fill func(string, *FSP_FSCTL_FILE_INFO) (bool, error)) error,
+) error {
+	trackDirBuffer(buf)
+	var entries []dirBufferEntry
+	if err := readDir(func(
+		name string, fileInfo *FSP_FSCTL_FILE_INFO,
+	) (bool, error) {
+		nameLen, err := checkDirInfoName(name, maxNameLen)
+		if err != nil {
+			return false, err
+		}
+		entry := dirBufferEntry{
+			name: name,
+			key:  make([]uint16, 0, nameLen),
+		}
+		for _, r := range name {
+			entry.key = utf16.AppendRune(entry.key, r)
+		}
+		if fileInfo != nil {
+			entry.info = *fileInfo
+		}
+		entries = append(entries, entry)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	slices.SortFunc(entries, func(a, b dirBufferEntry) int {
+		return slices.Compare(a.key, b.key)
+	})
+	buf.entriesMtx.Lock()
+	defer buf.entriesMtx.Unlock()
+	buf.entries = entries
+	return nil
+}
+
+// readBatched copies the entries buffered in Go after
+// the marker into the buffer like ReadDirectory, ending
+// with the terminating entry once all of them fit.
+func (buf *DirBuffer) readBatched(marker *uint16, buffer []byte) int {
+	buf.entriesMtx.RLock()
+	defer buf.entriesMtx.RUnlock()
+	index := 0
+	if marker != nil {
+		key := unsafe.Slice(marker, utf16PtrLenN(marker, maxPathLen))
+		var found bool
+		index, found = slices.BinarySearchFunc(buf.entries, key,
+			func(entry dirBufferEntry, key []uint16) int {
+				return slices.Compare(entry.key, key)
+			})
+		if found {
+			index++
+		}
+	}
+	n := 0
+	for _, entry := range buf.entries[index:] {
+		added := FileSystemAddDirInfo(entry.name, 0, &entry.info, buffer[n:])
+		if added == 0 {
+			return n
+		}
+		n += added
+	}
+	return n + FileSystemAddDirInfo("", 0, nil, buffer[n:])
 }
 
 // ReadDirectory fills the read content into the buffer when
@@ -892,9 +1423,31 @@ func (buf *DirBuffer) ReadDirectory(
 	return int(bytesTransferred)
 }
 
+// dirInfoScratchWords is the number of aligned words in the
+// scratch buffer of DirBufferFiller, which is large enough
+// to hold a FSP_FSCTL_DIR_INFO with a name of 255 UTF-16
+// code units, the usual maximum component length.
+const dirInfoScratchWords = (int(unsafe.Sizeof(FSP_FSCTL_DIR_INFO{})) +
+	255*SIZEOF_WCHAR + 7) / 8
+
+var dirInfoScratchPool = &sync.Pool{
+	New: func() any {
+		return &[dirInfoScratchWords]uint64{}
+	},
+}
+
 // DirBufferFiller is the acquired filler of file system.
 type DirBufferFiller struct {
 	buf *DirBuffer
+
+	// maxNameLen is the maximum component length of the
+	// file system, which defaults to 255 when it is 0.
+	maxNameLen uint16
+
+	// scratch is the aligned buffer for packing the entry
+	// to fill, borrowed from dirInfoScratchPool for the
+	// lifetime of the acquisition.
+	scratch *[dirInfoScratchWords]uint64
 }
 
 // Acquire the directory buffer filler when there has no
@@ -905,6 +1458,7 @@ type DirBufferFiller struct {
 // judge whether there is error or there's no need to
 // acquire the directory buffer yet.
 func (buf *DirBuffer) Acquire(reset bool) (*DirBufferFiller, error) {
+	trackDirBuffer(buf)
 	var resetVal uintptr
 	if reset {
 		resetVal = uintptr(1)
@@ -919,7 +1473,28 @@ func (buf *DirBuffer) Acquire(reset bool) (*DirBufferFiller, error) {
 	if (uint8(acquireOk) != 1) || err != nil {
 		return nil, err
 	}
-	return &DirBufferFiller{buf: buf}, nil
+	return &DirBufferFiller{
+		buf:     buf,
+		scratch: dirInfoScratchPool.Get().(*[dirInfoScratchWords]uint64),
+	}, nil
+}
+
+// checkDirInfoName rejects the name to fill which is not
+// representable or exceeds the maximum component length,
+// which defaults to 255 when it is 0, returning its length
+// in UTF-16 code units.
+func checkDirInfoName(name string, maxNameLen uint16) (int, error) {
+	if strings.IndexByte(name, 0) >= 0 {
+		return 0, syscall.EINVAL
+	}
+	nameLen := utf16EncodedLen(name)
+	if maxNameLen == 0 {
+		maxNameLen = defaultMaxComponentLength
+	}
+	if nameLen > int(maxNameLen) {
+		return 0, nameTooLong(nameLen, int(maxNameLen))
+	}
+	return nameLen, nil
 }
 
 // Fill a directory entry into the directory filler.
@@ -927,37 +1502,48 @@ func (buf *DirBuffer) Acquire(reset bool) (*DirBufferFiller, error) {
 // The iteration might also be stopped when the caller
 // returns false, in thise case we should also terminate
 // the iteration and copy the content out to the handler.
+//
+// A name longer than the maximum component length of the
+// file system, see MaxComponentLength, is rejected with an
+// error wrapping STATUS_NAME_TOO_LONG.
 func (b *DirBufferFiller) Fill(
 	name string, fileInfo *FSP_FSCTL_FILE_INFO,
 ) (bool, error) {
-	utf16, err := windows.UTF16FromString(name)
+	nameLen, err := checkDirInfoName(name, b.maxNameLen)
 	if err != nil {
 		return false, err
 	}
-	if len(utf16) > 0 && utf16[len(utf16)-1] == 0 {
-		// Prune the trailing NUL, since it is not need
-		// while copying to the directory buffer.
-		utf16 = utf16[:len(utf16)-1]
-	}
 	length := int(unsafe.Sizeof(FSP_FSCTL_DIR_INFO{}) +
-		uintptr(len(utf16))*SIZEOF_WCHAR)
-	alignedBuffer := make([]uint64, (length+7)/8)
-	alignedAddr := uintptr(unsafe.Pointer(&alignedBuffer[0]))
-	dirInfo := (*FSP_FSCTL_DIR_INFO)(unsafe.Pointer(alignedAddr))
+		uintptr(nameLen)*SIZEOF_WCHAR)
+
+	// Names longer than the scratch buffer are rare, so we
+	// just allocate a dedicated buffer for them.
+	var alignedBuffer []uint64
+	if words := (length + 7) / 8; b.scratch != nil && words <= len(b.scratch) {
+		alignedBuffer = b.scratch[:words]
+	} else {
+		alignedBuffer = make([]uint64, words)
+	}
+	alignedAddr := unsafe.Pointer(&alignedBuffer[0])
+	dirInfo := (*FSP_FSCTL_DIR_INFO)(alignedAddr)
+	*dirInfo = FSP_FSCTL_DIR_INFO{}
 	dirInfo.Size = uint16(length)
 	if fileInfo != nil {
 		dirInfo.FileInfo = *fileInfo
 	}
-	target := *((*[]uint16)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: alignedAddr + unsafe.Sizeof(FSP_FSCTL_DIR_INFO{}),
-		Len:  len(utf16),
-		Cap:  len(utf16),
-	})))
-	copy(target, utf16)
+	target := unsafe.Slice((*uint16)(unsafe.Add(
+		alignedAddr, unsafe.Sizeof(FSP_FSCTL_DIR_INFO{}))), nameLen)
+	target = target[:0]
+	for _, r := range name {
+		target = utf16.AppendRune(target, r)
+	}
 	copyOk, err := fillDirectoryBuffer.Call(
-		uintptr(unsafe.Pointer(&b.buf.ptr)), alignedAddr,
+		uintptr(unsafe.Pointer(&b.buf.ptr)), uintptr(alignedAddr),
 		ntStatusPtr,
 	)
+	// XXX: the content has been copied into the directory
+	// buffer once the call returns, so the scratch buffer is
+	// free for reuse by the next call to Fill.
 	runtime.KeepAlive(alignedBuffer)
 	// BUG: same bug as the acquire counterpart here.
 	return uint8(copyOk) != 0, err
@@ -967,6 +1553,10 @@ func (b *DirBufferFiller) Fill(
 func (b *DirBufferFiller) Release() {
 	_, _ = releaseDirectoryBuffer.Call(
 		uintptr(unsafe.Pointer(&b.buf.ptr)))
+	if b.scratch != nil {
+		dirInfoScratchPool.Put(b.scratch)
+		b.scratch = nil
+	}
 }
 
 // BehaviourReadDirectoryRaw is the raw interface of read
@@ -991,6 +1581,7 @@ func delegateReadDirectory(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	n, err := ref.readDirRaw.ReadDirectoryRaw(
 		ref, fileContext, pattern, marker,
 		enforceBytePtr(buf, int(length)))
@@ -1003,11 +1594,14 @@ var go_delegateReadDirectory = syscall.NewCallbackCDecl(func(
 	pattern, marker *uint16,
 	buf uintptr, length uint32, numRead *uint32,
 ) uintptr {
-	return uintptr(delegateReadDirectory(
+	ref := traceCall(fileSystem, "ReadDirectory")
+	status := delegateReadDirectory(
 		fileSystem, fileContext,
 		pattern, marker,
 		buf, length, numRead,
-	))
+	)
+	traceReturn(ref, "ReadDirectory", status)
+	return uintptr(status)
 })
 
 // BehaviourReadDirectoryOffset is a low-level interface
@@ -1069,26 +1663,63 @@ func (d *behaviourReadDirectoryDelegate) ReadDirectoryRaw(
 	if err != nil {
 		return 0, err
 	}
-	filler, err := dirBuf.Acquire(marker == nil)
-	if err != nil {
-		return 0, err
+	var readPattern string
+	if pattern != nil {
+		readPattern = utf16PtrToString(uintptr(unsafe.Pointer(pattern)))
 	}
-	if filler != nil {
-		if err := func() error {
-			defer filler.Release()
-			var readPattern string
-			if pattern != nil {
-				readPattern = windows.UTF16PtrToString(pattern)
-			}
-			return d.readDir.ReadDirectory(
-				fs, file, readPattern, filler.Fill)
-		}(); err != nil {
+	if fs.batchDirFills {
+		return d.readDirectoryBatched(fs, file, readPattern, marker, dirBuf, buf)
+	}
+	//
+	// The enumeration is cached in the buffer until the next
+	// rewind, WinFSP would otherwise acquire the empty buffer
+	// of an empty directory and enumerate it again for every
+	// read resumed from a marker.
+	if marker == nil {
+		dirBuf.filled.Store(false)
+	}
+	if !dirBuf.filled.Load() {
+		filler, err := dirBuf.Acquire(marker == nil)
+		if err != nil {
 			return 0, err
 		}
+		if filler != nil {
+			filler.maxNameLen = fs.MaxComponentLength()
+			if err := func() error {
+				defer filler.Release()
+				return d.readDir.ReadDirectory(
+					fs, file, readPattern, filler.Fill)
+			}(); err != nil {
+				return 0, err
+			}
+		}
+		dirBuf.filled.Store(true)
 	}
 	return dirBuf.ReadDirectory(marker, buf), nil
 }
 
+// readDirectoryBatched serves the read from the entries
+// buffered in Go, see BatchDirectoryFills.
+func (d *behaviourReadDirectoryDelegate) readDirectoryBatched(
+	fs *FileSystemRef, file uintptr, pattern string,
+	marker *uint16, dirBuf *DirBuffer, buf []byte,
+) (int, error) {
+	if marker == nil {
+		dirBuf.filled.Store(false)
+	}
+	if !dirBuf.filled.Load() {
+		if err := dirBuf.fillBatched(fs.MaxComponentLength(), func(
+			fill func(string, *FSP_FSCTL_FILE_INFO) (bool, error),
+		) error {
+			return d.readDir.ReadDirectory(fs, file, pattern, fill)
+		}); err != nil {
+			return 0, err
+		}
+		dirBuf.filled.Store(true)
+	}
+	return dirBuf.readBatched(marker, buf), nil
+}
+
 // BehaviourGetDirInfoByName get directory information for a
 // file or directory within a parent directory.
 type BehaviourGetDirInfoByName interface {
@@ -1106,6 +1737,7 @@ func delegateGetDirInfoByName(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	parentDirFile = ref.loadFile(parentDirFile)
 	return convertNTStatus(ref.getDirInfoByName.GetDirInfoByName(
 		ref, parentDirFile, utf16PtrToString(fileName),
 		(*FSP_FSCTL_DIR_INFO)(unsafe.Pointer(dirInfoAddr)),
@@ -1116,13 +1748,30 @@ var go_delegateGetDirInfoByName = syscall.NewCallbackCDecl(func(
 	fileSystem, parentDirFile uintptr,
 	fileName, dirInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateGetDirInfoByName(
+	ref := traceCall(fileSystem, "GetDirInfoByName")
+	status := delegateGetDirInfoByName(
 		fileSystem, parentDirFile,
 		fileName, dirInfoAddr,
-	))
+	)
+	traceReturnPath(ref, "GetDirInfoByName", fileName, status)
+	return uintptr(status)
 })
 
 // BehaviourDeviceIoControl processes control code.
+//
+// FSCTL_GET_REPARSE_POINT reaching the control operation
+// is routed to BehaviourGetReparsePoint if implemented,
+// with an empty file name, instead of being processed
+// here. The driver serves it by itself with
+// BehaviourGetReparsePoint when the reparse points are
+// enabled, i.e. BehaviourGetReparsePointByName is also
+// implemented, so it is only routed on the volumes whose
+// reparse points are disabled. These volumes process the
+// control codes even without BehaviourDeviceIoControl.
+//
+// The returned data is copied into the output buffer, and
+// STATUS_BUFFER_OVERFLOW is reported with the leading part
+// copied if it does not fit.
 type BehaviourDeviceIoControl interface {
 	DeviceIoControl(
 		fs *FileSystemRef, file uintptr,
@@ -1130,6 +1779,47 @@ type BehaviourDeviceIoControl interface {
 	) ([]byte, error)
 }
 
+// BehaviourDeviceIoControlEx processes control code by
+// writing into the output buffer directly.
+//
+// It returns the number of bytes written into output,
+// and the number of bytes required by the whole result.
+// If the required size exceeds the output buffer, the
+// status is STATUS_BUFFER_OVERFLOW when some bytes are
+// written, or STATUS_BUFFER_TOO_SMALL when none is.
+//
+// Please notice this interface is prioritized over
+// BehaviourDeviceIoControl.
+type BehaviourDeviceIoControlEx interface {
+	DeviceIoControlEx(
+		fs *FileSystemRef, file uintptr,
+		code uint32, input, output []byte,
+	) (written, required int, err error)
+}
+
+type behaviourDeviceIoControl struct {
+	deviceIoControl BehaviourDeviceIoControl
+}
+
+func (d *behaviourDeviceIoControl) DeviceIoControlEx(
+	fs *FileSystemRef, file uintptr,
+	code uint32, input, output []byte,
+) (int, int, error) {
+	result, err := d.deviceIoControl.DeviceIoControl(
+		fs, file, code, input)
+	if err != nil {
+		return 0, 0, err
+	}
+	return copy(output, result), len(result), nil
+}
+
+// routeGetReparsePoint tells whether FSCTL_GET_REPARSE_POINT
+// is routed to BehaviourGetReparsePoint, which is when the
+// reparse points are disabled, see BehaviourDeviceIoControl.
+func (ref *FileSystemRef) routeGetReparsePoint() bool {
+	return ref.getReparsePoint != nil && ref.getReparsePointByName == nil
+}
+
 func delegateDeviceIoControl(
 	fileSystem, fileContext uintptr, controlCode uint32,
 	inputBuffer uintptr, inputBufferLength uint32,
@@ -1141,17 +1831,37 @@ func delegateDeviceIoControl(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	input := enforceBytePtr(inputBuffer, int(inputBufferLength))
-	result, err := ref.deviceIoControl.DeviceIoControl(
-		ref, fileContext, controlCode, input,
+	output := enforceBytePtr(outputBuffer, int(outputBufferLength))
+	if controlCode == windows.FSCTL_GET_REPARSE_POINT &&
+		ref.routeGetReparsePoint() {
+		// Routed to BehaviourGetReparsePoint, for the
+		// requests not served by the driver itself. The
+		// request carries no file name, so it is empty.
+		usedBytes, err := ref.getReparsePoint.GetReparsePoint(
+			ref, fileContext, "", output)
+		if err != nil {
+			return convertNTStatus(err)
+		}
+		*bytesWritten = uint32(min(max(usedBytes, 0), len(output)))
+		return windows.STATUS_SUCCESS
+	}
+	if ref.deviceIoControl == nil {
+		return windows.STATUS_INVALID_DEVICE_REQUEST
+	}
+	written, required, err := ref.deviceIoControl.DeviceIoControlEx(
+		ref, fileContext, controlCode, input, output,
 	)
 	if err != nil {
 		return convertNTStatus(err)
 	}
-	output := enforceBytePtr(outputBuffer, int(outputBufferLength))
-	copied := copy(output, result)
-	*bytesWritten = uint32(copied)
-	if copied < len(output) {
+	written = min(max(written, 0), len(output))
+	*bytesWritten = uint32(written)
+	if required > len(output) {
+		if written == 0 {
+			return windows.STATUS_BUFFER_TOO_SMALL
+		}
 		return windows.STATUS_BUFFER_OVERFLOW
 	}
 	return windows.STATUS_SUCCESS
@@ -1163,12 +1873,15 @@ var go_delegateDeviceIoControl = syscall.NewCallbackCDecl(func(
 	outputBuffer uintptr, outputBufferLength uint32,
 	bytesWritten *uint32,
 ) uintptr {
-	return uintptr(delegateDeviceIoControl(
+	ref := traceCall(fileSystem, "DeviceIoControl")
+	status := delegateDeviceIoControl(
 		fileSystem, fileContext, controlCode,
 		inputBuffer, inputBufferLength,
 		outputBuffer, outputBufferLength,
 		bytesWritten,
-	))
+	)
+	traceReturn(ref, "DeviceIoControl", status)
+	return uintptr(status)
 })
 
 // BehaviourCreateEx creates file with extended attributes.
@@ -1232,7 +1945,7 @@ func delegateCreateEx(
 	if err != nil {
 		return convertNTStatus(err)
 	}
-	*file = result
+	ref.storeFile(file, result)
 	return windows.STATUS_SUCCESS
 }
 
@@ -1243,13 +1956,128 @@ var go_delegateCreateEx = syscall.NewCallbackCDecl(func(
 	extraBuffer uintptr, extraLength uint32, isReparse uint8,
 	file *uintptr, fileInfoAddr uintptr,
 ) uintptr {
-	return uintptr(delegateCreateEx(
+	ref := traceCall(fileSystem, "CreateEx")
+	status := delegateCreateEx(
 		fileSystem, fileName,
 		createOptions, grantedAccess, fileAttributes,
 		securityDescriptor, allocationSize,
 		extraBuffer, extraLength, isReparse,
 		file, fileInfoAddr,
+	)
+	traceReturnPath(ref, "CreateEx", fileName, status)
+	return uintptr(status)
+})
+
+// BehaviourGetEa gets the extended attributes of a file.
+//
+// The entries are packed into the buffer provided by
+// WinFSP, which is then filtered by the driver for the
+// query. The entries not fitting into the buffer are
+// left out.
+//
+// Implementing it marks the volume as supporting the
+// extended attributes, which should be supplied on
+// creation through BehaviourCreateEx.
+type BehaviourGetEa interface {
+	GetEa(fs *FileSystemRef, file uintptr) ([]EaEntry, error)
+}
+
+// packEaPrefix packs the most leading entries fitting
+// into the buffer of length bytes.
+func packEaPrefix(entries []EaEntry, length int) ([]byte, error) {
+	for n := len(entries); n > 0; n-- {
+		packed, err := FileSystemPackEa(entries[:n])
+		if err != nil {
+			return nil, err
+		}
+		if len(packed) <= length {
+			return packed, nil
+		}
+	}
+	return nil, nil
+}
+
+func delegateGetEa(
+	fileSystem, fileContext, ea uintptr,
+	eaLength uint32, bytesTransferred *uint32,
+) windows.NTStatus {
+	*bytesTransferred = 0
+	ref := loadFileSystemRef(fileSystem)
+	if ref == nil {
+		return ntStatusNoRef
+	}
+	fileContext = ref.loadFile(fileContext)
+	entries, err := ref.getEa.GetEa(ref, fileContext)
+	if err != nil {
+		return convertNTStatus(err)
+	}
+	packed, err := packEaPrefix(entries, int(eaLength))
+	if err != nil {
+		return convertNTStatus(err)
+	}
+	*bytesTransferred = uint32(copy(
+		enforceBytePtr(ea, int(eaLength)), packed))
+	return windows.STATUS_SUCCESS
+}
+
+var go_delegateGetEa = syscall.NewCallbackCDecl(func(
+	fileSystem, fileContext, ea uintptr,
+	eaLength uint32, bytesTransferred *uint32,
+) uintptr {
+	ref := traceCall(fileSystem, "GetEa")
+	status := delegateGetEa(
+		fileSystem, fileContext, ea,
+		eaLength, bytesTransferred,
+	)
+	traceReturn(ref, "GetEa", status)
+	return uintptr(status)
+})
+
+// BehaviourSetEa sets the extended attributes of a file.
+//
+// Each entry replaces the attribute of the same name,
+// compared case insensitively, while an entry with an
+// empty value removes it. The value of each entry
+// references the buffer of WinFSP, copy it if it needs
+// to outlive the call.
+type BehaviourSetEa interface {
+	SetEa(
+		fs *FileSystemRef, file uintptr,
+		ea []EaEntry, info *FSP_FSCTL_FILE_INFO,
+	) error
+}
+
+func delegateSetEa(
+	fileSystem, fileContext, ea uintptr,
+	eaLength uint32, fileInfoAddr uintptr,
+) windows.NTStatus {
+	ref := loadFileSystemRef(fileSystem)
+	if ref == nil {
+		return ntStatusNoRef
+	}
+	fileContext = ref.loadFile(fileContext)
+	entries, err := FileSystemEnumerateEa(
+		enforceBytePtr(ea, int(eaLength)))
+	if err != nil {
+		return windows.STATUS_EA_LIST_INCONSISTENT
+	}
+	return convertNTStatus(ref.setEa.SetEa(
+		ref, fileContext, entries,
+		(*FSP_FSCTL_FILE_INFO)(unsafe.Pointer(fileInfoAddr)),
 	))
+}
+
+var go_delegateSetEa = syscall.NewCallbackCDecl(func(
+	fileSystem, fileContext, ea uintptr,
+	eaLength uint32, fileInfoAddr uintptr,
+) uintptr {
+	ref := traceCall(fileSystem, "SetEa")
+	status := delegateSetEa(
+		fileSystem, fileContext, ea,
+		eaLength, fileInfoAddr,
+	)
+	traceReturn(ref, "SetEa", status)
+	return uintptr(status)
 })
 
 var (
@@ -1276,6 +2104,7 @@ func delegateDeleteReparsePoint(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	return convertNTStatus(ref.deleteReparsePoint.DeleteReparsePoint(
 		ref, fileContext, utf16PtrToString(fileName),
 		enforceBytePtr(buffer, int(size)),
@@ -1286,13 +2115,24 @@ var go_delegateDeleteReparsePoint = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, fileName uintptr,
 	buffer, size uintptr,
 ) uintptr {
-	return uintptr(delegateDeleteReparsePoint(
+	ref := traceCall(fileSystem, "DeleteReparsePoint")
+	status := delegateDeleteReparsePoint(
 		fileSystem, fileContext, fileName,
 		buffer, size,
-	))
+	)
+	traceReturnPath(ref, "DeleteReparsePoint", fileName, status)
+	return uintptr(status)
 })
 
 // BehaviourGetReparsePoint gets a reparse point.
+//
+// When the reparse points are not enabled, i.e. the file
+// system does not implement BehaviourGetReparsePointByName,
+// it also serves FSCTL_GET_REPARSE_POINT issued on the
+// files, which the driver forwards to the control
+// operation, see BehaviourDeviceIoControl. The name is
+// empty in that case, and the file must be identified by
+// the handle returned by Open or Create instead.
 type BehaviourGetReparsePoint interface {
 	GetReparsePoint(
 		fs *FileSystemRef, file uintptr, name string,
@@ -1308,6 +2148,7 @@ func delegateGetReparsePoint(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	bufferSize := int(*size)
 	usedBytes, err := ref.getReparsePoint.GetReparsePoint(
 		ref, fileContext, utf16PtrToString(fileName),
@@ -1324,10 +2165,13 @@ var go_delegateGetReparsePoint = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, fileName uintptr,
 	buffer uintptr, size *uintptr,
 ) uintptr {
-	return uintptr(delegateGetReparsePoint(
+	ref := traceCall(fileSystem, "GetReparsePoint")
+	status := delegateGetReparsePoint(
 		fileSystem, fileContext, fileName,
 		buffer, size,
-	))
+	)
+	traceReturnPath(ref, "GetReparsePoint", fileName, status)
+	return uintptr(status)
 })
 
 // BehaviourGetReparsePoint gets a reparse point.
@@ -1372,10 +2216,13 @@ var go_delegateGetReparsePointByName = syscall.NewCallbackCDecl(func(
 	fileSystem, context, fileName uintptr,
 	isDirectory uint8, buffer uintptr, size *uintptr,
 ) uintptr {
-	return uintptr(delegateGetReparsePointByName(
+	ref := traceCall(fileSystem, "GetReparsePointByName")
+	status := delegateGetReparsePointByName(
 		fileSystem, context, fileName,
 		isDirectory, buffer, size,
-	))
+	)
+	traceReturnPath(ref, "GetReparsePointByName", fileName, status)
+	return uintptr(status)
 })
 
 func delegateResolveReparsePoints(
@@ -1406,11 +2253,14 @@ var go_delegateResolveReparsePoints = syscall.NewCallbackCDecl(func(
 	reparsePointIndex uint32, resolveLastPathComponent uint8,
 	ioStatus, buffer uintptr, size *uintptr,
 ) uintptr {
-	return uintptr(delegateResolveReparsePoints(
+	ref := traceCall(fileSystem, "ResolveReparsePoints")
+	status := delegateResolveReparsePoints(
 		fileSystem, fileName,
 		reparsePointIndex, resolveLastPathComponent,
 		ioStatus, buffer, size,
-	))
+	)
+	traceReturn(ref, "ResolveReparsePoints", status)
+	return uintptr(status)
 })
 
 // BehaviourSetReparsePoint sets a reparse point.
@@ -1429,6 +2279,7 @@ func delegateSetReparsePoint(
 	if ref == nil {
 		return ntStatusNoRef
 	}
+	fileContext = ref.loadFile(fileContext)
 	return convertNTStatus(ref.setReparsePoint.SetReparsePoint(
 		ref, fileContext, utf16PtrToString(fileName),
 		enforceBytePtr(buffer, int(size)),
@@ -1439,23 +2290,38 @@ var go_delegateSetReparsePoint = syscall.NewCallbackCDecl(func(
 	fileSystem, fileContext, fileName uintptr,
 	buffer, size uintptr,
 ) uintptr {
-	return uintptr(delegateSetReparsePoint(
+	ref := traceCall(fileSystem, "SetReparsePoint")
+	status := delegateSetReparsePoint(
 		fileSystem, fileContext, fileName,
 		buffer, size,
-	))
+	)
+	traceReturnPath(ref, "SetReparsePoint", fileName, status)
+	return uintptr(status)
 })
 
 type option struct {
+	name                     string
 	caseSensitive            bool
 	casePreserveNames        bool
 	volumePrefix             string
 	fileSystemName           string
 	passPattern              bool
+	posixUnlinkRename        bool
+	wslFeatures              bool
 	attributes               uint32
 	creationTime             time.Time
 	debug                    bool
 	sectorSize               uint16
 	sectorsPerAllocationUnit uint16
+	maxTransferSize          uint32
+	maxComponentLength       uint16
+	batchDirFills            bool
+	fullContext              bool
+	cleanMountPoint          bool
+	poisonWrites             bool
+	transactTimeout          time.Duration
+	irpTimeout               time.Duration
+	logger                   log.Log
 }
 
 func newOption() *option {
@@ -1466,6 +2332,7 @@ func newOption() *option {
 		creationTime:             time.Now(),
 		sectorSize:               512,
 		sectorsPerAllocationUnit: 1,
+		maxComponentLength:       defaultMaxComponentLength,
 	}
 }
 
@@ -1508,7 +2375,8 @@ func CasePreserveNames(value bool) Option {
 
 // Debug controls whether WinFSP's debug logging will be
 // emitted for this file system. The destination for the debug
-// logging can be set using the DebugLogSetHandle function.
+// logging can be set using the DebugLogSetHandle function,
+// or PipeDebugLogToLogger to capture it into a log.Log.
 func Debug(value bool) Option {
 	return func(o *option) {
 		o.debug = value
@@ -1532,6 +2400,28 @@ func FileSystemName(value string) Option {
 	}
 }
 
+// WithName sets the identifier of the file system, which
+// can be retrieved by FileSystemRef.Name later.
+//
+// Unlike FileSystemName, the identifier is never seen by
+// the system, and serves only to distinguish multiple
+// mounted file systems within the same process, e.g. it
+// is attached to the entries reported to WithLogger.
+func WithName(value string) Option {
+	return func(o *option) {
+		o.name = value
+	}
+}
+
+// WithLogger sets the logger to which every operation
+// dispatched to the file system is reported, with the
+// name specified by WithName as a field.
+func WithLogger(value log.Log) Option {
+	return func(o *option) {
+		o.logger = value
+	}
+}
+
 // CreationTime sets the volume creation time explicitly,
 // instead of using the timestamp of calling mount.
 func CreationTime(value time.Time) Option {
@@ -1548,8 +2438,101 @@ func PassPattern(value bool) Option {
 	}
 }
 
+// PosixUnlinkRename specifies whether the file system
+// supports POSIX semantics of deleting and renaming files,
+// which are requested with FILE_DISPOSITION_POSIX_SEMANTICS
+// and FILE_RENAME_POSIX_SEMANTICS, e.g. by WSL.
+func PosixUnlinkRename(value bool) Option {
+	return func(o *option) {
+		o.posixUnlinkRename = value
+	}
+}
+
+// WSLFeatures specifies whether the file system supports
+// the features required by WSL, e.g. the metadata of
+// files stored in the extended attributes, which is only
+// available since WinFSP 2019.3 (version 1.5), and is
+// silently dropped on older installations.
+func WSLFeatures(value bool) Option {
+	return func(o *option) {
+		o.wslFeatures = value
+	}
+}
+
+// FullContextMode specifies whether WinFSP passes the
+// file context as FSP_FSCTL_TRANSACT_FULL_CONTEXT, i.e.
+// FspFSAttributeUmFileContextIsFullContext, instead of
+// its UserContext2 only, which is the default.
+//
+// The meaning of the file handle seen by the behaviours
+// is the same in both modes: it is the value returned by
+// Open or Create, and is passed back as is to the other
+// behaviours until Close. In the full context mode, the
+// handle is stored in UserContext2 with UserContext being
+// zero, and the address of the full context passed by
+// WinFSP is dereferenced before calling the behaviours,
+// so the handle must not be taken as the address of the
+// context. The full context passed with a request is a
+// copy of the one returned by Open or Create, so the
+// behaviours can not store state into it after open.
+func FullContextMode(value bool) Option {
+	return func(o *option) {
+		o.fullContext = value
+	}
+}
+
+// CleanMountPoint specifies whether the directory mount
+// point left behind by a file system no longer mounted is
+// removed by CleanStaleMountPoint before mounting, which
+// does nothing for the drive mount points.
+func CleanMountPoint(value bool) Option {
+	return func(o *option) {
+		o.cleanMountPoint = value
+	}
+}
+
+const (
+	minSectorSize     = 512
+	maxSectorSize     = 4096
+	maxAllocationUnit = 64 * 1024
+)
+
+// checkSectorSize reports the sector size and sectors
+// per allocation unit rejected by SectorSize.
+func checkSectorSize(sectorSize, sectorsPerAllocationUnit uint16) error {
+	if sectorSize < minSectorSize || sectorSize > maxSectorSize ||
+		sectorSize&(sectorSize-1) != 0 {
+		return errors.Errorf(
+			"sector size %d is not a power of two from %d to %d",
+			sectorSize, minSectorSize, maxSectorSize)
+	}
+	if sectorsPerAllocationUnit == 0 ||
+		sectorsPerAllocationUnit&(sectorsPerAllocationUnit-1) != 0 {
+		return errors.Errorf(
+			"sectors per allocation unit %d is not a power of two",
+			sectorsPerAllocationUnit)
+	}
+	if unit := uint32(sectorSize) *
+		uint32(sectorsPerAllocationUnit); unit > maxAllocationUnit {
+		return errors.Errorf(
+			"allocation unit %d exceeds %d", unit, maxAllocationUnit)
+	}
+	return nil
+}
+
+// wslFeaturesSupported tells whether the WinFSP of the
+// specified version recognizes FspFSAttributeWslFeatures.
+func wslFeaturesSupported(major, minor uint16) bool {
+	return major > 1 || (major == 1 && minor >= 5)
+}
+
 // SectorSize sets the sector size and sectors per allocation unit
 // for the volume.
+//
+// The sector size must be a power of two from 512 to 4096, and
+// the sectors per allocation unit a power of two, making up an
+// allocation unit of at most 64 KiB, otherwise Mount fails. The
+// default is 512 bytes per sector and 1 sector per allocation unit.
 func SectorSize(sectorSize, sectorsPerAllocationUnit uint16) Option {
 	return func(o *option) {
 		o.sectorSize = sectorSize
@@ -1557,6 +2540,140 @@ func SectorSize(sectorSize, sectorsPerAllocationUnit uint16) Option {
 	}
 }
 
+// MaxTransferSize limits the bytes passed to each call of
+// BehaviourRead and BehaviourWrite, the reads and writes
+// requested by WinFSP with larger buffers are split into
+// multiple calls, so that the file systems allocating
+// their own buffers for a call, e.g. to forward it over the
+// network, have their peak allocation bounded.
+//
+// WinFSP's volume params carry no transfer size, the
+// driver always passes the whole request, so the requests
+// are split upon dispatching. The chunks are consecutive
+// and stop at the first short transfer, the error after
+// some bytes transferred is dropped and hit again by the
+// next request.
+//
+// The size is rounded down to the multiple of the sector
+// size, and is at least a sector, which is reported to
+// WithLogger when the value is adjusted. The requests are
+// not split by default or when the value is 0.
+func MaxTransferSize(value uint32) Option {
+	return func(o *option) {
+		o.maxTransferSize = value
+	}
+}
+
+// PoisonWriteBuffers makes Write be passed a copy of the
+// buffer of WinFSP, which is overwritten with 0xdd bytes
+// once Write returns, so that the file systems retaining
+// the buffer past the call, against the contract of
+// BehaviourWrite, see garbage instead of silently racing
+// with WinFSP reusing it, which could be caught by their
+// tests. It is meant for debugging and is disabled by
+// default.
+func PoisonWriteBuffers(value bool) Option {
+	return func(o *option) {
+		o.poisonWrites = value
+	}
+}
+
+// defaultMaxComponentLength is the maximum component
+// length of WinFSP and NTFS when it is unspecified.
+const defaultMaxComponentLength = 255
+
+// MaxComponentLength sets the maximum length of each name
+// component in UTF-16 code units, which is reported to the
+// system in the volume params. The names longer than it are
+// rejected by DirBufferFiller.Fill. It is 255 by default,
+// and 0 restores the default.
+func MaxComponentLength(value uint16) Option {
+	return func(o *option) {
+		if value == 0 {
+			value = defaultMaxComponentLength
+		}
+		o.maxComponentLength = value
+	}
+}
+
+// BatchDirectoryFills makes BehaviourReadDirectory fill
+// the enumeration into a buffer kept in Go, which is then
+// sorted and copied out by Go as well, instead of filling
+// every entry into the directory buffer of WinFSP through
+// a separate DLL call. It saves a DLL call per entry when
+// enumerating large directories, at the cost of keeping
+// the entries of every enumerated directory in the Go
+// heap until it is rewound or closed.
+//
+// The behaviours reading directories by themselves, e.g.
+// BehaviourReadDirectoryRaw, are not affected.
+func BatchDirectoryFills(value bool) Option {
+	return func(o *option) {
+		o.batchDirFills = value
+	}
+}
+
+// clampTransferSize adjusts the size specified by
+// MaxTransferSize to the multiple of the sector size.
+func clampTransferSize(value uint32, sectorSize uint16) uint32 {
+	if value == 0 || sectorSize == 0 {
+		return value
+	}
+	unit := uint32(sectorSize)
+	return max(value/unit*unit, unit)
+}
+
+// TransactTimeout sets the interval the dispatchers poll
+// the WinFSP driver for new requests at. It never cancels
+// the operations, see IrpTimeout instead, and is clamped
+// from 1 to 10 seconds by WinFSP, which considers it
+// obsolete.
+//
+// The interval is rounded to milliseconds, and WinFSP's
+// default interval is used when it is unspecified.
+func TransactTimeout(value time.Duration) Option {
+	return func(o *option) {
+		o.transactTimeout = value
+	}
+}
+
+const (
+	minIrpTimeout = time.Minute
+	maxIrpTimeout = 10 * time.Minute
+)
+
+// IrpTimeout sets the time a request is allowed to stay
+// pending in the WinFSP driver before it is cancelled,
+// which is also the deadline of contexts returned by
+// FileSystemRef.OperationContext.
+//
+// The timeout must be from 1 to 10 minutes, and it is
+// rounded to milliseconds. WinFSP's default timeout is
+// used when it is unspecified.
+func IrpTimeout(value time.Duration) Option {
+	return func(o *option) {
+		o.irpTimeout = value
+	}
+}
+
+// checkTimeouts reports the timeouts which could not be
+// passed to WinFSP as they are, as the driver takes them
+// in milliseconds of uint32.
+func checkTimeouts(transactTimeout, irpTimeout time.Duration) error {
+	if transactTimeout < 0 ||
+		transactTimeout/time.Millisecond > math.MaxUint32 {
+		return errors.Errorf(
+			"transact timeout %v is out of range", transactTimeout)
+	}
+	if irpTimeout != 0 &&
+		(irpTimeout < minIrpTimeout || irpTimeout > maxIrpTimeout) {
+		return errors.Errorf(
+			"irp timeout %v is not from %v to %v",
+			irpTimeout, minIrpTimeout, maxIrpTimeout)
+	}
+	return nil
+}
+
 // Options is used to aggregate a bundle of options.
 func Options(opts ...Option) Option {
 	return func(o *option) {
@@ -1599,37 +2716,187 @@ func init() {
 	registerProc("FspFileSystemSetDebugLogF", &setDebugLogF)
 }
 
-// Mount attempts to mount a file system to specified mount
-// point, returning the handle to the real filesystem.
-func Mount(
-	fs BehaviourBase, mountpoint string, opts ...Option,
-) (*FileSystem, error) {
-	if fs == nil {
-		return nil, errors.New("invalid nil fs parameter")
+// compoundBehaviours are the behaviours consisting of
+// multiple methods, which might be implemented partially
+// by mistake and would then be silently left unwired.
+var compoundBehaviours = []reflect.Type{
+	reflect.TypeOf((*BehaviourReadDirectory)(nil)).Elem(),
+	reflect.TypeOf((*BehaviourCreateEx)(nil)).Elem(),
+}
+
+// checkCompoundBehaviours rejects the file system that
+// implements only part of a compound behaviour.
+func checkCompoundBehaviours(fs BehaviourBase) error {
+	fsType := reflect.TypeOf(fs)
+	for _, behaviour := range compoundBehaviours {
+		if fsType.Implements(behaviour) {
+			continue
+		}
+		var implemented, missing []string
+		for i := 0; i < behaviour.NumMethod(); i++ {
+			name := behaviour.Method(i).Name
+			if _, ok := fsType.MethodByName(name); ok {
+				implemented = append(implemented, name)
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		if len(implemented) == 0 {
+			continue
+		}
+		if len(missing) == 0 {
+			return errors.Errorf(
+				"%s implements %s with mismatched method signatures",
+				fsType, behaviour.Name())
+		}
+		return errors.Errorf(
+			"%s implements %s partially, missing %s",
+			fsType, behaviour.Name(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// exclusiveBehaviours are the pairs of behaviours of
+// which only the former is wired when both of them are
+// implemented, as documented by them, leaving the latter
+// unused, see warnExclusiveBehaviours.
+var exclusiveBehaviours = [][2]reflect.Type{{
+	reflect.TypeOf((*BehaviourCreateEx)(nil)).Elem(),
+	reflect.TypeOf((*BehaviourCreate)(nil)).Elem(),
+}, {
+	reflect.TypeOf((*BehaviourRead)(nil)).Elem(),
+	reflect.TypeOf((*BehaviourReadDirect)(nil)).Elem(),
+}, {
+	reflect.TypeOf((*BehaviourReadDirectoryOffset)(nil)).Elem(),
+	reflect.TypeOf((*BehaviourReadDirectoryRaw)(nil)).Elem(),
+}, {
+	reflect.TypeOf((*BehaviourReadDirectoryOffset)(nil)).Elem(),
+	reflect.TypeOf((*BehaviourReadDirectory)(nil)).Elem(),
+}, {
+	reflect.TypeOf((*BehaviourReadDirectoryRaw)(nil)).Elem(),
+	reflect.TypeOf((*BehaviourReadDirectory)(nil)).Elem(),
+}, {
+	reflect.TypeOf((*BehaviourDeviceIoControlEx)(nil)).Elem(),
+	reflect.TypeOf((*BehaviourDeviceIoControl)(nil)).Elem(),
+}}
+
+// warnExclusiveBehaviours logs the pairs of behaviours
+// implemented by the file system of which only the former
+// is used. It is not an error, since the priority is how
+// they are resolved, but the latter might be implemented
+// by mistake.
+func warnExclusiveBehaviours(fs BehaviourBase, option *option) {
+	if option.logger == nil {
+		return
 	}
-	if err := tryLoadWinFSP(); err != nil {
-		return nil, err
+	fsType := reflect.TypeOf(fs)
+	for _, pair := range exclusiveBehaviours {
+		if fsType.Implements(pair[0]) && fsType.Implements(pair[1]) {
+			option.logger.Log(log.TopicInfo, fmt.Sprintf(
+				"%s implements both %s and %s, only the former is used",
+				fsType, pair[0].Name(), pair[1].Name()))
+		}
 	}
+}
+
+// resolveOption applies the default options of the file
+// system and then the specified options.
+func resolveOption(fs BehaviourBase, opts []Option) *option {
 	option := newOption()
 	if inner, ok := fs.(BehaviourDefaultOptions); ok {
 		Options(inner.DefaultOptions()...)(option)
 	}
 	Options(opts...)(option)
-	created := false
+	return option
+}
 
-	// Place the reference map right now.
-	result := &FileSystem{}
-	fileSystemRef := &result.FileSystemRef
-	fileSystemAddr := uintptr(unsafe.Pointer(fileSystemRef))
-	_, loaded := refMap.LoadOrStore(fileSystemAddr, fileSystemRef)
-	if loaded {
-		return nil, errors.New("out of memory")
+// Validate inspects the file system and the options for
+// the wiring problems that would otherwise only surface
+// while the volume is in use, without touching the driver,
+// so that they could be caught by the tests of the file
+// system. Mount performs the same validation.
+//
+// The problems reported are:
+//
+//   - A compound behaviour, e.g. BehaviourCreateEx, which
+//     is implemented partially or with mismatched method
+//     signatures, and would not be wired at all.
+//   - The FspFSAttributePassQueryDirectoryFileName attribute
+//     without BehaviourGetDirInfoByName, which the driver
+//     relies upon to look up a single name.
+//   - The FspFSAttributePassQueryDirectoryFileName attribute
+//     with BehaviourReadDirectoryOffset, whose markers are
+//     offsets that the passed file names cannot resume from.
+//   - The SectorSize option out of the accepted ranges.
+//   - The TransactTimeout or IrpTimeout option out of the
+//     accepted ranges.
+func Validate(fs BehaviourBase, opts ...Option) error {
+	if fs == nil {
+		return errors.New("invalid nil fs parameter")
+	}
+	if err := checkCompoundBehaviours(fs); err != nil {
+		return err
+	}
+	fsType := reflect.TypeOf(fs)
+	option := resolveOption(fs, opts)
+	if option.attributes&FspFSAttributePassQueryDirectoryFileName != 0 {
+		if _, ok := fs.(BehaviourGetDirInfoByName); !ok {
+			return errors.Errorf(
+				"%s passes query directory file name "+
+					"without implementing BehaviourGetDirInfoByName", fsType)
+		}
+		if _, ok := fs.(BehaviourReadDirectoryOffset); ok {
+			return errors.Errorf(
+				"%s passes query directory file name "+
+					"with BehaviourReadDirectoryOffset", fsType)
+		}
 	}
-	defer func() {
-		if !created {
-			refMap.Delete(fileSystemAddr)
+	if err := checkSectorSize(
+		option.sectorSize, option.sectorsPerAllocationUnit); err != nil {
+		return err
+	}
+	if err := checkTimeouts(
+		option.transactTimeout, option.irpTimeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+// FirstFreeDriveLetter returns the first drive letter
+// from "Z:" down to "D:" which is not currently in use,
+// like the drive letters picked by WinFSP itself. The
+// floppy and system drives from "A:" to "C:" are skipped,
+// and the letters near them are left to the disks and
+// removable drives assigned by Windows.
+//
+// The drive letter might be taken by others before it
+// is mounted, so it is only a hint.
+func FirstFreeDriveLetter() (string, error) {
+	drives, err := windows.GetLogicalDrives()
+	if err != nil {
+		return "", errors.Wrap(err, "GetLogicalDrives")
+	}
+	return firstFreeDriveLetter(drives)
+}
+
+// firstFreeDriveLetter picks the letter of
+// FirstFreeDriveLetter among the drives in use, which is
+// the bit mask returned by GetLogicalDrives.
+func firstFreeDriveLetter(drives uint32) (string, error) {
+	for i := 'Z' - 'A'; i >= 'D'-'A'; i-- {
+		if drives&(1<<i) == 0 {
+			return string('A'+i) + ":", nil
 		}
-	}()
+	}
+	return "", errors.New("no free drive letter")
+}
+
+// wireBehaviours interprets the behaviours implemented
+// by the file system into the operations and the volume
+// attributes, and fills the reference with them.
+func wireBehaviours(
+	fs BehaviourBase, option *option, fileSystemRef *FileSystemRef,
+) (*FSP_FILE_SYSTEM_INTERFACE, uint32) {
 	attributes := option.attributes
 	if option.caseSensitive {
 		attributes |= FspFSAttributeCaseSensitive
@@ -1643,7 +2910,14 @@ func Mount(
 	if option.passPattern {
 		attributes |= FspFSAttributePassQueryDirectoryPattern
 	}
-	attributes |= FspFSAttributeUmFileContextIsUserContext2
+	if option.posixUnlinkRename {
+		attributes |= FspFSAttributeSupportsPosixUnlinkRename
+	}
+	if option.fullContext {
+		attributes |= FspFSAttributeUmFileContextIsFullContext
+	} else {
+		attributes |= FspFSAttributeUmFileContextIsUserContext2
+	}
 
 	// Intepret the behaviours to convert interface.
 	//
@@ -1653,9 +2927,32 @@ func Mount(
 	// and reused by the golang's runtime.
 	fileSystemOps := &FSP_FILE_SYSTEM_INTERFACE{}
 	fileSystemRef.base = fs
+	fileSystemRef.name = option.name
+	fileSystemRef.irpTimeout = option.irpTimeout
+	fileSystemRef.logger = option.logger
+	fileSystemRef.sectorSize = uint32(option.sectorSize)
+	fileSystemRef.allocationUnit = uint32(option.sectorSize) *
+		uint32(option.sectorsPerAllocationUnit)
+	fileSystemRef.maxComponent = option.maxComponentLength
+	fileSystemRef.batchDirFills = option.batchDirFills
+	fileSystemRef.fullContext = option.fullContext
+	fileSystemRef.poisonWrites = option.poisonWrites
+	warnExclusiveBehaviours(fs, option)
+	fileSystemRef.maxTransferSize = clampTransferSize(
+		option.maxTransferSize, option.sectorSize)
+	if fileSystemRef.maxTransferSize != option.maxTransferSize &&
+		option.logger != nil {
+		option.logger.Log(log.TopicInfo, fmt.Sprintf(
+			"max transfer size %d adjusted to %d by sector size %d",
+			option.maxTransferSize, fileSystemRef.maxTransferSize,
+			option.sectorSize))
+	}
 	fileSystemRef.fileSystemOps = fileSystemOps
 	fileSystemOps.Open = go_delegateOpen
 	fileSystemOps.Close = go_delegateClose
+	if inner, ok := fs.(BehaviourCloseWithInfo); ok {
+		fileSystemRef.closeWithInfo = inner
+	}
 	if inner, ok := fs.(BehaviourGetVolumeInfo); ok {
 		fileSystemRef.getVolumeInfo = inner
 		fileSystemOps.GetVolumeInfo = go_delegateGetVolumeInfo
@@ -1683,9 +2980,23 @@ func Mount(
 		fileSystemRef.cleanup = inner
 		fileSystemOps.Cleanup = go_delegateCleanup
 	}
+	if inner, ok := fs.(BehaviourGetEa); ok {
+		attributes |= FspFSAttributeExtendedAttributes
+		fileSystemRef.getEa = inner
+		fileSystemOps.GetEa = go_delegateGetEa
+	}
+	if inner, ok := fs.(BehaviourSetEa); ok {
+		fileSystemRef.setEa = inner
+		fileSystemOps.SetEa = go_delegateSetEa
+	}
 	if inner, ok := fs.(BehaviourRead); ok {
 		fileSystemRef.read = inner
 		fileSystemOps.Read = go_delegateRead
+	} else if inner, ok := fs.(BehaviourReadDirect); ok {
+		fileSystemRef.read = &behaviourReadDirect{
+			readDirect: inner,
+		}
+		fileSystemOps.Read = go_delegateRead
 	}
 	if inner, ok := fs.(BehaviourWrite); ok {
 		fileSystemRef.write = inner
@@ -1699,10 +3010,6 @@ func Mount(
 		fileSystemRef.getFileInfo = inner
 		fileSystemOps.GetFileInfo = go_delegateGetFileInfo
 	}
-	if inner, ok := fs.(BehaviourDeviceIoControl); ok {
-		fileSystemRef.deviceIoControl = inner
-		fileSystemOps.Control = go_delegateDeviceIoControl
-	}
 	if inner, ok := fs.(BehaviourDeleteReparsePoint); ok {
 		fileSystemRef.deleteReparsePoint = inner
 		fileSystemOps.DeleteReparsePoint = go_delegateDeleteReparsePoint
@@ -1763,9 +3070,79 @@ func Mount(
 		fileSystemRef.getDirInfoByName = inner
 		fileSystemOps.GetDirInfoByName = go_delegateGetDirInfoByName
 	}
-	if inner, ok := fs.(BehaviourDeviceIoControl); ok {
+	if inner, ok := fs.(BehaviourDeviceIoControlEx); ok {
+		attributes |= FspFSAttributeDeviceControl
 		fileSystemRef.deviceIoControl = inner
 		fileSystemOps.Control = go_delegateDeviceIoControl
+	} else if inner, ok := fs.(BehaviourDeviceIoControl); ok {
+		attributes |= FspFSAttributeDeviceControl
+		fileSystemRef.deviceIoControl = &behaviourDeviceIoControl{
+			deviceIoControl: inner,
+		}
+		fileSystemOps.Control = go_delegateDeviceIoControl
+	} else if fileSystemRef.routeGetReparsePoint() {
+		// Serve FSCTL_GET_REPARSE_POINT when it reaches the
+		// control operation, see delegateDeviceIoControl.
+		attributes |= FspFSAttributeDeviceControl
+		fileSystemOps.Control = go_delegateDeviceIoControl
+	}
+	return fileSystemOps, attributes
+}
+
+// Mount attempts to mount a file system to specified mount
+// point, returning the handle to the real filesystem.
+//
+// Mounting at "*" picks the first free drive letter
+// reported by FirstFreeDriveLetter, which could be
+// retrieved by FileSystemRef.MountPoint afterwards.
+//
+// The volume is presented as a fixed disk, or as a network
+// drive under VolumePrefix. Removable media is unsupported,
+// since WinFSP provides no parameter for the removable
+// media characteristic.
+func Mount(
+	fs BehaviourBase, mountpoint string, opts ...Option,
+) (*FileSystem, error) {
+	if err := Validate(fs, opts...); err != nil {
+		return nil, err
+	}
+	if mountpoint == "*" {
+		letter, err := FirstFreeDriveLetter()
+		if err != nil {
+			return nil, err
+		}
+		mountpoint = letter
+	}
+	if err := tryLoadWinFSP(); err != nil {
+		return nil, err
+	}
+	option := resolveOption(fs, opts)
+	created := false
+
+	// Place the reference map right now.
+	result := &FileSystem{}
+	fileSystemRef := &result.FileSystemRef
+	fileSystemAddr := uintptr(unsafe.Pointer(fileSystemRef))
+	_, loaded := refMap.LoadOrStore(fileSystemAddr, fileSystemRef)
+	if loaded {
+		return nil, errors.New("out of memory")
+	}
+	defer func() {
+		if !created {
+			refMap.Delete(fileSystemAddr)
+		}
+	}()
+	fileSystemOps, attributes := wireBehaviours(fs, option, fileSystemRef)
+	if option.wslFeatures {
+		// The versions lacking FspVersion predate the
+		// WSL features, which are then dropped.
+		major, minor, err := Version()
+		if err != nil && !errors.Is(err, ErrNotSupported) {
+			return nil, err
+		}
+		if err == nil && wslFeaturesSupported(major, minor) {
+			attributes |= FspFSAttributeWslFeatures
+		}
 	}
 
 	// Convert the file system names into their wchar types.
@@ -1780,6 +3157,24 @@ func Mount(
 	if err != nil {
 		return nil, convertError(err, option.fileSystemName)
 	}
+
+	// Reject the names that cannot fit in the volume params,
+	// the trailing NUL must also be stored.
+	tooLongError := func(kind, content string, maxLen int) error {
+		return errors.Errorf(
+			"%s %q too long, at most %d UTF-16 code units",
+			kind, content, maxLen)
+	}
+	const maxPrefixLen = len(FSP_FSCTL_VOLUME_PARAMS_V1{}.Prefix) - 1
+	if len(utf16Prefix) > maxPrefixLen+1 {
+		return nil, tooLongError(
+			"volume prefix", option.volumePrefix, maxPrefixLen)
+	}
+	const maxNameLen = len(FSP_FSCTL_VOLUME_PARAMS_V1{}.FileSystemName) - 1
+	if len(utf16Name) > maxNameLen+1 {
+		return nil, tooLongError(
+			"file system name", option.fileSystemName, maxNameLen)
+	}
 	utf16MountPoint, err := windows.UTF16PtrFromString(mountpoint)
 	if err != nil {
 		return nil, convertError(err, mountpoint)
@@ -1800,6 +3195,11 @@ func Mount(
 	volumeParams.SizeOfVolumeParamsV1 = sizeOfVolumeParamsV1
 	volumeParams.SectorSize = option.sectorSize
 	volumeParams.SectorsPerAllocationUnit = option.sectorsPerAllocationUnit
+	volumeParams.MaxComponentLength = option.maxComponentLength
+	volumeParams.TransactTimeout = uint32(
+		option.transactTimeout / time.Millisecond)
+	volumeParams.IrpTimeout = uint32(
+		option.irpTimeout / time.Millisecond)
 	nowFiletime := syscall.NsecToFiletime(
 		option.creationTime.UnixNano())
 	volumeParams.VolumeCreationTime =
@@ -1844,14 +3244,20 @@ func Mount(
 	}
 
 	// Attempt to mount the file system at mount point.
+	if option.cleanMountPoint && isDirectoryMountPoint(mountpoint) {
+		if err := CleanStaleMountPoint(mountpoint); err != nil {
+			return nil, err
+		}
+	}
 	err = setMountPoint.CallStatus(
 		uintptr(unsafe.Pointer(result.fileSystem)),
 		uintptr(unsafe.Pointer(utf16MountPoint)),
 	)
 	runtime.KeepAlive(utf16MountPoint)
 	if err != nil {
-		return nil, errors.Wrap(err, "mount file system")
+		return nil, errors.Wrapf(err, "mount file system at %q", mountpoint)
 	}
+	fileSystemRef.mountPoint = mountpoint
 
 	// Attempt to start the file system dispatcher.
 	err = startDispatcher.CallStatus(
@@ -1867,12 +3273,131 @@ func Mount(
 		}
 	}()
 	created = true
+	fileSystemRef.mounted.Store(result)
+	return result, nil
+}
+
+// MountMany mounts the file system at each of the mount
+// points, e.g. to make it visible at two drive letters,
+// returning the handles in the order of the mount points.
+//
+// WinFSP only allows a single mount point for a volume,
+// so a separate volume is created for each mount point,
+// all of them served by the same behaviours. The file
+// system must be safe to be invoked by the volumes
+// concurrently, and must key its state bound to a volume,
+// e.g. the watches of the directories to be notified
+// through FileSystemRef.Notify, on the FileSystemRef, as
+// the files opened through one volume are never seen by
+// the other.
+//
+// If any of the mounts fails, the ones already mounted
+// are unmounted and the error is returned.
+func MountMany(
+	fs BehaviourBase, mountpoints []string, opts ...Option,
+) ([]*FileSystem, error) {
+	var result []*FileSystem
+	for _, mountpoint := range mountpoints {
+		fileSystem, err := Mount(fs, mountpoint, opts...)
+		if err != nil {
+			for _, mounted := range result {
+				mounted.Unmount()
+			}
+			return nil, err
+		}
+		result = append(result, fileSystem)
+	}
 	return result, nil
 }
 
 // Unmount destroy the created file system.
+//
+// Calling Unmount on an unmounted file system is a no-op.
 func (f *FileSystem) Unmount() {
+	if !f.mounted.CompareAndSwap(f, nil) {
+		return
+	}
 	fileSystem := uintptr(unsafe.Pointer(f.fileSystem))
 	_, _ = stopDispatcher.Call(fileSystem)
+	f.unmountMtx.Lock()
+	defer f.unmountMtx.Unlock()
 	_, _ = fileSystemDelete.Call(fileSystem)
+	refMap.Delete(uintptr(unsafe.Pointer(&f.FileSystemRef)))
+}
+
+// DispatchStats is the health of the dispatcher of
+// a file system, see FileSystem.Statistics.
+type DispatchStats struct {
+	// Running tells whether the dispatcher is running,
+	// i.e. the file system has not been unmounted.
+	Running bool
+
+	// DispatcherThreads is the number of the threads
+	// started by WinFSP to dispatch the operations.
+	DispatcherThreads uint32
+
+	// DispatcherResult is the status with which the
+	// dispatcher threads have stopped unexpectedly, or
+	// STATUS_SUCCESS if they have not.
+	DispatcherResult windows.NTStatus
+
+	// Operations is the number of the operations
+	// dispatched to the file system so far.
+	Operations uint64
+
+	// PendingOperations is the number of the operations
+	// being dispatched to the file system at the moment.
+	// A pending count that stays non-zero while Operations
+	// stops growing is a hint of a wedged file system.
+	PendingOperations int64
+}
+
+// Statistics reports the health of the dispatcher of
+// the file system, which could be polled to detect a
+// wedged volume programmatically.
+//
+// The operations keep being counted by the same hook
+// reporting them to WithLogger. After Unmount, the
+// dispatcher is reported as stopped, with the counts
+// of the operations retained.
+func (f *FileSystem) Statistics() DispatchStats {
+	stats := DispatchStats{
+		DispatcherResult:  windows.STATUS_SUCCESS,
+		Operations:        f.operations.Load(),
+		PendingOperations: f.pending.Load(),
+	}
+	f.unmountMtx.RLock()
+	defer f.unmountMtx.RUnlock()
+	if f.mounted.Load() != f {
+		return stats
+	}
+	stats.Running = true
+	stats.DispatcherThreads = f.fileSystem.DispatcherThreadCount
+	stats.DispatcherResult = f.fileSystem.DispatcherResult
+	return stats
+}
+
+// Mounts returns the file systems mounted by this
+// process which have not been unmounted, ordered by
+// their mount points.
+func Mounts() []*FileSystem {
+	var result []*FileSystem
+	refMap.Range(func(_, value any) bool {
+		if fs := value.(*FileSystemRef).mounted.Load(); fs != nil {
+			result = append(result, fs)
+		}
+		return true
+	})
+	slices.SortFunc(result, func(a, b *FileSystem) int {
+		return strings.Compare(a.mountPoint, b.mountPoint)
+	})
+	return result
+}
+
+// UnmountAll unmounts every file system returned by
+// Mounts, e.g. upon exiting the process.
+func UnmountAll() {
+	for _, fs := range Mounts() {
+		fs.Unmount()
+	}
 }
@@ -0,0 +1,978 @@
+package winfsp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"unicode/utf16"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// fakeFileSystem places the reference into the reference
+// map, returning the FSP_FILE_SYSTEM to call delegates.
+func fakeFileSystem(t *testing.T, ref *FileSystemRef) *FSP_FILE_SYSTEM {
+	t.Helper()
+	addr := uintptr(unsafe.Pointer(ref))
+	refMap.Store(addr, ref)
+	t.Cleanup(func() { refMap.Delete(addr) })
+	return &FSP_FILE_SYSTEM{UserContext: addr}
+}
+
+type reparseSecurityByName struct {
+	index uint32
+}
+
+func (r reparseSecurityByName) GetSecurityByName(
+	fs *FileSystemRef, name string,
+	flags GetSecurityByNameFlags,
+) (uint32, *windows.SECURITY_DESCRIPTOR, error) {
+	return 0, nil, errors.Wrap(ReparseStatus{Index: r.index}, "resolve")
+}
+
+func TestGetSecurityByNameReparse(t *testing.T) {
+	const index = 4
+	fsp := fakeFileSystem(t, &FileSystemRef{
+		getSecurityByName: reparseSecurityByName{index: index},
+	})
+	name, err := windows.UTF16PtrFromString(`\link\file`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes := ^uint32(0)
+	status := delegateGetSecurityByName(
+		uintptr(unsafe.Pointer(fsp)),
+		uintptr(unsafe.Pointer(name)),
+		uintptr(unsafe.Pointer(&attributes)), 0, 0,
+	)
+	if status != windows.STATUS_REPARSE {
+		t.Errorf("status = %v; want STATUS_REPARSE", status)
+	}
+	if attributes != index {
+		t.Errorf("reparse index = %d; want %d", attributes, index)
+	}
+
+	// The status is still reported without the attributes.
+	status = delegateGetSecurityByName(
+		uintptr(unsafe.Pointer(fsp)),
+		uintptr(unsafe.Pointer(name)), 0, 0, 0,
+	)
+	if status != windows.STATUS_REPARSE {
+		t.Errorf("status = %v; want STATUS_REPARSE", status)
+	}
+}
+
+type directReader struct {
+	data []byte
+}
+
+func (r directReader) ReadDirect(
+	fs *FileSystemRef, file uintptr,
+	offset uint64, length uint32,
+) ([]byte, error) {
+	if offset >= uint64(len(r.data)) {
+		return nil, io.EOF
+	}
+	end := min(offset+uint64(length), uint64(len(r.data)))
+	return r.data[offset:end], nil
+}
+
+func TestReadDirect(t *testing.T) {
+	data := []byte("hello, world")
+	fsp := fakeFileSystem(t, &FileSystemRef{
+		read: &behaviourReadDirect{
+			readDirect: directReader{data: data},
+		},
+	})
+	buf := make([]byte, 5)
+	var n uint32
+	status := delegateRead(
+		uintptr(unsafe.Pointer(fsp)), 0,
+		uintptr(unsafe.Pointer(&buf[0])), 7,
+		uint32(len(buf)), &n,
+	)
+	if status != windows.STATUS_SUCCESS {
+		t.Fatalf("status = %v; want STATUS_SUCCESS", status)
+	}
+	if !bytes.Equal(buf[:n], data[7:]) {
+		t.Errorf("read %q; want %q", buf[:n], data[7:])
+	}
+	status = delegateRead(
+		uintptr(unsafe.Pointer(fsp)), 0,
+		uintptr(unsafe.Pointer(&buf[0])), uint64(len(data)),
+		uint32(len(buf)), &n,
+	)
+	if status != windows.STATUS_END_OF_FILE || n != 0 {
+		t.Errorf("status = %v, n = %d; want STATUS_END_OF_FILE", status, n)
+	}
+}
+
+func TestWSLFeaturesSupported(t *testing.T) {
+	for _, tc := range []struct {
+		major, minor uint16
+		want         bool
+	}{
+		{1, 4, false},
+		{1, 5, true},
+		{1, 12, true},
+		{2, 0, true},
+		{0, 9, false},
+	} {
+		if got := wslFeaturesSupported(tc.major, tc.minor); got != tc.want {
+			t.Errorf("wslFeaturesSupported(%d, %d) = %v; want %v",
+				tc.major, tc.minor, got, tc.want)
+		}
+	}
+}
+
+func TestOptionalProc(t *testing.T) {
+	dll, err := syscall.LoadDLL("kernel32.dll")
+	if err != nil {
+		t.Fatalf("LoadDLL: %v", err)
+	}
+	present := &optionalProc{name: "GetTickCount"}
+	if proc, err := present.find(dll); err != nil || proc == nil {
+		t.Errorf("find present = %v, %v; want the proc", proc, err)
+	}
+	missing := &optionalProc{name: "FspVersion"}
+	for range 2 {
+		if _, err := missing.find(dll); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("find missing = %v; want ErrNotSupported", err)
+		}
+	}
+}
+
+// eofReader reads from data, signalling the end of file
+// by returning (0, nil) instead of io.EOF if lazy.
+type eofReader struct {
+	data []byte
+	lazy bool
+}
+
+func (r eofReader) Read(
+	fs *FileSystemRef, file uintptr,
+	buf []byte, offset uint64,
+) (int, error) {
+	if offset >= uint64(len(r.data)) {
+		if r.lazy {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(buf, r.data[offset:])
+	if n < len(buf) && !r.lazy {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestReadEOFPolicy(t *testing.T) {
+	data := []byte("0123456789")
+	for _, lazy := range []bool{false, true} {
+		fsp := fakeFileSystem(t, &FileSystemRef{
+			read: eofReader{data: data, lazy: lazy},
+		})
+		for _, tc := range []struct {
+			offset uint64
+			length uint32
+			n      uint32
+			status windows.NTStatus
+		}{
+			{offset: 0, length: 4, n: 4, status: windows.STATUS_SUCCESS},
+			{offset: 8, length: 4, n: 2, status: windows.STATUS_SUCCESS},
+			{offset: 10, length: 4, n: 0, status: windows.STATUS_END_OF_FILE},
+			{offset: 12, length: 4, n: 0, status: windows.STATUS_END_OF_FILE},
+			{offset: 0, length: 0, n: 0, status: windows.STATUS_SUCCESS},
+			{offset: 10, length: 0, n: 0, status: windows.STATUS_SUCCESS},
+			{offset: 12, length: 0, n: 0, status: windows.STATUS_SUCCESS},
+		} {
+			buf := make([]byte, tc.length+1)
+			var n uint32
+			status := delegateRead(
+				uintptr(unsafe.Pointer(fsp)), 0,
+				uintptr(unsafe.Pointer(&buf[0])), tc.offset,
+				tc.length, &n,
+			)
+			if status != tc.status || n != tc.n {
+				t.Errorf("lazy %v, read(%d, %d) = %v, %d; want %v, %d",
+					lazy, tc.offset, tc.length, status, n, tc.status, tc.n)
+			}
+		}
+	}
+}
+
+type countingReader struct {
+	eofReader
+	chunks *[]int
+}
+
+func (r countingReader) Read(
+	fs *FileSystemRef, file uintptr,
+	buf []byte, offset uint64,
+) (int, error) {
+	*r.chunks = append(*r.chunks, len(buf))
+	return r.eofReader.Read(fs, file, buf, offset)
+}
+
+func TestCheckSectorSize(t *testing.T) {
+	for _, tc := range []struct {
+		sectorSize, sectorsPerAllocationUnit uint16
+		valid                                bool
+	}{
+		{512, 1, true},
+		{4096, 1, true},
+		{4096, 16, true},
+		{1024, 8, true},
+		{0, 1, false},
+		{256, 1, false},
+		{513, 1, false},
+		{8192, 1, false},
+		{512, 0, false},
+		{512, 3, false},
+		{4096, 32, false},
+	} {
+		err := checkSectorSize(tc.sectorSize, tc.sectorsPerAllocationUnit)
+		if (err == nil) != tc.valid {
+			t.Errorf("checkSectorSize(%d, %d) = %v; want valid %v",
+				tc.sectorSize, tc.sectorsPerAllocationUnit, err, tc.valid)
+		}
+	}
+}
+
+func TestMaxTransferSize(t *testing.T) {
+	for _, tc := range []struct {
+		value      uint32
+		sectorSize uint16
+		want       uint32
+	}{
+		{value: 0, sectorSize: 512, want: 0},
+		{value: 4096, sectorSize: 512, want: 4096},
+		{value: 5000, sectorSize: 512, want: 4608},
+		{value: 100, sectorSize: 512, want: 512},
+	} {
+		if got := clampTransferSize(tc.value, tc.sectorSize); got != tc.want {
+			t.Errorf("clampTransferSize(%d, %d) = %d; want %d",
+				tc.value, tc.sectorSize, got, tc.want)
+		}
+	}
+
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	var chunks []int
+	fsp := fakeFileSystem(t, &FileSystemRef{
+		read: countingReader{
+			eofReader: eofReader{data: data},
+			chunks:    &chunks,
+		},
+		maxTransferSize: 1024,
+	})
+	buf := make([]byte, 4096)
+	var n uint32
+	status := delegateRead(
+		uintptr(unsafe.Pointer(fsp)), 0,
+		uintptr(unsafe.Pointer(&buf[0])), 0,
+		uint32(len(buf)), &n,
+	)
+	if status != windows.STATUS_SUCCESS || n != uint32(len(data)) {
+		t.Fatalf("read = %v, %d; want success, %d", status, n, len(data))
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Errorf("read data mismatch")
+	}
+	if !slices.Equal(chunks, []int{1024, 1024, 1024}) {
+		t.Errorf("read chunks = %v; want [1024 1024 1024]", chunks)
+	}
+}
+
+func TestFillNameTooLong(t *testing.T) {
+	if got := (&FileSystemRef{}).MaxComponentLength(); got != 255 {
+		t.Errorf("default MaxComponentLength() = %d; want 255", got)
+	}
+	var option option
+	MaxComponentLength(0)(&option)
+	if option.maxComponentLength != 255 {
+		t.Errorf("MaxComponentLength(0) = %d; want 255",
+			option.maxComponentLength)
+	}
+
+	// The name is rejected before reaching WinFSP.
+	filler := &DirBufferFiller{buf: &DirBuffer{}}
+	var info FSP_FSCTL_FILE_INFO
+	_, err := filler.Fill(strings.Repeat("a", 300), &info)
+	if !errors.Is(err, windows.STATUS_NAME_TOO_LONG) {
+		t.Errorf("Fill of 300 code units = %v; want STATUS_NAME_TOO_LONG", err)
+	}
+	filler.maxNameLen = 100
+	_, err = filler.Fill(strings.Repeat("\U0001F600", 60), &info)
+	if !errors.Is(err, windows.STATUS_NAME_TOO_LONG) {
+		t.Errorf("Fill of 120 code units = %v; want STATUS_NAME_TOO_LONG", err)
+	}
+
+	buffer := make([]uint64, 1<<14)
+	raw := unsafe.Slice((*byte)(unsafe.Pointer(&buffer[0])), len(buffer)*8)
+	if n := FileSystemAddDirInfo(
+		strings.Repeat("a", 40000), 0, &info, raw); n != 0 {
+		t.Errorf("FileSystemAddDirInfo of oversized name = %d; want 0", n)
+	}
+}
+
+// sliceReadDir enumerates a fixed list of names.
+type sliceReadDir struct {
+	buf   DirBuffer
+	names []string
+	reads int
+}
+
+func (r *sliceReadDir) GetOrNewDirBuffer(
+	fs *FileSystemRef, file uintptr,
+) (*DirBuffer, error) {
+	return &r.buf, nil
+}
+
+func (r *sliceReadDir) ReadDirectory(
+	fs *FileSystemRef, file uintptr, pattern string,
+	fill func(string, *FSP_FSCTL_FILE_INFO) (bool, error),
+) error {
+	r.reads++
+	for i, name := range r.names {
+		ok, err := fill(name, &FSP_FSCTL_FILE_INFO{FileSize: uint64(i)})
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestReadDirectoryBatched(t *testing.T) {
+	readDir := &sliceReadDir{}
+	for i := 999; i >= 0; i-- {
+		readDir.names = append(readDir.names, fmt.Sprintf("file-%04d", i))
+	}
+	// U+FFFD sorts after the surrogates of U+1F600 in UTF-16,
+	// unlike in UTF-8.
+	readDir.names = append(readDir.names, "\uFFFD", "\U0001F600")
+	want := slices.Clone(readDir.names)
+	slices.SortFunc(want, func(a, b string) int {
+		return slices.Compare(utf16.Encode([]rune(a)), utf16.Encode([]rune(b)))
+	})
+	ref := &FileSystemRef{batchDirFills: true}
+	d := &behaviourReadDirectoryDelegate{readDir: readDir}
+
+	buffer := make([]uint64, 512)
+	raw := unsafe.Slice((*byte)(unsafe.Pointer(&buffer[0])), len(buffer)*8)
+	dirInfoSize := int(unsafe.Sizeof(FSP_FSCTL_DIR_INFO{}))
+	var got []string
+	var marker *uint16
+	for eof := false; !eof; {
+		n, err := d.ReadDirectoryRaw(ref, 0, nil, marker, raw)
+		if err != nil {
+			t.Fatalf("ReadDirectoryRaw: %v", err)
+		}
+		if n == 0 {
+			t.Fatalf("ReadDirectoryRaw read nothing after %d entries", len(got))
+		}
+		for offset := 0; offset < n; {
+			size := int(*(*uint16)(unsafe.Pointer(&raw[offset])))
+			if size == 0 {
+				eof = true
+				break
+			}
+			name := unsafe.Slice((*uint16)(unsafe.Pointer(
+				&raw[offset+dirInfoSize])), (size-dirInfoSize)/SIZEOF_WCHAR)
+			got = append(got, string(utf16.Decode(name)))
+			marker = &append(slices.Clone(name), 0)[0]
+			offset += (size + 7) &^ 7
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("enumerated %d entries out of order; want %d sorted",
+			len(got), len(want))
+	}
+	if readDir.reads != 1 {
+		t.Errorf("directory read %d times; want once", readDir.reads)
+	}
+	if _, err := d.ReadDirectoryRaw(ref, 0, nil, nil, raw); err != nil {
+		t.Fatalf("ReadDirectoryRaw: %v", err)
+	}
+	if readDir.reads != 2 {
+		t.Errorf("directory read %d times after rewind; want twice",
+			readDir.reads)
+	}
+
+	readDir.names = []string{strings.Repeat("a", 300)}
+	if _, err := d.ReadDirectoryRaw(ref, 0, nil, nil, raw); !errors.Is(
+		err, windows.STATUS_NAME_TOO_LONG) {
+		t.Errorf("batched fill of 300 code units = %v; want STATUS_NAME_TOO_LONG", err)
+	}
+}
+
+// casStore is a content addressed store, whose files are
+// only stored under their hashes once they are closed.
+type casStore struct {
+	pending map[uintptr][]byte
+	blobs   map[string][]byte
+	closed  int
+}
+
+func (c *casStore) Open(
+	fs *FileSystemRef, name string,
+	createOptions, grantedAccess uint32,
+	info *FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	return 0, windows.STATUS_NOT_IMPLEMENTED
+}
+
+func (c *casStore) Close(fs *FileSystemRef, file uintptr) {
+	c.closed++
+}
+
+func (c *casStore) CloseWithInfo(
+	fs *FileSystemRef, file uintptr,
+) (*FSP_FSCTL_FILE_INFO, error) {
+	data, ok := c.pending[file]
+	if !ok {
+		return nil, windows.STATUS_INVALID_HANDLE
+	}
+	delete(c.pending, file)
+	sum := sha256.Sum256(data)
+	c.blobs[hex.EncodeToString(sum[:])] = data
+	return &FSP_FSCTL_FILE_INFO{FileSize: uint64(len(data))}, nil
+}
+
+func TestCloseWithInfo(t *testing.T) {
+	store := &casStore{
+		pending: map[uintptr][]byte{1: []byte("hello")},
+		blobs:   map[string][]byte{},
+	}
+	fsp := fakeFileSystem(t, &FileSystemRef{
+		base:          store,
+		closeWithInfo: store,
+	})
+	if status := delegateClose(uintptr(unsafe.Pointer(fsp)), 1); status != 0 {
+		t.Fatalf("close = %v; want success", status)
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	if got := string(store.blobs[hex.EncodeToString(sum[:])]); got != "hello" {
+		t.Errorf("blob = %q after close; want finalized content", got)
+	}
+	if store.closed != 0 {
+		t.Errorf("Close called %d times along with CloseWithInfo", store.closed)
+	}
+	status := delegateClose(uintptr(unsafe.Pointer(fsp)), 2)
+	if status != windows.STATUS_INVALID_HANDLE {
+		t.Errorf("close of unknown file = %v; want STATUS_INVALID_HANDLE", status)
+	}
+}
+
+// fixedEa reports the same extended attributes for all
+// of the files.
+type fixedEa []EaEntry
+
+func (ea fixedEa) GetEa(fs *FileSystemRef, file uintptr) ([]EaEntry, error) {
+	return ea, nil
+}
+
+func TestGetEaTruncated(t *testing.T) {
+	ea := fixedEa{
+		{Name: "FIRST", Value: []byte("1")},
+		{Name: "SECOND", Value: []byte("22")},
+	}
+	fsp := fakeFileSystem(t, &FileSystemRef{getEa: ea})
+	whole, err := FileSystemPackEa(ea)
+	if err != nil {
+		t.Fatalf("FileSystemPackEa: %v", err)
+	}
+	first, err := FileSystemPackEa(ea[:1])
+	if err != nil {
+		t.Fatalf("FileSystemPackEa: %v", err)
+	}
+	for _, tc := range []struct {
+		length int
+		want   []byte
+	}{
+		{len(whole), whole},
+		{len(whole) - 1, first},
+		{len(first) - 1, nil},
+	} {
+		buf := make([]byte, tc.length+1)
+		var n uint32
+		status := delegateGetEa(uintptr(unsafe.Pointer(fsp)), 0,
+			uintptr(unsafe.Pointer(&buf[0])), uint32(tc.length), &n)
+		if status != windows.STATUS_SUCCESS || !bytes.Equal(buf[:n], tc.want) {
+			t.Errorf("GetEa(%d) = %v, %v; want success, %v",
+				tc.length, status, buf[:n], tc.want)
+		}
+	}
+}
+
+func TestBase(t *testing.T) {
+	store := &casStore{}
+	d, err := NewDetached(store)
+	if err != nil {
+		t.Fatalf("NewDetached: %v", err)
+	}
+	defer d.Close()
+	ref := loadFileSystemRef(uintptr(unsafe.Pointer(d.FileSystem())))
+	if ref == nil {
+		t.Fatal("file system reference not found")
+	}
+	base, ok := ref.Base().(BehaviourCloseWithInfo)
+	if !ok || base != BehaviourCloseWithInfo(store) {
+		t.Errorf("Base() = %v; want the mounted store", ref.Base())
+	}
+}
+
+func TestOpError(t *testing.T) {
+	opErr := &OpError{
+		Op:     "Open",
+		Path:   `\dir\file`,
+		Status: windows.STATUS_ACCESS_DENIED,
+	}
+	if status := convertNTStatus(errors.Wrap(opErr, "open")); status != opErr.Status {
+		t.Errorf("convertNTStatus = %v; want %v", status, opErr.Status)
+	}
+
+	ring := NewRingLog(4)
+	ref := &FileSystemRef{logger: ring}
+	name, err := windows.UTF16PtrFromString(`\dir\file`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traceReturnPath(ref, "Open", uintptr(unsafe.Pointer(name)),
+		windows.STATUS_OBJECT_NAME_NOT_FOUND)
+	traceReturnPath(ref, "Open", uintptr(unsafe.Pointer(name)),
+		windows.STATUS_SUCCESS)
+	entries := ring.Dump()
+	if len(entries) != 2 {
+		t.Fatalf("logged %d entries; want 2", len(entries))
+	}
+	var got *OpError
+	if !errors.As(entries[0].Status, &got) {
+		t.Fatalf("logged status %v is not an OpError", entries[0].Status)
+	}
+	if got.Op != "Open" || got.Path != `\dir\file` ||
+		got.Status != windows.STATUS_OBJECT_NAME_NOT_FOUND {
+		t.Errorf("logged OpError = %+v", got)
+	}
+	if entries[1].Status != nil {
+		t.Errorf("logged status of success = %v; want nil", entries[1].Status)
+	}
+}
+
+func TestPackNotifyInfo(t *testing.T) {
+	infos := []NotifyInfo{{
+		Filter: windows.FILE_NOTIFY_CHANGE_FILE_NAME,
+		Action: windows.FILE_ACTION_ADDED,
+		Name:   `\a`,
+	}, {
+		Filter: windows.FILE_NOTIFY_CHANGE_SIZE,
+		Action: windows.FILE_ACTION_MODIFIED,
+		Name:   `\dir\file`,
+	}}
+	buffer, size, err := packNotifyInfo(infos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 12+2*2 = 16 bytes, and 12+9*2 = 30 aligned to 32.
+	if size != 48 {
+		t.Fatalf("packed size = %d; want 48", size)
+	}
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&buffer[0])), size)
+	offset := 0
+	for _, info := range infos {
+		entry := unsafe.Pointer(&data[offset])
+		entrySize := int(*(*uint16)(entry))
+		nameLen := (entrySize - notifyInfoHeaderSize) / SIZEOF_WCHAR
+		name := windows.UTF16ToString(unsafe.Slice(
+			(*uint16)(unsafe.Add(entry, notifyInfoHeaderSize)), nameLen))
+		filter := *(*uint32)(unsafe.Add(entry, 4))
+		action := *(*uint32)(unsafe.Add(entry, 8))
+		if name != info.Name || filter != info.Filter || action != info.Action {
+			t.Errorf("entry at %d = %q, %d, %d; want %+v",
+				offset, name, filter, action, info)
+		}
+		offset += (entrySize + notifyInfoAlignment - 1) &^
+			(notifyInfoAlignment - 1)
+	}
+
+	_, _, err = packNotifyInfo([]NotifyInfo{{Name: strings.Repeat("a", 0x8000)}})
+	if !errors.Is(err, windows.STATUS_NAME_TOO_LONG) {
+		t.Errorf("packing overlong name = %v; want STATUS_NAME_TOO_LONG", err)
+	}
+}
+
+type echoIoControl struct{}
+
+func (echoIoControl) DeviceIoControl(
+	fs *FileSystemRef, file uintptr,
+	code uint32, data []byte,
+) ([]byte, error) {
+	return data, nil
+}
+
+func TestDeviceIoControlOverflow(t *testing.T) {
+	fsp := fakeFileSystem(t, &FileSystemRef{
+		deviceIoControl: &behaviourDeviceIoControl{
+			deviceIoControl: echoIoControl{},
+		},
+	})
+	input := []byte("12345678")
+	for _, tc := range []struct {
+		outputLen int
+		written   uint32
+		status    windows.NTStatus
+	}{
+		{outputLen: 16, written: 8, status: windows.STATUS_SUCCESS},
+		{outputLen: 8, written: 8, status: windows.STATUS_SUCCESS},
+		{outputLen: 4, written: 4, status: windows.STATUS_BUFFER_OVERFLOW},
+		{outputLen: 0, written: 0, status: windows.STATUS_BUFFER_TOO_SMALL},
+	} {
+		output := make([]byte, tc.outputLen+1)
+		var written uint32
+		status := delegateDeviceIoControl(
+			uintptr(unsafe.Pointer(fsp)), 0, 0,
+			uintptr(unsafe.Pointer(&input[0])), uint32(len(input)),
+			uintptr(unsafe.Pointer(&output[0])), uint32(tc.outputLen),
+			&written,
+		)
+		if status != tc.status || written != tc.written {
+			t.Errorf("output %d: status %v, written %d; want %v, %d",
+				tc.outputLen, status, written, tc.status, tc.written)
+		}
+		if !bytes.Equal(output[:written], input[:written]) {
+			t.Errorf("output %d: %q", tc.outputLen, output[:written])
+		}
+		if output[tc.outputLen] != 0 {
+			t.Errorf("output %d: written past the buffer", tc.outputLen)
+		}
+	}
+}
+
+func TestDebugTrackDirBuffers(t *testing.T) {
+	DebugTrackDirBuffers(true)
+	defer DebugTrackDirBuffers(false)
+
+	buf := &DirBuffer{}
+	if err := buf.fillBatched(0, func(
+		fill func(string, *FSP_FSCTL_FILE_INFO) (bool, error),
+	) error {
+		_, err := fill("file", nil)
+		return err
+	}); err != nil {
+		t.Fatalf("fillBatched: %v", err)
+	}
+	leaks := DirBufferLeaks()
+	if len(leaks) != 1 {
+		t.Fatalf("DirBufferLeaks = %d leaks; want 1", len(leaks))
+	}
+	if !strings.Contains(leaks[0], "winfsp.TestDebugTrackDirBuffers") {
+		t.Errorf("leak stack does not contain the test:\n%s", leaks[0])
+	}
+	buf.Delete()
+	if leaks := DirBufferLeaks(); len(leaks) != 0 {
+		t.Errorf("DirBufferLeaks after Delete = %q; want none", leaks)
+	}
+}
+
+// symlinkReparse reports every file as a symbolic link
+// to the target.
+type symlinkReparse struct {
+	target string
+}
+
+func (r symlinkReparse) GetReparsePoint(
+	fs *FileSystemRef, file uintptr, name string,
+	buffer []byte,
+) (int, error) {
+	data, err := BuildSymlinkReparse(r.target, true)
+	if err != nil {
+		return 0, err
+	}
+	if len(buffer) < len(data) {
+		return 0, windows.STATUS_BUFFER_TOO_SMALL
+	}
+	return copy(buffer, data), nil
+}
+
+func TestDeviceIoControlGetReparsePoint(t *testing.T) {
+	fsp := fakeFileSystem(t, &FileSystemRef{
+		getReparsePoint: symlinkReparse{target: `dir\target`},
+	})
+	control := func(code uint32, output []byte) (windows.NTStatus, []byte) {
+		var written uint32
+		status := delegateDeviceIoControl(
+			uintptr(unsafe.Pointer(fsp)), 0, code, 0, 0,
+			uintptr(unsafe.Pointer(&output[0])), uint32(len(output)),
+			&written,
+		)
+		return status, output[:written]
+	}
+
+	status, data := control(windows.FSCTL_GET_REPARSE_POINT,
+		make([]byte, windows.MAXIMUM_REPARSE_DATA_BUFFER_SIZE))
+	if status != windows.STATUS_SUCCESS {
+		t.Fatalf("FSCTL_GET_REPARSE_POINT: %v", status)
+	}
+	tag, target, err := ParseReparse(data)
+	if err != nil {
+		t.Fatalf("ParseReparse: %v", err)
+	}
+	if tag != windows.IO_REPARSE_TAG_SYMLINK || target != `dir\target` {
+		t.Errorf("reparse = %#x %q; want symlink %q", tag, target, `dir\target`)
+	}
+
+	status, _ = control(windows.FSCTL_GET_REPARSE_POINT, make([]byte, 8))
+	if status != windows.STATUS_BUFFER_TOO_SMALL {
+		t.Errorf("small buffer = %v; want STATUS_BUFFER_TOO_SMALL", status)
+	}
+
+	// The other codes are not served without device control.
+	status, _ = control(0, make([]byte, 8))
+	if status != windows.STATUS_INVALID_DEVICE_REQUEST {
+		t.Errorf("other code = %v; want STATUS_INVALID_DEVICE_REQUEST", status)
+	}
+
+	// Nor is it routed once the reparse points are enabled,
+	// as the driver serves it by itself.
+	ref := &FileSystemRef{
+		getReparsePoint:       symlinkReparse{target: `dir\target`},
+		getReparsePointByName: reparseByName{},
+	}
+	if ref.routeGetReparsePoint() {
+		t.Errorf("routed with the reparse points enabled")
+	}
+}
+
+// reparseByName enables the reparse points, having none.
+type reparseByName struct{}
+
+func (reparseByName) GetReparsePointByName(
+	fs *FileSystemRef, name string, isDirectory bool,
+	buffer []byte,
+) (int, error) {
+	return 0, windows.STATUS_NOT_A_REPARSE_POINT
+}
+
+func TestFirstFreeDriveLetter(t *testing.T) {
+	const (
+		a = 1 << iota
+		b
+		c
+		d
+	)
+	all := uint32(1<<26 - 1)
+	for _, tc := range []struct {
+		drives uint32
+		want   string
+	}{
+		{a | c, "Z:"},
+		{all &^ (d | 1<<('Y'-'A')), "Y:"},
+		{all &^ d, "D:"},
+		{all &^ (a | b), ""},
+	} {
+		got, err := firstFreeDriveLetter(tc.drives)
+		if got != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("firstFreeDriveLetter(%#x) = %q, %v; want %q",
+				tc.drives, got, err, tc.want)
+		}
+	}
+}
+
+func TestIsDirectoryMountPoint(t *testing.T) {
+	for _, tc := range []struct {
+		mountpoint string
+		want       bool
+	}{
+		{"*", false},
+		{"X:", false},
+		{`\\.\X:`, false},
+		{`C:\mnt`, true},
+		{`\\.\C:\mnt`, true},
+	} {
+		if got := isDirectoryMountPoint(tc.mountpoint); got != tc.want {
+			t.Errorf("isDirectoryMountPoint(%q) = %v; want %v",
+				tc.mountpoint, got, tc.want)
+		}
+	}
+}
+
+func TestMountPointOwns(t *testing.T) {
+	for _, tc := range []struct {
+		mountpoint, path string
+		want             bool
+	}{
+		{"X:", `X:\`, true},
+		{"X:", `x:\dir\file`, true},
+		{"X:", "x:/dir/file", true},
+		{"X:", `\\?\X:\dir`, true},
+		{`\\.\X:`, `X:\dir`, true},
+		{"X:", `Y:\dir`, false},
+		{`C:\mnt`, `c:\MNT\file`, true},
+		{`C:\mnt`, `C:\mnt\`, true},
+		{`C:\mnt`, `C:\mnt2\file`, false},
+		{`C:\mnt`, `C:\`, false},
+	} {
+		if got := mountPointOwns(tc.mountpoint, tc.path); got != tc.want {
+			t.Errorf("mountPointOwns(%q, %q) = %v; want %v",
+				tc.mountpoint, tc.path, got, tc.want)
+		}
+	}
+}
+
+// setReparsePoint sets the reparse data on the directory.
+func setReparsePoint(t *testing.T, dir string, data []byte) {
+	t.Helper()
+	utf16Dir, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := windows.CreateFile(
+		utf16Dir, windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	defer windows.CloseHandle(handle)
+	var size uint32
+	err = windows.DeviceIoControl(handle, windows.FSCTL_SET_REPARSE_POINT,
+		&data[0], uint32(len(data)), nil, 0, &size, nil)
+	if err != nil {
+		t.Fatalf("FSCTL_SET_REPARSE_POINT: %v", err)
+	}
+}
+
+func TestCleanStaleMountPoint(t *testing.T) {
+	base := t.TempDir()
+	exists := func(dir string) bool {
+		_, err := os.Lstat(dir)
+		return err == nil
+	}
+
+	if err := CleanStaleMountPoint(filepath.Join(base, "missing")); err != nil {
+		t.Errorf("missing directory: %v", err)
+	}
+
+	plain := filepath.Join(base, "plain")
+	if err := os.Mkdir(plain, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := CleanStaleMountPoint(plain); err != nil || !exists(plain) {
+		t.Errorf("plain directory: %v, exists %v; want kept", err, exists(plain))
+	}
+
+	// The junctions created by users are never removed.
+	junction := filepath.Join(base, "junction")
+	if err := os.Mkdir(junction, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	data, err := BuildMountPointReparse(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setReparsePoint(t, junction, data)
+	if err := CleanStaleMountPoint(junction); err == nil || !exists(junction) {
+		t.Errorf("junction: %v, exists %v; want error and kept",
+			err, exists(junction))
+	}
+
+	// The mount point of a volume which no longer exists.
+	stale := filepath.Join(base, "stale")
+	if err := os.Mkdir(stale, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	data, err = buildReparse(windows.IO_REPARSE_TAG_MOUNT_POINT,
+		`\Device\Volume{00000000-0000-0000-0000-000000000000}\`, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setReparsePoint(t, stale, data)
+	if err := CleanStaleMountPoint(stale); err != nil || exists(stale) {
+		t.Errorf("stale mount point: %v, exists %v; want removed",
+			err, exists(stale))
+	}
+}
+
+func TestUTF16PtrToStringN(t *testing.T) {
+	// The buffer is not terminated at all, so the
+	// conversion must stop at the maximum length.
+	buf := utf16.Encode([]rune("abcdef"))
+	ptr := uintptr(unsafe.Pointer(&buf[0]))
+	for _, tc := range []struct {
+		maxLen int
+		want   string
+	}{
+		{0, ""},
+		{3, "abc"},
+		{len(buf), "abcdef"},
+	} {
+		if got := utf16PtrToStringN(ptr, tc.maxLen); got != tc.want {
+			t.Errorf("utf16PtrToStringN(%d) = %q; want %q",
+				tc.maxLen, got, tc.want)
+		}
+	}
+
+	// The terminator within the maximum length ends it.
+	terminated := utf16.Encode([]rune("ab\x00cd"))
+	got := utf16PtrToStringN(uintptr(unsafe.Pointer(&terminated[0])), 5)
+	if got != "ab" {
+		t.Errorf("utf16PtrToStringN of terminated = %q; want %q", got, "ab")
+	}
+	if got := utf16PtrToStringN(0, 5); got != "" {
+		t.Errorf("utf16PtrToStringN(nil) = %q; want empty", got)
+	}
+}
+
+// retainingWrite keeps the buffer passed to Write, which
+// violates the contract of BehaviourWrite.
+type retainingWrite struct {
+	retained []byte
+}
+
+func (w *retainingWrite) Write(
+	fs *FileSystemRef, file uintptr,
+	buf []byte, offset uint64,
+	writeToEndOfFile, constrainedIo bool,
+	info *FSP_FSCTL_FILE_INFO,
+) (int, error) {
+	w.retained = buf
+	return len(buf), nil
+}
+
+func TestPoisonWriteBuffers(t *testing.T) {
+	for _, poison := range []bool{false, true} {
+		w := &retainingWrite{}
+		fsp := fakeFileSystem(t, &FileSystemRef{
+			write: w, poisonWrites: poison})
+		buf := []byte("retained past the call")
+		var n uint32
+		var info FSP_FSCTL_FILE_INFO
+		status := delegateWrite(
+			uintptr(unsafe.Pointer(fsp)), 0,
+			uintptr(unsafe.Pointer(&buf[0])), 0, uint32(len(buf)),
+			0, 0, &n, uintptr(unsafe.Pointer(&info)),
+		)
+		if status != windows.STATUS_SUCCESS || n != uint32(len(buf)) {
+			t.Fatalf("delegateWrite = %v, %d", status, n)
+		}
+		poisoned := bytes.Equal(w.retained,
+			bytes.Repeat([]byte{poisonByte}, len(buf)))
+		if poisoned != poison {
+			t.Errorf("poison %v: retained buffer = %q", poison, w.retained)
+		}
+		if string(buf) != "retained past the call" {
+			t.Errorf("poison %v: WinFSP buffer = %q", poison, buf)
+		}
+	}
+}
@@ -25,6 +25,21 @@ func Timestamp(t time.Time) uint64 {
 	return uint64FromFiletime(filetime)
 }
 
+// Now returns the file timestamp of the current time.
+func Now() uint64 {
+	return Timestamp(time.Now())
+}
+
 func Filetime(t syscall.Filetime) uint64 {
 	return uint64FromFiletime(&t)
 }
+
+// Time converts the file timestamp back into a golang's
+// timestamp, reversing Timestamp.
+func Time(value uint64) time.Time {
+	filetime := syscall.Filetime{
+		LowDateTime:  uint32(value),
+		HighDateTime: uint32(value >> 32),
+	}
+	return time.Unix(0, filetime.Nanoseconds())
+}
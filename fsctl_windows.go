@@ -137,6 +137,40 @@ type FSP_FSCTL_VOLUME_PARAMS_V1 struct {
 	// 504 bytes
 }
 
+// FSP_FSCTL_TRANSACT_REQ_CREATE is the leading part of
+// FSP_FSCTL_TRANSACT_REQ whose Kind is
+// FspFsctlTransactCreateKind.
+type FSP_FSCTL_TRANSACT_REQ_CREATE struct {
+	Version            uint16
+	Size               uint16
+	Kind               uint32
+	Hint               uint64
+	CreateOptions      uint32
+	FileAttributes     uint32
+	SecurityDescriptor FSP_FSCTL_TRANSACT_BUF
+	AllocationSize     uint64
+	AccessToken        uint64
+	DesiredAccess      uint32
+	GrantedAccess      uint32
+	ShareAccess        uint32
+	Ea                 FSP_FSCTL_TRANSACT_BUF
+	Flags              uint32
+	NamedStream        uint16
+}
+
+// Bits of FSP_FSCTL_TRANSACT_REQ_CREATE.Flags.
+const (
+	FspFsctlCreateUserMode = uint32(1) << iota
+	FspFsctlCreateHasTraversePrivilege
+	FspFsctlCreateHasBackupPrivilege
+	FspFsctlCreateHasRestorePrivilege
+	FspFsctlCreateOpenTargetDirectory
+	FspFsctlCreateCaseSensitive
+	FspFsctlCreateHasTrailingBackslash
+	FspFsctlCreateAcceptsSecurityDescriptor
+	FspFsctlCreateEaIsReparsePoint
+)
+
 type FSP_FSCTL_FILE_INFO struct {
 	FileAttributes uint32
 	ReparseTag     uint32
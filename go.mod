@@ -6,6 +6,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.8.1
 	golang.org/x/sys v0.15.0
+	golang.org/x/time v0.14.0
 )
 
 require (
@@ -0,0 +1,115 @@
+package gofs
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// The compression formats of FSCTL_GET_COMPRESSION and
+// FSCTL_SET_COMPRESSION.
+const (
+	compressionFormatNone    = 0
+	compressionFormatDefault = 1
+	compressionFormatLZNT1   = 2
+)
+
+// FileCompression is the interface for files which could
+// be marked as compressed, e.g. to keep the flag as the
+// metadata of the file, or to have the backend compress
+// its content. The state of the file is reported by the
+// FILE_ATTRIBUTE_COMPRESSED flag of its
+// `syscall.Win32FileAttributeData` in `os.FileInfo.Sys()`.
+//
+// Without this interface, changing the compression state
+// of the file fails, see WithCompression.
+type FileCompression interface {
+	File
+
+	// SetCompressed marks the file as compressed or not.
+	SetCompressed(compressed bool) error
+}
+
+// WithCompression makes gofs serve FSCTL_GET_COMPRESSION
+// and FSCTL_SET_COMPRESSION, e.g. issued by compact.exe or
+// the "compress" checkbox of Explorer, for the files
+// implementing FileCompression. Compressed files report
+// COMPRESSION_FORMAT_LZNT1, as NTFS does, regardless of
+// what the inner file system does with them.
+//
+// It marks the volume as processing control codes, which
+// are only served when WinFSP forwards them to the file
+// system. It is disabled by default.
+func WithCompression(v bool) NewOption {
+	return func(option *newOption) error {
+		option.compression = v
+		return nil
+	}
+}
+
+// compressedBitFromStat reports FILE_ATTRIBUTE_COMPRESSED
+// when it is set in the `os.FileInfo.Sys()` of type
+// `syscall.Win32FileAttributeData`.
+func compressedBitFromStat(selfStat os.FileInfo) uint32 {
+	if sys := selfStat.Sys(); sys != nil {
+		if v, ok := sys.(*syscall.Win32FileAttributeData); ok {
+			return v.FileAttributes & windows.FILE_ATTRIBUTE_COMPRESSED
+		}
+	}
+	return 0
+}
+
+// getCompression serves FSCTL_GET_COMPRESSION.
+func (fs *fileSystem) getCompression(file uintptr) ([]byte, error) {
+	handle, err := fs.load(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.lockChecked(); err != nil {
+		return nil, err
+	}
+	defer handle.unlockChecked()
+	fileInfo, err := fs.statFile(handle.file)
+	if err != nil {
+		return nil, err
+	}
+	format := uint16(compressionFormatNone)
+	if compressedBitFromStat(fileInfo) != 0 {
+		format = compressionFormatLZNT1
+	}
+	return binary.LittleEndian.AppendUint16(nil, format), nil
+}
+
+// setCompression serves FSCTL_SET_COMPRESSION.
+func (fs *fileSystem) setCompression(file uintptr, data []byte) error {
+	if len(data) < 2 {
+		return windows.STATUS_INVALID_PARAMETER
+	}
+	var compressed bool
+	switch binary.LittleEndian.Uint16(data) {
+	case compressionFormatNone:
+	case compressionFormatDefault, compressionFormatLZNT1:
+		compressed = true
+	default:
+		return windows.STATUS_INVALID_PARAMETER
+	}
+	handle, err := fs.load(file)
+	if err != nil {
+		return err
+	}
+	if err := handle.lockChecked(); err != nil {
+		return err
+	}
+	defer handle.unlockChecked()
+	if err := fs.checkWritablePath(handle.node.FilePath()); err != nil {
+		return err
+	}
+	compression, ok := handle.file.(FileCompression)
+	if !ok {
+		return windows.STATUS_INVALID_DEVICE_REQUEST
+	}
+	defer handle.resetFileInfo()
+	return compression.SetCompressed(compressed)
+}
@@ -0,0 +1,45 @@
+package gofs
+
+import (
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+// controlFileSystem is the fileSystem serving control
+// codes, i.e. IoctlCopyFileRange under WithCopyFileRange
+// when the inner file system implements
+// FileSystemCopyFileRange, the
+// compression codes under WithCompression,
+// FSCTL_QUERY_ALLOCATED_RANGES under WithAllocatedRanges,
+// and FSCTL_GET_REPARSE_POINT when the inner file system
+// implements FileSystemReadlink.
+//
+// It is a distinct type so that the volumes of the other
+// file systems are not marked as processing control codes.
+type controlFileSystem struct {
+	*fileSystem
+}
+
+func (fs controlFileSystem) DeviceIoControl(
+	ref *winfsp.FileSystemRef, file uintptr,
+	code uint32, data []byte,
+) ([]byte, error) {
+	switch {
+	case code == IoctlCopyFileRangeSource && fs.copyFileRange != nil:
+		return fs.ioctlCopyFileRangeSource(file)
+	case code == IoctlCopyFileRange && fs.copyFileRange != nil:
+		return fs.ioctlCopyFileRange(file, data)
+	case code == windows.FSCTL_GET_COMPRESSION && fs.compression:
+		return fs.getCompression(file)
+	case code == windows.FSCTL_SET_COMPRESSION && fs.compression:
+		return nil, fs.setCompression(file, data)
+	case code == windows.FSCTL_QUERY_ALLOCATED_RANGES && fs.allocatedRanges:
+		return fs.queryAllocatedRanges(file, data)
+	case code == windows.FSCTL_GET_REPARSE_POINT && fs.readlink != nil:
+		return fs.getReparsePoint(file)
+	}
+	return nil, windows.STATUS_INVALID_DEVICE_REQUEST
+}
+
+var _ winfsp.BehaviourDeviceIoControl = controlFileSystem{}
@@ -0,0 +1,220 @@
+package gofs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// FileSystemCopyFileRange allows the implementors of
+// FileSystem to copy the content between their own files
+// without transferring it through gofs, e.g. by issuing a
+// server-side copy on the cloud storage behind it.
+//
+// CopyFileRange copies length bytes of the source file
+// at sourceOffset into the target file at targetOffset,
+// extending the target file when necessary, and returns
+// the number of bytes copied.
+type FileSystemCopyFileRange interface {
+	FileSystem
+
+	CopyFileRange(
+		source string, sourceOffset int64,
+		target string, targetOffset int64, length int64,
+	) (int64, error)
+}
+
+// WithCopyFileRange makes gofs serve IoctlCopyFileRange and
+// IoctlCopyFileRangeSource when the inner file system
+// implements FileSystemCopyFileRange.
+//
+// It marks the volume as processing control codes, which
+// are only served when WinFSP forwards them to the file
+// system. It is disabled by default.
+func WithCopyFileRange(v bool) NewOption {
+	return func(option *newOption) error {
+		option.copyFileRange = v
+		return nil
+	}
+}
+
+// IoctlCopyFileRangeSource is the control code for naming
+// the file that the control code is issued on as the
+// source of IoctlCopyFileRange. The handle must have been
+// opened with FILE_READ_DATA.
+//
+// There is no input, and the output is the source token
+// as a little endian uint64, which remains valid until
+// the handle is closed.
+const IoctlCopyFileRangeSource = uint32(0x80476110)
+
+// IoctlCopyFileRange is the control code for copying the
+// content of a file on the volume into the file that the
+// control code is issued on, whose handle must have been
+// opened with FILE_WRITE_DATA.
+//
+// The input is built by CopyFileRangeInput, and the output
+// is the number of bytes copied as a little endian int64.
+//
+// The standard FSCTL_DUPLICATE_EXTENTS_TO_FILE identifies
+// the source by a handle of the calling process, which
+// cannot be resolved by the file system as WinFSP does not
+// report the calling process of control codes, so the
+// source is identified by the token that the caller gets
+// from IoctlCopyFileRangeSource instead. This way only
+// the files that the caller has opened for reading could
+// be copied from.
+const IoctlCopyFileRange = uint32(0x8047a10c)
+
+// copyFileRangeInputSize is the size of the source token,
+// offsets and length of the input.
+const copyFileRangeInputSize = 32
+
+// CopyFileRangeInput builds the input of IoctlCopyFileRange,
+// where the source is the token returned by
+// IoctlCopyFileRangeSource.
+func CopyFileRangeInput(
+	sourceToken uint64, sourceOffset, targetOffset, length int64,
+) []byte {
+	result := make([]byte, copyFileRangeInputSize)
+	binary.LittleEndian.PutUint64(result[0:], sourceToken)
+	binary.LittleEndian.PutUint64(result[8:], uint64(sourceOffset))
+	binary.LittleEndian.PutUint64(result[16:], uint64(targetOffset))
+	binary.LittleEndian.PutUint64(result[24:], uint64(length))
+	return result
+}
+
+// parseCopyFileRangeInput reverses CopyFileRangeInput.
+func parseCopyFileRangeInput(
+	data []byte,
+) (sourceToken uint64, sourceOffset, targetOffset, length int64, err error) {
+	if len(data) != copyFileRangeInputSize {
+		return 0, 0, 0, 0, windows.STATUS_INVALID_PARAMETER
+	}
+	sourceToken = binary.LittleEndian.Uint64(data[0:])
+	sourceOffset = int64(binary.LittleEndian.Uint64(data[8:]))
+	targetOffset = int64(binary.LittleEndian.Uint64(data[16:]))
+	length = int64(binary.LittleEndian.Uint64(data[24:]))
+	if sourceOffset < 0 || targetOffset < 0 || length < 0 {
+		return 0, 0, 0, 0, windows.STATUS_INVALID_PARAMETER
+	}
+	return sourceToken, sourceOffset, targetOffset, length, nil
+}
+
+// ioctlCopyFileRangeSource serves IoctlCopyFileRangeSource.
+//
+// The token is drawn randomly rather than derived from the
+// handle, so that it could not be guessed by the callers
+// which have not opened the file themselves.
+func (fs *fileSystem) ioctlCopyFileRangeSource(file uintptr) ([]byte, error) {
+	handle, err := fs.load(file)
+	if err != nil {
+		return nil, err
+	}
+	if !handle.readData {
+		return nil, windows.STATUS_ACCESS_DENIED
+	}
+	handle.mtx.Lock()
+	defer handle.mtx.Unlock()
+	if _, ok := fs.handles.Load(file); !ok {
+		// The handle is being closed.
+		return nil, windows.STATUS_INVALID_HANDLE
+	}
+	for handle.copyToken == 0 {
+		var token [8]byte
+		if _, err := rand.Read(token[:]); err != nil {
+			return nil, err
+		}
+		value := binary.LittleEndian.Uint64(token[:])
+		if value == 0 {
+			continue
+		}
+		if _, loaded := fs.copySources.LoadOrStore(value, handle); !loaded {
+			handle.copyToken = value
+		}
+	}
+	return binary.LittleEndian.AppendUint64(nil, handle.copyToken), nil
+}
+
+// lockHandlesChecked locks both handles for read in the
+// order of their addresses, so that the copies between
+// the same pair of files in the opposite directions do
+// not deadlock.
+func lockHandlesChecked(a, b *fileHandle) (unlock func(), err error) {
+	if a == b {
+		if err := a.lockChecked(); err != nil {
+			return nil, err
+		}
+		return a.unlockChecked, nil
+	}
+	if uintptr(unsafe.Pointer(a)) > uintptr(unsafe.Pointer(b)) {
+		a, b = b, a
+	}
+	if err := a.lockChecked(); err != nil {
+		return nil, err
+	}
+	if err := b.lockChecked(); err != nil {
+		a.unlockChecked()
+		return nil, err
+	}
+	return func() {
+		b.unlockChecked()
+		a.unlockChecked()
+	}, nil
+}
+
+// ioctlCopyFileRange serves the IoctlCopyFileRange.
+func (fs *fileSystem) ioctlCopyFileRange(
+	file uintptr, data []byte,
+) ([]byte, error) {
+	sourceToken, sourceOffset, targetOffset, length, err :=
+		parseCopyFileRangeInput(data)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := fs.load(file)
+	if err != nil {
+		return nil, err
+	}
+	if handle.flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return nil, windows.STATUS_ACCESS_DENIED
+	}
+	value, ok := fs.copySources.Load(sourceToken)
+	if !ok {
+		return nil, windows.STATUS_INVALID_HANDLE
+	}
+	source := value.(*fileHandle)
+	unlock, err := lockHandlesChecked(handle, source)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if source.copyToken != sourceToken {
+		// The source handle is being closed.
+		return nil, windows.STATUS_INVALID_HANDLE
+	}
+	targetLock := handle.node.RLockPath()
+	defer targetLock.Unlock()
+	if targetLock.IsExile() {
+		return nil, os.ErrNotExist
+	}
+	if err := fs.checkWritablePath(targetLock.FilePath()); err != nil {
+		return nil, err
+	}
+	sourceLock := source.node.RLockPath()
+	defer sourceLock.Unlock()
+	if sourceLock.IsExile() {
+		return nil, os.ErrNotExist
+	}
+	n, err := fs.copyFileRange(
+		sourceLock.FilePath(), sourceOffset,
+		targetLock.FilePath(), targetOffset, length)
+	handle.resetFileInfo()
+	if err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.AppendUint64(nil, uint64(n)), nil
+}
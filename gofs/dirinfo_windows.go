@@ -0,0 +1,94 @@
+package gofs
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+// dirInfoEntry is the entry filled by the enumeration,
+// see WithReaddirPlus.
+type dirInfoEntry struct {
+	name string
+	info winfsp.FSP_FSCTL_FILE_INFO
+}
+
+// dirInfoKey is the key of the entry name in the
+// directory opened by the handle.
+func (fs *fileSystem) dirInfoKey(name string, handle *fileHandle) string {
+	return fs.filterNameForLock(name, handle.caseSensitive)
+}
+
+// storeDirInfos replaces the entries of the directory
+// filled by the last enumeration.
+func (handle *fileHandle) storeDirInfos(
+	dirInfos map[string]dirInfoEntry, now time.Time,
+) {
+	handle.dirInfoMtx.Lock()
+	defer handle.dirInfoMtx.Unlock()
+	handle.dirInfos = dirInfos
+	handle.dirInfoTime = now
+}
+
+// loadDirInfo returns the entry filled by the last
+// enumeration if it is fresh enough.
+func (handle *fileHandle) loadDirInfo(
+	key string, ttl time.Duration, now time.Time,
+) (dirInfoEntry, bool) {
+	handle.dirInfoMtx.Lock()
+	defer handle.dirInfoMtx.Unlock()
+	if now.Sub(handle.dirInfoTime) >= ttl {
+		handle.dirInfos = nil
+		return dirInfoEntry{}, false
+	}
+	entry, ok := handle.dirInfos[key]
+	return entry, ok
+}
+
+func (fs *fileSystem) GetDirInfoByName(
+	ref *winfsp.FileSystemRef, parentDirFile uintptr,
+	name string, dirInfo *winfsp.FSP_FSCTL_DIR_INFO,
+) error {
+	handle, err := fs.load(parentDirFile)
+	if err != nil {
+		return err
+	}
+	if fs.readdirPlusTTL > 0 {
+		entry, ok := handle.loadDirInfo(
+			fs.dirInfoKey(name, handle), fs.readdirPlusTTL, fs.clock())
+		if ok {
+			return winfsp.FillDirInfoByName(dirInfo, entry.name, &entry.info)
+		}
+	}
+	if err := handle.lockChecked(); err != nil {
+		return err
+	}
+	defer handle.unlockChecked()
+	plock := handle.node.RLockPath()
+	defer plock.Unlock()
+	if plock.IsExile() {
+		return os.ErrNotExist
+	}
+	path := filepath.Join(plock.FilePath(), name)
+	fileInfo, err := fs.inner.Stat(path)
+	if err != nil {
+		return err
+	}
+	var fileID uint64
+	if fs.providesFileID {
+		if v, ok := fileInfo.(FileInfoFileID); ok {
+			fileID = v.FileID()
+		}
+	}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	if err := fs.fillInfoFromPathLocked(
+		ref, &info, path, fileInfo, nil, fileID); err != nil {
+		return err
+	}
+	return winfsp.FillDirInfoByName(
+		dirInfo, fs.encodeName(fileInfo.Name()), &info)
+}
+
+var _ winfsp.BehaviourGetDirInfoByName = (*fileSystem)(nil)
@@ -0,0 +1,128 @@
+package gofs
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+// FileSystemEa means the file system is able to keep the
+// extended attributes of its files, e.g. the ones set by
+// WSL for the owner and mode of the files it creates.
+//
+// GetEa returns the extended attributes of the file. SetEa
+// replaces the attributes of the same names, compared case
+// insensitively, and removes those with an empty value. It
+// is also called with the attributes supplied by creating
+// the file, right after the file is created and before it
+// is seen by the other handles. The values passed to SetEa
+// must be copied if they need to outlive the call.
+type FileSystemEa interface {
+	FileSystem
+
+	GetEa(name string) ([]winfsp.EaEntry, error)
+	SetEa(name string, ea []winfsp.EaEntry) error
+}
+
+// eaBehaviours are the behaviours of the fileSystem whose
+// inner file system implements FileSystemEa.
+//
+// They are embedded into distinct types, so that the
+// volumes of the other file systems are not marked as
+// supporting extended attributes.
+type eaBehaviours struct {
+	fs *fileSystem
+}
+
+type eaFileSystem struct {
+	*fileSystem
+	eaBehaviours
+}
+
+type controlEaFileSystem struct {
+	controlFileSystem
+	eaBehaviours
+}
+
+func (b eaBehaviours) CreateExWithExtendedAttribute(
+	ref *winfsp.FileSystemRef, name string,
+	createOptions, grantedAccess, fileAttributes uint32,
+	securityDescriptor *windows.SECURITY_DESCRIPTOR,
+	extendedAttribute *winfsp.FILE_FULL_EA_INFORMATION,
+	allocationSize uint64, info *winfsp.FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	ea, err := winfsp.EaEntries(extendedAttribute)
+	if err != nil {
+		return 0, windows.STATUS_EA_LIST_INCONSISTENT
+	}
+	return b.fs.create(
+		ref, name, createOptions, grantedAccess,
+		fileAttributes, ea, info,
+	)
+}
+
+// CreateExWithReparsePointData is not supported, as gofs
+// cannot create reparse points in the inner file system.
+func (b eaBehaviours) CreateExWithReparsePointData(
+	ref *winfsp.FileSystemRef, name string,
+	createOptions, grantedAccess, fileAttributes uint32,
+	securityDescriptor *windows.SECURITY_DESCRIPTOR,
+	extendedAttribute *winfsp.REPARSE_DATA_BUFFER_GENERIC,
+	allocationSize uint64, info *winfsp.FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	return 0, windows.STATUS_INVALID_DEVICE_REQUEST
+}
+
+var _ winfsp.BehaviourCreateEx = eaBehaviours{}
+
+func (b eaBehaviours) GetEa(
+	ref *winfsp.FileSystemRef, file uintptr,
+) ([]winfsp.EaEntry, error) {
+	handle, err := b.fs.load(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.lockChecked(); err != nil {
+		return nil, err
+	}
+	defer handle.unlockChecked()
+	plock := handle.node.RLockPath()
+	defer plock.Unlock()
+	if plock.IsExile() {
+		return nil, os.ErrNotExist
+	}
+	return b.fs.getEa(plock.FilePath())
+}
+
+var _ winfsp.BehaviourGetEa = eaBehaviours{}
+
+func (b eaBehaviours) SetEa(
+	ref *winfsp.FileSystemRef, file uintptr,
+	ea []winfsp.EaEntry, info *winfsp.FSP_FSCTL_FILE_INFO,
+) error {
+	handle, err := b.fs.load(file)
+	if err != nil {
+		return err
+	}
+	if err := handle.lockChecked(); err != nil {
+		return err
+	}
+	defer handle.unlockChecked()
+	defer handle.resetFileInfo()
+	plock := handle.node.RLockPath()
+	defer plock.Unlock()
+	if plock.IsExile() {
+		return os.ErrNotExist
+	}
+	if err := b.fs.checkWritablePath(plock.FilePath()); err != nil {
+		return err
+	}
+	if err := b.fs.setEa(plock.FilePath(), ea); err != nil {
+		return err
+	}
+	return b.fs.fillInfoFromHandle(ref, info, handle, nil, nil)
+}
+
+var _ winfsp.BehaviourSetEa = eaBehaviours{}
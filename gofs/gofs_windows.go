@@ -13,6 +13,7 @@ import (
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/windows"
+	"golang.org/x/time/rate"
 
 	"github.com/winfsp/go-winfsp"
 	"github.com/winfsp/go-winfsp/filetime"
@@ -42,6 +43,85 @@ type FileSystem interface {
 	Remove(name string) error
 }
 
+// FileSystemOpenBackup means the file system is able
+// to open files for backup, bypassing its own permission
+// checks. It is only called for the opens requested with
+// FILE_OPEN_FOR_BACKUP_INTENT and allowed by the hook
+// specified by `gofs.WithBackupIntent`, after OpenFile
+// fails with a permission error.
+//
+// The file opened for backup is only granted reading,
+// regardless of the flag.
+type FileSystemOpenBackup interface {
+	FileSystem
+
+	OpenFileBackup(name string, flag int) (File, error)
+}
+
+// FileSystemSyncVolume means the file system is able to
+// flush the data buffered across files, which is called
+// when the whole volume is flushed, e.g. by calling
+// FlushFileBuffers on the volume handle. Without this
+// interface, flushing the volume does nothing.
+type FileSystemSyncVolume interface {
+	FileSystem
+
+	SyncVolume() error
+}
+
+// FileSystemOpenRename means the file system is able to
+// rename the files which are open, e.g. the one keeping
+// the files in memory. When SupportsOpenRename reports
+// true, the file being renamed is kept open instead of
+// being closed and reopened around the rename, so that
+// its offset is preserved and the rename never leaves
+// the handle without an open file.
+type FileSystemOpenRename interface {
+	FileSystem
+
+	SupportsOpenRename() bool
+}
+
+// FileSystemHandleHooks means the file system tracks the
+// handles opened through gofs, e.g. to keep a state of its
+// own for each of them, such as a cached connection.
+//
+// OnOpen is called once a file has been opened or created,
+// with its name in the file system and the handle passed
+// to the behaviours, which stays unique until OnClose is
+// called with it after the file has been closed. The hooks
+// are called while handling the operations, so they must
+// not block.
+type FileSystemHandleHooks interface {
+	FileSystem
+
+	OnOpen(name string, handle uint64)
+	OnClose(handle uint64)
+}
+
+// FileSystemReadlink means the file system is able to
+// resolve its symbolic links, even though the os.FileInfo
+// it returns, e.g. from Readdir, does not tell them apart
+// from the other files.
+//
+// Readlink returns the target of the symbolic link, or an
+// error if the file is not a symbolic link. The files not
+// reported as reparse points by their os.FileInfo, see
+// FileInfoReparseTag, are reported as symbolic links when
+// Readlink succeeds on them, at the cost of calling it on
+// each such file whose information is queried, including
+// the entries of the listed directories.
+//
+// FSCTL_GET_REPARSE_POINT is served on them with the
+// target returned by Readlink, whose components are
+// encoded by WithNameEncoder. The target is stored as a
+// relative one unless it has a volume name, e.g. "C:".
+type FileSystemReadlink interface {
+	FileSystem
+
+	Readlink(name string) (string, error)
+}
+
 // FileInfoFileID means the provided os.FileInfo
 // is able to provide File ID. Will be ignored
 // unless the option
@@ -63,6 +143,39 @@ type FileInfoFileID interface {
 	FileID() uint64
 }
 
+// FileInfoReparseTag means the provided os.FileInfo
+// is a reparse point and is able to report its
+// reparse tag.
+//
+// If the provided os.FileInfo does not implement
+// FileInfoReparseTag, the reparse tag is guessed
+// from `os.FileInfo.Mode()` and `os.FileInfo.Sys()`
+// instead: a symbolic link is reported with
+// `IO_REPARSE_TAG_SYMLINK`, a named pipe, socket or
+// device is reported with the tag WSL uses for it, e.g.
+// `IO_REPARSE_TAG_LX_FIFO`, while a directory whose
+// `syscall.Win32FileAttributeData` carries the
+// `FILE_ATTRIBUTE_REPARSE_POINT` flag is reported
+// with `IO_REPARSE_TAG_MOUNT_POINT`.
+type FileInfoReparseTag interface {
+	os.FileInfo
+
+	ReparseTag() uint32
+}
+
+// FileInfoChangeTime means the provided os.FileInfo
+// is able to report the time its metadata was last
+// changed, which is distinct from the modify time.
+//
+// If the provided os.FileInfo does not implement
+// FileInfoChangeTime, the change time mirrors the
+// last write time.
+type FileInfoChangeTime interface {
+	os.FileInfo
+
+	ChangeTime() time.Time
+}
+
 type fileHandle struct {
 	node  *treelock.Node
 	dir   winfsp.DirBuffer
@@ -70,7 +183,181 @@ type fileHandle struct {
 	flags int
 	mtx   sync.RWMutex
 
+	// caseSensitive is set when the handle is opened with
+	// POSIX semantics, see WithPosixSemantics.
+	caseSensitive bool
+
+	// backup is set when the handle is opened for backup,
+	// see WithBackupIntent.
+	backup bool
+
+	// noBuffering is set when the handle is opened with
+	// FILE_NO_INTERMEDIATE_BUFFERING, see checkAlignment.
+	noBuffering bool
+
+	// readData is set when the handle is opened with
+	// FILE_READ_DATA, which is not told by the flags when
+	// the handle is opened without data access at all.
+	readData bool
+
+	// copyToken names the handle as the source of
+	// IoctlCopyFileRange once it is requested, see
+	// IoctlCopyFileRangeSource.
+	copyToken uint64
+
 	evaluatedIndex uint64
+
+	// reopen is set while the file is closed by Rename or
+	// Cleanup, and remains set if reopening it afterwards
+	// has failed, so that it is retried by the following
+	// operations on the handle, see ensureFileLocked.
+	reopen func() (File, error)
+
+	// watchKey is the key of the watch acquired for the
+	// directory, see FileSystemWatch.
+	watchKey watchKey
+	watching bool
+
+	// parentMtx guards the parent stat cache, which is
+	// accessed by fills holding handle.mtx for read.
+	parentMtx  sync.Mutex
+	parentPath string
+	parentStat os.FileInfo
+	parentTime time.Time
+
+	// infoMtx guards the file info cache, which is
+	// accessed by GetFileInfo holding handle.mtx for read.
+	// The generation is bumped upon every invalidation, so
+	// that a stale stat racing with it is not cached.
+	infoMtx        sync.Mutex
+	infoCache      winfsp.FSP_FSCTL_FILE_INFO
+	infoTime       time.Time
+	infoValid      bool
+	infoGeneration uint64
+
+	// dirInfoMtx guards the infos of the entries filled by
+	// the last enumeration of the directory, which are keyed
+	// by their names for lock, see WithReaddirPlus.
+	dirInfoMtx  sync.Mutex
+	dirInfos    map[string]dirInfoEntry
+	dirInfoTime time.Time
+}
+
+// parentStatCacheTTL is how long the cached stat of
+// the parent directory remains valid for a handle.
+//
+// The parent stat is only consulted to evaluate the
+// FILE_ATTRIBUTE_READONLY flag under AttribReadOnlyPOSIX,
+// so a change to the write
+// permission of the parent directory made outside of
+// this handle may take up to parentStatCacheTTL before
+// being reflected. Renaming the file (or any ancestor)
+// changes the parent path and invalidates the cache
+// immediately.
+const parentStatCacheTTL = time.Second
+
+// loadParentStat returns the cached parent stat if
+// it is for the specified path and is fresh enough.
+func (handle *fileHandle) loadParentStat(
+	path string, now time.Time,
+) os.FileInfo {
+	handle.parentMtx.Lock()
+	defer handle.parentMtx.Unlock()
+	if handle.parentStat == nil || handle.parentPath != path {
+		return nil
+	}
+	if now.Sub(handle.parentTime) >= parentStatCacheTTL {
+		return nil
+	}
+	return handle.parentStat
+}
+
+// storeParentStat updates the parent stat cache.
+func (handle *fileHandle) storeParentStat(
+	path string, stat os.FileInfo, now time.Time,
+) {
+	handle.parentMtx.Lock()
+	defer handle.parentMtx.Unlock()
+	handle.parentPath = path
+	handle.parentStat = stat
+	handle.parentTime = now
+}
+
+// resetParentStat invalidates the parent stat cache.
+func (handle *fileHandle) resetParentStat() {
+	handle.parentMtx.Lock()
+	defer handle.parentMtx.Unlock()
+	handle.parentPath = ""
+	handle.parentStat = nil
+}
+
+// loadFileInfo copies the cached file info into target
+// if it is fresh enough, otherwise it returns the current
+// generation to be passed to storeFileInfo.
+func (handle *fileHandle) loadFileInfo(
+	ttl time.Duration, now time.Time, target *winfsp.FSP_FSCTL_FILE_INFO,
+) (uint64, bool) {
+	handle.infoMtx.Lock()
+	defer handle.infoMtx.Unlock()
+	if handle.infoValid && now.Sub(handle.infoTime) < ttl {
+		*target = handle.infoCache
+		return handle.infoGeneration, true
+	}
+	return handle.infoGeneration, false
+}
+
+// storeFileInfo updates the file info cache, unless it
+// has been invalidated since the generation was loaded.
+func (handle *fileHandle) storeFileInfo(
+	generation uint64, now time.Time, info *winfsp.FSP_FSCTL_FILE_INFO,
+) {
+	handle.infoMtx.Lock()
+	defer handle.infoMtx.Unlock()
+	if handle.infoGeneration != generation {
+		return
+	}
+	handle.infoCache = *info
+	handle.infoTime = now
+	handle.infoValid = true
+}
+
+// resetFileInfo invalidates the file info cache, and
+// returns the new generation to be passed to storeFileInfo.
+func (handle *fileHandle) resetFileInfo() uint64 {
+	handle.infoMtx.Lock()
+	defer handle.infoMtx.Unlock()
+	handle.infoValid = false
+	handle.infoGeneration++
+	return handle.infoGeneration
+}
+
+// updateFileInfoAfterWrite updates the size and times of
+// the cached file info after writing, and copies it into
+// target. It returns false if nothing has been cached.
+func (handle *fileHandle) updateFileInfoAfterWrite(
+	ref *winfsp.FileSystemRef, size int64, now time.Time,
+	target *winfsp.FSP_FSCTL_FILE_INFO,
+) bool {
+	handle.infoMtx.Lock()
+	defer handle.infoMtx.Unlock()
+	handle.infoGeneration++
+	if !handle.infoValid {
+		return false
+	}
+	info := &handle.infoCache
+	info.FileSize = uint64(size)
+	info.AllocationSize = allocationSize(ref, info.FileSize)
+	mirrored := info.ChangeTime == info.LastWriteTime
+	info.LastWriteTime = filetime.Timestamp(now)
+	if mirrored {
+		// XXX: A distinct change time reported through
+		// FileInfoChangeTime is kept, since writing the
+		// data does not change the metadata.
+		info.ChangeTime = info.LastWriteTime
+	}
+	handle.infoTime = now
+	*target = *info
+	return true
 }
 
 // AttribReadOnlyTransMode controls how gofs
@@ -147,10 +434,12 @@ const (
 		AttribReadOnlyHonorSys
 )
 
-type exiledParentStat struct{}
+type exiledParentStat struct {
+	modTime time.Time
+}
 
 func (e *exiledParentStat) IsDir() bool        { return true }
-func (e *exiledParentStat) ModTime() time.Time { return time.Now() }
+func (e *exiledParentStat) ModTime() time.Time { return e.modTime }
 func (e *exiledParentStat) Name() string       { return "" }
 func (e *exiledParentStat) Size() int64        { return 0 }
 func (e *exiledParentStat) Sys() any           { return nil }
@@ -167,26 +456,84 @@ var _ os.FileInfo = &exiledParentStat{}
 
 type fileSystem struct {
 	inner   FileSystem
-	handles sync.Map
+	handles handleMap[*fileHandle]
 	locker  *treelock.TreeLocker
+	watcher *dirWatcher
 
 	labelLen int
 	label    [32]uint16
 
 	readOnlyTransMode    AttribReadOnlyTransMode
 	caseInsensitive      bool
+	posixSemantics       bool
 	providesFileID       bool
+	backupIntent         func(*winfsp.FileSystemRef) bool
+	fileInfoCacheTTL     time.Duration
+	readdirPlusTTL       time.Duration
+	securityDescriptor   *windows.SECURITY_DESCRIPTOR
+	clock                func() time.Time
+	shortNames           bool
+	readOnlyPaths        []string
+	compression          bool
+	allocatedRanges      bool
+	execAttribute        bool
+	umask                os.FileMode
+	limiter              *rate.Limiter
+	retry                RetryPolicy
+	nameEncode           func(string) string
+	syncVolume           func() error
+	openRename           bool
+	onOpen               func(name string, handle uint64)
+	onClose              func(handle uint64)
+	readlink             func(name string) (string, error)
+	getEa                func(name string) ([]winfsp.EaEntry, error)
+	setEa                func(name string, ea []winfsp.EaEntry) error
+	copyFileRange        func(string, int64, string, int64, int64) (int64, error)
 	defaultWinfspOptions []winfsp.Option
+
+	// copySources maps the tokens of IoctlCopyFileRangeSource
+	// to the handles they name.
+	copySources sync.Map
+}
+
+// openBackup attempts to open the file for backup
+// after OpenFile has failed with err.
+func (fs *fileSystem) openBackup(
+	name string, flag int, err error,
+) (File, error) {
+	if !errors.Is(err, os.ErrPermission) &&
+		!errors.Is(err, windows.STATUS_ACCESS_DENIED) {
+		return nil, err
+	}
+	inner, ok := fs.inner.(FileSystemOpenBackup)
+	if !ok {
+		return nil, err
+	}
+	return inner.OpenFileBackup(name, flag)
 }
 
-func (fs *fileSystem) filterNameForLock(name string) string {
+func (fs *fileSystem) filterNameForLock(
+	name string, caseSensitive bool,
+) string {
 	name = treelock.UnifyFilePath(name)
-	if fs.caseInsensitive {
+	if fs.caseInsensitive && !caseSensitive {
 		name = strings.ToUpper(name)
 	}
 	return name
 }
 
+// openedCaseSensitive tells whether the file being opened
+// has requested case sensitive name comparison, which is
+// the case of FILE_FLAG_POSIX_SEMANTICS.
+func (fs *fileSystem) openedCaseSensitive() bool {
+	if !fs.posixSemantics || !fs.caseInsensitive {
+		return false
+	}
+	request := winfsp.FileSystemOperationCreateRequest()
+	return request != nil &&
+		request.Flags&winfsp.FspFsctlCreateCaseSensitive != 0
+}
+
 func (fs *fileSystem) readOnlyBitFromSelfParentStats(
 	selfStat, parentStat os.FileInfo,
 ) uint32 {
@@ -228,6 +575,121 @@ func (fs *fileSystem) readOnlyBitFromSelfParentStats(
 	}
 }
 
+// The reparse tags with which WSL presents the special
+// files, which are not defined by x/sys/windows.
+const (
+	ioReparseTagAFUnix = 0x80000023
+	ioReparseTagLxFifo = 0x80000024
+	ioReparseTagLxChr  = 0x80000025
+	ioReparseTagLxBlk  = 0x80000026
+)
+
+// reparseTagFromStat returns the reparse tag of the
+// file, or 0 if the file is not a reparse point.
+func reparseTagFromStat(selfStat os.FileInfo) uint32 {
+	if v, ok := selfStat.(FileInfoReparseTag); ok {
+		return v.ReparseTag()
+	}
+	mode := selfStat.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return windows.IO_REPARSE_TAG_SYMLINK
+	case mode&os.ModeNamedPipe != 0:
+		return ioReparseTagLxFifo
+	case mode&os.ModeSocket != 0:
+		return ioReparseTagAFUnix
+	case mode&os.ModeCharDevice != 0:
+		return ioReparseTagLxChr
+	case mode&os.ModeDevice != 0:
+		return ioReparseTagLxBlk
+	}
+	if !mode.IsDir() {
+		return 0
+	}
+	if sys := selfStat.Sys(); sys != nil {
+		v, ok := sys.(*syscall.Win32FileAttributeData)
+		if ok && v.FileAttributes&windows.FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+			return windows.IO_REPARSE_TAG_MOUNT_POINT
+		}
+	}
+	return 0
+}
+
+// markSymlinkByReadlink reports the file as a symbolic
+// link when its os.FileInfo carries no reparse tag but
+// the inner file system resolves it as a symbolic link,
+// see FileSystemReadlink.
+func (fs *fileSystem) markSymlinkByReadlink(
+	path string, info *winfsp.FSP_FSCTL_FILE_INFO,
+) {
+	if fs.readlink == nil || info.ReparseTag != 0 {
+		return
+	}
+	if _, err := fs.readlink(path); err != nil {
+		return
+	}
+	info.FileAttributes &^= windows.FILE_ATTRIBUTE_NORMAL
+	info.FileAttributes |= windows.FILE_ATTRIBUTE_REPARSE_POINT
+	info.ReparseTag = windows.IO_REPARSE_TAG_SYMLINK
+}
+
+// temporaryBitFromStat reports FILE_ATTRIBUTE_TEMPORARY
+// when it is set in the `os.FileInfo.Sys()` of type
+// `syscall.Win32FileAttributeData`.
+func temporaryBitFromStat(selfStat os.FileInfo) uint32 {
+	if sys := selfStat.Sys(); sys != nil {
+		if v, ok := sys.(*syscall.Win32FileAttributeData); ok {
+			return v.FileAttributes & windows.FILE_ATTRIBUTE_TEMPORARY
+		}
+	}
+	return 0
+}
+
+// offlineBits are the attributes marking the files whose
+// content is kept remotely by the cloud and HSM backends,
+// which are passed through from the inner file system.
+const offlineBits = windows.FILE_ATTRIBUTE_OFFLINE |
+	windows.FILE_ATTRIBUTE_RECALL_ON_OPEN |
+	windows.FILE_ATTRIBUTE_RECALL_ON_DATA_ACCESS
+
+// offlineBitsFromStat reports the offlineBits set in the
+// `os.FileInfo.Sys()` of type `syscall.Win32FileAttributeData`,
+// so that Explorer shows such files as available online
+// only, and the applications aware of them could avoid
+// triggering the recall unnecessarily.
+func offlineBitsFromStat(selfStat os.FileInfo) uint32 {
+	if sys := selfStat.Sys(); sys != nil {
+		if v, ok := sys.(*syscall.Win32FileAttributeData); ok {
+			return v.FileAttributes & offlineBits
+		}
+	}
+	return 0
+}
+
+// creationTimeFromStat reports the creation time in the
+// `os.FileInfo.Sys()` of type `syscall.Win32FileAttributeData`,
+// which is the zero time if it is not available.
+func creationTimeFromStat(selfStat os.FileInfo) time.Time {
+	if sys := selfStat.Sys(); sys != nil {
+		if v, ok := sys.(*syscall.Win32FileAttributeData); ok && v != nil {
+			return time.Unix(0, v.CreationTime.Nanoseconds())
+		}
+	}
+	return time.Time{}
+}
+
+// archiveBitFromStat reports FILE_ATTRIBUTE_ARCHIVE
+// when it is set in the `os.FileInfo.Sys()` of type
+// `syscall.Win32FileAttributeData`.
+func archiveBitFromStat(selfStat os.FileInfo) uint32 {
+	if sys := selfStat.Sys(); sys != nil {
+		if v, ok := sys.(*syscall.Win32FileAttributeData); ok {
+			return v.FileAttributes & windows.FILE_ATTRIBUTE_ARCHIVE
+		}
+	}
+	return 0
+}
+
 func (fs *fileSystem) attributesFromSelfParentStats(
 	selfStat, parentStat os.FileInfo,
 ) uint32 {
@@ -235,24 +697,55 @@ func (fs *fileSystem) attributesFromSelfParentStats(
 	var attributes uint32
 	if mode.IsDir() {
 		attributes |= windows.FILE_ATTRIBUTE_DIRECTORY
+		attributes |= compressedBitFromStat(selfStat)
+		attributes |= offlineBitsFromStat(selfStat)
 	} else if mode.IsRegular() {
 		attributes |= fs.readOnlyBitFromSelfParentStats(selfStat, parentStat)
-	}
+		attributes |= temporaryBitFromStat(selfStat)
+		attributes |= archiveBitFromStat(selfStat)
+		attributes |= compressedBitFromStat(selfStat)
+		attributes |= offlineBitsFromStat(selfStat)
+		if fs.execAttribute && mode&0o111 != 0 {
+			attributes |= windows.FILE_ATTRIBUTE_NOT_CONTENT_INDEXED
+		}
+	} else if mode&os.ModeIrregular != 0 {
+		// The file of unknown type is neither a reparse
+		// point nor a normal file, and is marked as a
+		// system file so that it is skipped by most tools.
+		attributes |= windows.FILE_ATTRIBUTE_SYSTEM
+	}
+	if reparseTagFromStat(selfStat) != 0 {
+		attributes |= windows.FILE_ATTRIBUTE_REPARSE_POINT
+	}
+	// FILE_ATTRIBUTE_NORMAL is only valid alone, so it is
+	// never reported for directories, nor for the read only
+	// ones, which carry FILE_ATTRIBUTE_DIRECTORY anyway.
 	if attributes == 0 {
 		attributes = windows.FILE_ATTRIBUTE_NORMAL
 	}
 	return attributes
 }
 
+// allocationSize rounds the file size up to the
+// allocation unit of the file system.
+func allocationSize(ref *winfsp.FileSystemRef, fileSize uint64) uint64 {
+	allocationUnit := uint64(ref.AllocationUnit())
+	if allocationUnit == 0 {
+		allocationUnit = 4096
+	}
+	return (fileSize + allocationUnit - 1) /
+		allocationUnit * allocationUnit
+}
+
 func (fs *fileSystem) fillInfoFromSelfParentStats(
-	target *winfsp.FSP_FSCTL_FILE_INFO,
+	ref *winfsp.FileSystemRef, target *winfsp.FSP_FSCTL_FILE_INFO,
 	selfStat, parentStat os.FileInfo,
 	evaluatedIndexNumber uint64,
 ) {
 	target.FileAttributes = fs.attributesFromSelfParentStats(selfStat, parentStat)
-	target.ReparseTag = 0
+	target.ReparseTag = reparseTagFromStat(selfStat)
 	target.FileSize = uint64(selfStat.Size())
-	target.AllocationSize = ((target.FileSize + 4095) / 4096) * 4096
+	target.AllocationSize = allocationSize(ref, target.FileSize)
 	target.CreationTime = filetime.Timestamp(selfStat.ModTime())
 	target.LastAccessTime = target.CreationTime
 	target.LastWriteTime = target.CreationTime
@@ -263,18 +756,16 @@ func (fs *fileSystem) fillInfoFromSelfParentStats(
 
 	// We can extract more data from it if it is find data from
 	// windows, which is the one from golang's standard library.
-	sys := selfStat.Sys()
-	if sys == nil {
-		return
+	findData, ok := selfStat.Sys().(*syscall.Win32FileAttributeData)
+	if ok && findData != nil {
+		target.CreationTime = filetime.Filetime(findData.CreationTime)
+		target.LastAccessTime = filetime.Filetime(findData.LastAccessTime)
+		target.LastWriteTime = filetime.Filetime(findData.LastWriteTime)
+		target.ChangeTime = target.LastWriteTime
 	}
-	findData, ok := sys.(*syscall.Win32FileAttributeData)
-	if !ok {
-		return
+	if v, ok := selfStat.(FileInfoChangeTime); ok {
+		target.ChangeTime = filetime.Timestamp(v.ChangeTime())
 	}
-	target.CreationTime = filetime.Filetime(findData.CreationTime)
-	target.LastAccessTime = filetime.Filetime(findData.LastAccessTime)
-	target.LastWriteTime = filetime.Filetime(findData.LastWriteTime)
-	target.ChangeTime = target.LastWriteTime
 }
 
 func (fs *fileSystem) needParentStat() bool {
@@ -286,7 +777,7 @@ func (fs *fileSystem) needParentStat() bool {
 }
 
 func (fs *fileSystem) fillInfoFromPathLocked(
-	target *winfsp.FSP_FSCTL_FILE_INFO,
+	ref *winfsp.FileSystemRef, target *winfsp.FSP_FSCTL_FILE_INFO,
 	path string,
 	selfStat, parentStat os.FileInfo,
 	evaluatedIndexNumber uint64,
@@ -305,46 +796,54 @@ func (fs *fileSystem) fillInfoFromPathLocked(
 		}
 	}
 	fs.fillInfoFromSelfParentStats(
-		target, selfStat, parentStat, evaluatedIndexNumber,
+		ref, target, selfStat, parentStat, evaluatedIndexNumber,
 	)
+	fs.markSymlinkByReadlink(path, target)
 	return nil
 }
 
 // fillInfoFromHandleLocked fills the information
 // with a fileHandle. Must acquire the lock.
 func (fs *fileSystem) fillInfoFromHandleLocked(
-	target *winfsp.FSP_FSCTL_FILE_INFO,
+	ref *winfsp.FileSystemRef, target *winfsp.FSP_FSCTL_FILE_INFO,
 	handle *fileHandle,
 	selfStat, parentStat os.FileInfo,
 ) error {
 	var err error
 	if selfStat == nil && handle.file != nil {
-		selfStat, err = handle.file.Stat()
+		selfStat, err = fs.statFile(handle.file)
 		if err != nil {
 			return err
 		}
 	}
 	if parentStat == nil && fs.needParentStat() {
 		if handle.node.IsExile() {
-			parentStat = &exiledParentStat{}
+			parentStat = &exiledParentStat{modTime: fs.clock()}
 		} else {
 			parent := filepath.Dir(handle.node.FilePath())
 			parent = treelock.UnifyFilePath(parent)
-			if parentStat, err = fs.inner.Stat(parent); err != nil {
-				return err
+			parentStat = handle.loadParentStat(parent, fs.clock())
+			if parentStat == nil {
+				if parentStat, err = fs.inner.Stat(parent); err != nil {
+					return err
+				}
+				handle.storeParentStat(parent, parentStat, fs.clock())
 			}
 		}
 	}
 	fs.fillInfoFromSelfParentStats(
-		target, selfStat, parentStat, handle.evaluatedIndex,
+		ref, target, selfStat, parentStat, handle.evaluatedIndex,
 	)
+	if !handle.node.IsExile() {
+		fs.markSymlinkByReadlink(handle.node.FilePath(), target)
+	}
 	return nil
 }
 
 // fillInfoFromHandle fills the information with
 // a fileHandle. Will lock if the parent needs stat.
 func (fs *fileSystem) fillInfoFromHandle(
-	target *winfsp.FSP_FSCTL_FILE_INFO,
+	ref *winfsp.FileSystemRef, target *winfsp.FSP_FSCTL_FILE_INFO,
 	handle *fileHandle,
 	selfStat, parentStat os.FileInfo,
 ) error {
@@ -353,7 +852,7 @@ func (fs *fileSystem) fillInfoFromHandle(
 		defer plock.Unlock()
 	}
 	return fs.fillInfoFromHandleLocked(
-		target, handle, selfStat, parentStat,
+		ref, target, handle, selfStat, parentStat,
 	)
 }
 
@@ -362,12 +861,15 @@ func (fs *fileSystem) GetSecurityByName(
 	flags winfsp.GetSecurityByNameFlags,
 ) (uint32, *windows.SECURITY_DESCRIPTOR, error) {
 	var err error
-	name = treelock.UnifyFilePath(name)
-	plock := fs.locker.RLockFile(fs.filterNameForLock(name))
+	name = fs.resolveShortName(treelock.UnifyFilePath(name))
+	plock := fs.locker.RLockFile(fs.filterNameForLock(name, false))
 	defer plock.Unlock()
 	info, err := fs.inner.Stat(name)
-	if err != nil || flags == winfsp.GetExistenceOnly {
-		return 0, nil, err
+	if err != nil {
+		return 0, nil, fs.pathNotFound(name, err)
+	}
+	if flags == winfsp.GetExistenceOnly {
+		return 0, nil, nil
 	}
 	target := &winfsp.FSP_FSCTL_FILE_INFO{}
 	var fileID uint64
@@ -376,21 +878,51 @@ func (fs *fileSystem) GetSecurityByName(
 			fileID = v.FileID()
 		}
 	}
-	err = fs.fillInfoFromPathLocked(target, name, info, nil, fileID)
+	err = fs.fillInfoFromPathLocked(ref, target, name, info, nil, fileID)
 	if err != nil || flags == winfsp.GetAttributesByName {
 		return 0, nil, err
 	}
 	attributes := target.FileAttributes
 	var sd *windows.SECURITY_DESCRIPTOR
 	if (flags & winfsp.GetSecurityByName) != 0 {
-		// XXX: this is a mock up, the file is considered to
-		// be owned by current process, so it is okay to
-		// return the security descriptor of the process.
-		sd, err = procsd.Load()
+		sd, err = fs.loadSecurityDescriptor()
 	}
 	return attributes, sd, err
 }
 
+// pathNotFound turns the not-exist error of the name into
+// winfsp.ErrPathNotFound when its parent directory does
+// not exist either, since the inner file system might
+// not tell a missing directory from a missing file.
+func (fs *fileSystem) pathNotFound(name string, err error) error {
+	if !errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, winfsp.ErrPathNotFound) {
+		return err
+	}
+	parent := filepath.Dir(name)
+	if parent == name {
+		return err
+	}
+	if _, statErr := fs.inner.Stat(parent); errors.Is(statErr, os.ErrNotExist) {
+		return winfsp.ErrPathNotFound
+	}
+	return err
+}
+
+// loadSecurityDescriptor returns the security descriptor
+// reported for every file, see WithDefaultSecurityDescriptor.
+func (fs *fileSystem) loadSecurityDescriptor() (
+	*windows.SECURITY_DESCRIPTOR, error,
+) {
+	if fs.securityDescriptor != nil {
+		return fs.securityDescriptor, nil
+	}
+	// XXX: this is a mock up, the file is considered to
+	// be owned by current process, so it is okay to
+	// return the security descriptor of the process.
+	return procsd.Load()
+}
+
 var _ winfsp.BehaviourGetSecurityByName = (*fileSystem)(nil)
 
 const (
@@ -419,6 +951,7 @@ const (
 func (fs *fileSystem) openFile(
 	ref *winfsp.FileSystemRef, name string,
 	createOptions, grantedAccess uint32, mode os.FileMode,
+	attributes uint32, ea []winfsp.EaEntry,
 	info *winfsp.FSP_FSCTL_FILE_INFO,
 ) (uintptr, error) {
 	if createOptions&unsupportedCreateOptions != 0 {
@@ -453,7 +986,7 @@ func (fs *fileSystem) openFile(
 	// TODO: I've not studied the dispositions here carefully
 	// so the actual behaviour might be bizarre, and it would
 	// be helpful of you to correct them.
-	disposition := (createOptions >> 24) & 0x0ff
+	disposition := winfsp.CreateDisposition(createOptions)
 	switch disposition {
 	case windows.FILE_SUPERSEDE:
 		flags |= os.O_CREATE | os.O_TRUNC
@@ -471,26 +1004,35 @@ func (fs *fileSystem) openFile(
 	}
 
 	// Normalize the path to ensure identity of operation.
-	name = treelock.UnifyFilePath(name)
+	name = fs.resolveShortName(treelock.UnifyFilePath(name))
+	if writeAccess != 0 || flags&(os.O_CREATE|os.O_TRUNC) != 0 ||
+		createOptions&windows.FILE_DELETE_ON_CLOSE != 0 {
+		if err := fs.checkWritablePath(name); err != nil {
+			return 0, err
+		}
+	}
 
 	// Lock the file with desired mode.
 
 	// We are allowed to wait for the write operation
 	// for a more fluent user experience.
 	// TODO: create an option to control it?
-	lockFunc := fs.locker.RLockFile
+	lockFunc := fs.locker.RLockFileNode
 	if (createOptions&windows.FILE_DELETE_ON_CLOSE != 0) ||
 		(grantedAccess&windows.DELETE != 0) ||
 		(disposition == windows.FILE_SUPERSEDE) {
-		lockFunc = fs.locker.TryWLockFile
+		lockFunc = fs.locker.TryWLockFileNode
 	}
-	lock := lockFunc(fs.filterNameForLock(name))
+	caseSensitive := fs.openedCaseSensitive()
+	backup := createOptions&windows.FILE_OPEN_FOR_BACKUP_INTENT != 0 &&
+		writeAccess == 0 && flags&(os.O_CREATE|os.O_TRUNC) == 0 &&
+		fs.backupIntent != nil && fs.backupIntent(ref)
+	lock, node := lockFunc(fs.filterNameForLock(name, caseSensitive))
 	if lock == nil {
 		return 0, windows.STATUS_SHARING_VIOLATION
 	}
 	defer func() { lock.Unlock() }()
 	created := false
-	node := lock.RetainNode()
 	defer func() {
 		if !created {
 			node.Free()
@@ -502,20 +1044,24 @@ func (fs *fileSystem) openFile(
 	// Since the file has been opened with write
 	// lock, and no more new open file can be
 	// created before us returning, thus it
-	// suffices to check the number of references.
-	if flags&windows.FILE_SUPERSEDE != 0 {
-		if lock.CurrentRefs() > 1 {
+	// suffices to check the number of references,
+	// which are held by the lock and node of our own.
+	if winfsp.IsSupersede(createOptions) {
+		if lock.CurrentRefs() > 2 {
 			return 0, windows.STATUS_ACCESS_DENIED
 		}
 	}
 
 	// Attempt to allocate the file handle.
 	handle := &fileHandle{
-		node: node,
+		node:          node,
+		caseSensitive: caseSensitive,
+		backup:        backup,
+		noBuffering:   createOptions&windows.FILE_NO_INTERMEDIATE_BUFFERING != 0,
+		readData:      readAccess != 0,
 	}
 	handleAddr := uintptr(unsafe.Pointer(handle))
-	_, loaded := fs.handles.LoadOrStore(handleAddr, handle)
-	if loaded {
+	if fs.handles.LoadOrStore(handleAddr, handle) {
 		return 0, windows.ERROR_NOT_ENOUGH_MEMORY
 	}
 	defer func() {
@@ -530,7 +1076,7 @@ func (fs *fileSystem) openFile(
 		if flags&os.O_TRUNC != 0 {
 			return 0, windows.STATUS_INVALID_PARAMETER
 		}
-		mode |= os.FileMode(0111)
+		mode = (mode | os.FileMode(0111)) &^ fs.umask
 		if err := fs.inner.Mkdir(name, mode); err != nil {
 			if os.IsExist(err) ||
 				errors.Is(err, windows.STATUS_OBJECT_NAME_COLLISION) {
@@ -554,6 +1100,9 @@ func (fs *fileSystem) openFile(
 	// Attempt to open the file in the underlying file system.
 	dirCheckErr := windows.STATUS_NOT_A_DIRECTORY
 	file, err := fs.inner.OpenFile(name, accessFlags|flags, mode)
+	if err != nil && backup {
+		file, err = fs.openBackup(name, accessFlags|flags, err)
+	}
 	if err != nil {
 		// We will only try again if it complains about opening a
 		// directory file failed, but we should be able to open the
@@ -575,11 +1124,14 @@ func (fs *fileSystem) openFile(
 			accessFlags = os.O_RDONLY
 			flags = 0
 			file, err = fs.inner.OpenFile(name, accessFlags|flags, mode)
+			if err != nil && backup {
+				file, err = fs.openBackup(name, accessFlags|flags, err)
+			}
 			createOptions |= windows.FILE_DIRECTORY_FILE
 			dirCheckErr = windows.STATUS_OBJECT_NAME_NOT_FOUND
 		}
 		if err != nil {
-			return 0, err
+			return 0, fs.pathNotFound(name, err)
 		}
 	}
 	defer func() {
@@ -607,6 +1159,27 @@ func (fs *fileSystem) openFile(
 	default:
 	}
 
+	// Apply the attributes requested by creating the
+	// file, which are ignored without FileChattr just
+	// like overwriting the file.
+	if chattr, ok := file.(FileChattr); ok &&
+		attributes != 0 && !fileInfo.IsDir() {
+		if err := chattr.Chattr(attributes); err != nil {
+			return 0, err
+		}
+		if fileInfo, err = file.Stat(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Assign the extended attributes supplied by creating
+	// the file, see FileSystemEa.
+	if len(ea) != 0 {
+		if err := fs.setEa(name, ea); err != nil {
+			return 0, err
+		}
+	}
+
 	// Evaluate the file index for the file and cache it.
 	handle.evaluatedIndex = lock.AddrAsID()
 	if fs.providesFileID {
@@ -619,13 +1192,25 @@ func (fs *fileSystem) openFile(
 	//
 	// XXX: This must always be done after all fields in
 	// the handle are filled.
-	err = fs.fillInfoFromHandleLocked(info, handle, fileInfo, nil)
+	err = fs.fillInfoFromHandleLocked(ref, info, handle, fileInfo, nil)
 	if err != nil {
 		return 0, err
 	}
 
+	// Watch the directory for the changes made outside.
+	if fileInfo.IsDir() && fs.watcher != nil {
+		handle.watchKey = watchKey{
+			ref:  ref,
+			name: fs.filterNameForLock(name, caseSensitive),
+		}
+		handle.watching = fs.watcher.acquire(name, handle.watchKey)
+	}
+
 	// Finish opening the file and return to the caller.
 	created = true
+	if fs.onOpen != nil {
+		fs.onOpen(name, uint64(handleAddr))
+	}
 	return handleAddr, nil
 }
 
@@ -634,6 +1219,19 @@ func (fs *fileSystem) Create(
 	createOptions, grantedAccess, fileAttributes uint32,
 	securityDescriptor *windows.SECURITY_DESCRIPTOR,
 	allocationSize uint64, info *winfsp.FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	return fs.create(
+		ref, name, createOptions, grantedAccess,
+		fileAttributes, nil, info,
+	)
+}
+
+// create creates the file with the attributes and the
+// extended attributes, see Create.
+func (fs *fileSystem) create(
+	ref *winfsp.FileSystemRef, name string,
+	createOptions, grantedAccess, fileAttributes uint32,
+	ea []winfsp.EaEntry, info *winfsp.FSP_FSCTL_FILE_INFO,
 ) (uintptr, error) {
 	fileMode := os.FileMode(0444)
 	if fileAttributes&windows.FILE_ATTRIBUTE_READONLY == 0 {
@@ -642,9 +1240,10 @@ func (fs *fileSystem) Create(
 	if fileAttributes&windows.FILE_ATTRIBUTE_DIRECTORY != 0 {
 		fileMode |= os.FileMode(0111)
 	}
+	fileMode &^= fs.umask
 	return fs.openFile(
 		ref, name, createOptions, grantedAccess,
-		fileMode, info,
+		fileMode, fileAttributes, ea, info,
 	)
 }
 
@@ -657,55 +1256,161 @@ func (fs *fileSystem) Open(
 ) (uintptr, error) {
 	return fs.openFile(
 		ref, name, createOptions, grantedAccess,
-		os.FileMode(0), info,
+		os.FileMode(0), 0, nil, info,
 	)
 }
 
 func (fs *fileSystem) load(file uintptr) (*fileHandle, error) {
-	obj, ok := fs.handles.Load(file)
+	handle, ok := fs.handles.Load(file)
 	if !ok {
 		return nil, windows.STATUS_INVALID_HANDLE
 	}
-	return obj.(*fileHandle), nil
+	return handle, nil
 }
 
 func (fs *fileSystem) Close(
 	ref *winfsp.FileSystemRef, file uintptr,
 ) {
-	object, ok := fs.handles.LoadAndDelete(file)
+	fileHandle, ok := fs.handles.LoadAndDelete(file)
 	if !ok {
 		return
 	}
-	fileHandle := object.(*fileHandle)
 	fileHandle.mtx.Lock()
 	defer fileHandle.mtx.Unlock()
 	defer fileHandle.node.Free()
 	defer fileHandle.dir.Delete()
+	if fileHandle.watching {
+		fs.watcher.release(fileHandle.watchKey)
+		fileHandle.watching = false
+	}
 	if fileHandle.file != nil {
 		_ = fileHandle.file.Close()
 		fileHandle.file = nil
 	}
+	fileHandle.reopen = nil
+	if fileHandle.copyToken != 0 {
+		fs.copySources.Delete(fileHandle.copyToken)
+		fileHandle.copyToken = 0
+	}
+	if fs.onClose != nil {
+		fs.onClose(uint64(file))
+	}
 }
 
-func (handle *fileHandle) lockChecked() error {
-	handle.mtx.RLock()
-	valid := false
-	defer func() {
-		if !valid {
-			handle.mtx.RUnlock()
+// closeForReopen closes the file temporarily, since in
+// some file systems an opened file fails the rename or
+// removal of itself, arranging for it to be reopened at
+// its current path and offset by ensureFileLocked.
+//
+// The handle.mtx must be held exclusively.
+func (fs *fileSystem) closeForReopen(handle *fileHandle) error {
+	fileInfo, err := fs.statFile(handle.file)
+	if err != nil {
+		return err
+	}
+	var pos *int64
+	if fileInfo.Mode().IsRegular() {
+		value, err := handle.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
 		}
-	}()
-	if handle.file == nil {
+		pos = &value
+	}
+	_ = handle.file.Close()
+	handle.file = nil
+	handle.resetParentStat()
+	handle.resetFileInfo()
+	handle.reopen = func() (File, error) {
+		// It's either the file moved successfully so that the
+		// handle.node get placed under the target directory,
+		// or the file failing to move so that handle.node
+		// stays in its original position. Either case we
+		// can trust the file path from handle.node.FilePath().
+		name := handle.node.FilePath()
+		f, err := fs.inner.OpenFile(name, handle.flags, os.FileMode(0))
+		if err != nil && handle.backup {
+			f, err = fs.openBackup(name, handle.flags, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pos != nil {
+			if _, err := f.Seek(*pos, io.SeekStart); err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+		}
+		return f, nil
+	}
+	return nil
+}
+
+// ensureFileLocked reopens the file closed by Rename or
+// Cleanup if it has not been reopened yet, with the
+// handle.mtx held exclusively.
+//
+// A file failing to be reopened is reported as a sharing
+// violation, which is usually retried by the applications,
+// or as deleted if it no longer exists. Only the closed
+// handle is reported as an invalid handle.
+func (handle *fileHandle) ensureFileLocked() error {
+	if handle.file != nil {
+		return nil
+	}
+	if handle.reopen == nil {
 		return windows.STATUS_INVALID_HANDLE
 	}
-	valid = true
+	f, err := handle.reopen()
+	if err != nil {
+		if os.IsNotExist(err) ||
+			errors.Is(err, windows.STATUS_OBJECT_NAME_NOT_FOUND) {
+			return errors.Wrap(windows.STATUS_FILE_DELETED, err.Error())
+		}
+		return errors.Wrap(windows.STATUS_SHARING_VIOLATION, err.Error())
+	}
+	handle.file = f
+	handle.reopen = nil
 	return nil
 }
 
+func (handle *fileHandle) lockChecked() error {
+	for {
+		handle.mtx.RLock()
+		if handle.file != nil {
+			return nil
+		}
+		handle.mtx.RUnlock()
+		if err := func() error {
+			handle.mtx.Lock()
+			defer handle.mtx.Unlock()
+			return handle.ensureFileLocked()
+		}(); err != nil {
+			return err
+		}
+	}
+}
+
 func (handle *fileHandle) unlockChecked() {
 	handle.mtx.RUnlock()
 }
 
+// lockCheckedExclusive is lockChecked holding the handle
+// exclusively, for the operations made of several calls
+// to the file that must not interleave with the other
+// operations on the handle, e.g. Overwrite.
+func (handle *fileHandle) lockCheckedExclusive() error {
+	handle.mtx.Lock()
+	if err := handle.ensureFileLocked(); err != nil {
+		handle.mtx.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (handle *fileHandle) unlockCheckedExclusive() {
+	handle.mtx.Unlock()
+}
+
 var _ winfsp.BehaviourBase = (*fileSystem)(nil)
 
 func (fs *fileSystem) Overwrite(
@@ -719,18 +1424,37 @@ func (fs *fileSystem) Overwrite(
 	if err != nil {
 		return err
 	}
-	if err := handle.lockChecked(); err != nil {
+
+	// Hold the handle exclusively, so that the truncation
+	// and the attribute change are observed atomically by
+	// other operations on this handle.
+	if err := handle.lockCheckedExclusive(); err != nil {
 		return err
 	}
-	defer handle.unlockChecked()
+	defer handle.unlockCheckedExclusive()
+	if err := fs.checkWritablePath(handle.node.FilePath()); err != nil {
+		return err
+	}
+	defer handle.resetFileInfo()
+	chattr, chattrOk := handle.file.(FileChattr)
+	if chattrOk && !replaceAttributes {
+		err = fs.fillInfoFromHandle(ref, info, handle, nil, nil)
+		if err != nil {
+			return err
+		}
+		attributes |= info.FileAttributes
+	}
 	if err := handle.file.Truncate(0); err != nil {
 		return err
 	}
-	// TODO: support chmod operation in the future.
-	//
-	// It might seems like we are just ignoring the attribute
-	// update but we might support them in the future.
-	err = fs.fillInfoFromHandle(info, handle, nil, nil)
+	// Files without FileChattr keeps their attributes,
+	// as we have no way to update them.
+	if chattrOk {
+		if err := chattr.Chattr(attributes); err != nil {
+			return err
+		}
+	}
+	err = fs.fillInfoFromHandle(ref, info, handle, nil, nil)
 	if err != nil {
 		return err
 	}
@@ -770,6 +1494,9 @@ func (fs *fileSystem) ReadDirectory(
 	}
 	f, err := fs.inner.OpenFile(
 		plock.FilePath(), handle.flags, os.FileMode(0))
+	if err != nil && handle.backup {
+		f, err = fs.openBackup(plock.FilePath(), handle.flags, err)
+	}
 	if err != nil {
 		return err
 	}
@@ -782,6 +1509,13 @@ func (fs *fileSystem) ReadDirectory(
 	if err != nil {
 		return err
 	}
+	var dirInfos map[string]dirInfoEntry
+	if fs.readdirPlusTTL > 0 {
+		dirInfos = make(map[string]dirInfoEntry, len(fileInfos))
+		defer func() {
+			handle.storeDirInfos(dirInfos, fs.clock())
+		}()
+	}
 	for _, fileInfo := range fileInfos {
 		var info winfsp.FSP_FSCTL_FILE_INFO
 		var fileID uint64
@@ -790,8 +1524,16 @@ func (fs *fileSystem) ReadDirectory(
 				fileID = v.FileID()
 			}
 		}
-		fs.fillInfoFromSelfParentStats(&info, fileInfo, parentInfo, fileID)
-		ok, err := fill(fileInfo.Name(), &info)
+		fs.fillInfoFromSelfParentStats(ref, &info, fileInfo, parentInfo, fileID)
+		name := fs.encodeName(fileInfo.Name())
+		fs.markSymlinkByReadlink(filepath.Join(plock.FilePath(), name), &info)
+		if dirInfos != nil {
+			dirInfos[fs.dirInfoKey(name, handle)] = dirInfoEntry{
+				name: name,
+				info: info,
+			}
+		}
+		ok, err := fill(name, &info)
 		if err != nil || !ok {
 			return err
 		}
@@ -813,7 +1555,18 @@ func (fs *fileSystem) GetFileInfo(
 		return err
 	}
 	defer handle.unlockChecked()
-	return fs.fillInfoFromHandle(info, handle, nil, nil)
+	if fs.fileInfoCacheTTL <= 0 {
+		return fs.fillInfoFromHandle(ref, info, handle, nil, nil)
+	}
+	generation, ok := handle.loadFileInfo(fs.fileInfoCacheTTL, fs.clock(), info)
+	if ok {
+		return nil
+	}
+	if err := fs.fillInfoFromHandle(ref, info, handle, nil, nil); err != nil {
+		return err
+	}
+	handle.storeFileInfo(generation, fs.clock(), info)
+	return nil
 }
 
 var _ winfsp.BehaviourGetFileInfo = (*fileSystem)(nil)
@@ -825,7 +1578,7 @@ func (fs *fileSystem) GetSecurity(
 	if err != nil {
 		return nil, err
 	}
-	return procsd.Load()
+	return fs.loadSecurityDescriptor()
 }
 
 var _ winfsp.BehaviourGetSecurity = (*fileSystem)(nil)
@@ -873,15 +1626,75 @@ func (fs *fileSystem) SetBasicInfo(
 		return err
 	}
 	defer handle.unlockChecked()
-	err = fs.fillInfoFromHandle(info, handle, nil, nil)
-	if err != nil {
+	defer handle.resetFileInfo()
+	if err := fs.checkWritablePath(handle.node.FilePath()); err != nil {
 		return err
 	}
-	return windows.STATUS_ACCESS_DENIED
-}
+	// Both of the requested changes must be supported
+	// before applying any of them, so that a denied
+	// request leaves the file untouched.
+	setAttributes := flags&winfsp.SetBasicInfoAttributes != 0
+	setTimes := flags&^winfsp.SetBasicInfoAttributes != 0
+	chattr, chattrOk := handle.file.(FileChattr)
+	chtimes, chtimesOk := handle.file.(FileChtimes)
+	if (setAttributes && !chattrOk) || (setTimes && !chtimesOk) {
+		err = fs.fillInfoFromHandle(ref, info, handle, nil, nil)
+		if err != nil {
+			return err
+		}
+		return windows.STATUS_ACCESS_DENIED
+	}
+	if setAttributes {
+		// The DIRECTORY attribute is determined by the
+		// file itself, and NORMAL only stands for the
+		// absence of the other attributes.
+		if err := chattr.Chattr(attribute &^ (windows.FILE_ATTRIBUTE_DIRECTORY |
+			windows.FILE_ATTRIBUTE_NORMAL)); err != nil {
+			return err
+		}
+	}
+	if setTimes {
+		if err := chtimes.Chtimes(
+			basicInfoTime(flags, winfsp.SetBasicInfoCreationTime, creationTime),
+			basicInfoTime(flags, winfsp.SetBasicInfoLastAccessTime, lastAccessTime),
+			basicInfoTime(flags, winfsp.SetBasicInfoLastWriteTime, lastWriteTime),
+			basicInfoTime(flags, winfsp.SetBasicInfoChangeTime, changeTime),
+		); err != nil {
+			return err
+		}
+	}
+	return fs.fillInfoFromHandle(ref, info, handle, nil, nil)
+}
 
 var _ winfsp.BehaviourSetBasicInfo = (*fileSystem)(nil)
 
+// FileChtimes is the interface for files whose times
+// could be changed. Without this interface, setting the
+// times of the file is denied.
+type FileChtimes interface {
+	File
+
+	// Chtimes replaces the times of the file, leaving the
+	// ones specified as the zero time unchanged. The change
+	// time is set to the current time, as the metadata is
+	// being changed, unless it is specified explicitly.
+	Chtimes(creationTime, accessTime, writeTime, changeTime time.Time) error
+}
+
+// basicInfoTime converts the time passed to SetBasicInfo,
+// which is the zero time if the flag is not set.
+//
+// The values -1 and -2, which suspend and resume updating
+// the time by the file system, are ignored.
+func basicInfoTime(
+	flags, flag winfsp.SetBasicInfoFlags, value uint64,
+) time.Time {
+	if flags&flag == 0 || int64(value) < 0 {
+		return time.Time{}
+	}
+	return filetime.Time(value)
+}
+
 // FileTruncateEx is the truncate interface related to Windows
 // style opertations. Without this interface, we will be
 // imitating the set allocation size behaviour of file, making
@@ -894,6 +1707,20 @@ type FileTruncateEx interface {
 	Shrink(newSize int64) error
 }
 
+// FileChattr is the interface for files whose Windows
+// file attributes could be changed. Without this
+// interface, the attributes requested by overwriting
+// the file are ignored, while setting them through the
+// basic info of the file is denied.
+type FileChattr interface {
+	File
+
+	// Chattr replaces the file attributes with the
+	// specified FILE_ATTRIBUTE_* flags, the unsupported
+	// ones might be ignored.
+	Chattr(attributes uint32) error
+}
+
 type fileMimicTruncate struct {
 	File
 }
@@ -922,6 +1749,7 @@ func (fs *fileSystem) SetFileSize(
 		return err
 	}
 	defer handle.unlockChecked()
+	defer handle.resetFileInfo()
 	size := int64(newSize)
 	if setAllocationSize {
 		var shrinker FileTruncateEx
@@ -940,7 +1768,7 @@ func (fs *fileSystem) SetFileSize(
 			return err
 		}
 	}
-	return fs.fillInfoFromHandle(info, handle, nil, nil)
+	return fs.fillInfoFromHandle(ref, info, handle, nil, nil)
 }
 
 var _ winfsp.BehaviourSetFileSize = (*fileSystem)(nil)
@@ -953,17 +1781,125 @@ func (fs *fileSystem) Read(
 	if err != nil {
 		return 0, err
 	}
+	if err := fs.throttle(ref, len(buf)); err != nil {
+		return 0, err
+	}
 	if err := handle.lockChecked(); err != nil {
 		return 0, err
 	}
 	defer handle.unlockChecked()
+	if err := handle.checkAlignment(ref, offset, len(buf), false); err != nil {
+		return 0, err
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
 	// No matter random access or append only file handle
 	// on windows should support random read.
-	return handle.file.ReadAt(buf, int64(offset))
+	return fs.retryIO(func() (int, error) {
+		if reader, ok := handle.file.(FileReadVAt); ok {
+			return reader.ReadVAt(splitVectorSegments(buf), int64(offset))
+		}
+		return handle.file.ReadAt(buf, int64(offset))
+	})
 }
 
 var _ winfsp.BehaviourRead = (*fileSystem)(nil)
 
+// checkAlignment rejects the transfer through a handle
+// opened with FILE_NO_INTERMEDIATE_BUFFERING whose offset
+// or length is not a multiple of the sector size, just as
+// NTFS does, so that the inner file system only receives
+// the sector aligned transfers the application asked for.
+// The offset is not checked when writing to the end of
+// the file, which is decided by the inner file system.
+func (handle *fileHandle) checkAlignment(
+	ref *winfsp.FileSystemRef, offset uint64, length int,
+	writeToEndOfFile bool,
+) error {
+	if !handle.noBuffering {
+		return nil
+	}
+	sectorSize := uint64(ref.SectorSize())
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+	if uint64(length)%sectorSize != 0 ||
+		(!writeToEndOfFile && offset%sectorSize != 0) {
+		return windows.STATUS_INVALID_PARAMETER
+	}
+	return nil
+}
+
+// vectorSegmentSize is the size of segments passed to
+// FileReadVAt and FileWriteVAt, which is the page size
+// required by ReadFileScatter and WriteFileGather.
+const vectorSegmentSize = 4096
+
+// splitVectorSegments splits the buffer into segments
+// of vectorSegmentSize, with the last one possibly
+// being shorter.
+func splitVectorSegments(buf []byte) [][]byte {
+	result := make([][]byte, 0,
+		(len(buf)+vectorSegmentSize-1)/vectorSegmentSize)
+	for len(buf) > vectorSegmentSize {
+		result = append(result, buf[:vectorSegmentSize:vectorSegmentSize])
+		buf = buf[vectorSegmentSize:]
+	}
+	if len(buf) > 0 {
+		result = append(result, buf)
+	}
+	return result
+}
+
+// FileReadVAt is the scatter read interface of a file.
+//
+// When implemented, gofs reads into the buffer delivered
+// by WinFSP through this interface instead of ReadAt, with
+// the buffer split into page sized segments, so that it
+// could be mapped to ReadFileScatter without copying.
+type FileReadVAt interface {
+	File
+
+	// ReadVAt reads into the segments consecutively
+	// starting from the offset, with the same semantic
+	// as ReadAt on their concatenation.
+	ReadVAt([][]byte, int64) (int, error)
+}
+
+// FileWriteVAt is the gather write interface of a file,
+// which is the counterpart of FileReadVAt.
+//
+// It is only used for writing at specified offset, the
+// appending and constrained writes still go through
+// FileWriteEx.
+type FileWriteVAt interface {
+	File
+
+	// WriteVAt writes the segments consecutively starting
+	// from the offset, with the same semantic as WriteAt
+	// on their concatenation.
+	WriteVAt([][]byte, int64) (int, error)
+}
+
+// FileSizeAfterWrite means the file knows its size after
+// writing cheaply, e.g. the file kept in memory.
+//
+// When implemented, Write fills the file info reported to
+// WinFSP by updating the size and times of the one filled
+// by the first write through the handle, instead of
+// stating the file after every write. The other attributes
+// of the file are not refreshed until the next operation
+// invalidating the file info of the handle, e.g. setting
+// the basic info or the size of the file.
+type FileSizeAfterWrite interface {
+	File
+
+	// SizeAfterWrite returns the size of the file after
+	// the last write through it.
+	SizeAfterWrite() int64
+}
+
 // FileWriteEx is the write interface related to Windows style
 // writing. Without this interface, we will be imitating the
 // write behaviour of file, making it behaves strangely under
@@ -1038,10 +1974,21 @@ func (fs *fileSystem) Write(
 		// You may not write to an append-only file.
 		return 0, windows.STATUS_ACCESS_DENIED
 	}
+	if err := fs.throttle(ref, len(b)); err != nil {
+		return 0, err
+	}
 	if err := handle.lockChecked(); err != nil {
 		return 0, err
 	}
 	defer handle.unlockChecked()
+	// The constrained writes are paging writes issued by
+	// the system, which are aligned to pages by nature.
+	if !constrainedIo {
+		if err := handle.checkAlignment(
+			ref, offset, len(b), writeToEndOfFile); err != nil {
+			return 0, err
+		}
+	}
 	var writer FileWriteEx
 	if obj, ok := handle.file.(FileWriteEx); ok {
 		writer = obj
@@ -1052,27 +1999,43 @@ func (fs *fileSystem) Write(
 		}
 	}
 	var n int
-	if writeToEndOfFile && constrainedIo {
-		// Nothing to do here.
+	if len(b) == 0 || (writeToEndOfFile && constrainedIo) {
+		// Nothing to do here, the zero length write must
+		// neither extend nor append to the file.
 	} else if writeToEndOfFile {
 		n, err = writer.Append(b)
 	} else if constrainedIo {
-		n, err = writer.ConstrainedWriteAt(b, int64(offset))
+		n, err = fs.retryIO(func() (int, error) {
+			return writer.ConstrainedWriteAt(b, int64(offset))
+		})
+	} else if obj, ok := handle.file.(FileWriteVAt); ok {
+		n, err = fs.retryIO(func() (int, error) {
+			return obj.WriteVAt(splitVectorSegments(b), int64(offset))
+		})
 	} else {
-		n, err = handle.file.WriteAt(b, int64(offset))
-	}
+		n, err = fs.retryIO(func() (int, error) {
+			return handle.file.WriteAt(b, int64(offset))
+		})
+	}
+	// XXX: Since the driver code just take the information
+	// field for notification and display purpose, so only
+	// the lastly updated information is required, and the
+	// size is all that changes by writing.
+	sizer, sizeKnown := handle.file.(FileSizeAfterWrite)
+	if sizeKnown && err == nil && info != nil &&
+		handle.updateFileInfoAfterWrite(
+			ref, sizer.SizeAfterWrite(), fs.clock(), info) {
+		return n, nil
+	}
+	generation := handle.resetFileInfo()
 	if info != nil {
-		// XXX: Since the driver code just take the information
-		// field for notification and display purpose, so only
-		// the lastly updated information is required.
-		//
-		// TODO: What pieces of information is required by the
-		// driver? Can we optimize the number of `Stat`s if
-		// the FileAttributes is actually not needed?
-		statErr := fs.fillInfoFromHandle(info, handle, nil, nil)
+		statErr := fs.fillInfoFromHandle(ref, info, handle, nil, nil)
 		if statErr != nil && err == nil {
 			err = statErr
 		}
+		if statErr == nil && sizeKnown {
+			handle.storeFileInfo(generation, fs.clock(), info)
+		}
 	}
 	return n, err
 }
@@ -1085,6 +2048,9 @@ func (fs *fileSystem) Flush(
 ) error {
 	if file == 0 {
 		// Flush the whole filesystem, not a single file.
+		if fs.syncVolume != nil {
+			return fs.syncVolume()
+		}
 		return nil
 	}
 	handle, err := fs.load(file)
@@ -1095,12 +2061,23 @@ func (fs *fileSystem) Flush(
 		return err
 	}
 	defer handle.unlockChecked()
-	if err := handle.file.Sync(); err != nil {
+	defer handle.resetFileInfo()
+
+	// The temporary file is expected to be deleted soon,
+	// so its data is not forced into the storage.
+	fileInfo, err := fs.statFile(handle.file)
+	if err != nil {
 		return err
 	}
+	if temporaryBitFromStat(fileInfo) == 0 {
+		if err := handle.file.Sync(); err != nil {
+			return err
+		}
+		fileInfo = nil
+	}
 	// TODO: Again, is it the same case as `Stat`-ing
 	// in the Write method?
-	return fs.fillInfoFromHandle(info, handle, nil, nil)
+	return fs.fillInfoFromHandle(ref, info, handle, fileInfo, nil)
 }
 
 var _ winfsp.BehaviourFlush = (*fileSystem)(nil)
@@ -1127,6 +2104,9 @@ func (fs *fileSystem) CanDelete(
 	if plock.IsExile() {
 		return windows.STATUS_OBJECT_NAME_NOT_FOUND
 	}
+	if err := fs.checkWritablePath(plock.FilePath()); err != nil {
+		return err
+	}
 
 	// There's possibly node opening files under
 	// this node, which must fail the operation.
@@ -1134,7 +2114,7 @@ func (fs *fileSystem) CanDelete(
 		return windows.STATUS_ACCESS_DENIED
 	}
 
-	fileInfo, err := handle.file.Stat()
+	fileInfo, err := fs.statFile(handle.file)
 	if err != nil {
 		return err
 	}
@@ -1168,11 +2148,14 @@ func (fs *fileSystem) Cleanup(
 		return
 	}
 	if cleanupFlags&winfsp.FspCleanupDelete == 0 {
+		if cleanupFlags&winfsp.FspCleanupSetArchiveBit != 0 {
+			fs.setArchiveBit(handle)
+		}
 		return
 	}
 	handle.mtx.Lock()
 	defer handle.mtx.Unlock()
-	if handle.file == nil {
+	if handle.ensureFileLocked() != nil {
 		return
 	}
 	plock := handle.node.TryWLockPath()
@@ -1180,21 +2163,78 @@ func (fs *fileSystem) Cleanup(
 		return
 	}
 	defer plock.Unlock()
-	if plock.IsExile() {
+	if plock.IsExile() || fs.isReadOnlyPath(plock.FilePath()) {
 		return
 	}
 	exileLock := fs.locker.WLockExile()
 	defer exileLock.Unlock()
-	_ = handle.file.Close()
-	handle.file = nil
+	if fs.closeForReopen(handle) != nil {
+		return
+	}
 	if err := fs.inner.Remove(plock.FilePath()); err != nil {
+		// The file is still there, and is reopened so that
+		// the handle remains usable.
+		_ = handle.ensureFileLocked()
 		return
 	}
+	handle.reopen = nil
 	treelock.Exchange(plock, exileLock)
 }
 
 var _ winfsp.BehaviourCleanup = (*fileSystem)(nil)
 
+// FileSetArchive is the interface for files which could
+// have FILE_ATTRIBUTE_ARCHIVE set without touching the
+// other attributes of the file.
+type FileSetArchive interface {
+	File
+
+	// SetArchive adds FILE_ATTRIBUTE_ARCHIVE to the file.
+	SetArchive() error
+}
+
+// setArchiveBit adds FILE_ATTRIBUTE_ARCHIVE to the file
+// modified through the handle, as requested by WinFSP
+// upon cleanup, so that the backup tools could find the
+// file changed.
+//
+// The file is updated through FileSetArchive if it is
+// implemented. Otherwise FileChattr is called with the
+// attributes reported by the backend itself in the
+// `syscall.Win32FileAttributeData` of its stat, since the
+// attributes synthesized by gofs (e.g. the read-only bit
+// from AttribReadOnlyAlways, or the executable bit) must
+// not be written back. Files offering neither are left
+// as is.
+func (fs *fileSystem) setArchiveBit(handle *fileHandle) {
+	if err := handle.lockChecked(); err != nil {
+		return
+	}
+	defer handle.unlockChecked()
+	if fs.checkWritablePath(handle.node.FilePath()) != nil {
+		return
+	}
+	stat, err := fs.statFile(handle.file)
+	if err != nil || stat.IsDir() || archiveBitFromStat(stat) != 0 {
+		return
+	}
+	if setArchive, ok := handle.file.(FileSetArchive); ok {
+		err = setArchive.SetArchive()
+	} else if chattr, ok := handle.file.(FileChattr); ok {
+		data, ok := stat.Sys().(*syscall.Win32FileAttributeData)
+		if !ok {
+			return
+		}
+		attributes := data.FileAttributes &^ windows.FILE_ATTRIBUTE_NORMAL
+		err = chattr.Chattr(attributes | windows.FILE_ATTRIBUTE_ARCHIVE)
+	} else {
+		return
+	}
+	if err == nil {
+		handle.resetFileInfo()
+	}
+}
+
 func (fs *fileSystem) Rename(
 	ref *winfsp.FileSystemRef, file uintptr,
 	_, target string, replaceIfExist bool,
@@ -1205,8 +2245,8 @@ func (fs *fileSystem) Rename(
 	}
 	handle.mtx.Lock()
 	defer handle.mtx.Unlock()
-	if handle.file == nil {
-		return windows.STATUS_INVALID_HANDLE
+	if err := handle.ensureFileLocked(); err != nil {
+		return err
 	}
 	exileLock := fs.locker.WLockExile()
 	defer exileLock.Unlock()
@@ -1222,11 +2262,17 @@ func (fs *fileSystem) Rename(
 
 	// Normalize the source and target name.
 	source := oldLock.FilePath()
-	sourceFiltered := fs.filterNameForLock(source)
+	sourceFiltered := fs.filterNameForLock(source, handle.caseSensitive)
 
 	// Normalize the target name.
 	target = treelock.UnifyFilePath(target)
-	targetFiltered := fs.filterNameForLock(target)
+	if err := fs.checkWritablePath(source); err != nil {
+		return err
+	}
+	if err := fs.checkWritablePath(target); err != nil {
+		return err
+	}
+	targetFiltered := fs.filterNameForLock(target, handle.caseSensitive)
 
 	// Try to grab the target path's lock.
 	//
@@ -1259,50 +2305,34 @@ func (fs *fileSystem) Rename(
 		}
 	}
 
+	// Remember the creation time of the source, which is
+	// restored if the inner file system recreates the file
+	// by renaming it, e.g. by copying it to the target.
+	var creationTime time.Time
+	if _, ok := handle.file.(FileChtimes); ok {
+		if fileInfo, err := fs.statFile(handle.file); err == nil {
+			creationTime = creationTimeFromStat(fileInfo)
+		}
+	}
+
 	// Close the file temporarily, since in some filesystem,
 	// opening the file will cause the move operation to fail.
 	//
 	// Upon exit, the remaining file will be reopened and
 	// seek to its orignal offset, so that we can continue
-	// our operations.
-	fileInfo, err := handle.file.Stat()
-	if err != nil {
-		return err
-	}
-	var pos *int64
-	if fileInfo.Mode().IsRegular() {
-		value, err := handle.file.Seek(0, os.SEEK_CUR)
-		if err != nil {
+	// our operations. Should it fail, the reopening is
+	// retried by the following operations on the handle.
+	//
+	// The file system renaming open files keeps it open.
+	if fs.openRename {
+		handle.resetParentStat()
+		handle.resetFileInfo()
+	} else {
+		if err := fs.closeForReopen(handle); err != nil {
 			return err
 		}
-		pos = new(int64)
-		*pos = value
+		defer func() { _ = handle.ensureFileLocked() }()
 	}
-	_ = handle.file.Close()
-	handle.file = nil
-	defer func() {
-		// It's either the file moved successfully so that the
-		// handle.node get placed under the target directory,
-		// or the file failing to move so that handle.node
-		// stays in its original position. Either case we
-		// can trust the file path from handle.node.FilePath().
-		f, err := fs.inner.OpenFile(
-			handle.node.FilePath(), handle.flags, os.FileMode(0))
-		if err != nil {
-			return
-		}
-		defer func() {
-			if f != nil {
-				_ = f.Close()
-			}
-		}()
-		if pos != nil {
-			if _, err := f.Seek(*pos, os.SEEK_SET); err != nil {
-				return
-			}
-		}
-		handle.file, f = f, nil
-	}()
 
 	// Attempt to perform the rename operation now.
 	if err := fs.inner.Rename(source, target); err != nil {
@@ -1317,15 +2347,55 @@ func (fs *fileSystem) Rename(
 		treelock.Exchange(newLock, exileLock)
 		// newLock.node -> <exile>, exileLock.node -> source
 	}
+	if !creationTime.IsZero() {
+		fs.restoreCreationTime(handle, creationTime)
+	}
 	return nil
 }
 
+// restoreCreationTime reapplies the creation time to the
+// renamed file if it has been changed by renaming, which
+// is the best effort as the file has been renamed anyway.
+func (fs *fileSystem) restoreCreationTime(
+	handle *fileHandle, creationTime time.Time,
+) {
+	if err := handle.ensureFileLocked(); err != nil {
+		return
+	}
+	fileInfo, err := fs.statFile(handle.file)
+	if err != nil || creationTimeFromStat(fileInfo).Equal(creationTime) {
+		return
+	}
+	if chtimes, ok := handle.file.(FileChtimes); ok {
+		_ = chtimes.Chtimes(creationTime, time.Time{}, time.Time{}, time.Time{})
+		handle.resetFileInfo()
+	}
+}
+
 var _ winfsp.BehaviourRename = (*fileSystem)(nil)
 
 type newOption struct {
 	attribReadOnlyTransMode AttribReadOnlyTransMode
 	caseInsensitive         bool
+	posixSemantics          bool
 	providesFileID          bool
+	backupIntent            func(*winfsp.FileSystemRef) bool
+	fileInfoCacheTTL        time.Duration
+	readdirPlusTTL          time.Duration
+	operationTimeout        time.Duration
+	securityDescriptor      *windows.SECURITY_DESCRIPTOR
+	clock                   func() time.Time
+	shortNames              bool
+	nameEncode              func(string) string
+	nameDecode              func(string) string
+	readOnlyPaths           []string
+	compression             bool
+	copyFileRange           bool
+	allocatedRanges         bool
+	execAttribute           bool
+	umask                   os.FileMode
+	limiter                 *rate.Limiter
+	retry                   RetryPolicy
 	defaultWinfspOptions    []winfsp.Option
 }
 
@@ -1340,6 +2410,22 @@ func WithCaseInsensitive(v bool) NewOption {
 	}
 }
 
+// WithPosixSemantics enables the POSIX semantics of
+// deleting and renaming files on the volume, and makes
+// files opened with FILE_FLAG_POSIX_SEMANTICS compared
+// case sensitively under WithCaseInsensitive.
+//
+// Such files are locked by their exact names, so they
+// are not mutually excluded with the files of the same
+// name in other cases opened without POSIX semantics. The
+// inner file system must be able to tell them apart.
+func WithPosixSemantics(v bool) NewOption {
+	return func(option *newOption) error {
+		option.posixSemantics = v
+		return nil
+	}
+}
+
 func WithAttribReadOnlyTransMode(mode AttribReadOnlyTransMode) NewOption {
 	return func(option *newOption) (rerr error) {
 		defer func() {
@@ -1366,6 +2452,97 @@ func WithAttribReadOnlyTransMode(mode AttribReadOnlyTransMode) NewOption {
 	}
 }
 
+// WithUmask masks the permission bits off the mode of the
+// files and directories created through gofs, which is
+// otherwise 0666 or 0444 for files, and 0777 or 0555 for
+// directories, depending on FILE_ATTRIBUTE_READONLY, so
+// that the inner file system receives the mode as if it
+// were created by a POSIX process, e.g. 0644 with 0022.
+//
+// Only the permission bits could be masked. It is 0 by
+// default, which masks nothing.
+func WithUmask(mask os.FileMode) NewOption {
+	return func(option *newOption) error {
+		if mask&^os.ModePerm != 0 {
+			return errors.Errorf(
+				"apply WithUmask(%#o): not a permission mask", uint32(mask))
+		}
+		option.umask = mask
+		return nil
+	}
+}
+
+// WithThroughputLimiter throttles the bytes read from and
+// written to the files through gofs by the limiter, whose
+// limit is in bytes per second, e.g. to stay within the
+// quota of a metered cloud storage. The transfers larger
+// than the burst of the limiter are waited for in chunks
+// of the burst. It is nil by default, which throttles
+// nothing.
+//
+// The throttled operation waits in the dispatcher thread
+// serving it, so that a tight limit might occupy all of
+// the dispatcher threads and stall the other operations
+// of the volume. The wait is abandoned with
+// STATUS_IO_TIMEOUT when it would outlast the context of
+// FileSystemRef.OperationContext, see TransactTimeout.
+func WithThroughputLimiter(r *rate.Limiter) NewOption {
+	return func(option *newOption) error {
+		option.limiter = r
+		return nil
+	}
+}
+
+// WithRetry retries the operations of the inner file
+// system failed with the errors considered transient by
+// the policy, i.e. opening and stating the files, by name
+// or through the opened files, and reading and writing
+// them at the offsets. The appending
+// writes, and the operations modifying the namespace, e.g.
+// Mkdir, Rename and Remove, are never retried, since they
+// might have taken effect before failing. The policy
+// should only retry the errors which leave the operation
+// without effect, e.g. failing to create a file already
+// created fails with os.ErrExist on the retry.
+//
+// Each attempt is made in the dispatcher thread serving
+// the operation, which is bounded by the Deadline of the
+// policy, and by WithOperationTimeout for the opening and
+// stating by name. The operation abandoned by the timeout
+// keeps being retried in the background until the
+// Deadline, as its goroutine cannot be cancelled. It is
+// disabled by default.
+func WithRetry(policy RetryPolicy) NewOption {
+	return func(option *newOption) error {
+		if policy.Retry == nil {
+			return errors.New("apply WithRetry: no retry function")
+		}
+		if policy.Deadline <= 0 {
+			return errors.Errorf(
+				"apply WithRetry: non-positive deadline %s", policy.Deadline)
+		}
+		option.retry = policy
+		return nil
+	}
+}
+
+// WithExecAttribute makes the regular files whose mode
+// has any of the executable bits set report the
+// FILE_ATTRIBUTE_NOT_CONTENT_INDEXED, so that the
+// executables and scripts of the POSIX file systems could
+// be told apart on Windows.
+//
+// The attribute leaves the files handled as usual by the
+// applications, but it also keeps them out of the search
+// index, so their contents could no longer be found by
+// Windows Search. It is disabled by default.
+func WithExecAttribute(v bool) NewOption {
+	return func(option *newOption) error {
+		option.execAttribute = v
+		return nil
+	}
+}
+
 func WithProvideFileID(v bool) NewOption {
 	return func(option *newOption) error {
 		option.providesFileID = v
@@ -1373,6 +2550,189 @@ func WithProvideFileID(v bool) NewOption {
 	}
 }
 
+// WithBackupIntent makes gofs honor the reading opens
+// requested with FILE_OPEN_FOR_BACKUP_INTENT when allow
+// returns true, retrying them through the inner
+// FileSystemOpenBackup after a permission error, so
+// that backup software could read files and enumerate
+// directories it is otherwise not permitted to.
+//
+// This effectively bypasses the permission checks of the
+// inner file system, so allow must only return true for
+// the trusted callers, e.g. HasBackupPrivilege checks
+// whether the caller holds SeBackupPrivilege. By default
+// the backup intent is ignored.
+func WithBackupIntent(allow func(*winfsp.FileSystemRef) bool) NewOption {
+	return func(option *newOption) error {
+		option.backupIntent = allow
+		return nil
+	}
+}
+
+// WithFileInfoCacheTTL makes gofs cache the file info
+// returned by GetFileInfo on each handle for the specified
+// duration, which saves the stats of the inner file system
+// since WinFSP queries the file info very frequently, e.g.
+// when copying files. It is disabled by default.
+//
+// The cache is invalidated by the modifications made
+// through the same handle, while the modifications made
+// through other handles or outside of the file system
+// might take up to the duration to be reflected, so the
+// duration should be kept as short as a few milliseconds.
+func WithFileInfoCacheTTL(d time.Duration) NewOption {
+	return func(option *newOption) error {
+		option.fileInfoCacheTTL = d
+		return nil
+	}
+}
+
+// WithReaddirPlus makes gofs keep the file info computed
+// for each entry while enumerating a directory for the
+// specified duration, so that the entries queried right
+// after the enumeration by GetDirInfoByName, e.g. by the
+// applications calling FindFirstFile with an exact name,
+// are served without stating the inner file system. It
+// is disabled by default.
+//
+// The default options reported to WinFSP also enable the
+// FspFSAttributePassQueryDirectoryFileName attribute then,
+// so that these queries reach GetDirInfoByName. Like the
+// WithFileInfoCacheTTL, the modifications made outside of
+// the directory handle might take up to the duration to
+// be reflected.
+func WithReaddirPlus(d time.Duration) NewOption {
+	return func(option *newOption) error {
+		if d < 0 {
+			return errors.Errorf(
+				"apply WithReaddirPlus(%s): negative duration", d)
+		}
+		option.readdirPlusTTL = d
+		return nil
+	}
+}
+
+// WithOperationTimeout bounds the duration of each call
+// to the methods of the inner FileSystem, which are run in
+// a separate goroutine and fail with STATUS_IO_TIMEOUT if
+// they do not complete in time, so that a hung backend,
+// e.g. an unreachable network share, does not block the
+// dispatcher threads of WinFSP forever. The methods of the
+// opened File are not bounded. It is disabled by default.
+//
+// Go is unable to cancel the timed out call, so its
+// goroutine keeps running and holding whatever resources
+// it has acquired until the inner file system returns,
+// and the file opened by then will be closed and discarded.
+// A backend that never returns leaks a goroutine for every
+// timed out call. The timed out Mkdir, Rename and Remove
+// might also take effect after the failure is reported.
+func WithOperationTimeout(d time.Duration) NewOption {
+	return func(option *newOption) error {
+		if d < 0 {
+			return errors.Errorf(
+				"apply WithOperationTimeout(%s): negative timeout", d)
+		}
+		option.operationTimeout = d
+		return nil
+	}
+}
+
+// WithDefaultSecurityDescriptor specifies the security
+// descriptor reported for every file, e.g. to have them
+// owned by a fixed user or to grant a fixed DACL, without
+// implementing the security of each file. By default, the
+// security descriptor of the current process is reported,
+// making every file owned by the running user.
+//
+// The descriptor is cloned into a self relative one when
+// the option is applied, so the caller retains the
+// ownership of sd and may free or modify it afterwards.
+func WithDefaultSecurityDescriptor(sd *windows.SECURITY_DESCRIPTOR) NewOption {
+	return func(option *newOption) error {
+		if sd == nil || !sd.IsValid() {
+			return errors.New(
+				"apply WithDefaultSecurityDescriptor: invalid security descriptor")
+		}
+		clone, err := sd.ToSelfRelative()
+		if err != nil {
+			return errors.Wrap(err, "apply WithDefaultSecurityDescriptor")
+		}
+		option.securityDescriptor = clone
+		return nil
+	}
+}
+
+// WithClock specifies the source of the current time,
+// which ages the caches of gofs, e.g. WithFileInfoCacheTTL,
+// so that the tests could freeze or advance the time
+// deterministically. A nil clock restores time.Now, which
+// is the default.
+func WithClock(clock func() time.Time) NewOption {
+	return func(option *newOption) error {
+		option.clock = clock
+		return nil
+	}
+}
+
+// WithShortNames makes gofs resolve the 8.3 short names
+// generated by ShortNames back to the long names on open,
+// e.g. `\PROGRA~1\FOO~1.TXT` opens `\Program Files\foo
+// bar.text`, for the legacy applications which only deal
+// with short names. The components containing a tilde
+// which do not exist by themselves are looked up by
+// enumerating their parent directories.
+//
+// WinFSP never queries the short names, so they are not
+// reported in the directory enumeration, nor returned by
+// GetShortPathName, which leaves the long names intact.
+func WithShortNames(v bool) NewOption {
+	return func(option *newOption) error {
+		option.shortNames = v
+		return nil
+	}
+}
+
+// WithNameEncoder makes gofs translate the names between
+// the inner file system and WinFSP, for the inner file
+// systems whose names may contain the characters invalid
+// on Windows, e.g. the keys of an object storage.
+//
+// The encode function converts a single component of the
+// names of the inner file system, e.g. in the directory
+// enumeration, into the name seen through WinFSP, while
+// decode converts every component of the paths passed to
+// the inner file system back, which must reverse encode.
+// PercentEncodeName and PercentDecodeName are provided
+// for the common case.
+//
+// Every inner name is reachable by the single name that
+// encode produces, while the other names decoded into it,
+// e.g. `%41` for `A` with the percent encoding, fail with
+// STATUS_OBJECT_NAME_INVALID.
+//
+// Either function being nil disables the translation.
+func WithNameEncoder(encode, decode func(string) string) NewOption {
+	return func(option *newOption) error {
+		if encode == nil || decode == nil {
+			encode, decode = nil, nil
+		}
+		option.nameEncode = encode
+		option.nameDecode = decode
+		return nil
+	}
+}
+
+// HasBackupPrivilege tells whether the caller of the
+// create operation being handled holds the backup
+// privilege, which is intended to be used with
+// WithBackupIntent.
+func HasBackupPrivilege(*winfsp.FileSystemRef) bool {
+	request := winfsp.FileSystemOperationCreateRequest()
+	return request != nil &&
+		request.Flags&winfsp.FspFsctlCreateHasBackupPrivilege != 0
+}
+
 func WithDefaultWinfspOptions(opts ...winfsp.Option) NewOption {
 	return func(option *newOption) error {
 		option.defaultWinfspOptions = append(option.defaultWinfspOptions, opts...)
@@ -1386,6 +2746,14 @@ func (fs *fileSystem) DefaultOptions() []winfsp.Option {
 		result = append(result, winfsp.CaseSensitive(true))
 	}
 	result = append(result, winfsp.CasePreserveNames(true))
+	if fs.posixSemantics {
+		result = append(result, winfsp.PosixUnlinkRename(true))
+	}
+	result = append(result, winfsp.BatchDirectoryFills(true))
+	if fs.readdirPlusTTL > 0 {
+		result = append(result, winfsp.Attributes(
+			winfsp.FspFSAttributePassQueryDirectoryFileName))
+	}
 	result = append(result, fs.defaultWinfspOptions...)
 	return result
 }
@@ -1431,14 +2799,163 @@ func NewOptions(
 	if err := WithOptions(opts...)(&option); err != nil {
 		return nil, err
 	}
-	return &fileSystem{
+	watcher := newDirWatcher(fs, option.nameEncode, option.nameDecode)
+	clock := option.clock
+	if clock == nil {
+		clock = time.Now
+	}
+	var syncVolume func() error
+	if inner, ok := fs.(FileSystemSyncVolume); ok {
+		syncVolume = inner.SyncVolume
+		if timeout := option.operationTimeout; timeout > 0 {
+			syncVolume = func() error {
+				_, err := withTimeout(timeout, func() (struct{}, error) {
+					return struct{}{}, inner.SyncVolume()
+				}, nil)
+				return err
+			}
+		}
+	}
+	var openRename bool
+	if inner, ok := fs.(FileSystemOpenRename); ok {
+		openRename = inner.SupportsOpenRename()
+	}
+	var onOpen func(string, uint64)
+	var onClose func(uint64)
+	if inner, ok := fs.(FileSystemHandleHooks); ok {
+		decode := option.nameDecode
+		onOpen = func(name string, handle uint64) {
+			inner.OnOpen(mapPathComponents(name, decode), handle)
+		}
+		onClose = inner.OnClose
+	}
+	var readlink func(string) (string, error)
+	if inner, ok := fs.(FileSystemReadlink); ok {
+		encode, decode := option.nameEncode, option.nameDecode
+		timeout := option.operationTimeout
+		readlink = func(name string) (string, error) {
+			name, err := decodePath(name, encode, decode)
+			if err != nil {
+				return "", err
+			}
+			if timeout <= 0 {
+				return inner.Readlink(name)
+			}
+			return withTimeout(timeout, func() (string, error) {
+				return inner.Readlink(name)
+			}, nil)
+		}
+	}
+	var getEa func(string) ([]winfsp.EaEntry, error)
+	var setEa func(string, []winfsp.EaEntry) error
+	if inner, ok := fs.(FileSystemEa); ok {
+		encode, decode := option.nameEncode, option.nameDecode
+		timeout := option.operationTimeout
+		getEa = func(name string) ([]winfsp.EaEntry, error) {
+			name, err := decodePath(name, encode, decode)
+			if err != nil {
+				return nil, err
+			}
+			if timeout <= 0 {
+				return inner.GetEa(name)
+			}
+			return withTimeout(timeout, func() ([]winfsp.EaEntry, error) {
+				return inner.GetEa(name)
+			}, nil)
+		}
+		setEa = func(name string, ea []winfsp.EaEntry) error {
+			name, err := decodePath(name, encode, decode)
+			if err != nil {
+				return err
+			}
+			if timeout <= 0 {
+				return inner.SetEa(name, ea)
+			}
+			_, err = withTimeout(timeout, func() (struct{}, error) {
+				return struct{}{}, inner.SetEa(name, ea)
+			}, nil)
+			return err
+		}
+	}
+	var copyFileRange func(string, int64, string, int64, int64) (int64, error)
+	if inner, ok := fs.(FileSystemCopyFileRange); ok && option.copyFileRange {
+		decode, timeout := option.nameDecode, option.operationTimeout
+		copyFileRange = func(
+			source string, sourceOffset int64,
+			target string, targetOffset int64, length int64,
+		) (int64, error) {
+			source = mapPathComponents(source, decode)
+			target = mapPathComponents(target, decode)
+			if timeout <= 0 {
+				return inner.CopyFileRange(
+					source, sourceOffset, target, targetOffset, length)
+			}
+			return withTimeout(timeout, func() (int64, error) {
+				return inner.CopyFileRange(
+					source, sourceOffset, target, targetOffset, length)
+			}, nil)
+		}
+	}
+	readOnlyPaths := option.readOnlyPaths
+	if option.caseInsensitive {
+		readOnlyPaths = make([]string, len(option.readOnlyPaths))
+		for i, pattern := range option.readOnlyPaths {
+			readOnlyPaths[i] = strings.ToUpper(pattern)
+		}
+	}
+	if option.nameDecode != nil {
+		fs = newNameFileSystem(fs, option.nameEncode, option.nameDecode)
+	}
+	if option.retry.Retry != nil {
+		fs = newRetryFileSystem(fs, option.retry)
+	}
+	if option.operationTimeout > 0 {
+		fs = newTimeoutFileSystem(fs, option.operationTimeout)
+	}
+	result := &fileSystem{
 		inner:                fs,
 		locker:               treelock.New(),
+		watcher:              watcher,
 		readOnlyTransMode:    option.attribReadOnlyTransMode,
 		caseInsensitive:      option.caseInsensitive,
+		posixSemantics:       option.posixSemantics,
 		providesFileID:       option.providesFileID,
+		backupIntent:         option.backupIntent,
+		fileInfoCacheTTL:     option.fileInfoCacheTTL,
+		readdirPlusTTL:       option.readdirPlusTTL,
+		securityDescriptor:   option.securityDescriptor,
+		clock:                clock,
+		shortNames:           option.shortNames,
+		readOnlyPaths:        readOnlyPaths,
+		compression:          option.compression,
+		allocatedRanges:      option.allocatedRanges,
+		execAttribute:        option.execAttribute,
+		umask:                option.umask,
+		limiter:              option.limiter,
+		retry:                option.retry,
+		nameEncode:           option.nameEncode,
+		syncVolume:           syncVolume,
+		openRename:           openRename,
+		onOpen:               onOpen,
+		onClose:              onClose,
+		readlink:             readlink,
+		getEa:                getEa,
+		setEa:                setEa,
+		copyFileRange:        copyFileRange,
 		defaultWinfspOptions: option.defaultWinfspOptions,
-	}, nil
+	}
+	control := copyFileRange != nil || option.compression ||
+		option.allocatedRanges || readlink != nil
+	switch {
+	case control && getEa != nil:
+		return controlEaFileSystem{
+			controlFileSystem{result}, eaBehaviours{result}}, nil
+	case control:
+		return controlFileSystem{result}, nil
+	case getEa != nil:
+		return eaFileSystem{result, eaBehaviours{result}}, nil
+	}
+	return result, nil
 }
 
 // New create the file system with the
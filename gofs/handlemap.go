@@ -0,0 +1,75 @@
+package gofs
+
+import (
+	"sync"
+)
+
+// handleShards is the number of shards in handleMap,
+// which must be a power of two.
+const handleShards = 64
+
+type handleShard[T any] struct {
+	mtx     sync.RWMutex
+	handles map[uintptr]T
+}
+
+// handleMap maps the handle addresses to the handles.
+//
+// Under heavy open and close churn, a sync.Map keeps
+// promoting and copying its dirty map, so we shard the
+// handles by their addresses into mutex guarded maps
+// instead, where operations on different handles
+// seldom contend.
+//
+// The zero value is an empty map ready to use.
+type handleMap[T any] struct {
+	shards [handleShards]handleShard[T]
+}
+
+func (m *handleMap[T]) shard(key uintptr) *handleShard[T] {
+	// Heap objects are at least 8 bytes aligned and
+	// the small ones are packed by size classes, so
+	// we skip the always zero bits and fold in the
+	// higher bits to spread across the shards.
+	index := (key >> 4) ^ (key >> 10)
+	return &m.shards[index&(handleShards-1)]
+}
+
+// LoadOrStore stores the handle if the key is absent,
+// returning whether the key has been present.
+func (m *handleMap[T]) LoadOrStore(key uintptr, value T) bool {
+	shard := m.shard(key)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	if _, ok := shard.handles[key]; ok {
+		return true
+	}
+	if shard.handles == nil {
+		shard.handles = make(map[uintptr]T)
+	}
+	shard.handles[key] = value
+	return false
+}
+
+func (m *handleMap[T]) Load(key uintptr) (T, bool) {
+	shard := m.shard(key)
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	value, ok := shard.handles[key]
+	return value, ok
+}
+
+func (m *handleMap[T]) LoadAndDelete(key uintptr) (T, bool) {
+	shard := m.shard(key)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	value, ok := shard.handles[key]
+	if ok {
+		delete(shard.handles, key)
+	}
+	return value, ok
+}
+
+func (m *handleMap[T]) Delete(key uintptr) {
+	_, _ = m.LoadAndDelete(key)
+}
@@ -0,0 +1,91 @@
+package gofs
+
+import (
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+type testHandle struct {
+	id int
+}
+
+func TestHandleMapConcurrent(t *testing.T) {
+	var m handleMap[*testHandle]
+	const workers, rounds = 16, 1000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				handle := &testHandle{id: w*rounds + i}
+				key := uintptr(unsafe.Pointer(handle))
+				if m.LoadOrStore(key, handle) {
+					t.Errorf("handle %d already present", handle.id)
+					return
+				}
+				if !m.LoadOrStore(key, &testHandle{}) {
+					t.Errorf("handle %d stored twice", handle.id)
+					return
+				}
+				loaded, ok := m.Load(key)
+				if !ok || loaded != handle {
+					t.Errorf("handle %d not loaded", handle.id)
+					return
+				}
+				deleted, ok := m.LoadAndDelete(key)
+				if !ok || deleted != handle {
+					t.Errorf("handle %d not deleted", handle.id)
+					return
+				}
+				if _, ok := m.Load(key); ok {
+					t.Errorf("handle %d loaded after delete", handle.id)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for i := range m.shards {
+		if n := len(m.shards[i].handles); n != 0 {
+			t.Errorf("shard %d has %d leaked handles", i, n)
+		}
+	}
+}
+
+// benchmarkOpenClose simulates the open and close churn
+// on the handle table, each open is followed by a few
+// lookups made by the file operations.
+func benchmarkOpenClose(b *testing.B, store func(uintptr, *testHandle),
+	load func(uintptr), remove func(uintptr)) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			handle := &testHandle{}
+			key := uintptr(unsafe.Pointer(handle))
+			store(key, handle)
+			for i := 0; i < 4; i++ {
+				load(key)
+			}
+			remove(key)
+		}
+	})
+}
+
+func BenchmarkOpenCloseSyncMap(b *testing.B) {
+	var m sync.Map
+	benchmarkOpenClose(b,
+		func(key uintptr, h *testHandle) { m.LoadOrStore(key, h) },
+		func(key uintptr) { m.Load(key) },
+		func(key uintptr) { m.LoadAndDelete(key) },
+	)
+}
+
+func BenchmarkOpenCloseHandleMap(b *testing.B) {
+	var m handleMap[*testHandle]
+	benchmarkOpenClose(b,
+		func(key uintptr, h *testHandle) { m.LoadOrStore(key, h) },
+		func(key uintptr) { m.Load(key) },
+		func(key uintptr) { m.LoadAndDelete(key) },
+	)
+}
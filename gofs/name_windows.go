@@ -0,0 +1,217 @@
+package gofs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// nameInvalidChars are the characters which are valid in
+// the names of other systems but not in Windows names,
+// besides the control characters.
+const nameInvalidChars = `"*/:<>?\|`
+
+// PercentEncodeName encodes the characters of the name
+// which are invalid in Windows names, i.e. the control
+// characters and `"*/:<>?\|`, together with the percent
+// sign itself, into the `%XX` form, e.g. `a:b` into
+// `a%3Ab`. It is meant to be used with PercentDecodeName
+// by WithNameEncoder.
+func PercentEncodeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < ' ' || c == '%' || strings.IndexByte(nameInvalidChars, c) >= 0 {
+			b.WriteByte('%')
+			b.WriteByte("0123456789ABCDEF"[c>>4])
+			b.WriteByte("0123456789ABCDEF"[c&15])
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// PercentDecodeName reverses PercentEncodeName, and the
+// percent signs not followed by two hexadecimal digits
+// are kept as is. The names which PercentEncodeName never
+// produces, e.g. `%41` or `100%`, are decoded all the
+// same, but are rejected by WithNameEncoder.
+func PercentDecodeName(name string) string {
+	if strings.IndexByte(name, '%') < 0 {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) {
+			hi, ok1 := unhex(name[i+1])
+			lo, ok2 := unhex(name[i+2])
+			if ok1 && ok2 {
+				b.WriteByte(hi<<4 | lo)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// mapPathComponents applies fn to every component of the
+// unified path, e.g. `\dir\file`.
+func mapPathComponents(name string, fn func(string) string) string {
+	if fn == nil {
+		return name
+	}
+	components := strings.Split(name, string(filepath.Separator))
+	for i, component := range components {
+		if component != "" {
+			components[i] = fn(component)
+		}
+	}
+	return strings.Join(components, string(filepath.Separator))
+}
+
+// decodePath applies decode to every component of the
+// unified path, failing with STATUS_OBJECT_NAME_INVALID
+// if any component is not the one that encode produces,
+// e.g. `%41` for `A`. Otherwise the inner file would be
+// reachable by several names, which are distinct paths
+// to the tree locks, defeating the exclusion of them.
+func decodePath(
+	name string, encode, decode func(string) string,
+) (string, error) {
+	if decode == nil {
+		return name, nil
+	}
+	components := strings.Split(name, string(filepath.Separator))
+	for i, component := range components {
+		if component == "" {
+			continue
+		}
+		decoded := decode(component)
+		if encode(decoded) != component {
+			return "", windows.STATUS_OBJECT_NAME_INVALID
+		}
+		components[i] = decoded
+	}
+	return strings.Join(components, string(filepath.Separator)), nil
+}
+
+// encodeName converts the name of the inner file system
+// into the name seen through WinFSP, see WithNameEncoder.
+func (fs *fileSystem) encodeName(name string) string {
+	if fs.nameEncode == nil {
+		return name
+	}
+	return fs.nameEncode(name)
+}
+
+// nameFileSystem decodes the paths passed to the inner
+// file system, see WithNameEncoder.
+type nameFileSystem struct {
+	inner  FileSystem
+	encode func(string) string
+	decode func(string) string
+}
+
+func (fs *nameFileSystem) path(name string) (string, error) {
+	return decodePath(name, fs.encode, fs.decode)
+}
+
+func (fs *nameFileSystem) OpenFile(
+	name string, flag int, perm os.FileMode,
+) (File, error) {
+	name, err := fs.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.inner.OpenFile(name, flag, perm)
+}
+
+func (fs *nameFileSystem) Mkdir(name string, perm os.FileMode) error {
+	name, err := fs.path(name)
+	if err != nil {
+		return err
+	}
+	return fs.inner.Mkdir(name, perm)
+}
+
+func (fs *nameFileSystem) Stat(name string) (os.FileInfo, error) {
+	name, err := fs.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.inner.Stat(name)
+}
+
+func (fs *nameFileSystem) Rename(source, target string) error {
+	source, err := fs.path(source)
+	if err != nil {
+		return err
+	}
+	target, err = fs.path(target)
+	if err != nil {
+		return err
+	}
+	return fs.inner.Rename(source, target)
+}
+
+func (fs *nameFileSystem) Remove(name string) error {
+	name, err := fs.path(name)
+	if err != nil {
+		return err
+	}
+	return fs.inner.Remove(name)
+}
+
+var _ FileSystem = (*nameFileSystem)(nil)
+
+// nameFileSystemBackup is the nameFileSystem whose inner
+// file system implements FileSystemOpenBackup.
+type nameFileSystemBackup struct {
+	*nameFileSystem
+}
+
+func (fs nameFileSystemBackup) OpenFileBackup(
+	name string, flag int,
+) (File, error) {
+	inner := fs.inner.(FileSystemOpenBackup)
+	name, err := fs.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return inner.OpenFileBackup(name, flag)
+}
+
+var _ FileSystemOpenBackup = nameFileSystemBackup{}
+
+// newNameFileSystem wraps fs with the decoder, while
+// preserving the optional interfaces it implements.
+func newNameFileSystem(
+	fs FileSystem, encode, decode func(string) string,
+) FileSystem {
+	result := &nameFileSystem{
+		inner:  fs,
+		encode: encode,
+		decode: decode,
+	}
+	if _, ok := fs.(FileSystemOpenBackup); ok {
+		return nameFileSystemBackup{result}
+	}
+	return result
+}
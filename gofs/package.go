@@ -18,6 +18,31 @@
 // opening file with ignored cases, while preserving
 // the cases when the file was created.
 //
+// Byte-range locks requested by `LockFileEx` are granted
+// and enforced by the WinFSP driver in kernel, and there's
+// no user mode dispatch for them, so they never reach
+// gofs or the underlying file system. The implementor
+// need not and cannot take part in locking.
+//
+// Likewise, the share modes requested by `FILE_SHARE_*`
+// are checked by the WinFSP driver against the other open
+// handles of the file, failing the conflicting opens with
+// `STATUS_SHARING_VIOLATION` before they are dispatched,
+// so gofs does not track them again.
+//
+// Files opened with `FILE_FLAG_NO_BUFFERING` are read and
+// written in sectors, as specified by `winfsp.SectorSize`,
+// and the transfers whose offset or length is not aligned
+// to the sector size fail with `STATUS_INVALID_PARAMETER`,
+// just like on NTFS, rather than being buffered by gofs.
+//
+// The slices passed to `ReadAt` and `WriteAt` of the files
+// alias the buffers of WinFSP without being copied by gofs,
+// so they are only valid during the call, as required by
+// `io.ReaderAt` and `io.WriterAt`. The implementor must
+// copy the data it keeps past the call, which could be
+// checked by mounting with `winfsp.PoisonWriteBuffers`.
+//
 // This makes it works even if the underlying file system
 // is backed by a Window's native directory through the
 // language interfaces by Golang.
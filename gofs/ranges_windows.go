@@ -0,0 +1,100 @@
+package gofs
+
+import (
+	"encoding/binary"
+	"math"
+
+	"golang.org/x/sys/windows"
+)
+
+// Range is a range of bytes of a file, which starts at
+// Offset and spans Length bytes.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// FileAllocatedRanges is the interface for sparse files
+// which could tell the ranges of their content actually
+// stored, e.g. the ones that have been written, while the
+// rest of the file is a hole reading as zeros.
+//
+// Without this interface, the whole file is reported as
+// allocated, as NTFS does for the files not sparse.
+type FileAllocatedRanges interface {
+	File
+
+	// AllocatedRanges returns the allocated ranges of the
+	// file, which are sorted by their offsets and do not
+	// overlap with each other.
+	AllocatedRanges() ([]Range, error)
+}
+
+// WithAllocatedRanges makes gofs serve
+// FSCTL_QUERY_ALLOCATED_RANGES, e.g. issued by
+// `fsutil sparse queryrange` or the sparse-aware copying
+// tools, with the ranges reported by FileAllocatedRanges.
+//
+// It marks the volume as processing control codes, which
+// are only served when WinFSP forwards them to the file
+// system. It is disabled by default.
+func WithAllocatedRanges(v bool) NewOption {
+	return func(option *newOption) error {
+		option.allocatedRanges = v
+		return nil
+	}
+}
+
+// allocatedRangeSize is the size of the input and of each
+// entry of the output of FSCTL_QUERY_ALLOCATED_RANGES,
+// which are FILE_ALLOCATED_RANGE_BUFFER.
+const allocatedRangeSize = 16
+
+// queryAllocatedRanges serves FSCTL_QUERY_ALLOCATED_RANGES,
+// reporting the allocated ranges within the queried range.
+func (fs *fileSystem) queryAllocatedRanges(
+	file uintptr, data []byte,
+) ([]byte, error) {
+	if len(data) < allocatedRangeSize {
+		return nil, windows.STATUS_INVALID_PARAMETER
+	}
+	offset := int64(binary.LittleEndian.Uint64(data[0:]))
+	length := int64(binary.LittleEndian.Uint64(data[8:]))
+	if offset < 0 || length < 0 {
+		return nil, windows.STATUS_INVALID_PARAMETER
+	}
+	end := offset + min(length, math.MaxInt64-offset)
+	handle, err := fs.load(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.lockChecked(); err != nil {
+		return nil, err
+	}
+	defer handle.unlockChecked()
+	fileInfo, err := fs.statFile(handle.file)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		return nil, windows.STATUS_INVALID_PARAMETER
+	}
+	end = min(end, fileInfo.Size())
+	ranges := []Range{{Offset: 0, Length: fileInfo.Size()}}
+	if allocated, ok := handle.file.(FileAllocatedRanges); ok {
+		if ranges, err = allocated.AllocatedRanges(); err != nil {
+			return nil, err
+		}
+	}
+	var result []byte
+	for _, r := range ranges {
+		start := max(r.Offset, offset)
+		stop := min(r.Offset+r.Length, end)
+		if start >= stop {
+			continue
+		}
+		result = binary.LittleEndian.AppendUint64(result, uint64(start))
+		result = binary.LittleEndian.AppendUint64(result, uint64(stop-start))
+	}
+	return result, nil
+}
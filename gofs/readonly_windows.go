@@ -0,0 +1,73 @@
+package gofs
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// WithReadOnlyPaths makes the files matching any of the
+// patterns, and all files under the directories matching
+// them, read only, while the rest of the volume remains
+// writable. Creating, writing, overwriting, deleting and
+// renaming these files fail with
+// STATUS_MEDIA_WRITE_PROTECTED, just like on a read only
+// volume, while they can still be opened for reading.
+//
+// The patterns are matched by path.Match against the
+// cleaned paths with slashes, e.g. "/docs" or "/*/cache",
+// and are compared case insensitively under
+// WithCaseInsensitive. The option may be specified more
+// than once to add more patterns.
+//
+// The backslashes in the patterns are taken as path
+// separators like in the Windows paths, so they cannot
+// escape the special characters of path.Match. Such a
+// character is matched literally by a character class
+// instead, e.g. "/[*]" for the file named "*".
+func WithReadOnlyPaths(patterns []string) NewOption {
+	return func(option *newOption) error {
+		for _, pattern := range patterns {
+			pattern = path.Clean("/" + strings.ReplaceAll(pattern, `\`, "/"))
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err,
+					"apply WithReadOnlyPaths(%q)", pattern)
+			}
+			option.readOnlyPaths = append(option.readOnlyPaths, pattern)
+		}
+		return nil
+	}
+}
+
+// isReadOnlyPath tells whether the file or any of its
+// ancestors matches the patterns of WithReadOnlyPaths.
+func (fs *fileSystem) isReadOnlyPath(name string) bool {
+	if len(fs.readOnlyPaths) == 0 {
+		return false
+	}
+	name = path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))
+	if fs.caseInsensitive {
+		name = strings.ToUpper(name)
+	}
+	for ; ; name = path.Dir(name) {
+		for _, pattern := range fs.readOnlyPaths {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		if name == "/" {
+			return false
+		}
+	}
+}
+
+// checkWritablePath fails the modification of the file
+// made read only by WithReadOnlyPaths.
+func (fs *fileSystem) checkWritablePath(name string) error {
+	if fs.isReadOnlyPath(name) {
+		return windows.STATUS_MEDIA_WRITE_PROTECTED
+	}
+	return nil
+}
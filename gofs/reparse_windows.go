@@ -0,0 +1,44 @@
+package gofs
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+// getReparsePoint serves FSCTL_GET_REPARSE_POINT on the
+// files resolved as symbolic links by Readlink, see
+// FileSystemReadlink.
+func (fs *fileSystem) getReparsePoint(file uintptr) ([]byte, error) {
+	handle, err := fs.load(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.lockChecked(); err != nil {
+		return nil, err
+	}
+	defer handle.unlockChecked()
+	plock := handle.node.RLockPath()
+	defer plock.Unlock()
+	if plock.IsExile() {
+		return nil, os.ErrNotExist
+	}
+	target, err := fs.readlink(plock.FilePath())
+	if err != nil {
+		return nil, windows.STATUS_NOT_A_REPARSE_POINT
+	}
+	target = filepath.FromSlash(target)
+	if filepath.VolumeName(target) != "" {
+		return winfsp.BuildSymlinkReparse(target, false)
+	}
+	target = mapPathComponents(target, func(name string) string {
+		if name == "." || name == ".." {
+			return name
+		}
+		return fs.encodeName(name)
+	})
+	return winfsp.BuildSymlinkReparse(target, true)
+}
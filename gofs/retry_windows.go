@@ -0,0 +1,130 @@
+package gofs
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// RetryPolicy is the policy of retrying the operations
+// failed with the transient errors of the backend, e.g.
+// ECONNRESET or HTTP 503 of a network file system, rather
+// than failing the request of the application.
+type RetryPolicy struct {
+	// Retry decides whether the operation failed with err
+	// for the attempt-th time, counted from 1, is retried,
+	// and how long to back off before the retry.
+	Retry func(err error, attempt int) (backoff time.Duration, retry bool)
+
+	// Deadline bounds the duration of an operation with
+	// its retries, after which it is not retried anymore
+	// and fails with the last error, so that a backend
+	// failing persistently is not retried forever.
+	Deadline time.Duration
+}
+
+// withRetry runs fn until it succeeds, or until the policy
+// gives up on its error, returning the result of the last
+// attempt. The io.EOF is never retried, as it is not a
+// failure of the backend.
+//
+// The deadline is measured in the real time which the
+// backoff is slept in, rather than by WithClock, so that
+// a frozen clock does not retry the operation forever.
+func withRetry[T any](policy RetryPolicy, fn func() (T, error)) (T, error) {
+	deadline := time.Now().Add(policy.Deadline)
+	for attempt := 1; ; attempt++ {
+		value, err := fn()
+		if err == nil || err == io.EOF {
+			return value, err
+		}
+		backoff, retry := policy.Retry(err, attempt)
+		if !retry || time.Now().Add(backoff).After(deadline) {
+			return value, err
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// retryIO runs the read or write under the policy of
+// WithRetry, if any.
+func (fs *fileSystem) retryIO(fn func() (int, error)) (int, error) {
+	if fs.retry.Retry == nil {
+		return fn()
+	}
+	return withRetry(fs.retry, fn)
+}
+
+// statFile stats the opened file under the policy of
+// WithRetry, if any.
+func (fs *fileSystem) statFile(file File) (os.FileInfo, error) {
+	if fs.retry.Retry == nil {
+		return file.Stat()
+	}
+	return withRetry(fs.retry, file.Stat)
+}
+
+// retryFileSystem retries the opening and stating of the
+// inner file system, see WithRetry.
+type retryFileSystem struct {
+	inner  FileSystem
+	policy RetryPolicy
+}
+
+func (fs *retryFileSystem) OpenFile(
+	name string, flag int, perm os.FileMode,
+) (File, error) {
+	return withRetry(fs.policy, func() (File, error) {
+		return fs.inner.OpenFile(name, flag, perm)
+	})
+}
+
+func (fs *retryFileSystem) Mkdir(name string, perm os.FileMode) error {
+	return fs.inner.Mkdir(name, perm)
+}
+
+func (fs *retryFileSystem) Stat(name string) (os.FileInfo, error) {
+	return withRetry(fs.policy, func() (os.FileInfo, error) {
+		return fs.inner.Stat(name)
+	})
+}
+
+func (fs *retryFileSystem) Rename(source, target string) error {
+	return fs.inner.Rename(source, target)
+}
+
+func (fs *retryFileSystem) Remove(name string) error {
+	return fs.inner.Remove(name)
+}
+
+var _ FileSystem = (*retryFileSystem)(nil)
+
+// retryFileSystemBackup is the retryFileSystem whose
+// inner file system implements FileSystemOpenBackup.
+type retryFileSystemBackup struct {
+	*retryFileSystem
+}
+
+func (fs retryFileSystemBackup) OpenFileBackup(
+	name string, flag int,
+) (File, error) {
+	inner := fs.inner.(FileSystemOpenBackup)
+	return withRetry(fs.policy, func() (File, error) {
+		return inner.OpenFileBackup(name, flag)
+	})
+}
+
+var _ FileSystemOpenBackup = retryFileSystemBackup{}
+
+// newRetryFileSystem wraps fs with the policy, while
+// preserving the optional interfaces it implements.
+func newRetryFileSystem(fs FileSystem, policy RetryPolicy) FileSystem {
+	result := &retryFileSystem{
+		inner:  fs,
+		policy: policy,
+	}
+	if _, ok := fs.(FileSystemOpenBackup); ok {
+		return retryFileSystemBackup{result}
+	}
+	return result
+}
@@ -0,0 +1,178 @@
+package gofs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// shortNameInvalidChars are the characters which are
+// valid in long names but not in 8.3 short names, and
+// are replaced by underscores.
+const shortNameInvalidChars = "+,;=[]"
+
+// isShortName tells whether the name is a valid 8.3
+// name, which needs no generated short name.
+func isShortName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	base, ext, hasExt := strings.Cut(name, ".")
+	if base == "" || len(base) > 8 || len(ext) > 3 ||
+		(hasExt && ext == "") || strings.Contains(ext, ".") {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f ||
+			strings.ContainsRune(shortNameInvalidChars, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isGeneratedShortName tells whether the name has the
+// shape of a generated short name, e.g. "FOO~1.TXT".
+func isGeneratedShortName(name string) bool {
+	if !isShortName(name) {
+		return false
+	}
+	base, _, _ := strings.Cut(name, ".")
+	tilde := strings.LastIndexByte(base, '~')
+	if tilde < 0 || tilde == len(base)-1 {
+		return false
+	}
+	_, err := strconv.ParseUint(base[tilde+1:], 10, 32)
+	return err == nil
+}
+
+// shortNameComponent converts the component of a long
+// name into the characters allowed in short names.
+func shortNameComponent(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		switch {
+		case r == ' ' || r == '.':
+		case r < ' ' || r >= 0x7f ||
+			strings.ContainsRune(shortNameInvalidChars, r):
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ShortNames generates the 8.3 short names of the names
+// in a directory like FAT and NTFS do, e.g. "FOO~1.TXT"
+// for "foo bar.text", returning the map from the long
+// names to their short names. The names which are valid
+// 8.3 names already are not included.
+//
+// The short names are numbered in the order of the long
+// names, so that the same directory content always yields
+// the same short names.
+func ShortNames(names []string) map[string]string {
+	sorted := slices.Clone(names)
+	slices.Sort(sorted)
+	taken := make(map[string]struct{})
+	for _, name := range sorted {
+		if isShortName(name) {
+			taken[strings.ToUpper(name)] = struct{}{}
+		}
+	}
+	result := make(map[string]string)
+	for _, name := range sorted {
+		if isShortName(name) || name == "." || name == ".." {
+			continue
+		}
+		base, ext := name, ""
+		if dot := strings.LastIndexByte(name, '.'); dot > 0 {
+			base, ext = name[:dot], name[dot+1:]
+		}
+		base = shortNameComponent(base)
+		if base == "" {
+			base = "_"
+		}
+		ext = shortNameComponent(ext)
+		if len(ext) > 3 {
+			ext = ext[:3]
+		}
+		if ext != "" {
+			ext = "." + ext
+		}
+		for n := 1; ; n++ {
+			suffix := "~" + strconv.Itoa(n)
+			prefix := base
+			if len(prefix) > 8-len(suffix) {
+				prefix = prefix[:8-len(suffix)]
+			}
+			candidate := prefix + suffix + ext
+			if _, ok := taken[candidate]; !ok {
+				taken[candidate] = struct{}{}
+				result[name] = candidate
+				break
+			}
+		}
+	}
+	return result
+}
+
+// resolveShortName replaces the components of the name
+// which are generated short names that do not exist by
+// themselves with the long names they stand for, see
+// WithShortNames. The name must have been unified.
+func (fs *fileSystem) resolveShortName(name string) string {
+	if !fs.shortNames || !strings.Contains(name, "~") {
+		return name
+	}
+	components := strings.Split(name, string(filepath.Separator))
+	resolved := ""
+	for _, component := range components[1:] {
+		parent := resolved
+		if parent == "" {
+			parent = string(filepath.Separator)
+		}
+		resolved += string(filepath.Separator) + component
+		if !isGeneratedShortName(component) {
+			continue
+		}
+		if _, err := fs.inner.Stat(resolved); err == nil {
+			continue
+		}
+		if long, ok := fs.lookupShortName(parent, component); ok {
+			resolved = filepath.Join(parent, long)
+		}
+	}
+	if resolved == "" {
+		return name
+	}
+	return resolved
+}
+
+// lookupShortName finds the long name in the directory
+// whose generated short name is the specified one.
+func (fs *fileSystem) lookupShortName(dir, short string) (string, bool) {
+	f, err := fs.inner.OpenFile(dir, os.O_RDONLY, os.FileMode(0))
+	if err != nil {
+		return "", false
+	}
+	defer func() { _ = f.Close() }()
+	fileInfos, err := f.Readdir(-1)
+	if err != nil {
+		return "", false
+	}
+	names := make([]string, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		names = append(names, fs.encodeName(fileInfo.Name()))
+	}
+	short = strings.ToUpper(short)
+	for long, generated := range ShortNames(names) {
+		if generated == short {
+			return long, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,30 @@
+package gofs
+
+import (
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+// throttle waits for the limiter of WithThroughputLimiter
+// to admit n bytes of transfer, before the transfer is
+// issued to the file. The limiter is not held responsible
+// for the bytes that are not transferred in the end.
+func (fs *fileSystem) throttle(ref *winfsp.FileSystemRef, n int) error {
+	if fs.limiter == nil || n <= 0 {
+		return nil
+	}
+	ctx, cancel := ref.OperationContext()
+	defer cancel()
+	for n > 0 {
+		chunk := n
+		if burst := fs.limiter.Burst(); burst > 0 {
+			chunk = min(chunk, burst)
+		}
+		if err := fs.limiter.WaitN(ctx, chunk); err != nil {
+			return windows.STATUS_IO_TIMEOUT
+		}
+		n -= chunk
+	}
+	return nil
+}
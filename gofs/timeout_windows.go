@@ -0,0 +1,127 @@
+package gofs
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// withTimeout runs fn in a separate goroutine and waits
+// for at most timeout, returning STATUS_IO_TIMEOUT when
+// fn does not complete in time.
+//
+// The goroutine of fn cannot be cancelled, so it keeps
+// running after the timeout, and its result will be
+// passed to discard once it completes, which must
+// release the resources held by the result.
+func withTimeout[T any](
+	timeout time.Duration, fn func() (T, error), discard func(T),
+) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	// The channel is unbuffered so that the result is
+	// either taken by the caller or discarded, never both.
+	ch := make(chan result)
+	abandon := make(chan struct{})
+	go func() {
+		value, err := fn()
+		select {
+		case ch <- result{value: value, err: err}:
+		case <-abandon:
+			if err == nil && discard != nil {
+				discard(value)
+			}
+		}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.value, r.err
+	case <-timer.C:
+		close(abandon)
+		var zero T
+		return zero, windows.STATUS_IO_TIMEOUT
+	}
+}
+
+// timeoutFileSystem bounds the duration of each call to
+// the inner file system, see WithOperationTimeout.
+type timeoutFileSystem struct {
+	inner   FileSystem
+	timeout time.Duration
+}
+
+func closeFile(f File) {
+	_ = f.Close()
+}
+
+func (fs *timeoutFileSystem) OpenFile(
+	name string, flag int, perm os.FileMode,
+) (File, error) {
+	return withTimeout(fs.timeout, func() (File, error) {
+		return fs.inner.OpenFile(name, flag, perm)
+	}, closeFile)
+}
+
+func (fs *timeoutFileSystem) Mkdir(name string, perm os.FileMode) error {
+	_, err := withTimeout(fs.timeout, func() (struct{}, error) {
+		return struct{}{}, fs.inner.Mkdir(name, perm)
+	}, nil)
+	return err
+}
+
+func (fs *timeoutFileSystem) Stat(name string) (os.FileInfo, error) {
+	return withTimeout(fs.timeout, func() (os.FileInfo, error) {
+		return fs.inner.Stat(name)
+	}, nil)
+}
+
+func (fs *timeoutFileSystem) Rename(source, target string) error {
+	_, err := withTimeout(fs.timeout, func() (struct{}, error) {
+		return struct{}{}, fs.inner.Rename(source, target)
+	}, nil)
+	return err
+}
+
+func (fs *timeoutFileSystem) Remove(name string) error {
+	_, err := withTimeout(fs.timeout, func() (struct{}, error) {
+		return struct{}{}, fs.inner.Remove(name)
+	}, nil)
+	return err
+}
+
+var _ FileSystem = (*timeoutFileSystem)(nil)
+
+// timeoutFileSystemBackup is the timeoutFileSystem whose
+// inner file system implements FileSystemOpenBackup.
+type timeoutFileSystemBackup struct {
+	*timeoutFileSystem
+}
+
+func (fs timeoutFileSystemBackup) OpenFileBackup(
+	name string, flag int,
+) (File, error) {
+	inner := fs.inner.(FileSystemOpenBackup)
+	return withTimeout(fs.timeout, func() (File, error) {
+		return inner.OpenFileBackup(name, flag)
+	}, closeFile)
+}
+
+var _ FileSystemOpenBackup = timeoutFileSystemBackup{}
+
+// newTimeoutFileSystem wraps fs with the timeout, while
+// preserving the optional interfaces it implements.
+func newTimeoutFileSystem(fs FileSystem, timeout time.Duration) FileSystem {
+	result := &timeoutFileSystem{
+		inner:   fs,
+		timeout: timeout,
+	}
+	if _, ok := fs.(FileSystemOpenBackup); ok {
+		return timeoutFileSystemBackup{result}
+	}
+	return result
+}
@@ -0,0 +1,161 @@
+package gofs
+
+import (
+	"sync"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+// ChangeEvent is a change made to a file in the inner
+// file system bypassing gofs, see FileSystemWatch.
+type ChangeEvent struct {
+	// Name is the path of the changed file in the inner
+	// file system, e.g. `\dir\file`.
+	Name string
+
+	// Action is the FILE_ACTION_* of the change, e.g.
+	// FILE_ACTION_ADDED for a newly created file.
+	Action uint32
+}
+
+// FileSystemWatch allows the implementors of FileSystem
+// to report the changes made to a directory outside of
+// gofs, e.g. by other processes on the backing storage,
+// so that the applications watching the directory on the
+// volume are notified through FileSystemRef.Notify.
+//
+// Watch is called when a directory is opened and not yet
+// watched, and the returned function is called to stop
+// watching once the last handle to the directory is
+// closed, after which the events channel is no longer
+// received from. The stop function must not block on
+// the events channel, and errors returned by Watch are
+// ignored, leaving the directory unwatched.
+//
+// The volumes sharing the file system, see
+// winfsp.MountMany, watch the same directory separately,
+// each notified of the events of its own watch only.
+type FileSystemWatch interface {
+	FileSystem
+
+	Watch(name string) (<-chan ChangeEvent, func(), error)
+}
+
+// notifyFilter maps the action of a change into the
+// FILE_NOTIFY_CHANGE_* flags it matches.
+func notifyFilter(action uint32) uint32 {
+	switch action {
+	case windows.FILE_ACTION_MODIFIED:
+		return windows.FILE_NOTIFY_CHANGE_LAST_WRITE |
+			windows.FILE_NOTIFY_CHANGE_SIZE
+	default:
+		return windows.FILE_NOTIFY_CHANGE_FILE_NAME |
+			windows.FILE_NOTIFY_CHANGE_DIR_NAME
+	}
+}
+
+// watchKey identifies the watch of a directory by the
+// lock name of the directory and the volume notified,
+// since the volumes mounted by winfsp.MountMany share
+// the file system.
+type watchKey struct {
+	ref  *winfsp.FileSystemRef
+	name string
+}
+
+type dirWatch struct {
+	refs int
+	stop func()
+	done chan struct{}
+}
+
+// dirWatcher shares a watch among the handles of the
+// same directory opened through the same volume, see
+// watchKey.
+//
+// The names are translated by encode and decode between
+// the inner file system and WinFSP, see WithNameEncoder.
+type dirWatcher struct {
+	inner   FileSystemWatch
+	encode  func(string) string
+	decode  func(string) string
+	mtx     sync.Mutex
+	watches map[watchKey]*dirWatch
+}
+
+func newDirWatcher(fs FileSystem, encode, decode func(string) string) *dirWatcher {
+	inner, ok := fs.(FileSystemWatch)
+	if !ok {
+		return nil
+	}
+	return &dirWatcher{
+		inner:   inner,
+		encode:  encode,
+		decode:  decode,
+		watches: make(map[watchKey]*dirWatch),
+	}
+}
+
+// acquire watches the directory for the volume of the
+// key until the matching release, and returns whether it
+// is being watched.
+func (w *dirWatcher) acquire(name string, key watchKey) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if watch, ok := w.watches[key]; ok {
+		watch.refs++
+		return true
+	}
+	events, stop, err := w.inner.Watch(mapPathComponents(name, w.decode))
+	if err != nil {
+		return false
+	}
+	watch := &dirWatch{
+		refs: 1,
+		stop: stop,
+		done: make(chan struct{}),
+	}
+	w.watches[key] = watch
+	go func() {
+		for {
+			select {
+			case <-watch.done:
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				_ = key.ref.Notify(winfsp.NotifyInfo{
+					Filter: notifyFilter(event.Action),
+					Action: event.Action,
+					Name:   mapPathComponents(event.Name, w.encode),
+				})
+			}
+		}
+	}()
+	return true
+}
+
+func (w *dirWatcher) release(key watchKey) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	watch, ok := w.watches[key]
+	if !ok {
+		return
+	}
+	watch.refs--
+	if watch.refs > 0 {
+		return
+	}
+	delete(w.watches, key)
+	close(watch.done)
+
+	// The forwarding goroutine might be waiting in Notify
+	// for the operation releasing the watch to complete,
+	// so the inner watch must be stopped asynchronously.
+	if watch.stop != nil {
+		go watch.stop()
+	}
+}
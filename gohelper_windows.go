@@ -1,8 +1,14 @@
 package winfsp
 
 import (
+	"encoding/binary"
+	"math"
+	"strings"
 	"unicode/utf16"
 	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
 )
 
 // This file is even more restrictive than the
@@ -16,11 +22,30 @@ const (
 	replacementChar         = '\uFFFD' // Unicode replacement character
 )
 
+// utf16EncodedLen returns the number of UTF-16 code units
+// required to encode the string, with invalid runes being
+// replaced by the replacement character.
+func utf16EncodedLen(s string) int {
+	n := 0
+	for _, r := range s {
+		if utf16.RuneLen(r) == 2 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
 // FileSystemAddDirInfo adds directory information to a buffer like
 // FspFileSystemAddDirInfo.
 //
 // The buffer must be aligned to FSP_FSCTL_DIR_INFO, e.g. the buf
 // parameter of ReadDirectoryRaw.
+//
+// Like its C counterpart, it does not validate the name against
+// the maximum component length, but a name too long to be sized
+// by FSP_FSCTL_DIR_INFO is never added, as if the buffer is full.
 func FileSystemAddDirInfo(
 	name string,
 	nextOffset uint64,
@@ -37,22 +62,17 @@ func FileSystemAddDirInfo(
 		return 2
 	}
 
-	var utf16Len uint16
-	for _, r := range name {
-		switch utf16.RuneLen(r) {
-		case 1:
-			utf16Len++
-		case 2:
-			utf16Len += 2
-		default:
-			utf16Len++
-		}
-	}
-
 	dirInfoSize := uint16(unsafe.Sizeof(FSP_FSCTL_DIR_INFO{}))
+	maxNameLen := (math.MaxUint16 - int(dirInfoSize) -
+		int(dirInfoAlignment) + 1) / SIZEOF_WCHAR
+	nameLen := utf16EncodedLen(name)
+	if nameLen > maxNameLen {
+		return 0
+	}
+	utf16Len := uint16(nameLen)
 	requiredSize := dirInfoSize + utf16Len*SIZEOF_WCHAR
 	alignedSize := (requiredSize + dirInfoAlignment - 1) & ^(dirInfoAlignment - 1)
-	if uint16(len(buffer)) < alignedSize {
+	if len(buffer) < int(alignedSize) {
 		return 0
 	}
 
@@ -84,3 +104,326 @@ func FileSystemAddDirInfo(
 
 	return int(alignedSize)
 }
+
+// dirInfoMaxNameLen is the maximum length of the name
+// in UTF-16 code units that FillDirInfoByName packs,
+// which is the maximum component length of WinFSP.
+const dirInfoMaxNameLen = 255
+
+// nameTooLong reports a name exceeding the maximum
+// component length of the file system.
+func nameTooLong(nameLen, maxLen int) error {
+	return errors.Wrapf(windows.STATUS_NAME_TOO_LONG,
+		"name of %d UTF-16 code units exceeds %d", nameLen, maxLen)
+}
+
+// FillDirInfoByName packs the directory information for
+// BehaviourGetDirInfoByName, which is the FSP_FSCTL_DIR_INFO
+// followed by the UTF-16 encoded name without terminator.
+//
+// The dirInfo must be the one passed by WinFSP, whose
+// trailing buffer has room for a name of up to 255 UTF-16
+// code units, and longer names are rejected.
+func FillDirInfoByName(
+	dirInfo *FSP_FSCTL_DIR_INFO, name string,
+	fileInfo *FSP_FSCTL_FILE_INFO,
+) error {
+	utf16Len := utf16EncodedLen(name)
+	if utf16Len > dirInfoMaxNameLen {
+		return nameTooLong(utf16Len, dirInfoMaxNameLen)
+	}
+	dirInfoSize := unsafe.Sizeof(FSP_FSCTL_DIR_INFO{})
+	*dirInfo = FSP_FSCTL_DIR_INFO{}
+	dirInfo.Size = uint16(dirInfoSize) + uint16(utf16Len)*SIZEOF_WCHAR
+	if fileInfo != nil {
+		dirInfo.FileInfo = *fileInfo
+	}
+	target := unsafe.Slice((*uint16)(unsafe.Add(
+		unsafe.Pointer(dirInfo), dirInfoSize)), utf16Len)
+	target = target[:0]
+	for _, r := range name {
+		target = utf16.AppendRune(target, r)
+	}
+	return nil
+}
+
+// EaEntry is a decoded FILE_FULL_EA_INFORMATION entry.
+type EaEntry struct {
+	Name  string
+	Flags uint8
+	Value []byte
+}
+
+// eaHeaderSize is the size of FILE_FULL_EA_INFORMATION
+// without the variable length EaName field.
+const eaHeaderSize = int(unsafe.Offsetof(FILE_FULL_EA_INFORMATION{}.EaName))
+
+// eaEntrySize returns the size of a packed entry, not
+// including the padding to the next entry.
+func eaEntrySize(nameLen, valueLen int) int {
+	return eaHeaderSize + nameLen + 1 + valueLen
+}
+
+// FileSystemEnumerateEa decodes a packed chain of
+// FILE_FULL_EA_INFORMATION like FspFileSystemEnumerateEa.
+//
+// The value of each returned entry references the buffer,
+// copy it if it needs to outlive the buffer.
+func FileSystemEnumerateEa(buffer []byte) ([]EaEntry, error) {
+	var result []EaEntry
+	offset := 0
+	for offset < len(buffer) {
+		entry := buffer[offset:]
+		if len(entry) < eaHeaderSize {
+			return nil, errors.Errorf(
+				"truncated EA header at offset %d", offset)
+		}
+		next := binary.LittleEndian.Uint32(entry[0:4])
+		flags := entry[4]
+		nameLen := int(entry[5])
+		valueLen := int(binary.LittleEndian.Uint16(entry[6:8]))
+		size := eaEntrySize(nameLen, valueLen)
+		if len(entry) < size {
+			return nil, errors.Errorf(
+				"truncated EA entry at offset %d", offset)
+		}
+		name := entry[eaHeaderSize : eaHeaderSize+nameLen]
+		valueStart := eaHeaderSize + nameLen + 1
+		result = append(result, EaEntry{
+			Name:  string(name),
+			Flags: flags,
+			Value: entry[valueStart : valueStart+valueLen : valueStart+valueLen],
+		})
+		if next == 0 {
+			break
+		}
+		if int64(next) < int64(size) {
+			return nil, errors.Errorf(
+				"invalid EA next entry offset %d at offset %d", next, offset)
+		}
+		offset += int(next)
+	}
+	return result, nil
+}
+
+// EaEntries decodes the chain of FILE_FULL_EA_INFORMATION
+// passed to CreateExWithExtendedAttribute, whose length is
+// found by following the chain, which has been validated
+// by WinFSP. A nil chain decodes into no entry.
+//
+// The value of each returned entry references the chain,
+// copy it if it needs to outlive the call.
+func EaEntries(ea *FILE_FULL_EA_INFORMATION) ([]EaEntry, error) {
+	if ea == nil {
+		return nil, nil
+	}
+	size := 0
+	for {
+		entry := (*FILE_FULL_EA_INFORMATION)(
+			unsafe.Add(unsafe.Pointer(ea), size))
+		if entry.NextEntryOffset == 0 {
+			size += eaEntrySize(int(entry.EaNameLength),
+				int(uint16(entry.EaValueLength)))
+			break
+		}
+		size += int(entry.NextEntryOffset)
+	}
+	return FileSystemEnumerateEa(
+		unsafe.Slice((*byte)(unsafe.Pointer(ea)), size))
+}
+
+// FileSystemPackEa packs the entries into a chain of
+// FILE_FULL_EA_INFORMATION, which is the inverse of
+// FileSystemEnumerateEa. Each entry but the last is
+// padded to a 4-byte boundary.
+func FileSystemPackEa(entries []EaEntry) ([]byte, error) {
+	var result []byte
+	last := -1
+	for _, entry := range entries {
+		if len(entry.Name) == 0 || len(entry.Name) > math.MaxUint8 {
+			return nil, errors.Errorf(
+				"invalid EA name length %d", len(entry.Name))
+		}
+		if len(entry.Value) > math.MaxUint16 {
+			return nil, errors.Errorf(
+				"EA %q value too long", entry.Name)
+		}
+		if last >= 0 {
+			aligned := (len(result) + 3) &^ 3
+			binary.LittleEndian.PutUint32(
+				result[last:], uint32(aligned-last))
+			result = append(result, make([]byte, aligned-len(result))...)
+		}
+		last = len(result)
+		var header [eaHeaderSize]byte
+		header[4] = entry.Flags
+		header[5] = uint8(len(entry.Name))
+		binary.LittleEndian.PutUint16(header[6:], uint16(len(entry.Value)))
+		result = append(result, header[:]...)
+		result = append(result, entry.Name...)
+		result = append(result, 0)
+		result = append(result, entry.Value...)
+	}
+	return result, nil
+}
+
+const (
+	// reparseHeaderSize is the size of the header shared
+	// by all REPARSE_DATA_BUFFER, which is the tag, the
+	// data length and the reserved field.
+	reparseHeaderSize = 8
+
+	// reparseNtPrefix is the prefix of the NT namespace
+	// path for the substitute names.
+	reparseNtPrefix = `\??\`
+)
+
+// reparseSubstituteName converts an absolute win32 path
+// into the NT namespace path for the substitute name.
+func reparseSubstituteName(target string) string {
+	if strings.HasPrefix(target, `\\`) {
+		return reparseNtPrefix + `UNC\` + target[2:]
+	}
+	return reparseNtPrefix + target
+}
+
+// buildReparse builds the REPARSE_DATA_BUFFER of the
+// symlink or mount point layout, whose path buffer
+// follows the name offsets and lengths, and an extra
+// field of flags for symlink.
+func buildReparse(
+	tag uint32, substitute, print string,
+	flags []byte, terminate bool,
+) ([]byte, error) {
+	substitute16 := utf16.Encode([]rune(substitute))
+	print16 := utf16.Encode([]rune(print))
+	var terminator []uint16
+	if terminate {
+		terminator = []uint16{0}
+	}
+	var path []uint16
+	path = append(path, substitute16...)
+	path = append(path, terminator...)
+	printOffset := len(path) * SIZEOF_WCHAR
+	path = append(path, print16...)
+	path = append(path, terminator...)
+
+	dataLength := 8 + len(flags) + len(path)*SIZEOF_WCHAR
+	if dataLength > math.MaxUint16 {
+		return nil, errors.Errorf(
+			"reparse data of %d bytes too long", dataLength)
+	}
+	result := make([]byte, reparseHeaderSize+8, reparseHeaderSize+dataLength)
+	binary.LittleEndian.PutUint32(result[0:], tag)
+	binary.LittleEndian.PutUint16(result[4:], uint16(dataLength))
+	binary.LittleEndian.PutUint16(result[8:], 0)
+	binary.LittleEndian.PutUint16(result[10:],
+		uint16(len(substitute16)*SIZEOF_WCHAR))
+	binary.LittleEndian.PutUint16(result[12:], uint16(printOffset))
+	binary.LittleEndian.PutUint16(result[14:],
+		uint16(len(print16)*SIZEOF_WCHAR))
+	result = append(result, flags...)
+	for _, c := range path {
+		result = binary.LittleEndian.AppendUint16(result, c)
+	}
+	return result, nil
+}
+
+// BuildSymlinkReparse builds the REPARSE_DATA_BUFFER of a
+// symbolic link pointing to target.
+//
+// The relative target is stored as is with the
+// SYMLINK_FLAG_RELATIVE flag, otherwise the target must
+// be an absolute win32 path, e.g. "C:\dir" or "\\host\share",
+// which is stored as the print name and converted into the
+// NT namespace path as the substitute name.
+func BuildSymlinkReparse(target string, relative bool) ([]byte, error) {
+	var flags [4]byte
+	substitute := target
+	if relative {
+		binary.LittleEndian.PutUint32(flags[:], SYMLINK_FLAG_RELATIVE)
+	} else {
+		substitute = reparseSubstituteName(target)
+	}
+	return buildReparse(windows.IO_REPARSE_TAG_SYMLINK,
+		substitute, target, flags[:], false)
+}
+
+// BuildMountPointReparse builds the REPARSE_DATA_BUFFER of a
+// mount point, a.k.a. a junction, pointing to target, which
+// must be an absolute win32 path.
+func BuildMountPointReparse(target string) ([]byte, error) {
+	return buildReparse(windows.IO_REPARSE_TAG_MOUNT_POINT,
+		reparseSubstituteName(target), target, nil, true)
+}
+
+// ParseReparse parses the REPARSE_DATA_BUFFER of a
+// symbolic link or a mount point, returning its tag and
+// target, which is the print name if present, otherwise
+// the substitute name converted back into a win32 path.
+func ParseReparse(buffer []byte) (tag uint32, target string, err error) {
+	tag, substitute, printName, err := parseReparseNames(buffer)
+	if err != nil {
+		return 0, "", err
+	}
+	if printName != "" {
+		return tag, printName, nil
+	}
+	if rest, ok := strings.CutPrefix(substitute, reparseNtPrefix+`UNC\`); ok {
+		return tag, `\\` + rest, nil
+	}
+	return tag, strings.TrimPrefix(substitute, reparseNtPrefix), nil
+}
+
+// parseReparseNames parses the REPARSE_DATA_BUFFER of a
+// symbolic link or a mount point, returning its tag and
+// the substitute and print names as they are stored.
+func parseReparseNames(buffer []byte) (
+	tag uint32, substitute, printName string, err error,
+) {
+	if len(buffer) < reparseHeaderSize {
+		return 0, "", "", errors.New("reparse buffer truncated")
+	}
+	tag = binary.LittleEndian.Uint32(buffer[0:])
+	dataLength := int(binary.LittleEndian.Uint16(buffer[4:]))
+	if len(buffer) < reparseHeaderSize+dataLength {
+		return 0, "", "", errors.New("reparse data truncated")
+	}
+	data := buffer[reparseHeaderSize : reparseHeaderSize+dataLength]
+	var pathStart int
+	switch tag {
+	case windows.IO_REPARSE_TAG_SYMLINK:
+		pathStart = 12
+	case windows.IO_REPARSE_TAG_MOUNT_POINT:
+		pathStart = 8
+	default:
+		return tag, "", "", errors.Errorf("unsupported reparse tag %#x", tag)
+	}
+	if len(data) < pathStart {
+		return 0, "", "", errors.New("reparse data truncated")
+	}
+	path := data[pathStart:]
+	name := func(offset, length uint16) (string, error) {
+		if int(offset)+int(length) > len(path) || length%2 != 0 {
+			return "", errors.New("reparse name out of range")
+		}
+		name16 := make([]uint16, length/2)
+		for i := range name16 {
+			name16[i] = binary.LittleEndian.Uint16(path[int(offset)+2*i:])
+		}
+		return string(utf16.Decode(name16)), nil
+	}
+	printName, err = name(
+		binary.LittleEndian.Uint16(data[4:]),
+		binary.LittleEndian.Uint16(data[6:]))
+	if err != nil {
+		return 0, "", "", err
+	}
+	substitute, err = name(
+		binary.LittleEndian.Uint16(data[0:]),
+		binary.LittleEndian.Uint16(data[2:]))
+	if err != nil {
+		return 0, "", "", err
+	}
+	return tag, substitute, printName, nil
+}
@@ -0,0 +1,210 @@
+package winfsp_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+func TestFileSystemEnumerateEa(t *testing.T) {
+	buffer := []byte{
+		// First entry, next entry offset 16.
+		16, 0, 0, 0, 0x80, 3, 2, 0,
+		'F', 'O', 'O', 0, 'a', 'b', 0, 0,
+		// Second entry, which is the last.
+		0, 0, 0, 0, 0, 1, 0, 0,
+		'X', 0,
+	}
+	entries, err := winfsp.FileSystemEnumerateEa(buffer)
+	if err != nil {
+		t.Fatalf("FileSystemEnumerateEa: %v", err)
+	}
+	want := []winfsp.EaEntry{
+		{Name: "FOO", Flags: 0x80, Value: []byte("ab")},
+		{Name: "X", Flags: 0, Value: []byte{}},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries; want %d", len(entries), len(want))
+	}
+	for i := range want {
+		if entries[i].Name != want[i].Name ||
+			entries[i].Flags != want[i].Flags ||
+			!bytes.Equal(entries[i].Value, want[i].Value) {
+			t.Errorf("entry %d = %+v; want %+v", i, entries[i], want[i])
+		}
+	}
+
+	packed, err := winfsp.FileSystemPackEa(entries)
+	if err != nil {
+		t.Fatalf("FileSystemPackEa: %v", err)
+	}
+	if !bytes.Equal(packed, buffer) {
+		t.Errorf("FileSystemPackEa = %v; want %v", packed, buffer)
+	}
+}
+
+func TestFileSystemEnumerateEaTruncated(t *testing.T) {
+	buffer := []byte{0, 0, 0, 0, 0, 3, 2, 0, 'F', 'O'}
+	if _, err := winfsp.FileSystemEnumerateEa(buffer); err == nil {
+		t.Errorf("FileSystemEnumerateEa succeeded on truncated buffer")
+	}
+}
+
+func TestFileSystemPackEaRoundTrip(t *testing.T) {
+	entries := []winfsp.EaEntry{
+		{Name: "USER.ONE", Value: []byte("1")},
+		{Name: "LXUID", Flags: 0x80, Value: []byte{0xe8, 0x03, 0, 0}},
+		{Name: "EMPTY", Value: []byte{}},
+	}
+	packed, err := winfsp.FileSystemPackEa(entries)
+	if err != nil {
+		t.Fatalf("FileSystemPackEa: %v", err)
+	}
+	got, err := winfsp.FileSystemEnumerateEa(packed)
+	if err != nil {
+		t.Fatalf("FileSystemEnumerateEa: %v", err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("got %d entries; want %d", len(got), len(entries))
+	}
+	for i := range entries {
+		if got[i].Name != entries[i].Name ||
+			got[i].Flags != entries[i].Flags ||
+			!bytes.Equal(got[i].Value, entries[i].Value) {
+			t.Errorf("entry %d = %+v; want %+v", i, got[i], entries[i])
+		}
+	}
+}
+
+func TestEaEntries(t *testing.T) {
+	if got, err := winfsp.EaEntries(nil); got != nil || err != nil {
+		t.Errorf("EaEntries(nil) = %v, %v; want nil, nil", got, err)
+	}
+	entries := []winfsp.EaEntry{
+		{Name: "USER.ONE", Value: []byte("1")},
+		{Name: "LXUID", Flags: 0x80, Value: []byte{0xe8, 0x03, 0, 0}},
+	}
+	packed, err := winfsp.FileSystemPackEa(entries)
+	if err != nil {
+		t.Fatalf("FileSystemPackEa: %v", err)
+	}
+	got, err := winfsp.EaEntries(
+		(*winfsp.FILE_FULL_EA_INFORMATION)(unsafe.Pointer(&packed[0])))
+	if err != nil {
+		t.Fatalf("EaEntries: %v", err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("got %d entries; want %d", len(got), len(entries))
+	}
+	for i := range entries {
+		if got[i].Name != entries[i].Name ||
+			got[i].Flags != entries[i].Flags ||
+			!bytes.Equal(got[i].Value, entries[i].Value) {
+			t.Errorf("entry %d = %+v; want %+v", i, got[i], entries[i])
+		}
+	}
+}
+
+func TestFillDirInfoByName(t *testing.T) {
+	const name = "file-\U0001F600.txt"
+	dirInfoSize := unsafe.Sizeof(winfsp.FSP_FSCTL_DIR_INFO{})
+	buffer := make([]uint64, (dirInfoSize+255*2+7)/8)
+	for i := range buffer {
+		buffer[i] = ^uint64(0)
+	}
+	dirInfo := (*winfsp.FSP_FSCTL_DIR_INFO)(unsafe.Pointer(&buffer[0]))
+	fileInfo := &winfsp.FSP_FSCTL_FILE_INFO{FileSize: 42}
+	if err := winfsp.FillDirInfoByName(dirInfo, name, fileInfo); err != nil {
+		t.Fatalf("FillDirInfoByName: %v", err)
+	}
+	want := utf16.Encode([]rune(name))
+	if got, wantSize := uintptr(dirInfo.Size), dirInfoSize+uintptr(len(want))*2; got != wantSize {
+		t.Errorf("Size = %d; want %d", got, wantSize)
+	}
+	if dirInfo.FileInfo.FileSize != 42 || dirInfo.NextOffset != 0 {
+		t.Errorf("FileInfo = %+v, NextOffset = %d", dirInfo.FileInfo, dirInfo.NextOffset)
+	}
+	got := unsafe.Slice((*uint16)(unsafe.Add(
+		unsafe.Pointer(dirInfo), dirInfoSize)), len(want))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("name = %v; want %v", got, want)
+		}
+	}
+
+	long := strings.Repeat("a", 256)
+	if err := winfsp.FillDirInfoByName(dirInfo, long, fileInfo); err == nil {
+		t.Errorf("FillDirInfoByName with 256 code units should fail")
+	}
+}
+
+func TestReparseRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tag    uint32
+		target string
+		build  func(string) ([]byte, error)
+	}{{
+		name: "symlink", tag: windows.IO_REPARSE_TAG_SYMLINK,
+		target: `C:\dir\file`,
+		build: func(target string) ([]byte, error) {
+			return winfsp.BuildSymlinkReparse(target, false)
+		},
+	}, {
+		name: "relative symlink", tag: windows.IO_REPARSE_TAG_SYMLINK,
+		target: `..\file`,
+		build: func(target string) ([]byte, error) {
+			return winfsp.BuildSymlinkReparse(target, true)
+		},
+	}, {
+		name: "UNC symlink", tag: windows.IO_REPARSE_TAG_SYMLINK,
+		target: `\\host\share`,
+		build: func(target string) ([]byte, error) {
+			return winfsp.BuildSymlinkReparse(target, false)
+		},
+	}, {
+		name: "mount point", tag: windows.IO_REPARSE_TAG_MOUNT_POINT,
+		target: `C:\mnt`,
+		build:  winfsp.BuildMountPointReparse,
+	}} {
+		buffer, err := tc.build(tc.target)
+		if err != nil {
+			t.Fatalf("%s: build: %v", tc.name, err)
+		}
+		header := (*winfsp.REPARSE_DATA_BUFFER_GENERIC)(unsafe.Pointer(&buffer[0]))
+		if int(header.ReparseDataLength)+8 != len(buffer) {
+			t.Errorf("%s: ReparseDataLength = %d for %d bytes",
+				tc.name, header.ReparseDataLength, len(buffer))
+		}
+		tag, target, err := winfsp.ParseReparse(buffer)
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tc.name, err)
+		}
+		if tag != tc.tag || target != tc.target {
+			t.Errorf("%s: ParseReparse = %#x, %q; want %#x, %q",
+				tc.name, tag, target, tc.tag, tc.target)
+		}
+	}
+
+	// The substitute name of a mount point is in NT namespace.
+	buffer, err := winfsp.BuildMountPointReparse(`C:\mnt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountPoint := (*winfsp.REPARSE_DATA_BUFFER_MOUNT_POINT)(unsafe.Pointer(&buffer[0]))
+	path := unsafe.Slice(&mountPoint.PathBuffer[0],
+		mountPoint.SubstituteNameLength/2)
+	if got := string(utf16.Decode(path)); got != `\??\C:\mnt` {
+		t.Errorf("substitute name = %q", got)
+	}
+
+	if _, _, err := winfsp.ParseReparse(buffer[:10]); err == nil {
+		t.Errorf("ParseReparse of truncated buffer should fail")
+	}
+}
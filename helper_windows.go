@@ -1,12 +1,18 @@
 package winfsp
 
 import (
+	"bufio"
+	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp/log"
 )
 
 // Well, for this file, a function exported by WinFSP
@@ -48,6 +54,67 @@ func PosixMapSecurityDescriptorToPermissions(
 	return uid, gid, mode, nil
 }
 
+var posixMapPermissionsToSecurityDescriptor dllProc
+
+func init() {
+	registerOptionalProc(
+		"FspPosixMapPermissionsToSecurityDescriptor",
+		&posixMapPermissionsToSecurityDescriptor,
+	)
+}
+
+// PosixMapPermissionsToSecurityDescriptor maps POSIX permissions to a Windows
+// security descriptor, which is the reverse of
+// PosixMapSecurityDescriptorToPermissions.
+//
+// The security descriptor is copied into the memory managed by Go, and
+// the one allocated by WinFSP is deleted before returning, so there is
+// no need to call DeleteSecurityDescriptor on the result.
+// It fails with ErrNotSupported if the loaded WinFSP DLL
+// does not export FspPosixMapPermissionsToSecurityDescriptor.
+//
+// Will load WinFSP DLL if it has not been loaded, and **panic** if it
+// fails to load. If you don't want to panic, you should consider calling
+// `LoadWinFSP` or `LoadWinFSPWithDLL` and avoid calling this function
+// if it fails to load.
+func PosixMapPermissionsToSecurityDescriptor(
+	uid, gid, mode uint32,
+) (*windows.SECURITY_DESCRIPTOR, error) {
+	var securityDescriptor *windows.SECURITY_DESCRIPTOR
+	err := posixMapPermissionsToSecurityDescriptor.CallStatus(
+		uintptr(uid), uintptr(gid), uintptr(mode),
+		uintptr(unsafe.Pointer(&securityDescriptor)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "FspPosixMapPermissionsToSecurityDescriptor")
+	}
+	defer func() {
+		_, _ = deleteSecurityDescriptor.Call(
+			uintptr(unsafe.Pointer(securityDescriptor)),
+			posixMapPermissionsToSecurityDescriptor.Addr(),
+		)
+	}()
+	return copySecurityDescriptor(securityDescriptor), nil
+}
+
+// copySecurityDescriptor copies the self-relative security
+// descriptor into the memory managed by Go.
+func copySecurityDescriptor(
+	securityDescriptor *windows.SECURITY_DESCRIPTOR,
+) *windows.SECURITY_DESCRIPTOR {
+	length := int(securityDescriptor.Length())
+	length = max(length, int(unsafe.Sizeof(windows.SECURITY_DESCRIPTOR{})))
+	src := unsafe.Slice((*byte)(unsafe.Pointer(securityDescriptor)), length)
+
+	// The security descriptor contains pointers, so the
+	// copy must be aligned to the pointer size.
+	const ptrSize = int(unsafe.Sizeof(uintptr(0)))
+	alloc := make([]uintptr, (length+ptrSize-1)/ptrSize)
+	dst := unsafe.Slice((*byte)(unsafe.Pointer(&alloc[0])), length)
+	copy(dst, src)
+	return (*windows.SECURITY_DESCRIPTOR)(unsafe.Pointer(&dst[0]))
+}
+
 var posixMapSidToUid dllProc
 
 func init() {
@@ -157,10 +224,11 @@ func DeleteSecurityDescriptor(securityDescriptor *windows.SECURITY_DESCRIPTOR) e
 	setSecurityDescriptor.EnsureInitialized()
 
 	// Pass a function pointer to indicate this was created by FspSetSecurityDescriptor
-	// The C API expects this to match the function that created the descriptor
+	// The C API expects this to match the function that created the descriptor,
+	// and silently leaks the descriptor otherwise.
 	_, err := deleteSecurityDescriptor.Call(
 		uintptr(unsafe.Pointer(securityDescriptor)),
-		uintptr(unsafe.Pointer(setSecurityDescriptor.proc)),
+		setSecurityDescriptor.proc.Addr(),
 	)
 	runtime.KeepAlive(securityDescriptor)
 	if err != nil {
@@ -185,10 +253,75 @@ func init() {
 // `LoadWinFSP` or `LoadWinFSPWithDLL` and avoid calling this function
 // if it fails to load.
 func DebugLogSetHandle(handle syscall.Handle) error {
+	debugLogPipeMtx.Lock()
+	defer debugLogPipeMtx.Unlock()
+	return setDebugLogHandleLocked(handle, nil)
+}
+
+var (
+	debugLogPipeMtx sync.Mutex
+	debugLogPipe    *os.File
+)
+
+// setDebugLogHandleLocked sets the debug log handle, and
+// replaces the write end of the pipe created by
+// PipeDebugLogToLogger, closing the previous one so that
+// its reading goroutine exits.
+func setDebugLogHandleLocked(handle syscall.Handle, pipe *os.File) error {
 	_, err := debugLogSetHandle.Call(uintptr(handle))
 	if err != nil {
 		return errors.Wrap(err, "FspDebugLogSetHandle")
 	}
+	if debugLogPipe != nil {
+		_ = debugLogPipe.Close()
+	}
+	debugLogPipe = pipe
+	return nil
+}
+
+// PipeDebugLogToLogger routes the debug output of WinFSP,
+// enabled for the file systems mounted with Debug, into
+// the logger, forwarding each line as Log(TopicTrace, line)
+// from a background goroutine.
+//
+// The debug log handle is global to the process, so it
+// replaces the handle set by DebugLogSetHandle or the
+// previous call, and vice versa.
+//
+// Will load WinFSP DLL if it has not been loaded, and
+// **panic** if it fails to load, see DebugLogSetHandle.
+func PipeDebugLogToLogger(l log.Log) error {
+	if l == nil {
+		return errors.New("invalid nil logger parameter")
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "create debug log pipe")
+	}
+	debugLogPipeMtx.Lock()
+	defer debugLogPipeMtx.Unlock()
+	if err := setDebugLogHandleLocked(
+		syscall.Handle(writer.Fd()), writer); err != nil {
+		_ = reader.Close()
+		_ = writer.Close()
+		return err
+	}
+	go func() {
+		// The pipe must be drained until it is closed,
+		// otherwise the writes of WinFSP would block.
+		defer func() { _ = reader.Close() }()
+		buffered := bufio.NewReader(reader)
+		for {
+			line, err := buffered.ReadString('\n')
+			line = strings.TrimRight(line, "\r\n")
+			if line != "" {
+				l.Log(log.TopicTrace, line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
 	return nil
 }
 
@@ -212,6 +345,60 @@ func FileSystemOperationProcessId() uint32 {
 	return uint32(result)
 }
 
+var fileSystemGetOperationContext dllProc
+
+func init() {
+	registerOptionalProc("FspFileSystemGetOperationContext", &fileSystemGetOperationContext)
+}
+
+// FileSystemOperationCreateRequest gets the request of the
+// Create operation being handled, or nil if the current
+// operation is not a Create, or the loaded WinFSP DLL does
+// not export FspFileSystemGetOperationContext.
+//
+// This function can only be called from within a file system
+// operation handler, and the returned request must not be
+// referenced after the handler returns.
+//
+// Will load WinFSP DLL if it has not been loaded, and **panic** if it
+// fails to load. If you don't want to panic, you should consider calling
+// `LoadWinFSP` or `LoadWinFSPWithDLL` and avoid calling this function
+// if it fails to load.
+func FileSystemOperationCreateRequest() *FSP_FSCTL_TRANSACT_REQ_CREATE {
+	context, _ := fileSystemGetOperationContext.Call()
+	if context == 0 {
+		return nil
+	}
+	// FSP_FILE_SYSTEM_OPERATION_CONTEXT begins with the
+	// pointer to the FSP_FSCTL_TRANSACT_REQ.
+	request := *(*uintptr)(unsafe.Pointer(context))
+	if request == 0 {
+		return nil
+	}
+	result := (*FSP_FSCTL_TRANSACT_REQ_CREATE)(unsafe.Pointer(request))
+	if result.Kind != FspFsctlTransactCreateKind {
+		return nil
+	}
+	return result
+}
+
+// OperationToken gets the access token of the process
+// originating the Create operation being handled, which
+// could be used for access control or per user views.
+//
+// The token is owned by WinFSP and is only valid until
+// the handler returns, so it must neither be closed nor
+// be referenced afterwards.
+func (fileSystem *FileSystemRef) OperationToken() (windows.Token, error) {
+	request := FileSystemOperationCreateRequest()
+	if request == nil {
+		return 0, errors.New("not handling a create operation")
+	}
+	// The lower 32 bits are the token handle while the
+	// upper 32 bits are the originating process ID.
+	return windows.Token(request.AccessToken & 0xffffffff), nil
+}
+
 var fileSystemFindReparsePoint dllProc
 
 func init() {
@@ -0,0 +1,37 @@
+// Package callstack captures and formats the call stacks
+// recorded by the debug tracking of the allocations.
+package callstack
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// maxDepth is the number of frames captured at most.
+const maxDepth = 32
+
+// Capture returns the program counters of the calling
+// goroutine, skipping the callers of Capture up to skip,
+// i.e. 0 identifies the caller of Capture.
+func Capture(skip int) []uintptr {
+	stack := make([]uintptr, maxDepth)
+	// Skip runtime.Callers and Capture.
+	return stack[:runtime.Callers(skip+2, stack)]
+}
+
+// Format formats the program counters like the stack
+// traces printed by panics.
+func Format(stack []uintptr) string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n",
+			frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package log
+
+import (
+	"time"
+)
+
+// Topic classifies the messages passed to Log.Log.
+type Topic uint8
+
+const (
+	// TopicTrace is for verbose tracing messages,
+	// e.g. the debug output of WinFSP.
+	TopicTrace = Topic(iota)
+
+	// TopicInfo is for informational messages.
+	TopicInfo
+
+	// TopicError is for errors which cannot be
+	// returned to any caller.
+	TopicError
+)
+
+func (t Topic) String() string {
+	switch t {
+	case TopicTrace:
+		return "trace"
+	case TopicInfo:
+		return "info"
+	case TopicError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Field is a key-value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value any
+}
+
+// Log receives the operations and messages.
+//
+// The methods are called from the dispatcher threads of
+// the file system concurrently, so they must be safe for
+// concurrent use and should return quickly.
+type Log interface {
+	// Call is called before the operation is dispatched.
+	Call(op string, fields ...Field)
+
+	// Return is called after the operation returns, with
+	// status being nil if the operation succeeds.
+	Return(op string, status error, fields ...Field)
+
+	// Log is called with a free form message.
+	Log(topic Topic, msg string)
+}
+
+// Kind is the kind of an Entry.
+type Kind uint8
+
+const (
+	KindCall = Kind(iota)
+	KindReturn
+	KindLog
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindCall:
+		return "call"
+	case KindReturn:
+		return "return"
+	case KindLog:
+		return "log"
+	default:
+		return "unknown"
+	}
+}
+
+// Entry is a recorded call of Log, for the sinks
+// which would like to store the calls for later.
+type Entry struct {
+	Time    time.Time
+	Kind    Kind
+	Op      string
+	Status  error
+	Topic   Topic
+	Message string
+	Fields  []Field
+}
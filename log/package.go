@@ -0,0 +1,6 @@
+// Package log defines the interface through which the file
+// systems report their operations and diagnostic messages.
+//
+// The package is platform independent, so that log sinks
+// can be written and tested without WinFSP.
+package log
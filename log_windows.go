@@ -0,0 +1,132 @@
+package winfsp
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp/log"
+)
+
+// traceCall reports the operation to the logger of the
+// file system and counts it as pending, returning the
+// reference for traceReturn or nil if it is not found.
+func traceCall(fileSystem uintptr, op string) *FileSystemRef {
+	ref := loadFileSystemRef(fileSystem)
+	if ref == nil {
+		return nil
+	}
+	ref.operations.Add(1)
+	ref.pending.Add(1)
+	if ref.logger != nil {
+		ref.logger.Call(op, ref.logFields()...)
+	}
+	return ref
+}
+
+// traceReturn reports the status of the operation
+// whose traceCall has returned the reference.
+func traceReturn(
+	ref *FileSystemRef, op string, status windows.NTStatus,
+) {
+	if ref == nil {
+		return
+	}
+	ref.pending.Add(-1)
+	if ref.logger == nil {
+		return
+	}
+	var err error
+	if status != windows.STATUS_SUCCESS {
+		err = status
+	}
+	ref.logger.Return(op, err, ref.logFields()...)
+}
+
+// traceReturnPath is traceReturn for the operations on
+// the name, which reports the failure as an OpError.
+func traceReturnPath(
+	ref *FileSystemRef, op string, name uintptr,
+	status windows.NTStatus,
+) {
+	if ref == nil {
+		return
+	}
+	if ref.logger == nil || status == windows.STATUS_SUCCESS {
+		traceReturn(ref, op, status)
+		return
+	}
+	ref.pending.Add(-1)
+	ref.logger.Return(op, &OpError{
+		Op:     op,
+		Path:   utf16PtrToString(name),
+		Status: status,
+	}, ref.logFields()...)
+}
+
+func (fileSystem *FileSystemRef) logFields() []log.Field {
+	if fileSystem.name == "" {
+		return nil
+	}
+	return []log.Field{{Key: "name", Value: fileSystem.name}}
+}
+
+// RingLog is a log.Log retaining the most recent entries,
+// so that the history could be dumped when the file system
+// is found to be stuck.
+type RingLog struct {
+	mtx     sync.Mutex
+	entries []log.Entry
+	next    int
+	full    bool
+}
+
+// NewRingLog creates a RingLog retaining at most n entries.
+func NewRingLog(n int) *RingLog {
+	if n <= 0 {
+		n = 1
+	}
+	return &RingLog{entries: make([]log.Entry, n)}
+}
+
+func (r *RingLog) record(entry log.Entry) {
+	entry.Time = time.Now()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.entries[r.next] = entry
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+func (r *RingLog) Call(op string, fields ...log.Field) {
+	r.record(log.Entry{Kind: log.KindCall, Op: op, Fields: fields})
+}
+
+func (r *RingLog) Return(op string, status error, fields ...log.Field) {
+	r.record(log.Entry{
+		Kind: log.KindReturn, Op: op, Status: status, Fields: fields,
+	})
+}
+
+func (r *RingLog) Log(topic log.Topic, msg string) {
+	r.record(log.Entry{Kind: log.KindLog, Topic: topic, Message: msg})
+}
+
+// Dump returns the retained entries from the oldest
+// to the most recent one.
+func (r *RingLog) Dump() []log.Entry {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !r.full {
+		return append([]log.Entry(nil), r.entries[:r.next]...)
+	}
+	result := make([]log.Entry, 0, len(r.entries))
+	result = append(result, r.entries[r.next:]...)
+	return append(result, r.entries[:r.next]...)
+}
+
+var _ log.Log = (*RingLog)(nil)
@@ -3,19 +3,27 @@
 package memfs
 
 import (
+	"bytes"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/pkg/errors"
 	"golang.org/x/sys/windows"
 
+	"github.com/winfsp/go-winfsp"
 	"github.com/winfsp/go-winfsp/gofs"
+	"github.com/winfsp/go-winfsp/treelock"
 )
 
 type memObject interface {
@@ -23,9 +31,50 @@ type memObject interface {
 }
 
 type memFile struct {
-	dataMtx sync.Mutex
+	dataMtx sync.RWMutex
 	// Must acquire data.dataMtx to modify.
 	data []byte
+
+	// extents are the sorted and disjoint ranges of data
+	// which have been written, while the rest of the data
+	// is a hole of the sparse file, e.g. by extending the
+	// file with Truncate, see AllocatedRanges.
+	// Must acquire data.dataMtx to modify.
+	extents []gofs.Range
+}
+
+// materializeLocked adds the written range to the extents,
+// merging it with the ones it overlaps or adjoins.
+func (m *memFile) materializeLocked(off, n int64) {
+	if n <= 0 {
+		return
+	}
+	start, end := off, off+n
+	var result []gofs.Range
+	i := 0
+	for ; i < len(m.extents) &&
+		m.extents[i].Offset+m.extents[i].Length < start; i++ {
+		result = append(result, m.extents[i])
+	}
+	for ; i < len(m.extents) && m.extents[i].Offset <= end; i++ {
+		start = min(start, m.extents[i].Offset)
+		end = max(end, m.extents[i].Offset+m.extents[i].Length)
+	}
+	result = append(result, gofs.Range{Offset: start, Length: end - start})
+	m.extents = append(result, m.extents[i:]...)
+}
+
+// clipLocked cuts the extents beyond the size.
+func (m *memFile) clipLocked(size int64) {
+	var result []gofs.Range
+	for _, extent := range m.extents {
+		if extent.Offset >= size {
+			break
+		}
+		extent.Length = min(extent.Length, size-extent.Offset)
+		result = append(result, extent)
+	}
+	m.extents = result
 }
 
 func (m *memFile) size() int64 {
@@ -50,37 +99,167 @@ type memItem struct {
 	name       string
 	mode       os.FileMode
 	createTime time.Time
-	accessTime time.Time
 	modifyTime time.Time
 	obj        memObject
+
+	// changeTime is updated when the metadata changes,
+	// e.g. by renaming or Chattr, but not by writing.
+	changeTime time.Time
+
+	// temporary is set by FILE_ATTRIBUTE_TEMPORARY, and
+	// the data of a temporary file is released as soon as
+	// it is removed, see Chattr.
+	temporary bool
+
+	// compressed is set by FSCTL_SET_COMPRESSION, which is
+	// kept as the metadata only, see SetCompressed.
+	compressed bool
+
+	// archive is FILE_ATTRIBUTE_ARCHIVE, which is set by
+	// modifying the content of the file, and is only
+	// cleared by Chattr, e.g. by backup tools.
+	archive bool
+
+	// offline is FILE_ATTRIBUTE_OFFLINE and the RECALL_ON_*
+	// attributes set by Chattr, simulating a file kept by a
+	// cloud backend while its content is still in memory.
+	offline uint32
+
+	// writeBits are the write permission bits cleared by
+	// Chattr with FILE_ATTRIBUTE_READONLY, which are
+	// restored once the attribute is removed.
+	writeBits os.FileMode
+
+	// ea holds the extended attributes of the item, whose
+	// values are owned by the item, see SetEa.
+	ea []winfsp.EaEntry
+
+	// accessTime is the nanoseconds since the Unix epoch,
+	// which is updated on every read, so it is stored
+	// atomically to keep readers off the metaMtx.
+	accessTime atomic.Int64
+
+	// clock is the source of the times, see WithClock.
+	clock func() time.Time
 }
 
-func newMemItem(mode os.FileMode, name string, obj memObject) *memItem {
-	now := time.Now()
-	return &memItem{
+func newMemItem(
+	clock func() time.Time, mode os.FileMode, name string, obj memObject,
+) *memItem {
+	now := clock()
+	result := &memItem{
 		name:       name,
 		mode:       mode,
 		createTime: now,
-		accessTime: now,
 		modifyTime: now,
+		changeTime: now,
 		obj:        obj,
+		clock:      clock,
 	}
+	result.accessTime.Store(now.UnixNano())
+	return result
+}
+
+// access updates the access time of the item.
+func (m *memItem) access() {
+	m.accessTime.Store(m.clock().UnixNano())
 }
 
+// touch updates both the access and modify time of the item.
 func (m *memItem) touch() {
 	m.metaMtx.Lock()
 	defer m.metaMtx.Unlock()
-	now := time.Now()
-	m.accessTime = now
+	now := m.clock()
+	m.accessTime.Store(now.UnixNano())
+	m.modifyTime = now
+}
+
+// modify touches the item whose content is modified,
+// marking it for archiving, see Chattr.
+func (m *memItem) modify() {
+	m.metaMtx.Lock()
+	defer m.metaMtx.Unlock()
+	now := m.clock()
+	m.accessTime.Store(now.UnixNano())
 	m.modifyTime = now
+	m.archive = true
+}
+
+// chtimes replaces the times of the item, see Chtimes.
+func (m *memItem) chtimes(
+	creationTime, accessTime, writeTime, changeTime time.Time,
+) {
+	m.metaMtx.Lock()
+	defer m.metaMtx.Unlock()
+	if !creationTime.IsZero() {
+		m.createTime = creationTime
+	}
+	if !accessTime.IsZero() {
+		m.accessTime.Store(accessTime.UnixNano())
+	}
+	if !writeTime.IsZero() {
+		m.modifyTime = writeTime
+	}
+	if changeTime.IsZero() {
+		changeTime = m.clock()
+	}
+	m.changeTime = changeTime
+}
+
+// setCompressed marks the item as compressed or not,
+// while its content is never compressed actually.
+func (m *memItem) setCompressed(compressed bool) {
+	m.metaMtx.Lock()
+	defer m.metaMtx.Unlock()
+	m.compressed = compressed
+	m.changeTime = m.clock()
+}
+
+// getEa returns a copy of the extended attributes.
+func (m *memItem) getEa() []winfsp.EaEntry {
+	m.metaMtx.Lock()
+	defer m.metaMtx.Unlock()
+	return cloneEa(m.ea)
+}
+
+// setEa merges the extended attributes into the item,
+// where an empty value removes the attribute.
+func (m *memItem) setEa(ea []winfsp.EaEntry) {
+	m.metaMtx.Lock()
+	defer m.metaMtx.Unlock()
+	for _, entry := range ea {
+		m.ea = slices.DeleteFunc(m.ea, func(e winfsp.EaEntry) bool {
+			return strings.EqualFold(e.Name, entry.Name)
+		})
+		if len(entry.Value) != 0 {
+			entry.Value = bytes.Clone(entry.Value)
+			m.ea = append(m.ea, entry)
+		}
+	}
+	m.changeTime = m.clock()
+}
+
+func cloneEa(ea []winfsp.EaEntry) []winfsp.EaEntry {
+	result := slices.Clone(ea)
+	for i := range result {
+		result[i].Value = bytes.Clone(result[i].Value)
+	}
+	return result
 }
 
 type memStat struct {
 	name       string
 	mode       os.FileMode
+	createTime time.Time
+	accessTime time.Time
 	modifyTime time.Time
+	changeTime time.Time
 	size       int64
 	fileID     uint64
+	temporary  bool
+	compressed bool
+	archive    bool
+	offline    uint32
 }
 
 func (s memStat) IsDir() bool        { return s.mode.IsDir() }
@@ -88,7 +267,7 @@ func (s memStat) ModTime() time.Time { return s.modifyTime }
 func (s memStat) Mode() fs.FileMode  { return s.mode }
 func (s memStat) Name() string       { return s.name }
 func (s memStat) Size() int64        { return s.size }
-func (memStat) Sys() any             { return nil }
+func (s memStat) Sys() any           { return s.attributeData() }
 
 var _ os.FileInfo = memStat{}
 
@@ -96,16 +275,82 @@ func (s memStat) FileID() uint64 { return s.fileID }
 
 var _ gofs.FileInfoFileID = memStat{}
 
+func (s memStat) ChangeTime() time.Time { return s.changeTime }
+
+var _ gofs.FileInfoChangeTime = memStat{}
+
+// attributeData reports the distinct creation, access
+// and modify time of the item to gofs, which would
+// otherwise use the modify time for all of them.
+func (s memStat) attributeData() *syscall.Win32FileAttributeData {
+	var attributes uint32
+	if s.mode.IsDir() {
+		attributes |= windows.FILE_ATTRIBUTE_DIRECTORY
+	} else if s.mode.Perm()&0200 == 0 {
+		attributes |= windows.FILE_ATTRIBUTE_READONLY
+	}
+	if s.temporary {
+		attributes |= windows.FILE_ATTRIBUTE_TEMPORARY
+	}
+	if s.compressed {
+		attributes |= windows.FILE_ATTRIBUTE_COMPRESSED
+	}
+	if s.archive {
+		attributes |= windows.FILE_ATTRIBUTE_ARCHIVE
+	}
+	attributes |= s.offline
+	if attributes == 0 {
+		attributes = windows.FILE_ATTRIBUTE_NORMAL
+	}
+	size := uint64(s.size)
+	return &syscall.Win32FileAttributeData{
+		FileAttributes: attributes,
+		CreationTime:   syscall.NsecToFiletime(s.createTime.UnixNano()),
+		LastAccessTime: syscall.NsecToFiletime(s.accessTime.UnixNano()),
+		LastWriteTime:  syscall.NsecToFiletime(s.modifyTime.UnixNano()),
+		FileSizeHigh:   uint32(size >> 32),
+		FileSizeLow:    uint32(size),
+	}
+}
+
 func (item *memItem) stat() os.FileInfo {
 	item.metaMtx.Lock()
 	defer item.metaMtx.Unlock()
 	return memStat{
 		name:       item.name,
 		mode:       item.mode,
+		createTime: item.createTime,
+		accessTime: time.Unix(0, item.accessTime.Load()),
 		modifyTime: item.modifyTime,
+		changeTime: item.changeTime,
 		size:       item.obj.size(),
 		fileID:     uint64(uintptr(unsafe.Pointer(item))),
+		temporary:  item.temporary,
+		compressed: item.compressed,
+		archive:    item.archive,
+		offline:    item.offline,
+	}
+}
+
+// permits tells whether the mode of the item grants
+// the access requested by the flag of OpenFile.
+func (item *memItem) permits(flag int) bool {
+	item.metaMtx.Lock()
+	perm := item.mode.Perm()
+	item.metaMtx.Unlock()
+	var want os.FileMode
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		want = 0400
+	case os.O_WRONLY:
+		want = 0200
+	default:
+		want = 0600
 	}
+	if flag&(os.O_TRUNC|os.O_APPEND) != 0 {
+		want |= 0200
+	}
+	return perm&want == want
 }
 
 type MemFS struct {
@@ -113,7 +358,9 @@ type MemFS struct {
 	rootItem *memItem
 	rootDir  *memDir
 
-	caseInsensitive bool
+	caseInsensitive    bool
+	enforcePermissions bool
+	clock              func() time.Time
 }
 
 func (m *MemFS) keyForName(name string) string {
@@ -124,7 +371,11 @@ func (m *MemFS) keyForName(name string) string {
 }
 
 type newOption struct {
-	caseInsensitive bool
+	caseInsensitive    bool
+	enforcePermissions bool
+	clock              func() time.Time
+	dirs               []string
+	files              map[string][]byte
 }
 
 type NewOption func(*newOption)
@@ -135,26 +386,172 @@ func WithCaseInsensitive(v bool) NewOption {
 	}
 }
 
+// WithEnforcePermissions makes OpenFile check the access
+// requested by the flag against the owner bits of the mode
+// of an existing item, failing with STATUS_ACCESS_DENIED
+// when reading without 0400 or writing or truncating
+// without 0200. A newly created file is always granted.
+//
+// It is intended for exercising the permission denied
+// paths deterministically, and is disabled by default.
+func WithEnforcePermissions(v bool) NewOption {
+	return func(option *newOption) {
+		option.enforcePermissions = v
+	}
+}
+
+// WithClock specifies the source of the times of the
+// items, so that the tests could assert the timestamps
+// deterministically. A nil clock restores time.Now,
+// which is the default.
+func WithClock(clock func() time.Time) NewOption {
+	return func(option *newOption) {
+		option.clock = clock
+	}
+}
+
+// WithDirs seeds the file system with the directories,
+// e.g. `\dir` and `\dir\sub`, whose parents must be the
+// root or be seeded as well, in whatever order.
+func WithDirs(dirs []string) NewOption {
+	return func(option *newOption) {
+		option.dirs = append(option.dirs, dirs...)
+	}
+}
+
+// WithFiles seeds the file system with the files of the
+// content, keyed by their paths, e.g. `\dir\file`, whose
+// parents must be the root or be seeded by WithDirs. The
+// content is copied into the file system.
+func WithFiles(files map[string][]byte) NewOption {
+	return func(option *newOption) {
+		if option.files == nil {
+			option.files = make(map[string][]byte)
+		}
+		maps.Copy(option.files, files)
+	}
+}
+
+// New creates the file system, seeded by WithDirs and
+// WithFiles before it is returned, which panics if the
+// seeds are invalid, e.g. the parent of a seeded file
+// does not exist, since the seeds are fixed by the code
+// of the examples and tests.
 func New(opts ...NewOption) *MemFS {
 	var option newOption
 	for _, opt := range opts {
 		opt(&option)
 	}
+	if option.clock == nil {
+		option.clock = time.Now
+	}
 	rootDir := &memDir{
 		dentries: make(map[string]*memItem),
 	}
 	rootItem := newMemItem(
-		os.FileMode(0777)|os.ModeDir,
+		option.clock, os.FileMode(0777)|os.ModeDir,
 		"\\", rootDir,
 	)
 	result := &MemFS{
-		rootItem:        rootItem,
-		rootDir:         rootDir,
-		caseInsensitive: option.caseInsensitive,
+		rootItem:           rootItem,
+		rootDir:            rootDir,
+		caseInsensitive:    option.caseInsensitive,
+		enforcePermissions: option.enforcePermissions,
+		clock:              option.clock,
+	}
+	if err := result.seed(option.dirs, option.files); err != nil {
+		panic(err)
 	}
 	return result
 }
 
+// seed creates the directories and files of WithDirs
+// and WithFiles, the shallower directories first.
+func (m *MemFS) seed(dirs []string, files map[string][]byte) error {
+	dirs = slices.Clone(dirs)
+	for i := range dirs {
+		dirs[i] = treelock.UnifyFilePath(dirs[i])
+	}
+	slices.SortFunc(dirs, func(a, b string) int {
+		return strings.Count(a, `\`) - strings.Count(b, `\`)
+	})
+	for _, dir := range dirs {
+		if err := m.Mkdir(dir, 0o777); err != nil {
+			return errors.Wrapf(err, "memfs: seed directory %q", dir)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		f, err := m.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o666)
+		if err != nil {
+			return errors.Wrapf(err, "memfs: seed file %q", name)
+		}
+		_, err = f.WriteAt(files[name], 0)
+		_ = f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "memfs: seed file %q", name)
+		}
+	}
+	return nil
+}
+
+// clone deep-copies the item and its descendants,
+// with the fs mtx being held.
+func (item *memItem) clone() *memItem {
+	var obj memObject
+	switch o := item.obj.(type) {
+	case *memFile:
+		o.dataMtx.RLock()
+		obj = &memFile{
+			data:    bytes.Clone(o.data),
+			extents: slices.Clone(o.extents),
+		}
+		o.dataMtx.RUnlock()
+	case *memDir:
+		dentries := make(map[string]*memItem, len(o.dentries))
+		for key, child := range o.dentries {
+			dentries[key] = child.clone()
+		}
+		obj = &memDir{dentries: dentries}
+	}
+	item.metaMtx.Lock()
+	defer item.metaMtx.Unlock()
+	result := &memItem{
+		name:       item.name,
+		mode:       item.mode,
+		createTime: item.createTime,
+		modifyTime: item.modifyTime,
+		changeTime: item.changeTime,
+		obj:        obj,
+		temporary:  item.temporary,
+		compressed: item.compressed,
+		archive:    item.archive,
+		offline:    item.offline,
+		ea:         cloneEa(item.ea),
+		clock:      item.clock,
+	}
+	result.accessTime.Store(item.accessTime.Load())
+	return result
+}
+
+// Clone creates an independent deep copy of the file
+// system, including the file data, modes and times,
+// which is useful for snapshotting in tests.
+//
+// The files opened in the original file system are not
+// carried over, and the file IDs in the copy differ.
+func (m *MemFS) Clone() *MemFS {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	rootItem := m.rootItem.clone()
+	return &MemFS{
+		rootItem:           rootItem,
+		rootDir:            rootItem.obj.(*memDir),
+		caseInsensitive:    m.caseInsensitive,
+		enforcePermissions: m.enforcePermissions,
+		clock:              m.clock,
+	}
+}
+
 type memOpenFile struct {
 	item   *memItem
 	flag   int
@@ -185,9 +582,9 @@ func (m *memOpenFile) ReadAt(p []byte, off int64) (n int, err error) {
 		return 0, windows.ERROR_ACCESS_DENIED
 	}
 
-	defer m.item.touch()
-	m.file.dataMtx.Lock()
-	defer m.file.dataMtx.Unlock()
+	defer m.item.access()
+	m.file.dataMtx.RLock()
+	defer m.file.dataMtx.RUnlock()
 	sliceOff := min(off, int64(len(m.file.data)))
 	numRead := copy(p, m.file.data[sliceOff:])
 	if numRead == 0 && len(p) > 0 {
@@ -222,17 +619,19 @@ func (file *memFile) reserveLocked(size int64) {
 }
 
 func (m *memOpenFile) Truncate(size int64) error {
-	defer m.item.touch()
+	defer m.item.modify()
 	m.file.dataMtx.Lock()
 	defer m.file.dataMtx.Unlock()
 	m.file.reserveLocked(size)
 	m.file.data = m.file.data[:size]
+	m.file.clipLocked(size)
 	return nil
 }
 
 func (m *memOpenFile) writeAtLocked(p []byte, off int64) (n int, err error) {
 	sliceOff := min(off, int64(len(m.file.data)))
 	numWritten := copy(m.file.data[sliceOff:], p)
+	m.file.materializeLocked(sliceOff, int64(numWritten))
 	return numWritten, nil
 }
 
@@ -240,7 +639,7 @@ func (m *memOpenFile) writeWithDataLock(f func() (int, error)) (int, error) {
 	if m.flag&allModeFlags == os.O_RDONLY {
 		return 0, windows.STATUS_ACCESS_DENIED
 	}
-	defer m.item.touch()
+	defer m.item.modify()
 	m.file.dataMtx.Lock()
 	defer m.file.dataMtx.Unlock()
 	return f()
@@ -248,6 +647,15 @@ func (m *memOpenFile) writeWithDataLock(f func() (int, error)) (int, error) {
 
 func (m *memOpenFile) Write(p []byte) (n int, err error) {
 	return m.writeWithDataLock(func() (int, error) {
+		// Appending handle always writes at the end of file,
+		// other handles might have changed the size since
+		// the last write, so the offset is not reliable.
+		if m.flag&os.O_APPEND != 0 {
+			m.file.materializeLocked(int64(len(m.file.data)), int64(len(p)))
+			m.file.data = append(m.file.data, p...)
+			m.offset = int64(len(m.file.data))
+			return len(p), nil
+		}
 		numWritten, err := m.writeAtLocked(p, m.offset)
 		m.offset += int64(numWritten)
 		return numWritten, err
@@ -259,6 +667,9 @@ func (m *memOpenFile) WriteAt(p []byte, off int64) (n int, err error) {
 		if m.flag&os.O_APPEND != 0 {
 			return 0, windows.STATUS_ACCESS_DENIED
 		}
+		if len(p) == 0 {
+			return 0, nil
+		}
 		m.file.reserveLocked(off + int64(len(p)))
 		return m.writeAtLocked(p, off)
 	})
@@ -268,6 +679,7 @@ var _ gofs.File = (*memOpenFile)(nil)
 
 func (m *memOpenFile) Append(buf []byte) (int, error) {
 	return m.writeWithDataLock(func() (int, error) {
+		m.file.materializeLocked(int64(len(m.file.data)), int64(len(buf)))
 		m.file.data = append(m.file.data, buf...)
 		return len(buf), nil
 	})
@@ -281,25 +693,113 @@ func (m *memOpenFile) ConstrainedWriteAt(p []byte, off int64) (int, error) {
 
 var _ gofs.FileWriteEx = (*memOpenFile)(nil)
 
+func (m *memOpenFile) SizeAfterWrite() int64 {
+	m.file.dataMtx.RLock()
+	defer m.file.dataMtx.RUnlock()
+	return m.file.size()
+}
+
+var _ gofs.FileSizeAfterWrite = (*memOpenFile)(nil)
+
 func (m *memOpenFile) Shrink(newSize int64) error {
-	defer m.item.touch()
+	defer m.item.modify()
 	m.file.dataMtx.Lock()
 	defer m.file.dataMtx.Unlock()
 	if newSize < int64(len(m.file.data)) {
 		m.file.data = m.file.data[:newSize]
+		m.file.clipLocked(newSize)
 	}
 	return nil
 }
 
 var _ gofs.FileTruncateEx = (*memOpenFile)(nil)
 
+// AllocatedRanges reports the ranges of the file which
+// have been written, while the ranges of the file only
+// extended by Truncate are holes.
+func (m *memOpenFile) AllocatedRanges() ([]gofs.Range, error) {
+	m.file.dataMtx.RLock()
+	defer m.file.dataMtx.RUnlock()
+	return slices.Clone(m.file.extents), nil
+}
+
+var _ gofs.FileAllocatedRanges = (*memOpenFile)(nil)
+
+// Chattr maps FILE_ATTRIBUTE_READONLY to the write
+// permission bits, clearing all of them and restoring
+// the cleared ones once it is removed, or the owner's
+// write bit if none was cleared by Chattr. It keeps
+// FILE_ATTRIBUTE_TEMPORARY, FILE_ATTRIBUTE_ARCHIVE and
+// the offline attributes, which are the only attributes
+// memfs keeps.
+func (m *memOpenFile) Chattr(attributes uint32) error {
+	m.item.metaMtx.Lock()
+	defer m.item.metaMtx.Unlock()
+	m.item.temporary = attributes&windows.FILE_ATTRIBUTE_TEMPORARY != 0
+	m.item.archive = attributes&windows.FILE_ATTRIBUTE_ARCHIVE != 0
+	m.item.offline = attributes & (windows.FILE_ATTRIBUTE_OFFLINE |
+		windows.FILE_ATTRIBUTE_RECALL_ON_OPEN |
+		windows.FILE_ATTRIBUTE_RECALL_ON_DATA_ACCESS)
+	m.item.changeTime = m.item.clock()
+	if attributes&windows.FILE_ATTRIBUTE_READONLY != 0 {
+		if bits := m.item.mode & 0222; bits != 0 {
+			m.item.writeBits = bits
+		}
+		m.item.mode &^= os.FileMode(0222)
+	} else if m.item.mode&0222 == 0 {
+		bits := m.item.writeBits
+		if bits == 0 {
+			bits = 0200
+		}
+		m.item.mode |= bits
+		m.item.writeBits = 0
+	}
+	return nil
+}
+
+var _ gofs.FileChattr = (*memOpenFile)(nil)
+
+func (m *memOpenFile) SetArchive() error {
+	m.item.metaMtx.Lock()
+	defer m.item.metaMtx.Unlock()
+	m.item.archive = true
+	m.item.changeTime = m.item.clock()
+	return nil
+}
+
+var _ gofs.FileSetArchive = (*memOpenFile)(nil)
+
+func (m *memOpenFile) SetCompressed(compressed bool) error {
+	m.item.setCompressed(compressed)
+	return nil
+}
+
+var _ gofs.FileCompression = (*memOpenFile)(nil)
+
+func (m *memOpenFile) Chtimes(
+	creationTime, accessTime, writeTime, changeTime time.Time,
+) error {
+	m.item.chtimes(creationTime, accessTime, writeTime, changeTime)
+	return nil
+}
+
+var _ gofs.FileChtimes = (*memOpenFile)(nil)
+
 type memOpenDir struct {
-	fs       *MemFS
-	item     *memItem
-	dir      *memDir
-	snapOnce sync.Once
+	fs   *MemFS
+	item *memItem
+	dir  *memDir
+
+	// snapshot is the sorted entries of the directory taken
+	// by the first Readdir, which the following calls page
+	// through by off, so that the enumeration by a handle
+	// is a consistent view regardless of the concurrent
+	// modifications. It is only retaken after a rewind by
+	// seeking to the start, see Seek.
+	snapMtx  sync.Mutex
+	snapped  bool
 	snapshot []os.FileInfo
-	off      int64
+	off      int
 }
 
 const (
@@ -309,41 +809,66 @@ const (
 func (m *memOpenDir) Close() error                                   { return nil }
 func (m *memOpenDir) Read(p []byte) (n int, err error)               { return 0, errIsDir }
 func (m *memOpenDir) ReadAt(p []byte, off int64) (n int, err error)  { return 0, errIsDir }
-func (m *memOpenDir) Seek(offset int64, whence int) (int64, error)   { return 0, errIsDir }
 func (m *memOpenDir) Truncate(size int64) error                      { return errIsDir }
 func (m *memOpenDir) Write(p []byte) (n int, err error)              { return 0, errIsDir }
 func (m *memOpenDir) WriteAt(p []byte, off int64) (n int, err error) { return 0, errIsDir }
 
+// Seek rewinds the enumeration of the directory when
+// seeking to the start, after which the next Readdir
+// takes a new snapshot of the directory, as seeking a
+// directory opened by os.Open does.
+func (m *memOpenDir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errIsDir
+	}
+	m.snapMtx.Lock()
+	defer m.snapMtx.Unlock()
+	m.snapped = false
+	m.snapshot = nil
+	m.off = 0
+	return 0, nil
+}
+
+// Readdir follows the semantics of os.File.Readdir, and
+// pages through the snapshot of the directory taken by
+// its first call, see memOpenDir.
 func (m *memOpenDir) Readdir(count int) ([]os.FileInfo, error) {
-	m.snapOnce.Do(func() {
-		m.fs.mtx.Lock()
-		defer m.fs.mtx.Unlock()
-		var keys []string
-		for key := range m.dir.dentries {
-			keys = append(keys, key)
-		}
-		sort.Strings(keys)
-		var snapshot []os.FileInfo
-		for _, key := range keys {
-			stat := m.dir.dentries[key].stat()
-			snapshot = append(snapshot, stat)
-		}
-		m.snapshot = snapshot
-		m.off = 0
-	})
-	var result []os.FileInfo
+	m.snapMtx.Lock()
+	defer m.snapMtx.Unlock()
+	if !m.snapped {
+		m.takeSnapshot()
+	}
+	remaining := m.snapshot[m.off:]
 	if count <= 0 {
-		result = append(result, m.snapshot...)
-		return result, nil
-	} else {
-		result = make([]os.FileInfo, count)
-		sliceOff := min(m.off, int64(len(m.snapshot)))
-		copied := copy(result, m.snapshot[sliceOff:])
-		if copied == 0 {
-			return nil, io.EOF
-		}
-		return result[:copied], nil
+		m.off = len(m.snapshot)
+		return slices.Clone(remaining), nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	result := slices.Clone(remaining[:min(count, len(remaining))])
+	m.off += len(result)
+	return result, nil
+}
+
+// takeSnapshot snapshots the entries of the directory in
+// the order of their keys, with the snapMtx being held.
+func (m *memOpenDir) takeSnapshot() {
+	m.fs.mtx.Lock()
+	defer m.fs.mtx.Unlock()
+	var keys []string
+	for key := range m.dir.dentries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var snapshot []os.FileInfo
+	for _, key := range keys {
+		stat := m.dir.dentries[key].stat()
+		snapshot = append(snapshot, stat)
 	}
+	m.snapshot = snapshot
+	m.snapped = true
+	m.off = 0
 }
 
 func (m *memOpenDir) Stat() (os.FileInfo, error) {
@@ -357,8 +882,24 @@ func (m *memOpenDir) Sync() error {
 
 var _ gofs.File = (*memOpenDir)(nil)
 
+func (m *memOpenDir) Chtimes(
+	creationTime, accessTime, writeTime, changeTime time.Time,
+) error {
+	m.item.chtimes(creationTime, accessTime, writeTime, changeTime)
+	return nil
+}
+
+var _ gofs.FileChtimes = (*memOpenDir)(nil)
+
+func (m *memOpenDir) SetCompressed(compressed bool) error {
+	m.item.setCompressed(compressed)
+	return nil
+}
+
+var _ gofs.FileCompression = (*memOpenDir)(nil)
+
 func (fs *MemFS) findDirLocked(path string) (*memItem, *memDir, error) {
-	if path == "" || path == "\\" {
+	if treelock.IsRootFilePath(path) {
 		return fs.rootItem, fs.rootDir, nil
 	}
 	var err error
@@ -371,7 +912,7 @@ func (fs *MemFS) findDirLocked(path string) (*memItem, *memDir, error) {
 	key := fs.keyForName(base)
 	item, ok := parentDir.dentries[key]
 	if !ok {
-		return nil, nil, os.ErrNotExist
+		return nil, nil, winfsp.ErrPathNotFound
 	}
 	dir, isDir := item.obj.(*memDir)
 	if !isDir {
@@ -381,7 +922,8 @@ func (fs *MemFS) findDirLocked(path string) (*memItem, *memDir, error) {
 }
 
 func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
-	if name == "" || name == "\\" {
+	name = treelock.UnifyFilePath(name)
+	if treelock.IsRootFilePath(name) {
 		return &memOpenDir{
 			fs:   m,
 			item: m.rootItem,
@@ -402,6 +944,9 @@ func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, er
 
 	var result gofs.File
 	if item, ok := dir.dentries[key]; ok {
+		if m.enforcePermissions && !item.permits(flag) {
+			return nil, windows.STATUS_ACCESS_DENIED
+		}
 		switch t := item.obj.(type) {
 		case *memFile:
 			result = &memOpenFile{
@@ -427,7 +972,7 @@ func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, er
 
 	if flag&os.O_CREATE != 0 && result == nil {
 		file := &memFile{}
-		item := newMemItem(perm.Perm(), base, file)
+		item := newMemItem(m.clock, perm.Perm(), base, file)
 		dir.dentries[key] = item
 		result = &memOpenFile{
 			item: item,
@@ -449,7 +994,8 @@ func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, er
 }
 
 func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
-	if name == "" || name == "\\" {
+	name = treelock.UnifyFilePath(name)
+	if treelock.IsRootFilePath(name) {
 		return os.ErrExist
 	}
 
@@ -468,7 +1014,7 @@ func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
 	}
 
 	dir.dentries[key] = newMemItem(
-		perm.Perm()|fs.ModeDir,
+		m.clock, perm.Perm()|fs.ModeDir,
 		base,
 		&memDir{
 			dentries: make(map[string]*memItem),
@@ -479,7 +1025,8 @@ func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
 }
 
 func (m *MemFS) Remove(name string) error {
-	if name == "\\" || name == "" {
+	name = treelock.UnifyFilePath(name)
+	if treelock.IsRootFilePath(name) {
 		// Cannot delete root directory.
 		return windows.STATUS_ACCESS_DENIED
 	}
@@ -501,6 +1048,20 @@ func (m *MemFS) Remove(name string) error {
 
 	switch obj := item.obj.(type) {
 	case *memFile:
+		item.metaMtx.Lock()
+		temporary := item.temporary
+		item.metaMtx.Unlock()
+		if temporary {
+			// The temporary file is only removed by gofs once
+			// the last handle is being closed, so its data
+			// will not be read anymore.
+			defer func() {
+				obj.dataMtx.Lock()
+				defer obj.dataMtx.Unlock()
+				obj.data = nil
+				obj.extents = nil
+			}()
+		}
 	case *memDir:
 		if len(obj.dentries) > 0 {
 			return windows.STATUS_DIRECTORY_NOT_EMPTY
@@ -515,10 +1076,12 @@ func (m *MemFS) Remove(name string) error {
 }
 
 func (m *MemFS) Rename(src string, tgt string) error {
-	if src == "\\" || src == "" {
+	src = treelock.UnifyFilePath(src)
+	if treelock.IsRootFilePath(src) {
 		return windows.STATUS_ACCESS_DENIED
 	}
-	if tgt == "\\" || tgt == "" {
+	tgt = treelock.UnifyFilePath(tgt)
+	if treelock.IsRootFilePath(tgt) {
 		return windows.STATUS_ACCESS_DENIED
 	}
 
@@ -562,14 +1125,17 @@ func (m *MemFS) Rename(src string, tgt string) error {
 		item.metaMtx.Lock()
 		defer item.metaMtx.Unlock()
 		item.name = tgtBase
+		item.changeTime = item.clock()
 	}()
 	item.touch()
 	return nil
 }
 
-func (m *MemFS) Stat(name string) (os.FileInfo, error) {
-	if name == "" || name == "\\" {
-		return m.rootItem.stat(), nil
+// findItem looks up the item of the file or directory.
+func (m *MemFS) findItem(name string) (*memItem, error) {
+	name = treelock.UnifyFilePath(name)
+	if treelock.IsRootFilePath(name) {
+		return m.rootItem, nil
 	}
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
@@ -585,12 +1151,55 @@ func (m *MemFS) Stat(name string) (os.FileInfo, error) {
 	if !ok {
 		return nil, os.ErrNotExist
 	}
+	return item, nil
+}
 
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	item, err := m.findItem(name)
+	if err != nil {
+		return nil, err
+	}
 	return item.stat(), nil
 }
 
 var _ gofs.FileSystem = (*MemFS)(nil)
 
+func (m *MemFS) GetEa(name string) ([]winfsp.EaEntry, error) {
+	item, err := m.findItem(name)
+	if err != nil {
+		return nil, err
+	}
+	return item.getEa(), nil
+}
+
+func (m *MemFS) SetEa(name string, ea []winfsp.EaEntry) error {
+	item, err := m.findItem(name)
+	if err != nil {
+		return err
+	}
+	item.setEa(ea)
+	return nil
+}
+
+var _ gofs.FileSystemEa = (*MemFS)(nil)
+
+// SyncVolume does nothing, since memfs keeps nothing
+// buffered outside of the memory.
+func (m *MemFS) SyncVolume() error {
+	return nil
+}
+
+var _ gofs.FileSystemSyncVolume = (*MemFS)(nil)
+
+// SupportsOpenRename reports true, since memfs renames
+// files by moving their items between the directories,
+// and the open files keep referring to their items.
+func (m *MemFS) SupportsOpenRename() bool {
+	return true
+}
+
+var _ gofs.FileSystemOpenRename = (*MemFS)(nil)
+
 func (m *MemFS) DefaultOptions() []gofs.NewOption {
 	var result []gofs.NewOption
 	if m.caseInsensitive {
@@ -0,0 +1,3107 @@
+//go:build windows
+
+package memfs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+	"golang.org/x/time/rate"
+
+	"github.com/winfsp/go-winfsp"
+	"github.com/winfsp/go-winfsp/filetime"
+	"github.com/winfsp/go-winfsp/gofs"
+	"github.com/winfsp/go-winfsp/memfs"
+	"github.com/winfsp/go-winfsp/treelock"
+)
+
+func TestOpenRoot(t *testing.T) {
+	fs := memfs.New()
+	if err := fs.Mkdir(`\dir`, 0o777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for _, name := range []string{"", `\`, "/", ".", `\.`, `\dir\..`} {
+		fi, err := fs.Stat(name)
+		if err != nil {
+			t.Errorf("Stat(%q): %v", name, err)
+			continue
+		}
+		if !fi.IsDir() {
+			t.Errorf("Stat(%q): not a directory", name)
+		}
+		f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Errorf("OpenFile(%q): %v", name, err)
+			continue
+		}
+		ents, err := f.Readdir(-1)
+		_ = f.Close()
+		if err != nil {
+			t.Errorf("Readdir(%q): %v", name, err)
+			continue
+		}
+		if len(ents) != 1 || ents[0].Name() != "dir" {
+			t.Errorf("Readdir(%q) = %v; want only dir", name, ents)
+		}
+		if err := fs.Mkdir(name, 0o777); !os.IsExist(err) {
+			t.Errorf("Mkdir(%q) = %v; want exist", name, err)
+		}
+	}
+	if _, err := fs.Stat("dir"); err != nil {
+		t.Errorf("Stat(%q): %v", "dir", err)
+	}
+}
+
+func BenchmarkConcurrentRead(b *testing.B) {
+	fs := memfs.New()
+	f, err := fs.OpenFile(`\file`, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		b.Fatalf("OpenFile: %v", err)
+	}
+	data := bytes.Repeat([]byte{'a'}, 64*1024)
+	if _, err := f.WriteAt(data, 0); err != nil {
+		b.Fatalf("WriteAt: %v", err)
+	}
+	_ = f.Close()
+
+	const chunkSize = 4096
+	b.SetBytes(chunkSize)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		f, err := fs.OpenFile(`\file`, os.O_RDONLY, 0)
+		if err != nil {
+			b.Errorf("OpenFile: %v", err)
+			return
+		}
+		defer f.Close()
+		buf := make([]byte, chunkSize)
+		var off int64
+		for pb.Next() {
+			if _, err := f.ReadAt(buf, off); err != nil {
+				b.Errorf("ReadAt: %v", err)
+				return
+			}
+			if _, err := f.Stat(); err != nil {
+				b.Errorf("Stat: %v", err)
+				return
+			}
+			off = (off + chunkSize) % int64(len(data))
+		}
+	})
+}
+
+func TestWriteAppend(t *testing.T) {
+	fs := memfs.New()
+	f, err := fs.OpenFile(`\file`, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("head"), 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	a, err := fs.OpenFile(`\file`, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer a.Close()
+	if _, err := a.WriteAt([]byte("x"), 0); err == nil {
+		t.Errorf("WriteAt on append handle should fail")
+	}
+
+	// Interleave the appending writes with writes from
+	// the other handle which extends the file.
+	for _, chunk := range []string{"-1", "-2", "-3"} {
+		if _, err := a.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write(%q): %v", chunk, err)
+		}
+		if _, err := f.WriteAt([]byte("+"), 0); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if _, err := f.WriteAt([]byte("."), fi.Size()); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+	}
+	data := make([]byte, 64)
+	n, err := f.ReadAt(data, 0)
+	if err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if got, want := string(data[:n]), "+ead-1.-2.-3."; got != want {
+		t.Errorf("content = %q; want %q", got, want)
+	}
+}
+
+func TestOverwriteReplaceAttributes(t *testing.T) {
+	fs := memfs.New()
+	for _, name := range []string{`\replace`, `\merge`} {
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o444)
+		if err != nil {
+			t.Fatalf("OpenFile(%q): %v", name, err)
+		}
+		if _, err := f.WriteAt([]byte("data"), 0); err != nil {
+			t.Fatalf("WriteAt(%q): %v", name, err)
+		}
+		_ = f.Close()
+	}
+	base := gofs.New(fs)
+	overwriter := base.(winfsp.BehaviourOverwrite)
+	ref := &winfsp.FileSystemRef{}
+	for _, tc := range []struct {
+		name     string
+		replace  bool
+		readOnly bool
+	}{
+		{name: `\replace`, replace: true, readOnly: false},
+		{name: `\merge`, replace: false, readOnly: true},
+	} {
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		file, err := base.Open(ref, tc.name,
+			windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+			windows.FILE_GENERIC_READ|windows.FILE_GENERIC_WRITE, &info)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", tc.name, err)
+		}
+		if info.FileAttributes&windows.FILE_ATTRIBUTE_READONLY == 0 {
+			t.Errorf("%q is not readonly before overwrite", tc.name)
+		}
+		err = overwriter.Overwrite(ref, file,
+			windows.FILE_ATTRIBUTE_ARCHIVE, tc.replace, 0, &info)
+		base.Close(ref, file)
+		if err != nil {
+			t.Fatalf("Overwrite(%q): %v", tc.name, err)
+		}
+		readOnly := info.FileAttributes&windows.FILE_ATTRIBUTE_READONLY != 0
+		if readOnly != tc.readOnly || info.FileSize != 0 {
+			t.Errorf("Overwrite(%q, %v) = readonly %v, size %d",
+				tc.name, tc.replace, readOnly, info.FileSize)
+		}
+	}
+
+	// The write bits cleared by the read-only attribute are
+	// all restored once it is removed.
+	f, err := fs.OpenFile(`\shared`, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	_ = f.Close()
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\shared`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_GENERIC_READ|windows.FILE_GENERIC_WRITE, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	for _, tc := range []struct {
+		attributes uint32
+		perm       os.FileMode
+	}{
+		{windows.FILE_ATTRIBUTE_READONLY, 0o444},
+		{0, 0o666},
+	} {
+		err := overwriter.Overwrite(ref, file, tc.attributes, true, 0, &info)
+		if err != nil {
+			t.Fatalf("Overwrite(%#x): %v", tc.attributes, err)
+		}
+		stat, err := fs.Stat(`\shared`)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if perm := stat.Mode().Perm(); perm != tc.perm {
+			t.Errorf("Overwrite(%#x) perm = %v; want %v",
+				tc.attributes, perm, tc.perm)
+		}
+	}
+}
+
+// denyFS denies opening the items without any read
+// permission, unless they are opened for backup.
+type denyFS struct {
+	*memfs.MemFS
+}
+
+func (fs denyFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	if fi, err := fs.MemFS.Stat(name); err == nil && fi.Mode().Perm()&0o444 == 0 {
+		return nil, os.ErrPermission
+	}
+	return fs.MemFS.OpenFile(name, flag, perm)
+}
+
+func (fs denyFS) OpenFileBackup(name string, flag int) (gofs.File, error) {
+	return fs.MemFS.OpenFile(name, flag, 0)
+}
+
+func TestOpenBackupIntent(t *testing.T) {
+	inner := memfs.New()
+	if err := inner.Mkdir(`\tree`, 0); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	f, err := inner.OpenFile(`\tree\file`, os.O_CREATE|os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	_ = f.Close()
+
+	allowed := true
+	base, err := gofs.NewOptions(denyFS{inner},
+		gofs.WithBackupIntent(func(*winfsp.FileSystemRef) bool {
+			return allowed
+		}))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	open := func(name string, createOptions, access uint32) (uintptr, error) {
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		return base.Open(ref, name,
+			windows.FILE_OPEN<<winfsp.CreateDispositionShift|createOptions,
+			access, &info)
+	}
+
+	// Opening without backup intent is denied.
+	if _, err := open(`\tree\file`, 0, windows.FILE_READ_DATA); err == nil {
+		t.Errorf("Open without backup intent should fail")
+	}
+
+	// Writing is never granted by backup intent.
+	if _, err := open(`\tree\file`, windows.FILE_OPEN_FOR_BACKUP_INTENT,
+		windows.FILE_READ_DATA|windows.FILE_WRITE_DATA); err == nil {
+		t.Errorf("Open for writing with backup intent should fail")
+	}
+
+	file, err := open(`\tree\file`, windows.FILE_OPEN_FOR_BACKUP_INTENT,
+		windows.FILE_READ_DATA)
+	if err != nil {
+		t.Fatalf("Open file for backup: %v", err)
+	}
+	base.Close(ref, file)
+
+	dir, err := open(`\tree`, windows.FILE_OPEN_FOR_BACKUP_INTENT|
+		windows.FILE_DIRECTORY_FILE, windows.FILE_LIST_DIRECTORY)
+	if err != nil {
+		t.Fatalf("Open directory for backup: %v", err)
+	}
+	defer base.Close(ref, dir)
+	var names []string
+	err = base.(winfsp.BehaviourReadDirectory).ReadDirectory(ref, dir, "",
+		func(name string, _ *winfsp.FSP_FSCTL_FILE_INFO) (bool, error) {
+			names = append(names, name)
+			return true, nil
+		})
+	if err != nil {
+		t.Fatalf("ReadDirectory: %v", err)
+	}
+	if len(names) != 1 || names[0] != "file" {
+		t.Errorf("ReadDirectory = %v; want only file", names)
+	}
+
+	// The intent is ignored unless the hook allows it.
+	allowed = false
+	if _, err := open(`\tree\file`, windows.FILE_OPEN_FOR_BACKUP_INTENT,
+		windows.FILE_READ_DATA); err == nil {
+		t.Errorf("Open for backup should fail when disallowed")
+	}
+}
+
+// statCountFS counts the stats made on the opened files.
+type statCountFS struct {
+	*memfs.MemFS
+	stats *atomic.Int64
+}
+
+type statCountFile struct {
+	gofs.File
+	stats *atomic.Int64
+}
+
+func (f statCountFile) Stat() (os.FileInfo, error) {
+	f.stats.Add(1)
+	return f.File.Stat()
+}
+
+func (fs statCountFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return statCountFile{File: f, stats: fs.stats}, nil
+}
+
+func TestFileInfoCacheTTL(t *testing.T) {
+	var stats atomic.Int64
+	base, err := gofs.NewOptions(
+		statCountFS{MemFS: memfs.New(), stats: &stats},
+		gofs.WithFileInfoCacheTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\file`,
+		windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.FILE_WRITE_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	getFileInfo := base.(winfsp.BehaviourGetFileInfo).GetFileInfo
+
+	// Only the first query within the TTL stats the file.
+	before := stats.Load()
+	for i := 0; i < 3; i++ {
+		if err := getFileInfo(ref, file, &info); err != nil {
+			t.Fatalf("GetFileInfo: %v", err)
+		}
+	}
+	if n := stats.Load() - before; n != 1 {
+		t.Errorf("GetFileInfo made %d stats within TTL; want 1", n)
+	}
+
+	// Writing to the handle invalidates the cache.
+	_, err = base.(winfsp.BehaviourWrite).Write(
+		ref, file, []byte("data"), 0, false, false, nil)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	before = stats.Load()
+	if err := getFileInfo(ref, file, &info); err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	if n := stats.Load() - before; n != 1 || info.FileSize != 4 {
+		t.Errorf("GetFileInfo after write made %d stats, size %d; want 1, 4",
+			n, info.FileSize)
+	}
+}
+
+// slowFS blocks opening files until release is closed,
+// simulating a hung backend.
+type slowFS struct {
+	*memfs.MemFS
+	release chan struct{}
+	closed  chan struct{}
+}
+
+type closeNotifyFile struct {
+	gofs.File
+	closed chan struct{}
+}
+
+func (f closeNotifyFile) Close() error {
+	close(f.closed)
+	return f.File.Close()
+}
+
+func (fs slowFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	<-fs.release
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return closeNotifyFile{File: f, closed: fs.closed}, nil
+}
+
+func TestOperationTimeout(t *testing.T) {
+	inner := slowFS{
+		MemFS:   memfs.New(),
+		release: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	base, err := gofs.NewOptions(inner,
+		gofs.WithOperationTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	_, err = base.Open(ref, `\file`,
+		windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA, &info)
+	if err != windows.STATUS_IO_TIMEOUT {
+		t.Fatalf("Open = %v; want STATUS_IO_TIMEOUT", err)
+	}
+
+	// The file opened after the timeout is discarded.
+	close(inner.release)
+	select {
+	case <-inner.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("orphaned file is not closed")
+	}
+
+	if _, err := gofs.NewOptions(inner,
+		gofs.WithOperationTimeout(-time.Second)); err == nil {
+		t.Errorf("NewOptions with negative timeout should fail")
+	}
+}
+
+func TestDistinctTimes(t *testing.T) {
+	base := gofs.New(memfs.New())
+	ref := &winfsp.FileSystemRef{}
+	var created winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\file`,
+		windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.FILE_WRITE_DATA, &created)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+
+	// Windows clock might only tick every few milliseconds.
+	time.Sleep(50 * time.Millisecond)
+	_, err = base.(winfsp.BehaviourWrite).Write(
+		ref, file, []byte("data"), 0, false, false, nil)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	err = base.(winfsp.BehaviourGetFileInfo).GetFileInfo(ref, file, &info)
+	if err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	if info.CreationTime != created.CreationTime {
+		t.Errorf("CreationTime changed from %d to %d by write",
+			created.CreationTime, info.CreationTime)
+	}
+	if info.LastWriteTime <= info.CreationTime {
+		t.Errorf("LastWriteTime = %d; want later than CreationTime %d",
+			info.LastWriteTime, info.CreationTime)
+	}
+}
+
+func TestChangeTime(t *testing.T) {
+	var now atomic.Int64
+	now.Store(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano())
+	clock := func() time.Time { return time.Unix(0, now.Add(int64(time.Second))) }
+	base := gofs.New(memfs.New(memfs.WithClock(clock)))
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\file`,
+		windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+		windows.FILE_WRITE_DATA|windows.FILE_WRITE_ATTRIBUTES, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	setter := base.(winfsp.BehaviourSetBasicInfo)
+
+	// The change time is set independently of the write time.
+	changeTime := filetime.Timestamp(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	err = setter.SetBasicInfo(ref, file, winfsp.SetBasicInfoChangeTime,
+		windows.INVALID_FILE_ATTRIBUTES, 0, 0, 0, changeTime, &info)
+	if err != nil {
+		t.Fatalf("SetBasicInfo: %v", err)
+	}
+	if info.ChangeTime != changeTime {
+		t.Errorf("ChangeTime = %d; want %d", info.ChangeTime, changeTime)
+	}
+	if info.LastWriteTime == changeTime {
+		t.Errorf("LastWriteTime follows the ChangeTime set")
+	}
+
+	// Writing the data does not change the metadata.
+	_, err = base.(winfsp.BehaviourWrite).Write(
+		ref, file, []byte("data"), 0, false, false, &info)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	err = base.(winfsp.BehaviourGetFileInfo).GetFileInfo(ref, file, &info)
+	if err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	if info.ChangeTime != changeTime {
+		t.Errorf("ChangeTime after Write = %d; want %d", info.ChangeTime, changeTime)
+	}
+
+	// Setting the other times changes the metadata.
+	writeTime := filetime.Timestamp(time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC))
+	err = setter.SetBasicInfo(ref, file, winfsp.SetBasicInfoLastWriteTime,
+		windows.INVALID_FILE_ATTRIBUTES, 0, 0, writeTime, 0, &info)
+	if err != nil {
+		t.Fatalf("SetBasicInfo: %v", err)
+	}
+	if info.LastWriteTime != writeTime {
+		t.Errorf("LastWriteTime = %d; want %d", info.LastWriteTime, writeTime)
+	}
+	if info.ChangeTime <= writeTime || info.ChangeTime == changeTime {
+		t.Errorf("ChangeTime = %d; want the current time", info.ChangeTime)
+	}
+
+	// Changing the attributes goes through Chattr, which
+	// clears the ARCHIVE set by the Write.
+	if info.FileAttributes&windows.FILE_ATTRIBUTE_ARCHIVE == 0 {
+		t.Fatalf("FileAttributes after Write = %#x; want ARCHIVE", info.FileAttributes)
+	}
+	err = setter.SetBasicInfo(ref, file, winfsp.SetBasicInfoAttributes,
+		windows.FILE_ATTRIBUTE_NORMAL, 0, 0, 0, 0, &info)
+	if err != nil {
+		t.Fatalf("SetBasicInfo attributes: %v", err)
+	}
+	if info.FileAttributes&windows.FILE_ATTRIBUTE_ARCHIVE != 0 {
+		t.Errorf("FileAttributes = %#x; want ARCHIVE cleared", info.FileAttributes)
+	}
+}
+
+func TestFrozenClock(t *testing.T) {
+	frozen := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := func() time.Time { return frozen }
+	base, err := gofs.NewOptions(memfs.New(memfs.WithClock(clock)),
+		gofs.WithClock(clock), gofs.WithFileInfoCacheTTL(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	reader, err := base.Open(ref, `\file`,
+		windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, reader)
+	writer, err := base.Open(ref, `\file`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_WRITE_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, writer)
+
+	getFileInfo := base.(winfsp.BehaviourGetFileInfo).GetFileInfo
+	if err := getFileInfo(ref, reader, &info); err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	_, err = base.(winfsp.BehaviourWrite).Write(
+		ref, writer, []byte("data"), 0, false, false, nil)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// The frozen clock keeps the info cached by the reader
+	// fresh, despite the write through the other handle.
+	if err := getFileInfo(ref, reader, &info); err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	if info.FileSize != 0 {
+		t.Errorf("cached FileSize = %d; want 0", info.FileSize)
+	}
+	if err := getFileInfo(ref, writer, &info); err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	if info.FileSize != 4 {
+		t.Errorf("FileSize = %d; want 4", info.FileSize)
+	}
+	want := filetime.Timestamp(frozen)
+	if info.CreationTime != want || info.LastAccessTime != want ||
+		info.LastWriteTime != want || info.ChangeTime != want {
+		t.Errorf("times = %d, %d, %d, %d; want all %d",
+			info.CreationTime, info.LastAccessTime,
+			info.LastWriteTime, info.ChangeTime, want)
+	}
+}
+
+// modeFS overrides the modes of the files in memfs,
+// simulating a backend of special files.
+type modeFS struct {
+	*memfs.MemFS
+	modes map[string]os.FileMode
+}
+
+type modeFile struct {
+	gofs.File
+	mode os.FileMode
+}
+
+type modeInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (fi modeInfo) Mode() os.FileMode { return fi.mode }
+
+func (f modeFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return modeInfo{FileInfo: fi, mode: f.mode}, nil
+}
+
+func (fs modeFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if mode, ok := fs.modes[name]; ok {
+		return modeFile{File: f, mode: mode}, nil
+	}
+	return f, nil
+}
+
+func TestSpecialFileModes(t *testing.T) {
+	inner := modeFS{
+		MemFS: memfs.New(),
+		modes: map[string]os.FileMode{
+			`\link`:   os.ModeSymlink | 0o777,
+			`\fifo`:   os.ModeNamedPipe | 0o644,
+			`\socket`: os.ModeSocket | 0o644,
+			`\chr`:    os.ModeDevice | os.ModeCharDevice | 0o644,
+			`\blk`:    os.ModeDevice | 0o644,
+			`\odd`:    os.ModeIrregular | 0o644,
+		},
+	}
+	for name := range inner.modes {
+		f, err := inner.MemFS.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			t.Fatalf("OpenFile(%q): %v", name, err)
+		}
+		_ = f.Close()
+	}
+	base := gofs.New(inner)
+	ref := &winfsp.FileSystemRef{}
+	for _, tc := range []struct {
+		name       string
+		attributes uint32
+		reparseTag uint32
+	}{
+		{`\link`, windows.FILE_ATTRIBUTE_REPARSE_POINT, windows.IO_REPARSE_TAG_SYMLINK},
+		{`\fifo`, windows.FILE_ATTRIBUTE_REPARSE_POINT, 0x80000024},
+		{`\socket`, windows.FILE_ATTRIBUTE_REPARSE_POINT, 0x80000023},
+		{`\chr`, windows.FILE_ATTRIBUTE_REPARSE_POINT, 0x80000025},
+		{`\blk`, windows.FILE_ATTRIBUTE_REPARSE_POINT, 0x80000026},
+		{`\odd`, windows.FILE_ATTRIBUTE_SYSTEM, 0},
+	} {
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		file, err := base.Open(ref, tc.name,
+			windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+			windows.FILE_READ_ATTRIBUTES, &info)
+		if err != nil {
+			t.Errorf("Open(%q): %v", tc.name, err)
+			continue
+		}
+		base.Close(ref, file)
+		if info.FileAttributes != tc.attributes || info.ReparseTag != tc.reparseTag {
+			t.Errorf("Open(%q) attributes, tag = %#x, %#x; want %#x, %#x",
+				tc.name, info.FileAttributes, info.ReparseTag,
+				tc.attributes, tc.reparseTag)
+		}
+	}
+}
+
+// linkFS resolves the symbolic links listed in links,
+// while reporting them as regular files through memfs,
+// simulating a backend whose Readdir loses the links.
+type linkFS struct {
+	*memfs.MemFS
+	links map[string]string
+}
+
+func (fs linkFS) Readlink(name string) (string, error) {
+	if target, ok := fs.links[name]; ok {
+		return target, nil
+	}
+	return "", os.ErrInvalid
+}
+
+func TestReadDirectoryReparseTag(t *testing.T) {
+	inner := memfs.New()
+	if err := inner.Mkdir(`\dir`, 0o755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for _, name := range []string{`\dir\file`, `\dir\link`} {
+		f, err := inner.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			t.Fatalf("OpenFile(%q): %v", name, err)
+		}
+		_ = f.Close()
+	}
+	base := gofs.New(linkFS{
+		MemFS: inner,
+		links: map[string]string{`\dir\link`: `file`},
+	})
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	dir, err := base.Open(ref, `\dir`,
+		(windows.FILE_OPEN<<winfsp.CreateDispositionShift)|
+			windows.FILE_DIRECTORY_FILE,
+		windows.FILE_LIST_DIRECTORY, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, dir)
+	type entry struct{ attributes, reparseTag uint32 }
+	entries := make(map[string]entry)
+	err = base.(winfsp.BehaviourReadDirectory).ReadDirectory(ref, dir, "",
+		func(name string, info *winfsp.FSP_FSCTL_FILE_INFO) (bool, error) {
+			entries[name] = entry{info.FileAttributes, info.ReparseTag}
+			return true, nil
+		})
+	if err != nil {
+		t.Fatalf("ReadDirectory: %v", err)
+	}
+	want := map[string]entry{
+		"file": {windows.FILE_ATTRIBUTE_NORMAL, 0},
+		"link": {windows.FILE_ATTRIBUTE_REPARSE_POINT, windows.IO_REPARSE_TAG_SYMLINK},
+	}
+	if !maps.Equal(entries, want) {
+		t.Errorf("ReadDirectory = %v; want %v", entries, want)
+	}
+
+	// The directory info looked up by name agrees with it.
+	_, dirInfo, err := getDirInfoByName(base, ref, dir, "link")
+	if err != nil {
+		t.Fatalf("GetDirInfoByName: %v", err)
+	}
+	if dirInfo.ReparseTag != windows.IO_REPARSE_TAG_SYMLINK {
+		t.Errorf("GetDirInfoByName tag = %#x; want %#x",
+			dirInfo.ReparseTag, windows.IO_REPARSE_TAG_SYMLINK)
+	}
+
+	// So does the information of the opened link, whose
+	// reparse point could be read.
+	link, err := base.Open(ref, `\dir\link`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_ATTRIBUTES, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, link)
+	if info.ReparseTag != windows.IO_REPARSE_TAG_SYMLINK {
+		t.Errorf("Open tag = %#x; want %#x",
+			info.ReparseTag, windows.IO_REPARSE_TAG_SYMLINK)
+	}
+	control := base.(winfsp.BehaviourDeviceIoControl)
+	data, err := control.DeviceIoControl(
+		ref, link, windows.FSCTL_GET_REPARSE_POINT, nil)
+	if err != nil {
+		t.Fatalf("FSCTL_GET_REPARSE_POINT: %v", err)
+	}
+	tag, target, err := winfsp.ParseReparse(data)
+	if err != nil || tag != windows.IO_REPARSE_TAG_SYMLINK || target != "file" {
+		t.Errorf("ParseReparse = %#x, %q, %v; want symlink to %q",
+			tag, target, err, "file")
+	}
+	_, err = control.DeviceIoControl(
+		ref, dir, windows.FSCTL_GET_REPARSE_POINT, nil)
+	if err != windows.STATUS_NOT_A_REPARSE_POINT {
+		t.Errorf("FSCTL_GET_REPARSE_POINT on directory = %v; want %v",
+			err, windows.STATUS_NOT_A_REPARSE_POINT)
+	}
+}
+
+const helloWorld = "Hello, World!\n"
+
+// countWatchFS counts the directories being watched.
+type countWatchFS struct {
+	*memfs.MemFS
+	mtx      sync.Mutex
+	watching int
+}
+
+func (fs *countWatchFS) Watch(name string) (<-chan gofs.ChangeEvent, func(), error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.watching++
+	return make(chan gofs.ChangeEvent), func() {
+		fs.mtx.Lock()
+		defer fs.mtx.Unlock()
+		fs.watching--
+	}, nil
+}
+
+func (fs *countWatchFS) count() int {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return fs.watching
+}
+
+func TestWatchPerVolume(t *testing.T) {
+	inner := &countWatchFS{MemFS: memfs.New()}
+	base := gofs.New(inner)
+	open := func(ref *winfsp.FileSystemRef) uintptr {
+		t.Helper()
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		dir, err := base.Open(ref, `\`,
+			(windows.FILE_OPEN<<winfsp.CreateDispositionShift)|
+				windows.FILE_DIRECTORY_FILE,
+			windows.FILE_LIST_DIRECTORY, &info)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return dir
+	}
+
+	// The handles opened through the same volume share
+	// the watch, while the other volume, e.g. mounted by
+	// MountMany, has its own.
+	first, second := &winfsp.FileSystemRef{}, &winfsp.FileSystemRef{}
+	a, b := open(first), open(first)
+	if got := inner.count(); got != 1 {
+		t.Errorf("watches of one volume = %d; want 1", got)
+	}
+	c := open(second)
+	if got := inner.count(); got != 2 {
+		t.Errorf("watches of two volumes = %d; want 2", got)
+	}
+	base.Close(first, a)
+	base.Close(first, b)
+	base.Close(second, c)
+
+	// The inner watches are stopped asynchronously.
+	deadline := time.Now().Add(10 * time.Second)
+	for inner.count() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := inner.count(); got != 0 {
+		t.Errorf("watches after closing = %d; want 0", got)
+	}
+}
+
+func TestDirectoryNeverNormal(t *testing.T) {
+	inner := memfs.New()
+	for name, perm := range map[string]os.FileMode{`\ro`: 0o555, `\rw`: 0o755} {
+		if err := inner.Mkdir(name, perm); err != nil {
+			t.Fatalf("Mkdir(%q): %v", name, err)
+		}
+	}
+	for _, mode := range []gofs.AttribReadOnlyTransMode{
+		gofs.AttribReadOnlyWindows,
+		gofs.AttribReadOnlyBypass,
+		gofs.AttribReadOnlyAlways,
+		gofs.AttribReadOnlyPOSIX,
+		gofs.AttribReadOnlyWindows | gofs.AttribReadOnlyHonorSys,
+	} {
+		base, err := gofs.NewOptions(inner, gofs.WithAttribReadOnlyTransMode(mode))
+		if err != nil {
+			t.Fatalf("NewOptions: %v", err)
+		}
+		ref := &winfsp.FileSystemRef{}
+		check := func(op, name string, attributes uint32) {
+			t.Helper()
+			if attributes&windows.FILE_ATTRIBUTE_DIRECTORY == 0 ||
+				attributes&windows.FILE_ATTRIBUTE_NORMAL != 0 {
+				t.Errorf("mode %d: %s(%q) attributes = %#x; want directory without normal",
+					mode, op, name, attributes)
+			}
+		}
+		for _, name := range []string{`\`, `\ro`, `\rw`} {
+			var info winfsp.FSP_FSCTL_FILE_INFO
+			dir, err := base.Open(ref, name,
+				(windows.FILE_OPEN<<winfsp.CreateDispositionShift)|
+					windows.FILE_DIRECTORY_FILE,
+				windows.FILE_LIST_DIRECTORY, &info)
+			if err != nil {
+				t.Fatalf("Open(%q): %v", name, err)
+			}
+			check("Open", name, info.FileAttributes)
+			if name == `\` {
+				err = base.(winfsp.BehaviourReadDirectory).ReadDirectory(ref, dir, "",
+					func(name string, info *winfsp.FSP_FSCTL_FILE_INFO) (bool, error) {
+						check("ReadDirectory", name, info.FileAttributes)
+						return true, nil
+					})
+				if err != nil {
+					t.Errorf("ReadDirectory: %v", err)
+				}
+			}
+			base.Close(ref, dir)
+		}
+	}
+}
+
+func TestZeroLengthTransfer(t *testing.T) {
+	base := gofs.New(memfs.New())
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\a`,
+		windows.FILE_CREATE<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.FILE_WRITE_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	writer := base.(winfsp.BehaviourWrite)
+	reader := base.(winfsp.BehaviourRead)
+	if _, err := writer.Write(ref, file, []byte(helloWorld), 0,
+		false, false, &info); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	size := uint64(len(helloWorld))
+	for _, offset := range []uint64{0, 5, size, size + 100} {
+		if n, err := reader.Read(ref, file, nil, offset); n != 0 || err != nil {
+			t.Errorf("zero length Read at %d = %d, %v; want 0, nil",
+				offset, n, err)
+		}
+		for _, toEnd := range []bool{false, true} {
+			n, err := writer.Write(ref, file, nil, offset, toEnd, false, &info)
+			if n != 0 || err != nil {
+				t.Errorf("zero length Write at %d, to end %v = %d, %v; want 0, nil",
+					offset, toEnd, n, err)
+			}
+			if info.FileSize != size {
+				t.Errorf("zero length Write at %d, to end %v: size = %d; want %d",
+					offset, toEnd, info.FileSize, size)
+			}
+		}
+	}
+}
+
+func TestReadOnlyPaths(t *testing.T) {
+	inner := memfs.New()
+	for _, dir := range []string{`\ro`, `\rw`} {
+		if err := inner.Mkdir(dir, 0o755); err != nil {
+			t.Fatalf("Mkdir(%q): %v", dir, err)
+		}
+		f, err := inner.OpenFile(dir+`\file`, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		_, _ = f.Write([]byte(helloWorld))
+		_ = f.Close()
+	}
+	base, err := gofs.NewOptions(inner,
+		gofs.WithCaseInsensitive(true),
+		gofs.WithReadOnlyPaths([]string{"/RO"}))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	open := func(name string, disposition, access uint32) (uintptr, error) {
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		return base.Open(ref, name,
+			disposition<<winfsp.CreateDispositionShift, access, &info)
+	}
+	canDelete := base.(winfsp.BehaviourCanDelete).CanDelete
+	rename := base.(winfsp.BehaviourRename).Rename
+
+	// The file under the read only path can only be read.
+	file, err := open(`\ro\file`, windows.FILE_OPEN,
+		windows.FILE_READ_DATA|windows.DELETE)
+	if err != nil {
+		t.Fatalf("Open for reading: %v", err)
+	}
+	defer base.Close(ref, file)
+	buf := make([]byte, len(helloWorld))
+	if n, err := base.(winfsp.BehaviourRead).Read(ref, file, buf, 0); err != nil ||
+		string(buf[:n]) != helloWorld {
+		t.Errorf("Read = %q, %v; want %q", buf[:n], err, helloWorld)
+	}
+	for _, tc := range []struct {
+		name        string
+		disposition uint32
+		access      uint32
+	}{
+		{`\ro\file`, windows.FILE_OPEN, windows.FILE_WRITE_DATA},
+		{`\RO\file`, windows.FILE_OPEN, windows.FILE_APPEND_DATA},
+		{`\ro\file`, windows.FILE_OVERWRITE, windows.FILE_READ_DATA},
+		{`\ro\new`, windows.FILE_CREATE, windows.FILE_READ_DATA},
+	} {
+		if _, err := open(tc.name, tc.disposition, tc.access); err !=
+			windows.STATUS_MEDIA_WRITE_PROTECTED {
+			t.Errorf("Open(%q, %d, %#x) = %v; want STATUS_MEDIA_WRITE_PROTECTED",
+				tc.name, tc.disposition, tc.access, err)
+		}
+	}
+	if err := canDelete(ref, file, `\ro\file`); err !=
+		windows.STATUS_MEDIA_WRITE_PROTECTED {
+		t.Errorf("CanDelete = %v; want STATUS_MEDIA_WRITE_PROTECTED", err)
+	}
+	if err := rename(ref, file, `\ro\file`, `\rw\moved`, false); err !=
+		windows.STATUS_MEDIA_WRITE_PROTECTED {
+		t.Errorf("Rename out = %v; want STATUS_MEDIA_WRITE_PROTECTED", err)
+	}
+	setTimes := func(file uintptr) error {
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		writeTime := filetime.Timestamp(time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC))
+		return base.(winfsp.BehaviourSetBasicInfo).SetBasicInfo(
+			ref, file, winfsp.SetBasicInfoLastWriteTime,
+			windows.INVALID_FILE_ATTRIBUTES, 0, 0, writeTime, 0, &info)
+	}
+	if err := setTimes(file); err != windows.STATUS_MEDIA_WRITE_PROTECTED {
+		t.Errorf("SetBasicInfo = %v; want STATUS_MEDIA_WRITE_PROTECTED", err)
+	}
+
+	// The sibling remains writable, but cannot be moved
+	// into the read only path.
+	sibling, err := open(`\rw\file`, windows.FILE_OPEN,
+		windows.FILE_WRITE_DATA|windows.DELETE)
+	if err != nil {
+		t.Fatalf("Open sibling for writing: %v", err)
+	}
+	defer base.Close(ref, sibling)
+	if err := rename(ref, sibling, `\rw\file`, `\ro\moved`, false); err !=
+		windows.STATUS_MEDIA_WRITE_PROTECTED {
+		t.Errorf("Rename in = %v; want STATUS_MEDIA_WRITE_PROTECTED", err)
+	}
+	if err := canDelete(ref, sibling, `\rw\file`); err != nil {
+		t.Errorf("CanDelete sibling: %v", err)
+	}
+	if err := setTimes(sibling); err != nil {
+		t.Errorf("SetBasicInfo sibling: %v", err)
+	}
+	if err := rename(ref, sibling, `\rw\file`, `\rw\moved`, false); err != nil {
+		t.Errorf("Rename sibling: %v", err)
+	}
+	if _, err := gofs.NewOptions(inner,
+		gofs.WithReadOnlyPaths([]string{"/["})); err == nil {
+		t.Errorf("NewOptions with malformed pattern should fail")
+	}
+}
+
+func TestNoBufferingAlignment(t *testing.T) {
+	base := gofs.New(memfs.New())
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\a`,
+		(windows.FILE_CREATE<<winfsp.CreateDispositionShift)|
+			windows.FILE_NO_INTERMEDIATE_BUFFERING,
+		windows.FILE_READ_DATA|windows.FILE_WRITE_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	writer := base.(winfsp.BehaviourWrite)
+	reader := base.(winfsp.BehaviourRead)
+	if n, err := writer.Write(ref, file, make([]byte, 1024), 0,
+		false, false, &info); err != nil || n != 1024 {
+		t.Fatalf("aligned Write = %d, %v; want 1024, nil", n, err)
+	}
+	if n, err := reader.Read(ref, file, make([]byte, 512), 512); err != nil || n != 512 {
+		t.Errorf("aligned Read = %d, %v; want 512, nil", n, err)
+	}
+	for _, tc := range []struct {
+		offset uint64
+		length int
+	}{
+		{1, 512},
+		{0, 100},
+		{512, 513},
+	} {
+		_, err := reader.Read(ref, file, make([]byte, tc.length), tc.offset)
+		if err != windows.STATUS_INVALID_PARAMETER {
+			t.Errorf("Read(%d, %d) = %v; want STATUS_INVALID_PARAMETER",
+				tc.offset, tc.length, err)
+		}
+		_, err = writer.Write(ref, file, make([]byte, tc.length), tc.offset,
+			false, false, &info)
+		if err != windows.STATUS_INVALID_PARAMETER {
+			t.Errorf("Write(%d, %d) = %v; want STATUS_INVALID_PARAMETER",
+				tc.offset, tc.length, err)
+		}
+	}
+
+	// The handles opened with buffering are not restricted.
+	buffered, err := base.Open(ref, `\a`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, buffered)
+	if n, err := reader.Read(ref, buffered, make([]byte, 100), 1); err != nil || n != 100 {
+		t.Errorf("unaligned buffered Read = %d, %v; want 100, nil", n, err)
+	}
+}
+
+func TestReadDuringRename(t *testing.T) {
+	inner := memfs.New()
+	f, err := inner.OpenFile(`\a`, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	_, _ = f.Write([]byte(helloWorld))
+	_ = f.Close()
+	base := gofs.New(inner)
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\a`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.DELETE, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+
+	read := base.(winfsp.BehaviourRead).Read
+	rename := base.(winfsp.BehaviourRename).Rename
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for range 4 {
+		go func() {
+			buf := make([]byte, len(helloWorld))
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				n, err := read(ref, file, buf, 0)
+				if err != nil || string(buf[:n]) != helloWorld {
+					errs <- errors.Errorf("Read = %q, %v", buf[:n], err)
+					return
+				}
+			}
+		}()
+	}
+	names := []string{`\a`, `\b`}
+	for i := range 1000 {
+		if err := rename(ref, file, names[i%2], names[(i+1)%2], false); err != nil {
+			t.Errorf("Rename: %v", err)
+			break
+		}
+	}
+	close(done)
+	for range 4 {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// flakyOpenFS fails the specified number of the following
+// opens, simulating a transient failure of the backend.
+type flakyOpenFS struct {
+	*memfs.MemFS
+	failures *atomic.Int64
+}
+
+func (fs flakyOpenFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	if fs.failures.Add(-1) >= 0 {
+		return nil, windows.ERROR_NETWORK_BUSY
+	}
+	return fs.MemFS.OpenFile(name, flag, perm)
+}
+
+// SupportsOpenRename reports false so that the file is
+// reopened by Rename.
+func (fs flakyOpenFS) SupportsOpenRename() bool {
+	return false
+}
+
+func TestRenameReopenFailure(t *testing.T) {
+	inner := flakyOpenFS{MemFS: memfs.New(), failures: &atomic.Int64{}}
+	f, err := inner.MemFS.OpenFile(`\a`, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	_, _ = f.Write([]byte(helloWorld))
+	_ = f.Close()
+	base := gofs.New(inner)
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\a`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.DELETE, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+
+	// Both the reopening by Rename and by the next Read fail.
+	inner.failures.Store(2)
+	err = base.(winfsp.BehaviourRename).Rename(ref, file, `\a`, `\b`, false)
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	read := base.(winfsp.BehaviourRead).Read
+	buf := make([]byte, len(helloWorld))
+	if _, err := read(ref, file, buf, 0); !errors.Is(
+		err, windows.STATUS_SHARING_VIOLATION) {
+		t.Fatalf("Read while reopen fails = %v; want STATUS_SHARING_VIOLATION", err)
+	}
+	n, err := read(ref, file, buf, 0)
+	if err != nil || string(buf[:n]) != helloWorld {
+		t.Errorf("Read after reopen = %q, %v; want %q", buf[:n], err, helloWorld)
+	}
+}
+
+func TestShortNames(t *testing.T) {
+	got := gofs.ShortNames([]string{
+		"Long File Other.text", "Long File Name.text",
+		"README.TXT", "a+b.c", ".profile",
+	})
+	want := map[string]string{
+		"Long File Name.text":  "LONGFI~1.TEX",
+		"Long File Other.text": "LONGFI~2.TEX",
+		"a+b.c":                "A_B~1.C",
+		".profile":             "PROFIL~1",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("ShortNames = %v; want %v", got, want)
+	}
+
+	inner := memfs.New()
+	if err := inner.Mkdir(`\Program Files`, 0o777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for name, content := range map[string]string{
+		`\Program Files\Long File Name.text`:  "name",
+		`\Program Files\Long File Other.text`: "other",
+	} {
+		f, err := inner.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		_, _ = f.Write([]byte(content))
+		_ = f.Close()
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	base := gofs.New(inner)
+	if _, err := base.Open(ref, `\PROGRA~1\LONGFI~2.TEX`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA, &info); err == nil {
+		t.Errorf("Open by short name succeeded without WithShortNames")
+	}
+
+	base, err := gofs.NewOptions(inner, gofs.WithShortNames(true))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	_, _, err = base.(winfsp.BehaviourGetSecurityByName).GetSecurityByName(
+		ref, `\progra~1\longfi~1.tex`, winfsp.GetExistenceOnly)
+	if err != nil {
+		t.Errorf("GetSecurityByName by short name: %v", err)
+	}
+	file, err := base.Open(ref, `\PROGRA~1\LONGFI~2.TEX`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open by short name: %v", err)
+	}
+	defer base.Close(ref, file)
+	buf := make([]byte, 16)
+	n, err := base.(winfsp.BehaviourRead).Read(ref, file, buf, 0)
+	if err != nil || string(buf[:n]) != "other" {
+		t.Errorf("Read = %q, %v; want %q", buf[:n], err, "other")
+	}
+}
+
+func TestDefaultSecurityDescriptor(t *testing.T) {
+	const sddl = "O:WDG:WDD:(A;;GR;;;WD)"
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		t.Fatalf("SecurityDescriptorFromString: %v", err)
+	}
+	base, err := gofs.NewOptions(memfs.New(),
+		gofs.WithDefaultSecurityDescriptor(sd))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	_, got, err := base.(winfsp.BehaviourGetSecurityByName).GetSecurityByName(
+		ref, `\`, winfsp.GetAttributesSecurity)
+	if err != nil {
+		t.Fatalf("GetSecurityByName: %v", err)
+	}
+	if got.String() != sddl {
+		t.Errorf("GetSecurityByName = %q; want %q", got.String(), sddl)
+	}
+
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.READ_CONTROL, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	got, err = base.(winfsp.BehaviourGetSecurity).GetSecurity(ref, file)
+	if err != nil {
+		t.Fatalf("GetSecurity: %v", err)
+	}
+	if got.String() != sddl {
+		t.Errorf("GetSecurity = %q; want %q", got.String(), sddl)
+	}
+
+	if _, err := gofs.NewOptions(memfs.New(),
+		gofs.WithDefaultSecurityDescriptor(nil)); err == nil {
+		t.Errorf("NewOptions with nil security descriptor should fail")
+	}
+}
+
+func TestEnforcePermissions(t *testing.T) {
+	for _, enforce := range []bool{false, true} {
+		fs := memfs.New(memfs.WithEnforcePermissions(enforce))
+		for name, perm := range map[string]os.FileMode{
+			`\readonly`:  0o444,
+			`\writeonly`: 0o200,
+		} {
+			f, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
+			if err != nil {
+				t.Fatalf("create %s: %v", name, err)
+			}
+			_ = f.Close()
+		}
+		for _, tc := range []struct {
+			name    string
+			flag    int
+			allowed bool
+		}{
+			{`\readonly`, os.O_RDONLY, true},
+			{`\readonly`, os.O_WRONLY, false},
+			{`\readonly`, os.O_RDWR, false},
+			{`\readonly`, os.O_RDONLY | os.O_TRUNC, false},
+			{`\writeonly`, os.O_WRONLY, true},
+			{`\writeonly`, os.O_WRONLY | os.O_APPEND, true},
+			{`\writeonly`, os.O_RDONLY, false},
+			{`\writeonly`, os.O_RDWR, false},
+		} {
+			f, err := fs.OpenFile(tc.name, tc.flag, 0)
+			if err == nil {
+				_ = f.Close()
+			}
+			if !enforce || tc.allowed {
+				if err != nil {
+					t.Errorf("enforce %v, OpenFile(%s, %#x): %v",
+						enforce, tc.name, tc.flag, err)
+				}
+			} else if err != windows.STATUS_ACCESS_DENIED {
+				t.Errorf("enforce %v, OpenFile(%s, %#x) = %v; want STATUS_ACCESS_DENIED",
+					enforce, tc.name, tc.flag, err)
+			}
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	readAll := func(fs *memfs.MemFS, name string) string {
+		t.Helper()
+		f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile(%q): %v", name, err)
+		}
+		defer f.Close()
+		buf := make([]byte, 64)
+		n, err := f.ReadAt(buf, 0)
+		if err != nil && n == 0 {
+			return ""
+		}
+		return string(buf[:n])
+	}
+	write := func(fs *memfs.MemFS, name, data string) {
+		t.Helper()
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o666)
+		if err != nil {
+			t.Fatalf("OpenFile(%q): %v", name, err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte(data), 0); err != nil {
+			t.Fatalf("WriteAt(%q): %v", name, err)
+		}
+	}
+
+	orig := memfs.New()
+	if err := orig.Mkdir(`\dir`, 0o777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	write(orig, `\dir\file`, "original")
+	origStat, err := orig.Stat(`\dir\file`)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	clone := orig.Clone()
+	cloneStat, err := clone.Stat(`\dir\file`)
+	if err != nil {
+		t.Fatalf("Stat clone: %v", err)
+	}
+	if !cloneStat.ModTime().Equal(origStat.ModTime()) ||
+		cloneStat.Mode() != origStat.Mode() {
+		t.Errorf("clone stat = %v %v; want %v %v", cloneStat.ModTime(),
+			cloneStat.Mode(), origStat.ModTime(), origStat.Mode())
+	}
+
+	// Mutate both and check they diverge.
+	write(orig, `\dir\file`, "ORIGINAL")
+	write(clone, `\dir\other`, "cloned")
+	if err := clone.Remove(`\dir\file`); err != nil {
+		t.Fatalf("Remove clone: %v", err)
+	}
+	if got := readAll(orig, `\dir\file`); got != "ORIGINAL" {
+		t.Errorf("original file = %q", got)
+	}
+	if _, err := orig.Stat(`\dir\other`); !os.IsNotExist(err) {
+		t.Errorf("original has file created in clone: %v", err)
+	}
+	if _, err := clone.Stat(`\dir\file`); !os.IsNotExist(err) {
+		t.Errorf("clone has file removed: %v", err)
+	}
+	if got := readAll(clone, `\dir\other`); got != "cloned" {
+		t.Errorf("clone file = %q", got)
+	}
+}
+
+func TestNoLeaksAfterClose(t *testing.T) {
+	treelock.DebugTrackAllocs(true)
+	defer treelock.DebugTrackAllocs(false)
+	winfsp.DebugTrackDirBuffers(true)
+	defer winfsp.DebugTrackDirBuffers(false)
+
+	inner := memfs.New()
+	if err := inner.Mkdir(`\dir`, 0o777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	base := gofs.New(inner)
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	dir, err := base.Open(ref, `\dir`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_LIST_DIRECTORY, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	dirBuf, err := base.(winfsp.BehaviourReadDirectory).GetOrNewDirBuffer(ref, dir)
+	if err != nil {
+		t.Fatalf("GetOrNewDirBuffer: %v", err)
+	}
+	filler, err := dirBuf.Acquire(true)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if filler != nil {
+		filler.Release()
+	}
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\dir\file`,
+		0, windows.FILE_WRITE_DATA|windows.DELETE, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	base.(winfsp.BehaviourCleanup).Cleanup(
+		ref, file, `\dir\file`, winfsp.FspCleanupDelete)
+	base.Close(ref, file)
+	if leaks := treelock.Leaks(); len(leaks) == 0 {
+		t.Errorf("no lock tracked for the open directory")
+	}
+	base.Close(ref, dir)
+
+	for _, leak := range treelock.Leaks() {
+		t.Errorf("leaked %v", leak)
+	}
+	for _, stack := range winfsp.DirBufferLeaks() {
+		t.Errorf("leaked DirBuffer filled at:\n%s", stack)
+	}
+}
+
+// syncCountFS counts the syncs made on the opened files,
+// which keep the FileChattr of memfs.
+type syncCountFS struct {
+	*memfs.MemFS
+	syncs *atomic.Int64
+}
+
+type syncCountFile struct {
+	gofs.FileChattr
+	syncs *atomic.Int64
+}
+
+func (f syncCountFile) Sync() error {
+	f.syncs.Add(1)
+	return f.FileChattr.Sync()
+}
+
+func (fs syncCountFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	chattr, ok := f.(gofs.FileChattr)
+	if !ok {
+		return f, nil
+	}
+	return syncCountFile{FileChattr: chattr, syncs: fs.syncs}, nil
+}
+
+func TestTemporaryAttribute(t *testing.T) {
+	syncs := &atomic.Int64{}
+	base := gofs.New(syncCountFS{MemFS: memfs.New(), syncs: syncs})
+	ref := &winfsp.FileSystemRef{}
+	create := base.(winfsp.BehaviourCreate).Create
+	flush := base.(winfsp.BehaviourFlush).Flush
+	getFileInfo := base.(winfsp.BehaviourGetFileInfo).GetFileInfo
+
+	for _, tc := range []struct {
+		name      string
+		attrs     uint32
+		wantSyncs int64
+	}{
+		{`\normal`, windows.FILE_ATTRIBUTE_NORMAL, 1},
+		{`\temporary`, windows.FILE_ATTRIBUTE_TEMPORARY, 0},
+	} {
+		syncs.Store(0)
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		file, err := create(ref, tc.name,
+			windows.FILE_CREATE<<winfsp.CreateDispositionShift,
+			windows.FILE_WRITE_DATA, tc.attrs, nil, 0, &info)
+		if err != nil {
+			t.Fatalf("Create(%q): %v", tc.name, err)
+		}
+		wantTemp := tc.attrs & windows.FILE_ATTRIBUTE_TEMPORARY
+		if info.FileAttributes&windows.FILE_ATTRIBUTE_TEMPORARY != wantTemp {
+			t.Errorf("Create(%q) attributes = %#x", tc.name, info.FileAttributes)
+		}
+		if err := getFileInfo(ref, file, &info); err != nil {
+			t.Fatalf("GetFileInfo(%q): %v", tc.name, err)
+		}
+		if info.FileAttributes&windows.FILE_ATTRIBUTE_TEMPORARY != wantTemp {
+			t.Errorf("GetFileInfo(%q) attributes = %#x", tc.name, info.FileAttributes)
+		}
+		if err := flush(ref, file, &info); err != nil {
+			t.Fatalf("Flush(%q): %v", tc.name, err)
+		}
+		if got := syncs.Load(); got != tc.wantSyncs {
+			t.Errorf("Flush(%q) synced %d times; want %d", tc.name, got, tc.wantSyncs)
+		}
+		base.Close(ref, file)
+	}
+}
+
+func TestPercentNameRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		canonical bool
+	}{
+		{"plain", true},
+		{"a%3Ab", true},
+		{"100%25", true},
+		{"a%3ab", false},
+		{"%41", false},
+		{"100%", false},
+		{"%zz", false},
+	} {
+		decoded := gofs.PercentDecodeName(tc.name)
+		got := gofs.PercentEncodeName(decoded) == tc.name
+		if got != tc.canonical {
+			t.Errorf("encode(decode(%q)) = %q; canonical %v, want %v",
+				tc.name, gofs.PercentEncodeName(decoded), got, tc.canonical)
+		}
+	}
+}
+
+func TestNameEncoder(t *testing.T) {
+	for _, name := range []string{"plain", "a:b", "100%", `q?"<*>|`, "%3A", "\x01"} {
+		encoded := gofs.PercentEncodeName(name)
+		if strings.ContainsAny(encoded, `"*/:<>?\|`+"\x01") {
+			t.Errorf("PercentEncodeName(%q) = %q; has invalid characters", name, encoded)
+		}
+		if decoded := gofs.PercentDecodeName(encoded); decoded != name {
+			t.Errorf("PercentDecodeName(%q) = %q; want %q", encoded, decoded, name)
+		}
+	}
+
+	inner := memfs.New()
+	if err := inner.Mkdir(`\bucket`, 0o777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	f, err := inner.OpenFile(`\bucket\2024:report`, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	_, _ = f.Write([]byte(helloWorld))
+	_ = f.Close()
+
+	base, err := gofs.NewOptions(inner, gofs.WithNameEncoder(
+		gofs.PercentEncodeName, gofs.PercentDecodeName))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	dir, err := base.Open(ref, `\bucket`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_LIST_DIRECTORY, &info)
+	if err != nil {
+		t.Fatalf("Open directory: %v", err)
+	}
+	defer base.Close(ref, dir)
+	var names []string
+	err = base.(winfsp.BehaviourReadDirectory).ReadDirectory(ref, dir, "",
+		func(name string, _ *winfsp.FSP_FSCTL_FILE_INFO) (bool, error) {
+			names = append(names, name)
+			return true, nil
+		})
+	if err != nil {
+		t.Fatalf("ReadDirectory: %v", err)
+	}
+	if len(names) != 1 || names[0] != "2024%3Areport" {
+		t.Fatalf("ReadDirectory = %q; want only the encoded name", names)
+	}
+
+	file, err := base.Open(ref, `\bucket\`+names[0],
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.DELETE, &info)
+	if err != nil {
+		t.Fatalf("Open encoded name: %v", err)
+	}
+	defer base.Close(ref, file)
+	buf := make([]byte, 64)
+	n, err := base.(winfsp.BehaviourRead).Read(ref, file, buf, 0)
+	if err != nil || string(buf[:n]) != helloWorld {
+		t.Errorf("Read = %q, %v; want %q", buf[:n], err, helloWorld)
+	}
+
+	if err := base.(winfsp.BehaviourRename).Rename(ref, file,
+		`\bucket\2024%3Areport`, `\bucket\2025%3Areport`, false); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := inner.Stat(`\bucket\2025:report`); err != nil {
+		t.Errorf("Stat renamed inner key: %v", err)
+	}
+	if _, _, err := base.(winfsp.BehaviourGetSecurityByName).GetSecurityByName(
+		ref, `\bucket\2025%3Areport`, winfsp.GetExistenceOnly); err != nil {
+		t.Errorf("GetSecurityByName encoded name: %v", err)
+	}
+
+	// The names which are not encoded canonically would
+	// alias the inner names, and are rejected.
+	for _, name := range []string{`\bucket\2025%3areport`, `\%62ucket`, `\100%`} {
+		_, err := base.(winfsp.BehaviourCreate).Create(ref, name,
+			0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+		if !errors.Is(err, windows.STATUS_OBJECT_NAME_INVALID) {
+			t.Errorf("Create(%q) = %v; want STATUS_OBJECT_NAME_INVALID", name, err)
+		}
+	}
+}
+
+// syncVolumeFS counts the volume syncs.
+type syncVolumeFS struct {
+	*memfs.MemFS
+	syncs atomic.Int64
+}
+
+func (fs *syncVolumeFS) SyncVolume() error {
+	fs.syncs.Add(1)
+	return fs.MemFS.SyncVolume()
+}
+
+func TestSyncVolume(t *testing.T) {
+	for _, opts := range [][]gofs.NewOption{
+		nil,
+		{gofs.WithOperationTimeout(time.Minute)},
+	} {
+		fs := &syncVolumeFS{MemFS: memfs.New()}
+		base, err := gofs.NewOptions(fs, opts...)
+		if err != nil {
+			t.Fatalf("NewOptions: %v", err)
+		}
+		ref := &winfsp.FileSystemRef{}
+		flush := base.(winfsp.BehaviourFlush).Flush
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		file, err := base.Open(ref, `\`,
+			windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+			windows.FILE_LIST_DIRECTORY, &info)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if err := flush(ref, file, &info); err != nil {
+			t.Fatalf("Flush file: %v", err)
+		}
+		base.Close(ref, file)
+		if got := fs.syncs.Load(); got != 0 {
+			t.Errorf("SyncVolume called %d times by a file flush", got)
+		}
+		if err := flush(ref, 0, nil); err != nil {
+			t.Fatalf("Flush volume: %v", err)
+		}
+		if got := fs.syncs.Load(); got != 1 {
+			t.Errorf("SyncVolume called %d times; want once", got)
+		}
+	}
+}
+
+// getDirInfoByName queries the entry in the directory,
+// returning the name and the file info reported.
+func getDirInfoByName(
+	base winfsp.BehaviourBase, ref *winfsp.FileSystemRef,
+	dir uintptr, name string,
+) (string, winfsp.FSP_FSCTL_FILE_INFO, error) {
+	dirInfoSize := unsafe.Sizeof(winfsp.FSP_FSCTL_DIR_INFO{})
+	buf := make([]uint64, (int(dirInfoSize)+255*2+7)/8)
+	dirInfo := (*winfsp.FSP_FSCTL_DIR_INFO)(unsafe.Pointer(&buf[0]))
+	err := base.(winfsp.BehaviourGetDirInfoByName).GetDirInfoByName(
+		ref, dir, name, dirInfo)
+	if err != nil {
+		return "", winfsp.FSP_FSCTL_FILE_INFO{}, err
+	}
+	name16 := unsafe.Slice((*uint16)(unsafe.Add(unsafe.Pointer(dirInfo),
+		dirInfoSize)), (uintptr(dirInfo.Size)-dirInfoSize)/2)
+	return windows.UTF16ToString(name16), dirInfo.FileInfo, nil
+}
+
+func TestReaddirPlus(t *testing.T) {
+	for _, ttl := range []time.Duration{0, time.Hour} {
+		inner := memfs.New(memfs.WithCaseInsensitive(true))
+		f, err := inner.OpenFile(`\File.txt`, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		_, _ = f.Write([]byte(helloWorld))
+		_ = f.Close()
+		base, err := gofs.NewOptions(inner, gofs.WithReaddirPlus(ttl))
+		if err != nil {
+			t.Fatalf("NewOptions: %v", err)
+		}
+		ref := &winfsp.FileSystemRef{}
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		dir, err := base.Open(ref, `\`,
+			windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+			windows.FILE_LIST_DIRECTORY, &info)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		err = base.(winfsp.BehaviourReadDirectory).ReadDirectory(ref, dir, "",
+			func(string, *winfsp.FSP_FSCTL_FILE_INFO) (bool, error) {
+				return true, nil
+			})
+		if err != nil {
+			t.Fatalf("ReadDirectory: %v", err)
+		}
+
+		name, info, err := getDirInfoByName(base, ref, dir, "FILE.TXT")
+		if err != nil || name != "File.txt" || info.FileSize != uint64(len(helloWorld)) {
+			t.Errorf("GetDirInfoByName(ttl=%v) = %q, %d, %v; want %q, %d",
+				ttl, name, info.FileSize, err, "File.txt", len(helloWorld))
+		}
+
+		// The removal bypassing gofs is only observed
+		// when the enumeration is not kept.
+		if err := inner.Remove(`\File.txt`); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+		_, _, err = getDirInfoByName(base, ref, dir, "File.txt")
+		if cached := err == nil; cached != (ttl > 0) {
+			t.Errorf("GetDirInfoByName(ttl=%v) after removal = %v", ttl, err)
+		}
+		base.Close(ref, dir)
+	}
+}
+
+func BenchmarkReaddirPlus(b *testing.B) {
+	inner := memfs.New()
+	var names []string
+	for i := range 1000 {
+		name := fmt.Sprintf("file-%04d", i)
+		f, err := inner.OpenFile(`\`+name, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			b.Fatalf("OpenFile: %v", err)
+		}
+		_ = f.Close()
+		names = append(names, name)
+	}
+	for _, ttl := range []time.Duration{0, time.Second} {
+		b.Run(fmt.Sprintf("ttl=%v", ttl), func(b *testing.B) {
+			base, err := gofs.NewOptions(inner,
+				gofs.WithReaddirPlus(ttl), gofs.WithAttribReadOnlyTransMode(
+					gofs.AttribReadOnlyPOSIX))
+			if err != nil {
+				b.Fatalf("NewOptions: %v", err)
+			}
+			ref := &winfsp.FileSystemRef{}
+			var info winfsp.FSP_FSCTL_FILE_INFO
+			dir, err := base.Open(ref, `\`,
+				windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+				windows.FILE_LIST_DIRECTORY, &info)
+			if err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			defer base.Close(ref, dir)
+			readDir := base.(winfsp.BehaviourReadDirectory).ReadDirectory
+			b.ResetTimer()
+			for range b.N {
+				err := readDir(ref, dir, "",
+					func(string, *winfsp.FSP_FSCTL_FILE_INFO) (bool, error) {
+						return true, nil
+					})
+				if err != nil {
+					b.Fatalf("ReadDirectory: %v", err)
+				}
+				for _, name := range names {
+					if _, _, err := getDirInfoByName(base, ref, dir, name); err != nil {
+						b.Fatalf("GetDirInfoByName: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// sizeStatCountFS counts the stats made on the opened
+// files, which still report their size after write.
+type sizeStatCountFS struct {
+	statCountFS
+}
+
+type sizeStatCountFile struct {
+	statCountFile
+	sizer gofs.FileSizeAfterWrite
+}
+
+func (f sizeStatCountFile) SizeAfterWrite() int64 {
+	return f.sizer.SizeAfterWrite()
+}
+
+func (fs sizeStatCountFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return sizeStatCountFile{
+		statCountFile: statCountFile{File: f, stats: fs.stats},
+		sizer:         f.(gofs.FileSizeAfterWrite),
+	}, nil
+}
+
+func TestSizeAfterWrite(t *testing.T) {
+	var stats atomic.Int64
+	base := gofs.New(sizeStatCountFS{
+		statCountFS{MemFS: memfs.New(), stats: &stats}})
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\file`,
+		windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.FILE_WRITE_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	write := base.(winfsp.BehaviourWrite).Write
+
+	// Only the first write stats the file, while the
+	// following ones update the size of its file info.
+	before := stats.Load()
+	for i := range 3 {
+		_, err := write(ref, file, []byte(helloWorld),
+			uint64(i*len(helloWorld)), false, false, &info)
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if want := uint64((i + 1) * len(helloWorld)); info.FileSize != want {
+			t.Errorf("Write #%d FileSize = %d; want %d", i, info.FileSize, want)
+		}
+		if info.AllocationSize < info.FileSize {
+			t.Errorf("Write #%d AllocationSize = %d; want at least %d",
+				i, info.AllocationSize, info.FileSize)
+		}
+	}
+	if n := stats.Load() - before; n != 1 {
+		t.Errorf("Write made %d stats; want 1", n)
+	}
+
+	// Truncating the file invalidates the file info.
+	setFileSize := base.(winfsp.BehaviourSetFileSize).SetFileSize
+	if err := setFileSize(ref, file, 0, false, &info); err != nil {
+		t.Fatalf("SetFileSize: %v", err)
+	}
+	before = stats.Load()
+	_, err = write(ref, file, []byte(helloWorld), 0, false, false, &info)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n := stats.Load() - before; n != 1 || info.FileSize != uint64(len(helloWorld)) {
+		t.Errorf("Write after truncation made %d stats, size %d; want 1, %d",
+			n, info.FileSize, len(helloWorld))
+	}
+}
+
+func BenchmarkSequentialWrite(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		fs   func() gofs.FileSystem
+	}{
+		{"stat", func() gofs.FileSystem {
+			return statCountFS{MemFS: memfs.New(), stats: new(atomic.Int64)}
+		}},
+		{"sizeAfterWrite", func() gofs.FileSystem { return memfs.New() }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			base := gofs.New(tc.fs())
+			ref := &winfsp.FileSystemRef{}
+			var info winfsp.FSP_FSCTL_FILE_INFO
+			file, err := base.Open(ref, `\file`,
+				windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+				windows.FILE_WRITE_DATA, &info)
+			if err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			defer base.Close(ref, file)
+			write := base.(winfsp.BehaviourWrite).Write
+			const chunkSize = 4096
+			data := make([]byte, chunkSize)
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := write(ref, file, data,
+					uint64(i%1024)*chunkSize, false, false, &info)
+				if err != nil {
+					b.Fatalf("Write: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSequentialRead(b *testing.B) {
+	base := gofs.New(memfs.New())
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\file`,
+		windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.FILE_WRITE_DATA, &info)
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	const chunkSize = 4096
+	const numChunks = 1024
+	data := bytes.Repeat([]byte{'a'}, chunkSize*numChunks)
+	_, err = base.(winfsp.BehaviourWrite).Write(
+		ref, file, data, 0, false, false, &info)
+	if err != nil {
+		b.Fatalf("Write: %v", err)
+	}
+	read := base.(winfsp.BehaviourRead).Read
+	buf := make([]byte, chunkSize)
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := read(ref, file, buf, uint64(i%numChunks)*chunkSize); err != nil {
+			b.Fatalf("Read: %v", err)
+		}
+	}
+}
+
+func BenchmarkRandomWrite(b *testing.B) {
+	base := gofs.New(memfs.New())
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\file`,
+		windows.FILE_OPEN_IF<<winfsp.CreateDispositionShift,
+		windows.FILE_WRITE_DATA, &info)
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	write := base.(winfsp.BehaviourWrite).Write
+	const chunkSize = 4096
+	const numChunks = 1024
+
+	// The offsets are drawn by a fixed linear congruential
+	// generator, so that the runs are comparable.
+	data := make([]byte, chunkSize)
+	seed := uint32(1)
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		seed = seed*1664525 + 1013904223
+		offset := uint64(seed>>16%numChunks) * chunkSize
+		if _, err := write(ref, file, data, offset, false, false, &info); err != nil {
+			b.Fatalf("Write: %v", err)
+		}
+	}
+}
+
+// openCountFS counts the files opened and closed, and
+// keeps the last opened file.
+type openCountFS struct {
+	*memfs.MemFS
+	opens, closes *atomic.Int64
+	last          *gofs.File
+}
+
+type closeCountFile struct {
+	gofs.File
+	closes *atomic.Int64
+}
+
+func (f closeCountFile) Close() error {
+	f.closes.Add(1)
+	return f.File.Close()
+}
+
+func (fs openCountFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.opens.Add(1)
+	*fs.last = f
+	return closeCountFile{File: f, closes: fs.closes}, nil
+}
+
+func TestOpenRename(t *testing.T) {
+	inner := openCountFS{
+		MemFS:  memfs.New(),
+		opens:  &atomic.Int64{},
+		closes: &atomic.Int64{},
+		last:   new(gofs.File),
+	}
+	f, err := inner.MemFS.OpenFile(`\a`, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	_, _ = f.Write([]byte(helloWorld))
+	_ = f.Close()
+	base := gofs.New(inner)
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.Open(ref, `\a`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA|windows.DELETE, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, file)
+	opened := *inner.last
+	if _, err := opened.Seek(5, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	// The file is kept open across the rename.
+	opens, closes := inner.opens.Load(), inner.closes.Load()
+	err = base.(winfsp.BehaviourRename).Rename(ref, file, `\a`, `\b`, false)
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if n := inner.opens.Load() - opens; n != 0 {
+		t.Errorf("Rename opened %d files; want 0", n)
+	}
+	if n := inner.closes.Load() - closes; n != 0 {
+		t.Errorf("Rename closed %d files; want 0", n)
+	}
+	if pos, err := opened.Seek(0, io.SeekCurrent); err != nil || pos != 5 {
+		t.Errorf("offset after Rename = %d, %v; want 5", pos, err)
+	}
+	buf := make([]byte, len(helloWorld))
+	n, err := base.(winfsp.BehaviourRead).Read(ref, file, buf, 0)
+	if err != nil || string(buf[:n]) != helloWorld {
+		t.Errorf("Read after Rename = %q, %v; want %q", buf[:n], err, helloWorld)
+	}
+	if _, err := inner.Stat(`\b`); err != nil {
+		t.Errorf("Stat renamed file: %v", err)
+	}
+}
+
+// copyRangeFS is the memfs implementing server-side copy,
+// which records the copies made through it.
+type copyRangeFS struct {
+	*memfs.MemFS
+	copies *[]string
+}
+
+func (fs copyRangeFS) CopyFileRange(
+	source string, sourceOffset int64,
+	target string, targetOffset int64, length int64,
+) (int64, error) {
+	*fs.copies = append(*fs.copies, fmt.Sprintf(
+		"%s@%d->%s@%d+%d", source, sourceOffset, target, targetOffset, length))
+	src, err := fs.OpenFile(source, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = src.Close() }()
+	dst, err := fs.OpenFile(target, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = dst.Close() }()
+	return io.Copy(
+		io.NewOffsetWriter(dst, targetOffset),
+		io.NewSectionReader(src, sourceOffset, length))
+}
+
+func TestCopyFileRange(t *testing.T) {
+	if _, ok := gofs.New(memfs.New()).(winfsp.BehaviourDeviceIoControl); ok {
+		t.Errorf("file system without CopyFileRange processes control codes")
+	}
+	inner := copyRangeFS{MemFS: memfs.New(), copies: new([]string)}
+	if _, ok := gofs.New(inner).(winfsp.BehaviourDeviceIoControl); ok {
+		t.Errorf("file system without WithCopyFileRange processes control codes")
+	}
+	f, err := inner.OpenFile(`\a`, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	_, _ = f.Write([]byte(helloWorld))
+	_ = f.Close()
+	base, err := gofs.NewOptions(inner, gofs.WithCopyFileRange(true))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\b`,
+		0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer base.Close(ref, file)
+	ioctl, ok := base.(winfsp.BehaviourDeviceIoControl)
+	if !ok {
+		t.Fatalf("file system with CopyFileRange does not process control codes")
+	}
+
+	// The source is only named by a handle opened for reading.
+	openSource := func(access uint32) uintptr {
+		t.Helper()
+		source, err := base.Open(ref, `\a`,
+			windows.FILE_OPEN<<winfsp.CreateDispositionShift, access, &info)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return source
+	}
+	attrOnly := openSource(windows.FILE_READ_ATTRIBUTES)
+	_, err = ioctl.DeviceIoControl(ref, attrOnly, gofs.IoctlCopyFileRangeSource, nil)
+	base.Close(ref, attrOnly)
+	if !errors.Is(err, windows.STATUS_ACCESS_DENIED) {
+		t.Errorf("source token without FILE_READ_DATA = %v; want STATUS_ACCESS_DENIED", err)
+	}
+	source := openSource(windows.FILE_READ_DATA)
+	output, err := ioctl.DeviceIoControl(ref, source, gofs.IoctlCopyFileRangeSource, nil)
+	if err != nil || len(output) != 8 {
+		t.Fatalf("IoctlCopyFileRangeSource = %v, %v", output, err)
+	}
+	token := binary.LittleEndian.Uint64(output)
+
+	output, err = ioctl.DeviceIoControl(ref, file, gofs.IoctlCopyFileRange,
+		gofs.CopyFileRangeInput(token, 7, 2, 5))
+	if err != nil {
+		t.Fatalf("DeviceIoControl: %v", err)
+	}
+	if want := []byte{5, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(output, want) {
+		t.Errorf("output = %v; want %v", output, want)
+	}
+	if want := []string{`\a@7->\b@2+5`}; strings.Join(*inner.copies, ",") !=
+		strings.Join(want, ",") {
+		t.Errorf("copies = %q; want %q", *inner.copies, want)
+	}
+	err = base.(winfsp.BehaviourGetFileInfo).GetFileInfo(ref, file, &info)
+	if err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	if info.FileSize != 7 {
+		t.Errorf("FileSize = %d; want 7", info.FileSize)
+	}
+
+	_, err = ioctl.DeviceIoControl(ref, file, gofs.IoctlCopyFileRange, []byte{1})
+	if !errors.Is(err, windows.STATUS_INVALID_PARAMETER) {
+		t.Errorf("malformed input error = %v; want STATUS_INVALID_PARAMETER", err)
+	}
+
+	// The token is revoked by closing the source handle,
+	// and the unknown tokens are rejected.
+	base.Close(ref, source)
+	for _, token := range []uint64{token, token + 1} {
+		_, err = ioctl.DeviceIoControl(ref, file, gofs.IoctlCopyFileRange,
+			gofs.CopyFileRangeInput(token, 0, 0, 1))
+		if !errors.Is(err, windows.STATUS_INVALID_HANDLE) {
+			t.Errorf("unknown token error = %v; want STATUS_INVALID_HANDLE", err)
+		}
+	}
+	if len(*inner.copies) != 1 {
+		t.Errorf("copies = %q; want only the first one", *inner.copies)
+	}
+	_, err = ioctl.DeviceIoControl(ref, file, 0, nil)
+	if !errors.Is(err, windows.STATUS_INVALID_DEVICE_REQUEST) {
+		t.Errorf("unknown code error = %v; want STATUS_INVALID_DEVICE_REQUEST", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	base, err := gofs.NewOptions(memfs.New(), gofs.WithCompression(true))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\a`,
+		0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer base.Close(ref, file)
+	ioctl := base.(winfsp.BehaviourDeviceIoControl)
+	getInfo := base.(winfsp.BehaviourGetFileInfo).GetFileInfo
+	for _, tc := range []struct {
+		format     uint16
+		compressed bool
+	}{
+		{2, true}, // COMPRESSION_FORMAT_LZNT1
+		{0, false},
+		{1, true}, // COMPRESSION_FORMAT_DEFAULT
+	} {
+		_, err := ioctl.DeviceIoControl(ref, file, windows.FSCTL_SET_COMPRESSION,
+			binary.LittleEndian.AppendUint16(nil, tc.format))
+		if err != nil {
+			t.Fatalf("FSCTL_SET_COMPRESSION(%d): %v", tc.format, err)
+		}
+		if err := getInfo(ref, file, &info); err != nil {
+			t.Fatalf("GetFileInfo: %v", err)
+		}
+		compressed := info.FileAttributes&windows.FILE_ATTRIBUTE_COMPRESSED != 0
+		if compressed != tc.compressed {
+			t.Errorf("format %d: attributes = %#x; want compressed %v",
+				tc.format, info.FileAttributes, tc.compressed)
+		}
+		output, err := ioctl.DeviceIoControl(
+			ref, file, windows.FSCTL_GET_COMPRESSION, nil)
+		want := []byte{0, 0}
+		if tc.compressed {
+			want = []byte{2, 0}
+		}
+		if err != nil || !bytes.Equal(output, want) {
+			t.Errorf("format %d: FSCTL_GET_COMPRESSION = %v, %v; want %v",
+				tc.format, output, err, want)
+		}
+	}
+	_, err = ioctl.DeviceIoControl(ref, file, windows.FSCTL_SET_COMPRESSION,
+		[]byte{5, 0})
+	if !errors.Is(err, windows.STATUS_INVALID_PARAMETER) {
+		t.Errorf("unknown format error = %v; want STATUS_INVALID_PARAMETER", err)
+	}
+}
+
+func TestAllocatedRanges(t *testing.T) {
+	base, err := gofs.NewOptions(memfs.New(), gofs.WithAllocatedRanges(true))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\sparse`,
+		0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer base.Close(ref, file)
+
+	// Two extents separated by the holes of extending the
+	// file, the second of which is written in two adjoining
+	// pieces.
+	const size = 1 << 20
+	err = base.(winfsp.BehaviourSetFileSize).SetFileSize(
+		ref, file, size, false, &info)
+	if err != nil {
+		t.Fatalf("SetFileSize: %v", err)
+	}
+	data := bytes.Repeat([]byte{'x'}, 4096)
+	for _, offset := range []uint64{4096, 65536, 65536 + 4096} {
+		_, err := base.(winfsp.BehaviourWrite).Write(
+			ref, file, data, offset, false, false, &info)
+		if err != nil {
+			t.Fatalf("Write(%d): %v", offset, err)
+		}
+	}
+	query := func(offset, length int64) [][2]int64 {
+		t.Helper()
+		var input []byte
+		input = binary.LittleEndian.AppendUint64(input, uint64(offset))
+		input = binary.LittleEndian.AppendUint64(input, uint64(length))
+		output, err := base.(winfsp.BehaviourDeviceIoControl).DeviceIoControl(
+			ref, file, windows.FSCTL_QUERY_ALLOCATED_RANGES, input)
+		if err != nil {
+			t.Fatalf("FSCTL_QUERY_ALLOCATED_RANGES(%d, %d): %v",
+				offset, length, err)
+		}
+		var result [][2]int64
+		for ; len(output) >= 16; output = output[16:] {
+			result = append(result, [2]int64{
+				int64(binary.LittleEndian.Uint64(output[0:])),
+				int64(binary.LittleEndian.Uint64(output[8:])),
+			})
+		}
+		return result
+	}
+	for _, tc := range []struct {
+		offset, length int64
+		want           [][2]int64
+	}{
+		{0, size, [][2]int64{{4096, 4096}, {65536, 8192}}},
+		{6144, 65536, [][2]int64{{6144, 2048}, {65536, 6144}}},
+		{8192, 57344, nil},
+		{65536, 1 << 62, [][2]int64{{65536, 8192}}},
+	} {
+		if got := query(tc.offset, tc.length); !slices.Equal(got, tc.want) {
+			t.Errorf("ranges in [%d, +%d) = %v; want %v",
+				tc.offset, tc.length, got, tc.want)
+		}
+	}
+
+	// Shrinking the file cuts the extents beyond it.
+	err = base.(winfsp.BehaviourSetFileSize).SetFileSize(
+		ref, file, 65536+1024, false, &info)
+	if err != nil {
+		t.Fatalf("SetFileSize: %v", err)
+	}
+	want := [][2]int64{{4096, 4096}, {65536, 1024}}
+	if got := query(0, size); !slices.Equal(got, want) {
+		t.Errorf("ranges after shrinking = %v; want %v", got, want)
+	}
+}
+
+// hookFS is the memfs tracking the handles opened through
+// gofs by the handle hooks.
+type hookFS struct {
+	*memfs.MemFS
+	mtx     *sync.Mutex
+	handles map[uint64]string
+}
+
+func (fs hookFS) OnOpen(name string, handle uint64) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.handles[handle] = name
+}
+
+func (fs hookFS) OnClose(handle uint64) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	delete(fs.handles, handle)
+}
+
+func (fs hookFS) open() []string {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return slices.Sorted(maps.Values(fs.handles))
+}
+
+func TestHandleHooks(t *testing.T) {
+	inner := hookFS{
+		MemFS:   memfs.New(),
+		mtx:     &sync.Mutex{},
+		handles: make(map[uint64]string),
+	}
+	base := gofs.New(inner)
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	a, err := base.(winfsp.BehaviourCreate).Create(ref, `\a`,
+		0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	b, err := base.Open(ref, `\a`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	_, err = base.Open(ref, `\missing`,
+		windows.FILE_OPEN<<winfsp.CreateDispositionShift,
+		windows.FILE_READ_DATA, &info)
+	if err == nil {
+		t.Fatalf("Open missing file succeeded")
+	}
+	if got, want := inner.open(), []string{`\a`, `\a`}; !slices.Equal(got, want) {
+		t.Errorf("open handles = %q; want %q", got, want)
+	}
+	if _, ok := inner.handles[uint64(a)]; !ok {
+		t.Errorf("handle %#x is not reported by OnOpen", a)
+	}
+
+	base.Close(ref, a)
+	if got := len(inner.open()); got != 1 {
+		t.Errorf("%d open handles after Close; want 1", got)
+	}
+	if _, ok := inner.handles[uint64(b)]; !ok {
+		t.Errorf("remaining handle %#x is not tracked", b)
+	}
+	base.Close(ref, b)
+	if got := len(inner.open()); got != 0 {
+		t.Errorf("%d open handles after closing all; want 0", got)
+	}
+}
+
+func TestCreateWithEa(t *testing.T) {
+	base := gofs.New(memfs.New())
+	packed, err := winfsp.FileSystemPackEa([]winfsp.EaEntry{
+		{Name: "LXUID", Value: []byte{0xe8, 0x03, 0, 0}},
+		{Name: "user.comment", Value: []byte("hello")},
+	})
+	if err != nil {
+		t.Fatalf("FileSystemPackEa: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreateEx).CreateExWithExtendedAttribute(
+		ref, `\a`, 0, windows.FILE_WRITE_DATA, 0, nil,
+		(*winfsp.FILE_FULL_EA_INFORMATION)(unsafe.Pointer(&packed[0])),
+		0, &info)
+	if err != nil {
+		t.Fatalf("CreateExWithExtendedAttribute: %v", err)
+	}
+	defer base.Close(ref, file)
+
+	// The values must have been copied out of the buffer.
+	clear(packed)
+	getEa := base.(winfsp.BehaviourGetEa).GetEa
+	ea, err := getEa(ref, file)
+	if err != nil {
+		t.Fatalf("GetEa: %v", err)
+	}
+	if len(ea) != 2 ||
+		ea[0].Name != "LXUID" || !bytes.Equal(ea[0].Value, []byte{0xe8, 0x03, 0, 0}) ||
+		ea[1].Name != "user.comment" || string(ea[1].Value) != "hello" {
+		t.Errorf("GetEa = %+v", ea)
+	}
+
+	// An empty value removes the attribute, regardless of
+	// the case of its name.
+	err = base.(winfsp.BehaviourSetEa).SetEa(ref, file,
+		[]winfsp.EaEntry{{Name: "USER.COMMENT"}}, &info)
+	if err != nil {
+		t.Fatalf("SetEa: %v", err)
+	}
+	ea, err = getEa(ref, file)
+	if err != nil || len(ea) != 1 || ea[0].Name != "LXUID" {
+		t.Errorf("GetEa after removal = %+v, %v", ea, err)
+	}
+
+	// Creating without extended attributes assigns none.
+	other, err := base.(winfsp.BehaviourCreateEx).CreateExWithExtendedAttribute(
+		ref, `\b`, 0, windows.FILE_WRITE_DATA, 0, nil, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("CreateExWithExtendedAttribute: %v", err)
+	}
+	defer base.Close(ref, other)
+	if ea, err := getEa(ref, other); err != nil || len(ea) != 0 {
+		t.Errorf("GetEa without extended attributes = %+v, %v", ea, err)
+	}
+}
+
+func TestReaddirPagesConsistently(t *testing.T) {
+	fs := memfs.New()
+	const numStable = 50
+	for i := range numStable {
+		f, err := fs.OpenFile(fmt.Sprintf(`\stable-%03d`, i), os.O_CREATE, 0o666)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		_ = f.Close()
+	}
+	dir, err := fs.OpenFile(`\`, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer func() { _ = dir.Close() }()
+
+	// Keep adding and removing the entries interleaving
+	// with the stable ones while the directory is paged.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			name := fmt.Sprintf(`\stable-%03d-churn`, i%numStable)
+			if f, err := fs.OpenFile(name, os.O_CREATE, 0o666); err == nil {
+				_ = f.Close()
+			}
+			_ = fs.Remove(name)
+		}
+	}()
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	readPages := func() []string {
+		var names []string
+		for {
+			infos, err := dir.Readdir(7)
+			if err == io.EOF {
+				return names
+			}
+			if err != nil {
+				t.Fatalf("Readdir: %v", err)
+			}
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+		}
+	}
+	for pass := range 3 {
+		names := readPages()
+		if !slices.IsSorted(names) || len(slices.Compact(slices.Clone(names))) != len(names) {
+			t.Errorf("pass %d: names are not a single sorted pass: %q", pass, names)
+		}
+		stable := slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+			return strings.HasSuffix(name, "-churn")
+		})
+		if len(stable) != numStable {
+			t.Errorf("pass %d: %d stable entries; want %d", pass, len(stable), numStable)
+		}
+		if infos, err := dir.Readdir(-1); err != nil || len(infos) != 0 {
+			t.Errorf("pass %d: Readdir(-1) at the end = %d, %v; want none",
+				pass, len(infos), err)
+		}
+		if _, err := dir.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+	}
+}
+
+func TestExecAttribute(t *testing.T) {
+	fs := memfs.New()
+	for name, perm := range map[string]os.FileMode{
+		`\script`: 0o755, `\owner`: 0o744, `\plain`: 0o644,
+	} {
+		f, err := fs.OpenFile(name, os.O_CREATE, perm)
+		if err != nil {
+			t.Fatalf("OpenFile(%q): %v", name, err)
+		}
+		_ = f.Close()
+	}
+	const attr = windows.FILE_ATTRIBUTE_NOT_CONTENT_INDEXED
+	ref := &winfsp.FileSystemRef{}
+	for _, enabled := range []bool{true, false} {
+		base, err := gofs.NewOptions(fs, gofs.WithExecAttribute(enabled))
+		if err != nil {
+			t.Fatalf("NewOptions: %v", err)
+		}
+		for name, exec := range map[string]bool{
+			`\script`: true, `\owner`: true, `\plain`: false,
+		} {
+			var info winfsp.FSP_FSCTL_FILE_INFO
+			file, err := base.Open(
+				ref, name, 0, windows.FILE_READ_ATTRIBUTES, &info)
+			if err != nil {
+				t.Fatalf("Open(%q): %v", name, err)
+			}
+			base.Close(ref, file)
+			want := enabled && exec
+			if got := info.FileAttributes&attr != 0; got != want {
+				t.Errorf("WithExecAttribute(%v): attributes of %q = %#x; "+
+					"want NOT_CONTENT_INDEXED %v",
+					enabled, name, info.FileAttributes, want)
+			}
+		}
+	}
+}
+
+func TestOfflineAttributes(t *testing.T) {
+	base := gofs.New(memfs.New())
+	const offline = windows.FILE_ATTRIBUTE_OFFLINE |
+		windows.FILE_ATTRIBUTE_RECALL_ON_DATA_ACCESS
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\cloud`,
+		0, windows.FILE_WRITE_DATA, offline, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer base.Close(ref, file)
+	check := func(op string, attributes uint32) {
+		t.Helper()
+		if attributes&offline != offline ||
+			attributes&windows.FILE_ATTRIBUTE_NORMAL != 0 {
+			t.Errorf("%s attributes = %#x; want %#x without NORMAL",
+				op, attributes, offline)
+		}
+	}
+	check("Create", info.FileAttributes)
+	if err := base.(winfsp.BehaviourGetFileInfo).GetFileInfo(ref, file, &info); err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	check("GetFileInfo", info.FileAttributes)
+
+	dir, err := base.Open(ref, `\`,
+		(windows.FILE_OPEN<<winfsp.CreateDispositionShift)|
+			windows.FILE_DIRECTORY_FILE,
+		windows.FILE_LIST_DIRECTORY, &info)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer base.Close(ref, dir)
+	found := false
+	err = base.(winfsp.BehaviourReadDirectory).ReadDirectory(ref, dir, "",
+		func(name string, info *winfsp.FSP_FSCTL_FILE_INFO) (bool, error) {
+			if name == "cloud" {
+				found = true
+				check("ReadDirectory", info.FileAttributes)
+			}
+			return true, nil
+		})
+	if err != nil || !found {
+		t.Fatalf("ReadDirectory = %v, found %v", err, found)
+	}
+}
+
+func TestArchiveAttribute(t *testing.T) {
+	base := gofs.New(memfs.New())
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\file`,
+		0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer base.Close(ref, file)
+	archived := func(op string, want bool) {
+		t.Helper()
+		err := base.(winfsp.BehaviourGetFileInfo).GetFileInfo(ref, file, &info)
+		if err != nil {
+			t.Fatalf("GetFileInfo: %v", err)
+		}
+		got := info.FileAttributes&windows.FILE_ATTRIBUTE_ARCHIVE != 0
+		if got != want {
+			t.Errorf("archive bit after %s = %v; want %v", op, got, want)
+		}
+	}
+	archived("Create", false)
+
+	// Writing the file marks it for archiving.
+	_, err = base.(winfsp.BehaviourWrite).Write(
+		ref, file, []byte("data"), 0, false, false, &info)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	archived("Write", true)
+
+	// Replacing the attributes clears it explicitly.
+	err = base.(winfsp.BehaviourOverwrite).Overwrite(
+		ref, file, 0, true, 0, &info)
+	if err != nil {
+		t.Fatalf("Overwrite: %v", err)
+	}
+	archived("Overwrite", false)
+
+	// WinFSP asks for it upon cleaning up the handle that
+	// modified the file.
+	base.(winfsp.BehaviourCleanup).Cleanup(
+		ref, file, "", winfsp.FspCleanupSetArchiveBit)
+	archived("Cleanup", true)
+}
+
+func TestArchiveAttributeKeepsBackend(t *testing.T) {
+	fs := memfs.New()
+	base, err := gofs.NewOptions(fs,
+		gofs.WithAttribReadOnlyTransMode(gofs.AttribReadOnlyAlways))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\file`,
+		0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	base.(winfsp.BehaviourCleanup).Cleanup(
+		ref, file, "", winfsp.FspCleanupSetArchiveBit)
+	base.Close(ref, file)
+
+	// The read-only bit synthesized by gofs must not be
+	// written back to the backend with the archive bit.
+	stat, err := fs.Stat("file")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if stat.Mode().Perm()&0200 == 0 {
+		t.Errorf("mode = %v; want writable", stat.Mode())
+	}
+	data := stat.Sys().(*syscall.Win32FileAttributeData)
+	if data.FileAttributes&windows.FILE_ATTRIBUTE_ARCHIVE == 0 {
+		t.Errorf("attributes = %#x; want archive", data.FileAttributes)
+	}
+}
+
+func TestThroughputLimiter(t *testing.T) {
+	const (
+		limit = 1 << 20
+		burst = 64 << 10
+		total = 512 << 10
+	)
+	limiter := rate.NewLimiter(limit, burst)
+	base, err := gofs.NewOptions(memfs.New(),
+		gofs.WithThroughputLimiter(limiter))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\file`,
+		0, windows.FILE_READ_DATA|windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer base.Close(ref, file)
+
+	// Beyond the initial burst, the transfer is limited to
+	// the rate, both when writing and when reading. The
+	// write exceeds the burst so that it is waited for in
+	// chunks.
+	want := time.Duration(total-burst) * time.Second / limit
+	start := time.Now()
+	data := bytes.Repeat([]byte{'x'}, 2*burst)
+	for offset := 0; offset < total; offset += len(data) {
+		_, err := base.(winfsp.BehaviourWrite).Write(
+			ref, file, data, uint64(offset), false, false, &info)
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < want {
+		t.Errorf("writing %d bytes took %s; want at least %s",
+			total, elapsed, want)
+	}
+
+	// The write has drained the burst, so the whole read
+	// is limited.
+	want = time.Duration(total) * time.Second / limit
+	start = time.Now()
+	buf := make([]byte, burst)
+	for offset := 0; offset < total; offset += len(buf) {
+		_, err := base.(winfsp.BehaviourRead).Read(
+			ref, file, buf, uint64(offset))
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < want*9/10 {
+		t.Errorf("reading %d bytes took %s; want about %s",
+			total, elapsed, want)
+	}
+}
+
+// flakyFS is the memfs whose operations fail with a
+// transient error for the first few attempts of each.
+type flakyFS struct {
+	*memfs.MemFS
+	mtx      *sync.Mutex
+	attempts map[string]int
+	failures int
+}
+
+func newFlakyFS() flakyFS {
+	return flakyFS{
+		MemFS:    memfs.New(),
+		mtx:      &sync.Mutex{},
+		attempts: make(map[string]int),
+		failures: 2,
+	}
+}
+
+// fail counts the attempt of the operation, failing the
+// first failures of them.
+func (fs flakyFS) fail(op string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.attempts[op]++
+	if fs.attempts[op] <= fs.failures {
+		return syscall.ECONNRESET
+	}
+	return nil
+}
+
+func (fs flakyFS) OpenFile(
+	name string, flag int, perm os.FileMode,
+) (gofs.File, error) {
+	if err := fs.fail("open"); err != nil {
+		return nil, err
+	}
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return flakyFile{File: f, fs: fs}, nil
+}
+
+func (fs flakyFS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.fail("stat"); err != nil {
+		return nil, err
+	}
+	return fs.MemFS.Stat(name)
+}
+
+type flakyFile struct {
+	gofs.File
+	fs flakyFS
+}
+
+func (f flakyFile) Stat() (os.FileInfo, error) {
+	if err := f.fs.fail("fstat"); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f flakyFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.fail("read"); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f flakyFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.fail("write"); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestRetry(t *testing.T) {
+	transient := func(err error, attempt int) (time.Duration, bool) {
+		return time.Millisecond, errors.Is(err, syscall.ECONNRESET)
+	}
+	fs := newFlakyFS()
+	base, err := gofs.NewOptions(fs, gofs.WithRetry(gofs.RetryPolicy{
+		Retry: transient, Deadline: time.Second,
+	}))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\file`,
+		0, windows.FILE_READ_DATA|windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer base.Close(ref, file)
+	_, err = base.(winfsp.BehaviourWrite).Write(
+		ref, file, []byte(helloWorld), 0, false, false, &info)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, len(helloWorld))
+	n, err := base.(winfsp.BehaviourRead).Read(ref, file, buf, 0)
+	if err != nil || string(buf[:n]) != helloWorld {
+		t.Fatalf("Read = %q, %v; want %q", buf[:n], err, helloWorld)
+	}
+	_, _, err = base.(winfsp.BehaviourGetSecurityByName).GetSecurityByName(
+		ref, `\file`, winfsp.GetExistenceOnly)
+	if err != nil {
+		t.Fatalf("GetSecurityByName: %v", err)
+	}
+	for _, op := range []string{"open", "stat", "fstat", "read", "write"} {
+		if fs.attempts[op] < 3 {
+			t.Errorf("%s attempted %d times; want at least 3",
+				op, fs.attempts[op])
+		}
+	}
+
+	// The operation failing past the deadline is failed.
+	fs = newFlakyFS()
+	base, err = gofs.NewOptions(fs, gofs.WithRetry(gofs.RetryPolicy{
+		Retry: func(err error, attempt int) (time.Duration, bool) {
+			return time.Second, true
+		},
+		Deadline: time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	_, err = base.(winfsp.BehaviourCreate).Create(ref, `\file`,
+		0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Create past the deadline = %v; want ECONNRESET", err)
+	}
+
+	// The deadline is measured in the real time, so a
+	// frozen clock does not retry the operation forever.
+	fs = newFlakyFS()
+	fs.failures = math.MaxInt
+	frozen := time.Now()
+	base, err = gofs.NewOptions(fs,
+		gofs.WithClock(func() time.Time { return frozen }),
+		gofs.WithRetry(gofs.RetryPolicy{
+			Retry: func(err error, attempt int) (time.Duration, bool) {
+				return time.Millisecond, true
+			},
+			Deadline: 50 * time.Millisecond,
+		}))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := base.(winfsp.BehaviourCreate).Create(ref, `\file`,
+			0, windows.FILE_WRITE_DATA, 0, nil, 0, &info)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("Create with a frozen clock = %v; "+
+				"want ECONNRESET", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Create with a frozen clock kept retrying " +
+			"past the deadline")
+	}
+	_, err = gofs.NewOptions(fs, gofs.WithRetry(gofs.RetryPolicy{
+		Retry: transient,
+	}))
+	if err == nil {
+		t.Errorf("NewOptions accepted a policy without deadline")
+	}
+}
+
+func TestSeedValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []memfs.NewOption
+	}{
+		{"missing parent of directory", []memfs.NewOption{
+			memfs.WithDirs([]string{`\a\b`})}},
+		{"missing parent of file", []memfs.NewOption{
+			memfs.WithFiles(map[string][]byte{`\a\file`: nil})}},
+		{"file and directory of the same path", []memfs.NewOption{
+			memfs.WithFiles(map[string][]byte{`\a`: nil}),
+			memfs.WithDirs([]string{`\a`})}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: New did not panic", tc.name)
+				}
+			}()
+			memfs.New(tc.opts...)
+		}()
+	}
+}
+
+// copyRenameFS renames the files by copying them to the
+// target and removing the source, like the backends which
+// have no rename, which recreates the files.
+type copyRenameFS struct {
+	*memfs.MemFS
+}
+
+// SupportsOpenRename reports false, since the open files
+// keep referring to the removed source.
+func (fs copyRenameFS) SupportsOpenRename() bool {
+	return false
+}
+
+func (fs copyRenameFS) Rename(source, target string) error {
+	src, err := fs.OpenFile(source, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.NewSectionReader(src, 0, 1<<20))
+	_ = src.Close()
+	if err != nil {
+		return err
+	}
+	tgt, err := fs.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
+	if err != nil {
+		return err
+	}
+	_, err = tgt.WriteAt(data, 0)
+	_ = tgt.Close()
+	if err != nil {
+		return err
+	}
+	return fs.Remove(source)
+}
+
+func TestRenamePreservesCreationTime(t *testing.T) {
+	var now atomic.Int64
+	now.Store(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	clock := func() time.Time {
+		return time.Unix(0, now.Add(int64(time.Hour)))
+	}
+	inner := memfs.New(memfs.WithClock(clock))
+	base := gofs.New(copyRenameFS{inner})
+	ref := &winfsp.FileSystemRef{}
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	file, err := base.(winfsp.BehaviourCreate).Create(ref, `\source`,
+		0, windows.FILE_WRITE_DATA|windows.DELETE, 0, nil, 0, &info)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer base.Close(ref, file)
+	created := info.CreationTime
+	_, err = base.(winfsp.BehaviourWrite).Write(
+		ref, file, []byte(helloWorld), 0, false, false, &info)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	err = base.(winfsp.BehaviourRename).Rename(ref, file, `\source`, `\target`, false)
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := base.(winfsp.BehaviourGetFileInfo).GetFileInfo(ref, file, &info); err != nil {
+		t.Fatalf("GetFileInfo: %v", err)
+	}
+	if info.CreationTime != created || info.FileSize != uint64(len(helloWorld)) {
+		t.Errorf("after rename creation time = %d, size %d; want %d, %d",
+			info.CreationTime, info.FileSize, created, len(helloWorld))
+	}
+	fileInfo, err := inner.Stat(`\target`)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	ft := fileInfo.Sys().(*syscall.Win32FileAttributeData).CreationTime
+	if got := filetime.Filetime(ft); got != created {
+		t.Errorf("creation time of the target = %d; want %d", got, created)
+	}
+}
+
+func TestUmask(t *testing.T) {
+	inner := memfs.New()
+	base, err := gofs.NewOptions(inner, gofs.WithUmask(0o027))
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	ref := &winfsp.FileSystemRef{}
+	create := base.(winfsp.BehaviourCreate).Create
+	for _, tc := range []struct {
+		name          string
+		createOptions uint32
+		attributes    uint32
+		want          os.FileMode
+	}{
+		{`\file`, 0, 0, 0o640},
+		{`\readonly`, 0, windows.FILE_ATTRIBUTE_READONLY, 0o440},
+		{`\dir`, windows.FILE_DIRECTORY_FILE, 0, 0o750},
+	} {
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		file, err := create(ref, tc.name,
+			windows.FILE_CREATE<<winfsp.CreateDispositionShift|tc.createOptions,
+			windows.FILE_READ_ATTRIBUTES, tc.attributes, nil, 0, &info)
+		if err != nil {
+			t.Fatalf("Create(%q): %v", tc.name, err)
+		}
+		base.Close(ref, file)
+		fileInfo, err := inner.Stat(tc.name)
+		if err != nil {
+			t.Fatalf("Stat(%q): %v", tc.name, err)
+		}
+		if got := fileInfo.Mode().Perm(); got != tc.want {
+			t.Errorf("mode of %q = %#o; want %#o", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := gofs.NewOptions(inner, gofs.WithUmask(os.ModeDir)); err == nil {
+		t.Errorf("NewOptions accepted a umask beyond the permission bits")
+	}
+}
@@ -0,0 +1,458 @@
+//go:build windows && (amd64 || arm64)
+
+package mocktransact
+
+import (
+	"runtime"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+// The information of a completed create, telling how the
+// file has been opened.
+const (
+	FILE_SUPERSEDED  = 0
+	FILE_OPENED      = 1
+	FILE_CREATED     = 2
+	FILE_OVERWRITTEN = 3
+)
+
+// Response is the response to a transact request.
+type Response struct {
+	// IoStatus carries the NTSTATUS returned by the
+	// operation, and the information of the request,
+	// e.g. the number of bytes read or written.
+	IoStatus winfsp.FSP_IO_STATUS
+
+	// FileInfo is the file info filled by the operation,
+	// which is left zero by the operations filling none.
+	FileInfo winfsp.FSP_FSCTL_FILE_INFO
+}
+
+// Status returns the NTSTATUS of the response.
+func (r Response) Status() windows.NTStatus {
+	return windows.NTStatus(r.IoStatus.Status)
+}
+
+// Err returns the NTSTATUS of the response as an error,
+// or nil if the request has succeeded.
+func (r Response) Err() error {
+	if status := r.Status(); status != windows.STATUS_SUCCESS {
+		return status
+	}
+	return nil
+}
+
+// Handle is the file opened by Transactor.Create.
+type Handle struct {
+	context winfsp.FSP_FSCTL_TRANSACT_FULL_CONTEXT
+}
+
+// Transactor issues the transact requests against the
+// operations of a detached file system.
+type Transactor struct {
+	detached *winfsp.Detached
+}
+
+// New wires the file system with the options, in the same
+// way as winfsp.Mount does. The result must be released
+// after use, once all handles have been closed.
+func New(fs winfsp.BehaviourBase, opts ...winfsp.Option) (*Transactor, error) {
+	detached, err := winfsp.NewDetached(fs, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Transactor{detached: detached}, nil
+}
+
+// Release releases the detached file system.
+func (t *Transactor) Release() {
+	t.detached.Close()
+}
+
+// Detached returns the detached file system, whose
+// FileSystemRef is the one passed to the behaviours.
+func (t *Transactor) Detached() *winfsp.Detached {
+	return t.detached
+}
+
+func (t *Transactor) fileSystem() uintptr {
+	return uintptr(unsafe.Pointer(t.detached.FileSystem()))
+}
+
+func (t *Transactor) ops() *winfsp.FSP_FILE_SYSTEM_INTERFACE {
+	return t.detached.FileSystem().Interface
+}
+
+func (t *Transactor) fullContext() bool {
+	return t.detached.FileSystem().UmFileContextIsFullContext != 0
+}
+
+// contextAddr is the address the operations opening the
+// file store the file context at.
+func (t *Transactor) contextAddr(h *Handle) uintptr {
+	if t.fullContext() {
+		return uintptr(unsafe.Pointer(&h.context))
+	}
+	return uintptr(unsafe.Pointer(&h.context.UserContext2))
+}
+
+// fileContext is the file context passed to the
+// operations on the opened file.
+func (t *Transactor) fileContext(h *Handle) uintptr {
+	if t.fullContext() {
+		return uintptr(unsafe.Pointer(&h.context))
+	}
+	return uintptr(h.context.UserContext2)
+}
+
+// ntStatus truncates the result of the operation into
+// the NTSTATUS it returns.
+func ntStatus(r uintptr) uint32 {
+	return uint32(r)
+}
+
+func boolArg(value bool) uintptr {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// CreateRequest is the request of creating or opening
+// a file, as FspFsctlTransactCreateKind.
+type CreateRequest struct {
+	// FileName is the path of the file, e.g. `\dir\file`.
+	FileName string
+
+	// Disposition is the FILE_* create disposition, e.g.
+	// FILE_OPEN_IF, placed in the high byte of the create
+	// options passed to the operations.
+	Disposition uint32
+
+	// CreateOptions are the FILE_* create options, e.g.
+	// FILE_DIRECTORY_FILE.
+	CreateOptions uint32
+
+	// DesiredAccess is passed as the granted access.
+	DesiredAccess uint32
+
+	// FileAttributes and AllocationSize are used when
+	// the file is created or overwritten.
+	FileAttributes uint32
+	AllocationSize uint64
+}
+
+// Create opens or creates the file by the disposition of
+// the request, in the way the WinFSP DLL does. The handle
+// is only returned when the request has succeeded, and the
+// information of the response is one of FILE_OPENED, etc.
+func (t *Transactor) Create(req CreateRequest) (*Handle, Response) {
+	var rsp Response
+	name, err := windows.UTF16PtrFromString(req.FileName)
+	if err != nil {
+		rsp.IoStatus.Status = uint32(windows.STATUS_OBJECT_NAME_INVALID)
+		return nil, rsp
+	}
+	handle := &Handle{}
+
+	// The memory passed to the operations is pinned, which
+	// also moves it onto the heap, since the stack might be
+	// moved while the callbacks are running.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(name)
+	pinner.Pin(handle)
+	pinner.Pin(&rsp)
+	ops := t.ops()
+	createOptions := req.Disposition<<winfsp.CreateDispositionShift |
+		req.CreateOptions&winfsp.CreateFlagsMask
+	open := func() uint32 {
+		if ops.Open == 0 {
+			return uint32(windows.STATUS_INVALID_DEVICE_REQUEST)
+		}
+		r, _, _ := syscall.SyscallN(ops.Open,
+			t.fileSystem(), uintptr(unsafe.Pointer(name)),
+			uintptr(createOptions), uintptr(req.DesiredAccess),
+			t.contextAddr(handle), uintptr(unsafe.Pointer(&rsp.FileInfo)))
+		return ntStatus(r)
+	}
+	create := func() uint32 {
+		var r uintptr
+		switch {
+		case ops.Create != 0:
+			r, _, _ = syscall.SyscallN(ops.Create,
+				t.fileSystem(), uintptr(unsafe.Pointer(name)),
+				uintptr(createOptions), uintptr(req.DesiredAccess),
+				uintptr(req.FileAttributes), 0, uintptr(req.AllocationSize),
+				t.contextAddr(handle), uintptr(unsafe.Pointer(&rsp.FileInfo)))
+		case ops.CreateEx != 0:
+			r, _, _ = syscall.SyscallN(ops.CreateEx,
+				t.fileSystem(), uintptr(unsafe.Pointer(name)),
+				uintptr(createOptions), uintptr(req.DesiredAccess),
+				uintptr(req.FileAttributes), 0, uintptr(req.AllocationSize),
+				0, 0, 0,
+				t.contextAddr(handle), uintptr(unsafe.Pointer(&rsp.FileInfo)))
+		default:
+			return uint32(windows.STATUS_INVALID_DEVICE_REQUEST)
+		}
+		return ntStatus(r)
+	}
+	overwrite := func(replace bool) uint32 {
+		if ops.Overwrite == 0 {
+			return uint32(windows.STATUS_INVALID_DEVICE_REQUEST)
+		}
+		r, _, _ := syscall.SyscallN(ops.Overwrite,
+			t.fileSystem(), t.fileContext(handle),
+			uintptr(req.FileAttributes), boolArg(replace),
+			uintptr(req.AllocationSize), uintptr(unsafe.Pointer(&rsp.FileInfo)))
+		return ntStatus(r)
+	}
+
+	notFound := uint32(windows.STATUS_OBJECT_NAME_NOT_FOUND)
+	status := uint32(windows.STATUS_INVALID_PARAMETER)
+	switch req.Disposition {
+	case windows.FILE_CREATE:
+		status, rsp.IoStatus.Information = create(), FILE_CREATED
+	case windows.FILE_OPEN:
+		status, rsp.IoStatus.Information = open(), FILE_OPENED
+	case windows.FILE_OPEN_IF:
+		status, rsp.IoStatus.Information = open(), FILE_OPENED
+		if status == notFound {
+			status, rsp.IoStatus.Information = create(), FILE_CREATED
+		}
+	case windows.FILE_OVERWRITE, windows.FILE_OVERWRITE_IF,
+		windows.FILE_SUPERSEDE:
+		status = open()
+		switch {
+		case status == notFound && req.Disposition != windows.FILE_OVERWRITE:
+			status, rsp.IoStatus.Information = create(), FILE_CREATED
+		case status == uint32(windows.STATUS_SUCCESS):
+			replace := req.Disposition == windows.FILE_SUPERSEDE
+			rsp.IoStatus.Information = FILE_OVERWRITTEN
+			if replace {
+				rsp.IoStatus.Information = FILE_SUPERSEDED
+			}
+			if status = overwrite(replace); status != uint32(windows.STATUS_SUCCESS) {
+				t.Close(handle)
+			}
+		}
+	}
+	rsp.IoStatus.Status = status
+	if status != uint32(windows.STATUS_SUCCESS) {
+		rsp.IoStatus.Information = 0
+		return nil, rsp
+	}
+	return handle, rsp
+}
+
+// Read reads at most length bytes of the file at offset,
+// as FspFsctlTransactReadKind. The information of the
+// response is the number of bytes read.
+func (t *Transactor) Read(h *Handle, offset uint64, length uint32) ([]byte, Response) {
+	var rsp Response
+	ops := t.ops()
+	if ops.Read == 0 {
+		rsp.IoStatus.Status = uint32(windows.STATUS_INVALID_DEVICE_REQUEST)
+		return nil, rsp
+	}
+	buf := make([]byte, length+1)
+	var n uint32
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&buf[0])
+	pinner.Pin(&n)
+	r, _, _ := syscall.SyscallN(ops.Read,
+		t.fileSystem(), t.fileContext(h),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(offset),
+		uintptr(length), uintptr(unsafe.Pointer(&n)))
+	rsp.IoStatus.Status = ntStatus(r)
+	rsp.IoStatus.Information = n
+	return buf[:min(n, length)], rsp
+}
+
+// WriteRequest is the request of writing to a file, as
+// FspFsctlTransactWriteKind.
+type WriteRequest struct {
+	Offset           uint64
+	Data             []byte
+	WriteToEndOfFile bool
+	ConstrainedIo    bool
+}
+
+// Write writes the data to the file. The information of
+// the response is the number of bytes written.
+func (t *Transactor) Write(h *Handle, req WriteRequest) Response {
+	var rsp Response
+	ops := t.ops()
+	if ops.Write == 0 {
+		rsp.IoStatus.Status = uint32(windows.STATUS_INVALID_DEVICE_REQUEST)
+		return rsp
+	}
+	// The buffer is never empty so that it has an address.
+	buf := append(make([]byte, 0, len(req.Data)+1), req.Data...)
+	var n uint32
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&buf[:1][0])
+	pinner.Pin(&n)
+	pinner.Pin(&rsp)
+	r, _, _ := syscall.SyscallN(ops.Write,
+		t.fileSystem(), t.fileContext(h),
+		uintptr(unsafe.Pointer(&buf[:1][0])), uintptr(req.Offset),
+		uintptr(len(req.Data)),
+		boolArg(req.WriteToEndOfFile), boolArg(req.ConstrainedIo),
+		uintptr(unsafe.Pointer(&n)), uintptr(unsafe.Pointer(&rsp.FileInfo)))
+	rsp.IoStatus.Status = ntStatus(r)
+	rsp.IoStatus.Information = n
+	return rsp
+}
+
+// DirInfo is an entry filled by ReadDirectory.
+type DirInfo struct {
+	Name     string
+	FileInfo winfsp.FSP_FSCTL_FILE_INFO
+
+	// NextOffset is the marker of the entry following it
+	// when the file system uses directory offsets, see
+	// winfsp.BehaviourReadDirectoryOffset.
+	NextOffset uint64
+}
+
+// sizeOfDirInfo is the size of FSP_FSCTL_DIR_INFO
+// preceding the file name.
+const sizeOfDirInfo = int(unsafe.Sizeof(winfsp.FSP_FSCTL_DIR_INFO{}))
+
+// parseDirInfos parses the entries filled into the buffer,
+// each of which is aligned to 8 bytes, until an entry of
+// zero size or the end of the buffer.
+func parseDirInfos(buf []byte) []DirInfo {
+	var result []DirInfo
+	for len(buf) >= sizeOfDirInfo {
+		info := (*winfsp.FSP_FSCTL_DIR_INFO)(unsafe.Pointer(&buf[0]))
+		size := int(info.Size)
+		if size < sizeOfDirInfo || size > len(buf) {
+			break
+		}
+		name := make([]uint16, (size-sizeOfDirInfo)/2)
+		for i := range name {
+			name[i] = *(*uint16)(unsafe.Pointer(&buf[sizeOfDirInfo+2*i]))
+		}
+		result = append(result, DirInfo{
+			Name:       string(utf16.Decode(name)),
+			FileInfo:   info.FileInfo,
+			NextOffset: info.NextOffset,
+		})
+		size = (size + 7) &^ 7
+		if size >= len(buf) {
+			break
+		}
+		buf = buf[size:]
+	}
+	return result
+}
+
+// ReadDirectory reads the entries of the directory after
+// the marker, or from the start if the marker is nil, into
+// a buffer of length bytes, as FspFsctlTransactQueryDirectoryKind.
+// The information of the response is the number of bytes
+// filled into the buffer.
+//
+// The marker is passed as the name of the entry, or as its
+// NextOffset when the file system uses directory offsets.
+func (t *Transactor) ReadDirectory(
+	h *Handle, pattern string, marker *DirInfo, length uint32,
+) ([]DirInfo, Response) {
+	var rsp Response
+	ops := t.ops()
+	if ops.ReadDirectory == 0 {
+		rsp.IoStatus.Status = uint32(windows.STATUS_INVALID_DEVICE_REQUEST)
+		return nil, rsp
+	}
+	var patternPtr, markerPtr *uint16
+	if pattern != "" {
+		p, err := windows.UTF16PtrFromString(pattern)
+		if err != nil {
+			rsp.IoStatus.Status = uint32(windows.STATUS_OBJECT_NAME_INVALID)
+			return nil, rsp
+		}
+		patternPtr = p
+	}
+	if marker != nil {
+		if t.detached.Attributes()&
+			winfsp.FspFSAttributeDirectoryMarkerAsNextOffset != 0 {
+			offset := new(uint64)
+			*offset = marker.NextOffset
+			markerPtr = (*uint16)(unsafe.Pointer(offset))
+		} else {
+			p, err := windows.UTF16PtrFromString(marker.Name)
+			if err != nil {
+				rsp.IoStatus.Status = uint32(windows.STATUS_OBJECT_NAME_INVALID)
+				return nil, rsp
+			}
+			markerPtr = p
+		}
+	}
+	buf := make([]byte, length+1)
+	var n uint32
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&buf[0])
+	pinner.Pin(&n)
+	if patternPtr != nil {
+		pinner.Pin(patternPtr)
+	}
+	if markerPtr != nil {
+		pinner.Pin(markerPtr)
+	}
+	r, _, _ := syscall.SyscallN(ops.ReadDirectory,
+		t.fileSystem(), t.fileContext(h),
+		uintptr(unsafe.Pointer(patternPtr)), uintptr(unsafe.Pointer(markerPtr)),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(length),
+		uintptr(unsafe.Pointer(&n)))
+	rsp.IoStatus.Status = ntStatus(r)
+	rsp.IoStatus.Information = n
+	if rsp.Err() != nil {
+		return nil, rsp
+	}
+	return parseDirInfos(buf[:min(n, length)]), rsp
+}
+
+// Cleanup cleans up the file as the last handle to it is
+// closed, as FspFsctlTransactCleanupKind, where the flags
+// are the FspCleanup* flags, e.g. FspCleanupDelete.
+func (t *Transactor) Cleanup(h *Handle, fileName string, flags uint32) Response {
+	var rsp Response
+	ops := t.ops()
+	if ops.Cleanup == 0 {
+		return rsp
+	}
+	name, err := windows.UTF16PtrFromString(fileName)
+	if err != nil {
+		rsp.IoStatus.Status = uint32(windows.STATUS_OBJECT_NAME_INVALID)
+		return rsp
+	}
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(name)
+	_, _, _ = syscall.SyscallN(ops.Cleanup,
+		t.fileSystem(), t.fileContext(h),
+		uintptr(unsafe.Pointer(name)), uintptr(flags))
+	return rsp
+}
+
+// Close closes the file, as FspFsctlTransactCloseKind,
+// after which the handle must no longer be used.
+func (t *Transactor) Close(h *Handle) Response {
+	var rsp Response
+	if ops := t.ops(); ops.Close != 0 {
+		_, _, _ = syscall.SyscallN(ops.Close,
+			t.fileSystem(), t.fileContext(h))
+	}
+	return rsp
+}
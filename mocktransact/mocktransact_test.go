@@ -0,0 +1,315 @@
+//go:build windows && (amd64 || arm64)
+
+package mocktransact_test
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/winfsp/go-winfsp"
+	"github.com/winfsp/go-winfsp/mocktransact"
+)
+
+// flatFS is a flat file system keeping its files in a
+// map, which calls nothing from the WinFSP DLL, so that
+// it could be driven without WinFSP installed.
+type flatFS struct {
+	mtx     sync.Mutex
+	files   map[string][]byte
+	handles map[uintptr]string
+	next    uintptr
+}
+
+func newFlatFS(names ...string) *flatFS {
+	fs := &flatFS{
+		files:   map[string][]byte{`\`: nil},
+		handles: make(map[uintptr]string),
+	}
+	for _, name := range names {
+		fs.files[name] = []byte(name)
+	}
+	return fs
+}
+
+func (fs *flatFS) fill(name string, info *winfsp.FSP_FSCTL_FILE_INFO) {
+	*info = winfsp.FSP_FSCTL_FILE_INFO{}
+	if name == `\` {
+		info.FileAttributes = windows.FILE_ATTRIBUTE_DIRECTORY
+		return
+	}
+	info.FileAttributes = windows.FILE_ATTRIBUTE_NORMAL
+	info.FileSize = uint64(len(fs.files[name]))
+}
+
+func (fs *flatFS) openLocked(
+	name string, info *winfsp.FSP_FSCTL_FILE_INFO,
+) uintptr {
+	fs.next++
+	fs.handles[fs.next] = name
+	fs.fill(name, info)
+	return fs.next
+}
+
+func (fs *flatFS) Open(
+	ref *winfsp.FileSystemRef, name string,
+	createOptions, grantedAccess uint32,
+	info *winfsp.FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if _, ok := fs.files[name]; !ok {
+		return 0, windows.STATUS_OBJECT_NAME_NOT_FOUND
+	}
+	return fs.openLocked(name, info), nil
+}
+
+func (fs *flatFS) Create(
+	ref *winfsp.FileSystemRef, name string,
+	createOptions, grantedAccess, fileAttributes uint32,
+	securityDescriptor *windows.SECURITY_DESCRIPTOR,
+	allocationSize uint64, info *winfsp.FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if _, ok := fs.files[name]; ok {
+		return 0, windows.STATUS_OBJECT_NAME_COLLISION
+	}
+	fs.files[name] = nil
+	return fs.openLocked(name, info), nil
+}
+
+func (fs *flatFS) Overwrite(
+	ref *winfsp.FileSystemRef, file uintptr,
+	attributes uint32, replaceAttributes bool,
+	allocationSize uint64, info *winfsp.FSP_FSCTL_FILE_INFO,
+) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	name := fs.handles[file]
+	fs.files[name] = nil
+	fs.fill(name, info)
+	return nil
+}
+
+func (fs *flatFS) Close(ref *winfsp.FileSystemRef, file uintptr) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	delete(fs.handles, file)
+}
+
+func (fs *flatFS) Read(
+	ref *winfsp.FileSystemRef, file uintptr,
+	buf []byte, offset uint64,
+) (int, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	data := fs.files[fs.handles[file]]
+	if offset >= uint64(len(data)) {
+		return 0, io.EOF
+	}
+	return copy(buf, data[offset:]), nil
+}
+
+func (fs *flatFS) Write(
+	ref *winfsp.FileSystemRef, file uintptr,
+	buf []byte, offset uint64,
+	writeToEndOfFile, constrainedIo bool,
+	info *winfsp.FSP_FSCTL_FILE_INFO,
+) (int, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	name := fs.handles[file]
+	data := fs.files[name]
+	if writeToEndOfFile {
+		offset = uint64(len(data))
+	}
+	if end := offset + uint64(len(buf)); end > uint64(len(data)) {
+		data = append(data, make([]byte, end-uint64(len(data)))...)
+	}
+	copy(data[offset:], buf)
+	fs.files[name] = data
+	fs.fill(name, info)
+	return len(buf), nil
+}
+
+func (fs *flatFS) ReadDirectoryOffset(
+	ref *winfsp.FileSystemRef, file uintptr,
+	pattern *uint16, marker uint64, buf []byte,
+) (int, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	var names []string
+	for name := range fs.files {
+		if name != `\` {
+			names = append(names, strings.TrimPrefix(name, `\`))
+		}
+	}
+	slices.Sort(names)
+	n := 0
+	for i := int(marker); i < len(names); i++ {
+		var info winfsp.FSP_FSCTL_FILE_INFO
+		fs.fill(`\`+names[i], &info)
+		added := winfsp.FileSystemAddDirInfo(
+			names[i], uint64(i+1), &info, buf[n:])
+		if added == 0 {
+			return n, nil
+		}
+		n += added
+	}
+	return n + winfsp.FileSystemAddDirInfo("", 0, nil, buf[n:]), nil
+}
+
+func newTransactor(t *testing.T, fs *flatFS) *mocktransact.Transactor {
+	t.Helper()
+	tr, err := mocktransact.New(fs)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(tr.Release)
+	return tr
+}
+
+func TestCreate(t *testing.T) {
+	fs := newFlatFS(`\a`)
+	tr := newTransactor(t, fs)
+	for _, tc := range []struct {
+		name        string
+		disposition uint32
+		status      windows.NTStatus
+		information uint32
+	}{
+		{`\a`, windows.FILE_OPEN, windows.STATUS_SUCCESS, mocktransact.FILE_OPENED},
+		{`\b`, windows.FILE_OPEN, windows.STATUS_OBJECT_NAME_NOT_FOUND, 0},
+		{`\a`, windows.FILE_CREATE, windows.STATUS_OBJECT_NAME_COLLISION, 0},
+		{`\b`, windows.FILE_CREATE, windows.STATUS_SUCCESS, mocktransact.FILE_CREATED},
+		{`\c`, windows.FILE_OPEN_IF, windows.STATUS_SUCCESS, mocktransact.FILE_CREATED},
+		{`\c`, windows.FILE_OPEN_IF, windows.STATUS_SUCCESS, mocktransact.FILE_OPENED},
+		{`\d`, windows.FILE_OVERWRITE, windows.STATUS_OBJECT_NAME_NOT_FOUND, 0},
+		{`\a`, windows.FILE_OVERWRITE, windows.STATUS_SUCCESS, mocktransact.FILE_OVERWRITTEN},
+		{`\a`, windows.FILE_SUPERSEDE, windows.STATUS_SUCCESS, mocktransact.FILE_SUPERSEDED},
+		{`\d`, windows.FILE_OVERWRITE_IF, windows.STATUS_SUCCESS, mocktransact.FILE_CREATED},
+	} {
+		h, rsp := tr.Create(mocktransact.CreateRequest{
+			FileName:      tc.name,
+			Disposition:   tc.disposition,
+			DesiredAccess: windows.FILE_READ_DATA | windows.FILE_WRITE_DATA,
+		})
+		if rsp.Status() != tc.status ||
+			rsp.IoStatus.Information != tc.information {
+			t.Errorf("Create(%q, %d) = %v, %d; want %v, %d",
+				tc.name, tc.disposition, rsp.Status(),
+				rsp.IoStatus.Information, tc.status, tc.information)
+		}
+		if (h != nil) != (tc.status == windows.STATUS_SUCCESS) {
+			t.Errorf("Create(%q, %d) handle = %v", tc.name, tc.disposition, h)
+		}
+		if h != nil {
+			tr.Close(h)
+		}
+	}
+	if len(fs.handles) != 0 {
+		t.Errorf("%d handles left open", len(fs.handles))
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	for _, fullContext := range []bool{false, true} {
+		fs := newFlatFS()
+		tr, err := mocktransact.New(fs, winfsp.FullContextMode(fullContext))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		h, rsp := tr.Create(mocktransact.CreateRequest{
+			FileName:      `\file`,
+			Disposition:   windows.FILE_CREATE,
+			DesiredAccess: windows.FILE_READ_DATA | windows.FILE_WRITE_DATA,
+		})
+		if err := rsp.Err(); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		rsp = tr.Write(h, mocktransact.WriteRequest{Offset: 0, Data: []byte("hello")})
+		if rsp.Err() != nil || rsp.IoStatus.Information != 5 || rsp.FileInfo.FileSize != 5 {
+			t.Errorf("Write = %v, %d, size %d; want success, 5, size 5",
+				rsp.Status(), rsp.IoStatus.Information, rsp.FileInfo.FileSize)
+		}
+		rsp = tr.Write(h, mocktransact.WriteRequest{
+			Data: []byte(" world"), WriteToEndOfFile: true})
+		if rsp.Err() != nil || rsp.FileInfo.FileSize != 11 {
+			t.Errorf("Write to end of file = %v, size %d; want success, size 11",
+				rsp.Status(), rsp.FileInfo.FileSize)
+		}
+		data, rsp := tr.Read(h, 6, 100)
+		if rsp.Err() != nil || string(data) != "world" {
+			t.Errorf("Read = %v, %q; want success, %q", rsp.Status(), data, "world")
+		}
+		_, rsp = tr.Read(h, 100, 10)
+		if rsp.Status() != windows.STATUS_END_OF_FILE {
+			t.Errorf("Read past end of file = %v; want STATUS_END_OF_FILE", rsp.Status())
+		}
+		tr.Close(h)
+		tr.Release()
+	}
+}
+
+func TestReadDirectory(t *testing.T) {
+	fs := newFlatFS(`\a`, `\bb`, `\ccc`, `\dddd`)
+	tr := newTransactor(t, fs)
+	h, rsp := tr.Create(mocktransact.CreateRequest{
+		FileName:      `\`,
+		Disposition:   windows.FILE_OPEN,
+		CreateOptions: windows.FILE_DIRECTORY_FILE,
+		DesiredAccess: windows.FILE_LIST_DIRECTORY,
+	})
+	if err := rsp.Err(); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer tr.Close(h)
+
+	// The small buffer only holds a few entries at once,
+	// so the rest are read by resuming after the marker.
+	var names []string
+	var marker *mocktransact.DirInfo
+	for {
+		entries, rsp := tr.ReadDirectory(h, "", marker, 256)
+		if err := rsp.Err(); err != nil {
+			t.Fatalf("ReadDirectory: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+			if size := uint64(len(`\` + entry.Name)); entry.FileInfo.FileSize != size {
+				t.Errorf("size of %q = %d; want %d",
+					entry.Name, entry.FileInfo.FileSize, size)
+			}
+		}
+		marker = &entries[len(entries)-1]
+	}
+	if want := []string{"a", "bb", "ccc", "dddd"}; !slices.Equal(names, want) {
+		t.Errorf("names = %q; want %q", names, want)
+	}
+}
+
+func TestWiring(t *testing.T) {
+	tr := newTransactor(t, newFlatFS(`\a`))
+	h, rsp := tr.Create(mocktransact.CreateRequest{
+		FileName: `\a`, Disposition: windows.FILE_OPEN,
+	})
+	if err := rsp.Err(); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer tr.Close(h)
+	if ops := tr.Detached().FileSystem().Interface; ops.Flush != 0 {
+		t.Errorf("Flush is wired without BehaviourFlush")
+	}
+	if tr.Detached().Attributes()&
+		winfsp.FspFSAttributeDirectoryMarkerAsNextOffset == 0 {
+		t.Errorf("directory offsets are not marked in the attributes")
+	}
+}
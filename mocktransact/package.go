@@ -0,0 +1,19 @@
+// Package mocktransact simulates the WinFSP dispatcher in
+// process, so that the file systems could be tested
+// through the callbacks wired by winfsp.NewDetached, in
+// the same way they are invoked once mounted, without
+// installing WinFSP or creating a volume.
+//
+// The requests are issued in the shapes of the transact
+// requests sent by the WinFSP driver, e.g. a create with
+// its disposition, and the responses carry the NTSTATUS
+// and the information returned through the callbacks.
+//
+// Unlike the WinFSP DLL, the access checks and the
+// security descriptors are not simulated, and a create
+// overwriting the file completes the overwrite at once
+// rather than in a separate request.
+//
+// Only the 64-bit platforms are supported, on which the
+// C calling convention of the callbacks is native.
+package mocktransact
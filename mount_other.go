@@ -0,0 +1,28 @@
+//go:build !windows
+
+package winfsp
+
+// BehaviourBase is the file system to be mounted, which
+// could never be mounted on this platform.
+type BehaviourBase interface{}
+
+type option struct{}
+
+// Option is the options that could be passed to mount,
+// which are ignored on this platform.
+type Option func(*option)
+
+// FileSystem is the mounted file system, which is never
+// returned on this platform.
+type FileSystem struct{}
+
+// Mount always fails with ErrUnsupportedPlatform on the
+// platforms other than Windows.
+func Mount(
+	fs BehaviourBase, mountpoint string, opts ...Option,
+) (*FileSystem, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// Unmount does nothing, since nothing could be mounted.
+func (f *FileSystem) Unmount() {}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package winfsp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+func TestMountUnsupported(t *testing.T) {
+	fs, err := winfsp.Mount(nil, "X:")
+	if !errors.Is(err, winfsp.ErrUnsupportedPlatform) || fs != nil {
+		t.Errorf("Mount = %v, %v; want ErrUnsupportedPlatform", fs, err)
+	}
+}
@@ -0,0 +1,244 @@
+package winfsp
+
+import (
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+var fileSystemPreflight dllProc
+
+func init() {
+	registerOptionalProc("FspFileSystemPreflight", &fileSystemPreflight)
+}
+
+// Preflight checks whether a file system could likely be
+// mounted at the mount point by Mount with the options,
+// without creating a volume, so that the configuration
+// could be validated before committing to it.
+//
+// The check fails if WinFSP cannot be loaded, the driver
+// selected by the options, see VolumePrefix, is not
+// loaded, or the mount point is already in use, e.g. the
+// drive letter is taken or the directory already exists.
+// It fails with ErrNotSupported if the loaded WinFSP DLL
+// does not export FspFileSystemPreflight.
+// A successful check does not guarantee that the mount
+// succeeds, since the mount point might be taken between
+// the check and the mount.
+//
+// As with Mount, "*" stands for the first free drive
+// letter, which is always available when there is one.
+func Preflight(mountpoint string, opts ...Option) error {
+	if mountpoint == "*" {
+		letter, err := FirstFreeDriveLetter()
+		if err != nil {
+			return err
+		}
+		mountpoint = letter
+	}
+	if err := tryLoadWinFSP(); err != nil {
+		return err
+	}
+	option := newOption()
+	Options(opts...)(option)
+	driverName := fspDiskDeviceName
+	if option.volumePrefix != "" {
+		driverName = fspNetDeviceName
+	}
+	utf16Driver := windows.StringToUTF16Ptr(driverName)
+	utf16MountPoint, err := windows.UTF16PtrFromString(mountpoint)
+	if err != nil {
+		return errors.Wrapf(err, "string %q convert utf16", mountpoint)
+	}
+	err = fileSystemPreflight.CallStatus(
+		uintptr(unsafe.Pointer(utf16Driver)),
+		uintptr(unsafe.Pointer(utf16MountPoint)),
+	)
+	runtime.KeepAlive(utf16Driver)
+	runtime.KeepAlive(utf16MountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "preflight mount point %q", mountpoint)
+	}
+	return nil
+}
+
+// ErrMountPointInUse is returned by CleanStaleMountPoint
+// when the directory is the mount point of a file system
+// which is still mounted.
+var ErrMountPointInUse = errors.New("mount point in use")
+
+// winfspVolumePrefix is the prefix of the substitute name
+// of the mount point reparse set by WinFSP on directories,
+// which is the NT name of the volume, while the ordinary
+// junctions are targeted at the `\??\` namespace.
+const winfspVolumePrefix = `\Device\Volume{`
+
+// isDirectoryMountPoint tells whether WinFSP mounts the
+// file system at the mount point as a directory, rather
+// than as a drive, e.g. "X:" or "*".
+func isDirectoryMountPoint(mountpoint string) bool {
+	name := strings.TrimPrefix(mountpoint, `\\.\`)
+	if name == "" || name == "*" {
+		return false
+	}
+	return !(len(name) == 2 && name[1] == ':')
+}
+
+// normalizeMountPath converts the mount point or the
+// path into an upper cased form without the `\\.\` or
+// `\\?\` prefix, the trailing separators and the forward
+// slashes, so that they could be compared by prefix.
+func normalizeMountPath(path string) string {
+	path = strings.ReplaceAll(path, "/", `\`)
+	for _, prefix := range []string{`\\.\`, `\\?\`} {
+		path = strings.TrimPrefix(path, prefix)
+	}
+	return strings.ToUpper(strings.TrimRight(path, `\`))
+}
+
+// mountPointOwns tells whether the path is the mount
+// point or is located under it.
+func mountPointOwns(mountpoint, path string) bool {
+	mountpoint = normalizeMountPath(mountpoint)
+	path = normalizeMountPath(path)
+	if mountpoint == "" || !strings.HasPrefix(path, mountpoint) {
+		return false
+	}
+	return len(path) == len(mountpoint) || path[len(mountpoint)] == '\\'
+}
+
+// FindMount returns the file system mounted by this
+// process which the path is located on, e.g. `x:/dir`
+// belongs to the file system mounted at "X:".
+//
+// The path must be absolute, and is compared with the
+// mount points case-insensitively. When the mount points
+// are nested, e.g. a directory mount point on a volume
+// mounted by this process, the innermost one is returned.
+func FindMount(path string) (*FileSystem, bool) {
+	var result *FileSystem
+	for _, fs := range Mounts() {
+		if !mountPointOwns(fs.mountPoint, path) {
+			continue
+		}
+		if result == nil || len(normalizeMountPath(fs.mountPoint)) >
+			len(normalizeMountPath(result.mountPoint)) {
+			result = fs
+		}
+	}
+	return result, result != nil
+}
+
+// CleanStaleMountPoint removes the directory left behind
+// as the mount point of a file system which is no longer
+// mounted, e.g. after the process serving it crashed, so
+// that the directory can be used as the mount point again.
+//
+// The directory is only removed when all of the following
+// holds, otherwise it is kept as is:
+//
+//   - It is a mount point reparse whose target is the NT
+//     name of a volume with no print name, which is how
+//     WinFSP marks the directories it mounts at, unlike
+//     the junctions created by users.
+//   - The target volume is gone, i.e. opening it through
+//     the directory fails as not found or not ready. It
+//     returns ErrMountPointInUse if the volume could be
+//     opened, or the error if opening it fails otherwise.
+//   - It is empty, since WinFSP always mounts at a newly
+//     created directory, otherwise removing it fails.
+//
+// Nothing is done and nil is returned if the directory
+// does not exist or is not a reparse point at all, while
+// an error is returned for any other reparse point.
+func CleanStaleMountPoint(dir string) error {
+	stale, err := isStaleMountPoint(dir)
+	if err != nil || !stale {
+		return err
+	}
+	utf16Dir, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return errors.Wrapf(err, "string %q convert utf16", dir)
+	}
+	if err := windows.RemoveDirectory(utf16Dir); err != nil {
+		return errors.Wrapf(err, "remove stale mount point %q", dir)
+	}
+	return nil
+}
+
+// isStaleMountPoint tells whether the directory is the
+// mount point of a WinFSP file system no longer mounted,
+// see CleanStaleMountPoint.
+func isStaleMountPoint(dir string) (bool, error) {
+	utf16Dir, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return false, errors.Wrapf(err, "string %q convert utf16", dir)
+	}
+	handle, err := windows.CreateFile(
+		utf16Dir, windows.FILE_READ_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|
+			windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS|
+			windows.FILE_FLAG_OPEN_REPARSE_POINT, 0,
+	)
+	if err == windows.ERROR_FILE_NOT_FOUND ||
+		err == windows.ERROR_PATH_NOT_FOUND {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "open mount point %q", dir)
+	}
+	var info windows.ByHandleFileInformation
+	err = windows.GetFileInformationByHandle(handle, &info)
+	if err != nil {
+		_ = windows.CloseHandle(handle)
+		return false, errors.Wrapf(err, "query mount point %q", dir)
+	}
+	if info.FileAttributes&windows.FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		_ = windows.CloseHandle(handle)
+		return false, nil
+	}
+	buffer := make([]byte, windows.MAXIMUM_REPARSE_DATA_BUFFER_SIZE)
+	var size uint32
+	err = windows.DeviceIoControl(
+		handle, windows.FSCTL_GET_REPARSE_POINT, nil, 0,
+		&buffer[0], uint32(len(buffer)), &size, nil,
+	)
+	_ = windows.CloseHandle(handle)
+	if err != nil {
+		return false, errors.Wrapf(err, "get reparse point of %q", dir)
+	}
+	tag, substitute, printName, err := parseReparseNames(buffer[:size])
+	if err != nil || tag != windows.IO_REPARSE_TAG_MOUNT_POINT ||
+		printName != "" || !strings.HasPrefix(substitute, winfspVolumePrefix) {
+		return false, errors.Errorf("%q is not a WinFSP mount point", dir)
+	}
+
+	// The mount point is still in use if the volume behind
+	// it can be opened through it. Only the volume being
+	// gone tells that it is stale, while the other errors,
+	// e.g. access denied by a volume of another user, might
+	// well be returned by a live volume.
+	handle, err = windows.CreateFile(
+		utf16Dir, windows.FILE_READ_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|
+			windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS, 0,
+	)
+	switch err {
+	case nil:
+		_ = windows.CloseHandle(handle)
+		return false, errors.Wrapf(ErrMountPointInUse, "%q", dir)
+	case windows.ERROR_FILE_NOT_FOUND, windows.ERROR_PATH_NOT_FOUND,
+		windows.ERROR_NOT_READY, windows.ERROR_UNRECOGNIZED_VOLUME:
+		return true, nil
+	default:
+		return false, errors.Wrapf(err, "open volume of mount point %q", dir)
+	}
+}
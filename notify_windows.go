@@ -0,0 +1,131 @@
+package winfsp
+
+import (
+	"time"
+	"unicode/utf16"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	fileSystemNotifyBegin dllProc
+	fileSystemNotifyEnd   dllProc
+	fileSystemNotify      dllProc
+)
+
+func init() {
+	registerOptionalProc("FspFileSystemNotifyBegin", &fileSystemNotifyBegin)
+	registerOptionalProc("FspFileSystemNotifyEnd", &fileSystemNotifyEnd)
+	registerOptionalProc("FspFileSystemNotify", &fileSystemNotify)
+}
+
+// NotifyInfo is a change of a file to be reported by
+// FileSystemRef.Notify.
+type NotifyInfo struct {
+	// Filter is the FILE_NOTIFY_CHANGE_* flags matching
+	// the change, e.g. FILE_NOTIFY_CHANGE_FILE_NAME.
+	Filter uint32
+
+	// Action is the FILE_ACTION_* of the change,
+	// e.g. FILE_ACTION_ADDED.
+	Action uint32
+
+	// Name is the full path of the changed file from
+	// the root of the file system, e.g. `\dir\file`.
+	Name string
+}
+
+// notifyInfoHeaderSize is the size of FSP_FSCTL_NOTIFY_INFO
+// preceding the name, and notifyInfoAlignment is the
+// alignment of each packed entry.
+const (
+	notifyInfoHeaderSize = 12
+	notifyInfoAlignment  = 8
+)
+
+// notifyBeginTimeout is how long Notify waits for the
+// operations in progress to finish.
+const notifyBeginTimeout = time.Second
+
+// packNotifyInfo packs the changes into consecutive
+// FSP_FSCTL_NOTIFY_INFO entries like the helper
+// FspFileSystemAddNotifyInfo, returning the buffer and
+// the number of bytes packed.
+func packNotifyInfo(infos []NotifyInfo) ([]uint64, int, error) {
+	size := 0
+	for _, info := range infos {
+		nameLen := utf16EncodedLen(info.Name)
+		entrySize := notifyInfoHeaderSize + nameLen*SIZEOF_WCHAR
+		if entrySize > 0xffff {
+			return nil, 0, nameTooLong(nameLen,
+				(0xffff-notifyInfoHeaderSize)/SIZEOF_WCHAR)
+		}
+		size += (entrySize + notifyInfoAlignment - 1) &^
+			(notifyInfoAlignment - 1)
+	}
+	buffer := make([]uint64, (size+7)/8)
+	if size == 0 {
+		return buffer, 0, nil
+	}
+	base := unsafe.Pointer(&buffer[0])
+	offset := 0
+	for _, info := range infos {
+		name := utf16.Encode([]rune(info.Name))
+		entrySize := notifyInfoHeaderSize + len(name)*SIZEOF_WCHAR
+		entry := unsafe.Add(base, offset)
+		*(*uint16)(entry) = uint16(entrySize)
+		*(*uint32)(unsafe.Add(entry, 4)) = info.Filter
+		*(*uint32)(unsafe.Add(entry, 8)) = info.Action
+		if len(name) > 0 {
+			copy(unsafe.Slice((*uint16)(unsafe.Add(
+				entry, notifyInfoHeaderSize)), len(name)), name)
+		}
+		offset += (entrySize + notifyInfoAlignment - 1) &^
+			(notifyInfoAlignment - 1)
+	}
+	return buffer, size, nil
+}
+
+// Notify reports the changes made to the files bypassing
+// the file system, e.g. by other processes on the backing
+// storage, so that the applications watching the
+// directories are notified and the caches of WinFSP are
+// invalidated.
+//
+// Notify waits for the operations in progress to finish,
+// so it must not be called from within an operation of
+// the same file system, otherwise it fails with the
+// STATUS_CANT_WAIT after a while. It fails with
+// ErrNotSupported if the loaded WinFSP DLL does not export
+// the notify procs.
+func (fileSystem *FileSystemRef) Notify(infos ...NotifyInfo) error {
+	f := fileSystem.mounted.Load()
+	if f == nil {
+		return errors.New("notify unmounted file system")
+	}
+	f.unmountMtx.RLock()
+	defer f.unmountMtx.RUnlock()
+	if f.mounted.Load() != f {
+		return errors.New("notify unmounted file system")
+	}
+	buffer, size, err := packNotifyInfo(infos)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	fsp := uintptr(unsafe.Pointer(f.fileSystem))
+	if err := fileSystemNotifyBegin.CallStatus(fsp,
+		uintptr(notifyBeginTimeout/time.Millisecond)); err != nil {
+		return errors.Wrap(err, "FspFileSystemNotifyBegin")
+	}
+	defer func() { _ = fileSystemNotifyEnd.CallStatus(fsp) }()
+	if err := fileSystemNotify.CallStatus(fsp,
+		uintptr(unsafe.Pointer(&buffer[0])), uintptr(size),
+	); err != nil {
+		return errors.Wrap(err, "FspFileSystemNotify")
+	}
+	return nil
+}
@@ -6,4 +6,11 @@
 //
 // The API interfaces are only usable on windows, since
 // they refers to the native API on winfsp.dll.
+//
+// The file names passed to the behaviours are the full
+// paths from the root of the file system, e.g. `\dir\file`,
+// which are not limited by MAX_PATH. WinFSP itself limits
+// a path to FSP_FSCTL_TRANSACT_PATH_SIZEMAX, i.e. 1024
+// UTF-16 code units, and each of its components to the
+// MaxComponentLength of the file system.
 package winfsp
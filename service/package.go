@@ -0,0 +1,8 @@
+// Package service runs WinFSP file systems under the
+// windows service control manager.
+//
+// It is a thin wrapper around winfsp.Service, which in
+// turn wraps the FspService API of WinFSP, mounting the
+// file systems when the service starts and unmounting
+// them when the service is requested to stop.
+package service
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/winfsp/go-winfsp"
+)
+
+// StartFunc mounts the file systems served by the
+// service, with the arguments passed by the service
+// control manager, or from the command line when
+// running in console mode.
+//
+// Every returned file system will be unmounted when
+// the service is requested to stop.
+type StartFunc func(args []string) ([]*winfsp.FileSystem, error)
+
+type option struct {
+	consoleMode bool
+}
+
+// Option configures RunAsService.
+type Option func(*option)
+
+// WithConsoleMode specifies whether the service is
+// allowed to run as an ordinary console program when
+// it is not started by the service control manager,
+// which is convenient for debugging. Ctrl+C stops the
+// service in console mode.
+//
+// Console mode is allowed by default.
+func WithConsoleMode(value bool) Option {
+	return func(o *option) {
+		o.consoleMode = value
+	}
+}
+
+type handler struct {
+	start StartFunc
+
+	mtx         sync.Mutex
+	fileSystems []*winfsp.FileSystem
+}
+
+func (h *handler) Start(_ *winfsp.Service, args []string) error {
+	fileSystems, err := h.start(args)
+	if err != nil {
+		for _, fs := range fileSystems {
+			fs.Unmount()
+		}
+		return err
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.fileSystems = append(h.fileSystems, fileSystems...)
+	return nil
+}
+
+func (h *handler) Stop(_ *winfsp.Service) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, fs := range h.fileSystems {
+		fs.Unmount()
+	}
+	h.fileSystems = nil
+	return nil
+}
+
+// RunAsService runs the service with the specified name
+// until it is stopped, mounting the file systems by
+// start when the service starts.
+//
+// The function blocks the calling goroutine, so it is
+// usually the last call in the main function.
+func RunAsService(name string, start StartFunc, opts ...Option) error {
+	if start == nil {
+		return errors.New("invalid nil start parameter")
+	}
+	option := &option{
+		consoleMode: true,
+	}
+	for _, opt := range opts {
+		opt(option)
+	}
+	service, err := winfsp.NewService(name, &handler{start: start})
+	if err != nil {
+		return err
+	}
+	defer service.Delete()
+	if option.consoleMode {
+		service.AllowConsoleMode()
+	}
+	if err := service.Loop(); err != nil {
+		return errors.Wrapf(err, "run service %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package winfsp
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	serviceCreate           dllProc
+	serviceDelete           dllProc
+	serviceAllowConsoleMode dllProc
+	serviceLoop             dllProc
+	serviceStop             dllProc
+	serviceGetExitCode      dllProc
+)
+
+func init() {
+	registerOptionalProc("FspServiceCreate", &serviceCreate)
+	registerOptionalProc("FspServiceDelete", &serviceDelete)
+	registerOptionalProc("FspServiceAllowConsoleMode", &serviceAllowConsoleMode)
+	registerOptionalProc("FspServiceLoop", &serviceLoop)
+	registerOptionalProc("FspServiceStop", &serviceStop)
+	registerOptionalProc("FspServiceGetExitCode", &serviceGetExitCode)
+}
+
+// maxCommandLineLen is the maximum length of the command
+// line on Windows in UTF-16 code units, which bounds each
+// of the service arguments.
+const maxCommandLineLen = 32767
+
+// BehaviourService is the callbacks of a WinFSP service.
+//
+// Start is invoked with the service arguments once the
+// service control manager starts the service, and the
+// file systems should be mounted there. Stop is invoked
+// when the service is requested to stop, and the file
+// systems mounted by Start should be unmounted there.
+//
+// Errors returned by both methods are converted into
+// NTSTATUS and reported to the service control manager.
+type BehaviourService interface {
+	Start(service *Service, args []string) error
+	Stop(service *Service) error
+}
+
+// Service is the created object of WinFSP's service.
+//
+// It wraps the FSP_SERVICE object, which handles the
+// interaction with the service control manager, and
+// must be released by Delete after use.
+type Service struct {
+	service uintptr
+	handler BehaviourService
+}
+
+// serviceMap maps the FSP_SERVICE pointer to the Service,
+// since the callbacks only receive the former.
+var serviceMap sync.Map
+
+func loadService(service uintptr) *Service {
+	value, ok := serviceMap.Load(service)
+	if !ok {
+		return nil
+	}
+	return value.(*Service)
+}
+
+var go_delegateServiceStart = syscall.NewCallbackCDecl(func(
+	service uintptr, argc uint32, argv uintptr,
+) uintptr {
+	s := loadService(service)
+	if s == nil {
+		return uintptr(ntStatusNoRef)
+	}
+	args := make([]string, 0, argc)
+	ptrs := unsafe.Slice((*uintptr)(unsafe.Pointer(argv)), argc)
+	for _, ptr := range ptrs {
+		args = append(args, utf16PtrToStringN(ptr, maxCommandLineLen))
+	}
+	return uintptr(convertNTStatus(s.handler.Start(s, args)))
+})
+
+var go_delegateServiceStop = syscall.NewCallbackCDecl(func(
+	service uintptr,
+) uintptr {
+	s := loadService(service)
+	if s == nil {
+		return uintptr(ntStatusNoRef)
+	}
+	return uintptr(convertNTStatus(s.handler.Stop(s)))
+})
+
+// NewService creates a WinFSP service with the specified
+// name, whose callbacks are dispatched to handler.
+//
+// The service will not run until Loop is called. It fails
+// with ErrNotSupported if the loaded WinFSP DLL does not
+// export the service procs.
+func NewService(name string, handler BehaviourService) (*Service, error) {
+	if handler == nil {
+		return nil, errors.New("invalid nil handler parameter")
+	}
+	if err := tryLoadWinFSP(); err != nil {
+		return nil, err
+	}
+	utf16Name, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "convert service name")
+	}
+	var service uintptr
+	if err := serviceCreate.CallStatus(
+		uintptr(unsafe.Pointer(utf16Name)),
+		go_delegateServiceStart,
+		go_delegateServiceStop,
+		0,
+		uintptr(unsafe.Pointer(&service)),
+	); err != nil {
+		return nil, errors.Wrap(err, "FspServiceCreate")
+	}
+	result := &Service{
+		service: service,
+		handler: handler,
+	}
+	serviceMap.Store(service, result)
+	return result, nil
+}
+
+// AllowConsoleMode allows the service to run as an
+// ordinary console program when it is not started by
+// the service control manager, in which case Stop is
+// invoked upon receiving Ctrl+C.
+func (s *Service) AllowConsoleMode() {
+	_, _ = serviceAllowConsoleMode.Call(s.service)
+}
+
+// Loop runs the service until it is stopped, either by
+// the service control manager or by Stop.
+func (s *Service) Loop() error {
+	if err := serviceLoop.CallStatus(s.service); err != nil {
+		return errors.Wrap(err, "FspServiceLoop")
+	}
+	return nil
+}
+
+// Stop requests the service to stop, the Stop method of
+// the handler will be invoked and Loop will return.
+func (s *Service) Stop() {
+	_, _ = serviceStop.Call(s.service)
+}
+
+// ExitCode retrieves the exit code reported to the
+// service control manager.
+func (s *Service) ExitCode() uint32 {
+	code, _ := serviceGetExitCode.Call(s.service)
+	return uint32(code)
+}
+
+// Delete releases the service, it must not be called
+// while Loop is still running.
+func (s *Service) Delete() {
+	serviceMap.Delete(s.service)
+	_, _ = serviceDelete.Call(s.service)
+}
@@ -0,0 +1,110 @@
+package treelock
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/winfsp/go-winfsp/internal/callstack"
+)
+
+// Leak is an allocation of the tree locker which has not
+// been released yet, see DebugTrackAllocs.
+type Leak struct {
+	// Kind is the type of the allocation, which is one
+	// of "Node", "NodeLock" and "PathLock".
+	Kind string
+
+	// Stack is the formatted call stack at allocation.
+	Stack string
+}
+
+func (l Leak) String() string {
+	return l.Kind + " allocated at:\n" + l.Stack
+}
+
+// allocRecord is the allocation recorded while tracking.
+type allocRecord struct {
+	kind  string
+	seq   uint64
+	stack []uintptr
+}
+
+var (
+	trackAllocs  atomic.Bool
+	allocsMtx    sync.Mutex
+	allocSeq     uint64
+	trackedAlloc = make(map[any]allocRecord)
+)
+
+// DebugTrackAllocs enables or disables recording the
+// allocation stack of every Node, NodeLock and PathLock,
+// so that the ones not yet released can be reported by
+// Leaks. Disabling the tracking forgets the allocations
+// recorded so far.
+//
+// A tracked allocation is kept reachable until it is
+// released, so that it will not be silently released by
+// its finalizer, and leaks are reported reliably instead
+// of depending on the timing of garbage collection.
+//
+// The tracking is meant for debugging and testing only,
+// since capturing the stack slows down every allocation.
+func DebugTrackAllocs(enable bool) {
+	trackAllocs.Store(enable)
+	if !enable {
+		allocsMtx.Lock()
+		defer allocsMtx.Unlock()
+		clear(trackedAlloc)
+	}
+}
+
+// trackAlloc records the allocation of obj if tracking.
+func trackAlloc(kind string, obj any) {
+	if !trackAllocs.Load() {
+		return
+	}
+	// Skip trackAlloc and the creator.
+	stack := callstack.Capture(2)
+	allocsMtx.Lock()
+	defer allocsMtx.Unlock()
+	allocSeq++
+	trackedAlloc[obj] = allocRecord{
+		kind:  kind,
+		seq:   allocSeq,
+		stack: stack,
+	}
+}
+
+// untrackAlloc forgets obj once it has been released.
+func untrackAlloc(obj any) {
+	if !trackAllocs.Load() {
+		return
+	}
+	allocsMtx.Lock()
+	defer allocsMtx.Unlock()
+	delete(trackedAlloc, obj)
+}
+
+// Leaks returns the allocations which are recorded since
+// DebugTrackAllocs is enabled and have not been released,
+// in the order of allocation.
+func Leaks() []Leak {
+	allocsMtx.Lock()
+	records := make([]allocRecord, 0, len(trackedAlloc))
+	for _, record := range trackedAlloc {
+		records = append(records, record)
+	}
+	allocsMtx.Unlock()
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].seq < records[j].seq
+	})
+	result := make([]Leak, 0, len(records))
+	for _, record := range records {
+		result = append(result, Leak{
+			Kind:  record.kind,
+			Stack: callstack.Format(record.stack),
+		})
+	}
+	return result
+}
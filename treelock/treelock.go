@@ -5,6 +5,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"sync"
 	"unsafe"
 )
@@ -24,6 +25,7 @@ import (
 type node struct {
 	rc       uint64
 	name     string
+	key      string
 	parent   *node
 	children map[string]*node
 	exile    bool
@@ -41,15 +43,46 @@ var childMapPool = &sync.Pool{
 type TreeLocker struct {
 	mtx  sync.Mutex
 	root *node
+	fold func(string) string
 }
 
-func New() *TreeLocker {
-	return &TreeLocker{
+// Option configures the TreeLocker upon creation.
+type Option func(*TreeLocker)
+
+// WithCaseFold specifies the function to normalize
+// the names before looking them up in the tree, so
+// that the differently spelled names of the same
+// file, e.g. "Foo" and "foo" in a case insensitive
+// file system, are locked as the same node.
+//
+// The node keeps the spelling which allocates it,
+// which is what SlashPath and FilePath return.
+func WithCaseFold(fold func(string) string) Option {
+	return func(tl *TreeLocker) {
+		tl.fold = fold
+	}
+}
+
+func New(opts ...Option) *TreeLocker {
+	result := &TreeLocker{
 		root: &node{
 			name:   "",
 			parent: nil,
 		},
 	}
+	for _, opt := range opts {
+		opt(result)
+	}
+	return result
+}
+
+// keyOf returns the key of the name in the
+// children map of its parent.
+func (tl *TreeLocker) keyOf(name string) string {
+	if tl.fold == nil {
+		return name
+	}
+	return tl.fold(name)
 }
 
 // allocClean gets or allocates the nodes in
@@ -71,14 +104,16 @@ func (tl *TreeLocker) allocClean(p string) *node {
 	if dirNode.children == nil {
 		dirNode.children = childMapPool.Get().(map[string]*node)
 	}
-	baseNode, ok := dirNode.children[base]
+	key := tl.keyOf(base)
+	baseNode, ok := dirNode.children[key]
 	if !ok {
 		baseNode = &node{
 			name:   base,
+			key:    key,
 			parent: dirNode,
 		}
 		dirNode.rc += 1
-		dirNode.children[base] = baseNode
+		dirNode.children[key] = baseNode
 	}
 	return baseNode
 }
@@ -101,7 +136,7 @@ func (n *node) free() {
 	}
 	n.rc -= 1
 	if n.rc == 0 && n.parent != nil {
-		delete(n.parent.children, n.name)
+		delete(n.parent.children, n.key)
 		if len(n.parent.children) == 0 {
 			childMapPool.Put(n.parent.children)
 			n.parent.children = nil
@@ -162,6 +197,12 @@ func UnifyFilePath(p string) string {
 	return filepath.FromSlash(cleanFilePath(p))
 }
 
+// IsRootFilePath tells whether the file path refers
+// to the root, e.g. "", ".", "/", "\\" or "X:".
+func IsRootFilePath(p string) bool {
+	return cleanFilePath(p) == "/"
+}
+
 // nodeLocker is just a combination of a node and
 // a locker, to provide appropriate operations.
 // Its resource management is done by the object
@@ -280,6 +321,7 @@ func (tl *TreeLocker) createNode(node *node) *Node {
 	runtime.SetFinalizer(result, func(l *Node) {
 		l.Free()
 	})
+	trackAlloc("Node", result)
 	success = true
 	return result
 }
@@ -311,6 +353,7 @@ func (tl *TreeLocker) AllocExile() *Node {
 func (n *Node) Free() {
 	runtime.SetFinalizer(n, nil)
 	n.once.Do(func() {
+		untrackAlloc(n)
 		n.locker.mtx.Lock()
 		defer n.locker.mtx.Unlock()
 		n.node.free()
@@ -363,6 +406,7 @@ func (nl *NodeLock) unlock() {
 
 func (nl *NodeLock) Unlock() {
 	nl.once.Do(func() {
+		untrackAlloc(nl)
 		nl.unlock()
 	})
 }
@@ -390,6 +434,7 @@ func (n *node) createNodeLock(locker *TreeLocker, write bool) *NodeLock {
 	runtime.SetFinalizer(result, func(nl *NodeLock) {
 		nl.Unlock()
 	})
+	trackAlloc("NodeLock", result)
 	success = true
 	return result
 }
@@ -559,6 +604,7 @@ func (pl *PathLock) unlock() {
 func (pl *PathLock) Unlock() {
 	runtime.SetFinalizer(pl, nil)
 	pl.once.Do(func() {
+		untrackAlloc(pl)
 		pl.unlock()
 	})
 }
@@ -586,6 +632,7 @@ func (node *node) createPathLock(locker *TreeLocker, write bool) *PathLock {
 	runtime.SetFinalizer(result, func(pl *PathLock) {
 		pl.Unlock()
 	})
+	trackAlloc("PathLock", result)
 	success = true
 	return result
 }
@@ -594,31 +641,39 @@ func (n *Node) createPathLock(write bool) *PathLock {
 	return n.node.createPathLock(n.locker, write)
 }
 
+// runlockPath read unlocks the node and its ancestors,
+// from the node up to the root.
 func (n *node) runlockPath() {
-	if n == nil {
-		return
+	for ; n != nil; n = n.parent {
+		n.runlockNode()
 	}
-	defer n.parent.runlockPath()
-	defer n.runlockNode()
 }
 
-func (n *node) tryRLockPath(wait bool) (blocker *node) {
-	if n == nil {
-		return nil
+// ancestors appends the node and its ancestors to the
+// slice, from the node up to the root.
+func (n *node) ancestors(result []*node) []*node {
+	for ; n != nil; n = n.parent {
+		result = append(result, n)
 	}
-	if blk := n.parent.tryRLockPath(wait); blk != nil {
-		return blk
-	}
-	locked := false
-	defer func() {
-		if !locked {
-			n.parent.runlockPath()
+	return result
+}
+
+// tryRLockPath read locks the node and its ancestors,
+// from the root down to the node. The nodes locked so
+// far are unlocked if any of them fails, and the node
+// failed is returned as the blocker.
+//
+// The path is iterated rather than recursed, so that
+// locking a deep path will not grow the stack.
+func (n *node) tryRLockPath(wait bool) (blocker *node) {
+	var buf [16]*node
+	path := n.ancestors(buf[:0])
+	for i := len(path) - 1; i >= 0; i-- {
+		if !path[i].tryRlockNode(wait) {
+			path[i].parent.runlockPath()
+			return path[i]
 		}
-	}()
-	if !n.tryRlockNode(wait) {
-		return n
 	}
-	locked = true
 	return nil
 }
 
@@ -673,33 +728,54 @@ func (n *Node) RLockPath() *PathLock {
 	}
 }
 
-func (tl *TreeLocker) rlockClean(p string) *PathLock {
+func (tl *TreeLocker) rlockClean(
+	p string, retain bool,
+) (*PathLock, *Node) {
 	for {
-		result, waitCh := func() (*PathLock, chan struct{}) {
+		result, retained, waitCh := func() (
+			*PathLock, *Node, chan struct{},
+		) {
 			tl.mtx.Lock()
 			defer tl.mtx.Unlock()
 			node := tl.allocRetainClean(p)
 			defer node.free()
 			blocker := node.tryRLockPath(true)
 			if blocker != nil {
-				return nil, blocker.waitCh
+				return nil, nil, blocker.waitCh
+			}
+			lock := node.createPathLock(tl, false)
+			if !retain {
+				return lock, nil, nil
 			}
-			return node.createPathLock(tl, false), nil
+			return lock, tl.createNode(node), nil
 		}()
 		if waitCh != nil {
 			<-waitCh
 			continue
 		}
-		return result
+		return result, retained
 	}
 }
 
 func (tl *TreeLocker) RLockSlash(p string) *PathLock {
-	return tl.rlockClean(cleanSlashPath(p))
+	result, _ := tl.rlockClean(cleanSlashPath(p), false)
+	return result
 }
 
 func (tl *TreeLocker) RLockFile(p string) *PathLock {
-	return tl.rlockClean(cleanFilePath(p))
+	result, _ := tl.rlockClean(cleanFilePath(p), false)
+	return result
+}
+
+// RLockFileNode acquires the reader lock of the file
+// path specified like RLockFile, and also retains
+// the locked node like RetainNode, under a single
+// acquisition of the tree mutex.
+//
+// The node outlives the lock and must be manually
+// freed.
+func (tl *TreeLocker) RLockFileNode(p string) (*PathLock, *Node) {
+	return tl.rlockClean(cleanFilePath(p), true)
 }
 
 func (n *node) tryWLockPath() (acquired bool) {
@@ -733,23 +809,38 @@ func (n *Node) TryWLockPath() *PathLock {
 	return nil
 }
 
-func (tl *TreeLocker) tryWLockClean(p string) *PathLock {
+func (tl *TreeLocker) tryWLockClean(
+	p string, retain bool,
+) (*PathLock, *Node) {
 	tl.mtx.Lock()
 	defer tl.mtx.Unlock()
 	node := tl.allocRetainClean(p)
 	defer node.free()
-	if node.tryWLockPath() {
-		return node.createPathLock(tl, true)
+	if !node.tryWLockPath() {
+		return nil, nil
 	}
-	return nil
+	lock := node.createPathLock(tl, true)
+	if !retain {
+		return lock, nil
+	}
+	return lock, tl.createNode(node)
 }
 
 func (tl *TreeLocker) TryWLockSlash(p string) *PathLock {
-	return tl.tryWLockClean(cleanSlashPath(p))
+	result, _ := tl.tryWLockClean(cleanSlashPath(p), false)
+	return result
 }
 
 func (tl *TreeLocker) TryWLockFile(p string) *PathLock {
-	return tl.tryWLockClean(cleanFilePath(p))
+	result, _ := tl.tryWLockClean(cleanFilePath(p), false)
+	return result
+}
+
+// TryWLockFileNode is the writer lock counterpart
+// of RLockFileNode, returning nils if the lock
+// cannot be acquired.
+func (tl *TreeLocker) TryWLockFileNode(p string) (*PathLock, *Node) {
+	return tl.tryWLockClean(cleanFilePath(p), true)
 }
 
 // Exchange the nodes locked by the two
@@ -774,9 +865,10 @@ func Exchange(p1, p2 *PathLock) {
 	p1.locker.mtx.Lock()
 	defer p1.locker.mtx.Unlock()
 	p1Name, p2Name := p1.node.name, p2.node.name
+	p1Key, p2Key := p1.node.key, p2.node.key
 	p1Parent, p2Parent := p1.node.parent, p2.node.parent
-	if (p1Parent != nil && p1Parent.children[p1Name] != p1.node) ||
-		(p2Parent != nil && p2Parent.children[p2Name] != p2.node) {
+	if (p1Parent != nil && p1Parent.children[p1Key] != p1.node) ||
+		(p2Parent != nil && p2Parent.children[p2Key] != p2.node) {
 		panic("children mismatch")
 	}
 	p1Exile, p2Exile := p1.node.exile, p2.node.exile
@@ -785,16 +877,18 @@ func Exchange(p1, p2 *PathLock) {
 		panic("cannot resurrent exiled tree")
 	}
 	if p1Parent != nil {
-		p1Parent.children[p1Name] = p2.node
+		p1Parent.children[p1Key] = p2.node
 	}
 	p2.node.name = p1Name
+	p2.node.key = p1Key
 	p2.node.parent = p1Parent
 	p2.node.exile = p1Exile
 	if p2Parent != nil {
-		p2Parent.children[p2Name] = p1.node
+		p2Parent.children[p2Key] = p1.node
 	}
 	p1.node.parent = p2Parent
 	p1.node.name = p2Name
+	p1.node.key = p2Key
 	p1.node.exile = p2Exile
 }
 
@@ -818,6 +912,7 @@ func Split(pl *PathLock) (*PathLock, *NodeLock) {
 
 		if !plConsumed {
 			runtime.SetFinalizer(pl, nil)
+			untrackAlloc(pl)
 			defer func() {
 				if !success {
 					pl.unlock()
@@ -906,6 +1001,7 @@ func Join(pl *PathLock, nl *NodeLock) *PathLock {
 		})
 		if !plConsumed {
 			runtime.SetFinalizer(pl, nil)
+			untrackAlloc(pl)
 			defer func() {
 				if !plFreed {
 					pl.unlock()
@@ -922,6 +1018,7 @@ func Join(pl *PathLock, nl *NodeLock) *PathLock {
 		})
 		if !nlConsumed {
 			runtime.SetFinalizer(nl, nil)
+			untrackAlloc(nl)
 			defer func() {
 				if !nlFreed {
 					nl.unlock()
@@ -979,3 +1076,55 @@ func (tl *TreeLocker) WLockExile() *PathLock {
 	}
 	return exile.createPathLock(tl, true)
 }
+
+// walkEntry is the state of a node captured by Walk.
+type walkEntry struct {
+	path        string
+	refs        uint64
+	writeLocked bool
+}
+
+// walk captures the node and its descendants in the
+// order of their keys.
+func (n *node) walk(p string, entries []walkEntry) []walkEntry {
+	entries = append(entries, walkEntry{
+		path:        p,
+		refs:        n.rc,
+		writeLocked: n.readers < 0,
+	})
+	keys := make([]string, 0, len(n.children))
+	for key := range n.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := n.children[key]
+		entries = child.walk(path.Join(p, child.name), entries)
+	}
+	return entries
+}
+
+// Walk visits the nodes alive in the tree, starting from
+// the root "/", with their slash paths, reference counts
+// and whether they are write locked, until fn returns
+// false. It is intended for diagnostics, e.g. listing the
+// open files, and the nodes in the exile are not visited.
+//
+// The tree is captured while holding the mutex, but fn is
+// invoked after releasing it, so fn may call back into
+// the locker, while the captured state might be stale by
+// the time fn sees it.
+func (tl *TreeLocker) Walk(
+	fn func(path string, refs uint64, writeLocked bool) bool,
+) {
+	entries := func() []walkEntry {
+		tl.mtx.Lock()
+		defer tl.mtx.Unlock()
+		return tl.root.walk("/", nil)
+	}()
+	for _, entry := range entries {
+		if !fn(entry.path, entry.refs, entry.writeLocked) {
+			return
+		}
+	}
+}
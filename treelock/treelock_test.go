@@ -2,6 +2,7 @@ package treelock
 
 import (
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -119,6 +120,22 @@ func TestResolution(t *testing.T) {
 	}()
 }
 
+func TestIsRootFilePath(t *testing.T) {
+	assert := Assert{assert.New(t)}
+	for _, p := range []string{
+		"", ".", "/", filepath.FromSlash("/"),
+		filepath.FromSlash("/a/.."), filepath.FromSlash("./"),
+	} {
+		assert.True(IsRootFilePath(p), "%q", p)
+		assert.Equal(filepath.FromSlash("/"), UnifyFilePath(p), "%q", p)
+	}
+	for _, p := range []string{
+		"a", filepath.FromSlash("/a"), filepath.FromSlash("/a/b/.."),
+	} {
+		assert.False(IsRootFilePath(p), "%q", p)
+	}
+}
+
 func TestOperation(t *testing.T) {
 	assert := Assert{assert.New(t)}
 	tl := New()
@@ -175,6 +192,85 @@ func TestOperation(t *testing.T) {
 	assert.Equal(true, nodeA1.HasChild())
 }
 
+func TestLockFileNode(t *testing.T) {
+	assert := Assert{assert.New(t)}
+	tl := New()
+	assert.EmptyLocker(tl)
+	defer assert.EmptyLocker(tl)
+
+	rlock, rnode := tl.RLockFileNode(filepath.Join("a", "b"))
+	assert.NotNil(rlock)
+	assert.NotNil(rnode)
+	assert.Equal(&rlock.node, &rnode.node)
+	assert.Equal(uint64(2), rnode.CurrentRefs())
+	assert.Equal(int64(1), tl.root.children["a"].children["b"].readers)
+	rlock.Unlock()
+
+	// The node remains valid after the lock is released.
+	assert.Equal(uint64(1), rnode.CurrentRefs())
+	assert.Equal(int64(0), tl.root.children["a"].children["b"].readers)
+	assert.Equal(filepath.FromSlash("/a/b"), rnode.FilePath())
+
+	wlock, wnode := tl.TryWLockFileNode(filepath.Join("a", "b"))
+	assert.NotNil(wlock)
+	assert.NotNil(wnode)
+	assert.Equal(&rnode.node, &wnode.node)
+	assert.Equal(uint64(3), wnode.CurrentRefs())
+
+	failLock, failNode := tl.TryWLockFileNode(filepath.Join("a", "b"))
+	assert.Nil(failLock)
+	assert.Nil(failNode)
+	wlock.Unlock()
+	wnode.Free()
+
+	// The node must be freed to clean up the tree.
+	assert.Equal(uint64(1), rnode.CurrentRefs())
+	rnode.Free()
+}
+
+func TestCaseFold(t *testing.T) {
+	assert := Assert{assert.New(t)}
+	tl := New(WithCaseFold(strings.ToLower))
+	assert.EmptyLocker(tl)
+	defer assert.EmptyLocker(tl)
+
+	wlock := tl.TryWLockSlash("/Foo")
+	assert.NotNil(wlock)
+	assert.Nil(tl.TryRLockSlash("/foo"))
+	assert.Nil(tl.TryRLockSlash("/FOO/bar"))
+	assert.Nil(tl.TryWLockSlash("/fOO"))
+
+	// The node keeps the spelling allocating it.
+	assert.Equal("/Foo", wlock.SlashPath())
+	wlock.Unlock()
+
+	rlock := tl.TryRLockSlash("/foo")
+	assert.NotNil(rlock)
+	assert.Equal("/foo", rlock.SlashPath())
+	rlock.Unlock()
+
+	// Exchanging must keep the nodes reachable by keys.
+	lockA := tl.TryWLockSlash("/A")
+	lockB := tl.TryWLockSlash("/B")
+	Exchange(lockA, lockB)
+	assert.Equal("/B", lockA.SlashPath())
+	assert.Equal("/A", lockB.SlashPath())
+	assert.Nil(tl.TryRLockSlash("/a"))
+	assert.Nil(tl.TryRLockSlash("/b"))
+	lockA.Unlock()
+	lockB.Unlock()
+
+	// Without case folding, the names are distinct.
+	plain := New()
+	lock1 := plain.TryWLockSlash("/Foo")
+	lock2 := plain.TryWLockSlash("/foo")
+	assert.NotNil(lock1)
+	assert.NotNil(lock2)
+	lock1.Unlock()
+	lock2.Unlock()
+	assert.EmptyLocker(plain)
+}
+
 func TestPathRLockShare(t *testing.T) {
 	assert := Assert{assert.New(t)}
 	tl := New()
@@ -990,3 +1086,132 @@ func TestDowngrade(t *testing.T) {
 		assert.Equal(false, lock1.IsWrite())
 	}()
 }
+
+func TestWalk(t *testing.T) {
+	assert := Assert{assert.New(t)}
+	tl := New()
+	assert.EmptyLocker(tl)
+	defer assert.EmptyLocker(tl)
+
+	wlock := tl.TryWLockSlash("/a/b")
+	assert.NotNil(wlock)
+	defer wlock.Unlock()
+	rlock := tl.TryRLockSlash("/c")
+	assert.NotNil(rlock)
+	defer rlock.Unlock()
+	node := tl.AllocSlash("/a/d/e")
+	defer node.Free()
+
+	type visit struct {
+		path        string
+		refs        uint64
+		writeLocked bool
+	}
+	var visits []visit
+	tl.Walk(func(path string, refs uint64, writeLocked bool) bool {
+		// Calling back into the locker must not deadlock.
+		assert.Equal("/a/d/e", node.SlashPath())
+		visits = append(visits, visit{path, refs, writeLocked})
+		return true
+	})
+	assert.Equal([]visit{
+		{"/", 2, false},
+		{"/a", 2, false},
+		{"/a/b", 1, true},
+		{"/a/d", 1, false},
+		{"/a/d/e", 1, false},
+		{"/c", 1, false},
+	}, visits)
+
+	// Returning false stops the walk.
+	count := 0
+	tl.Walk(func(string, uint64, bool) bool {
+		count++
+		return count < 2
+	})
+	assert.Equal(2, count)
+}
+
+func leakPathLock(tl *TreeLocker) *PathLock {
+	return tl.RLockSlash("/a/b")
+}
+
+func TestDebugTrackAllocs(t *testing.T) {
+	assert := Assert{assert.New(t)}
+	tl := New()
+	assert.EmptyLocker(tl)
+	defer assert.EmptyLocker(tl)
+
+	DebugTrackAllocs(true)
+	defer DebugTrackAllocs(false)
+
+	node := tl.AllocSlash("/a")
+	pl, nl := Split(node.RLockPath())
+	pl = Join(pl, nl)
+	pl.Unlock()
+	node.Free()
+	assert.Empty(Leaks())
+
+	leaked := leakPathLock(tl)
+	leaks := Leaks()
+	assert.Len(leaks, 1)
+	assert.Equal("PathLock", leaks[0].Kind)
+	assert.Contains(leaks[0].Stack, "treelock.leakPathLock")
+	assert.Contains(leaks[0].Stack, "treelock.TestDebugTrackAllocs")
+	assert.Contains(leaks[0].String(), "PathLock allocated at:")
+
+	leaked.Unlock()
+	assert.Empty(Leaks())
+}
+
+func TestDeepPathLock(t *testing.T) {
+	assert := Assert{assert.New(t)}
+	tl := New()
+	assert.EmptyLocker(tl)
+	defer assert.EmptyLocker(tl)
+
+	const depth = 5000
+	components := make([]string, depth)
+	for i := range components {
+		components[i] = "d"
+	}
+	deep := "/" + strings.Join(components, "/")
+	middle := "/" + strings.Join(components[:depth/2], "/")
+
+	// Every ancestor is read locked by the deep path.
+	rlock := tl.TryRLockSlash(deep)
+	assert.NotNil(rlock)
+	assert.Equal(int64(1), tl.root.readers)
+	assert.Nil(tl.TryWLockSlash(middle))
+	rlock.Unlock()
+
+	wlock := tl.TryWLockSlash(middle)
+	assert.NotNil(wlock)
+
+	// The ancestors locked before the blocker must be
+	// rolled back when locking the deep path fails, so
+	// they remain read locked by the writer only.
+	assert.Nil(tl.TryRLockSlash(deep))
+	assert.Equal(int64(1), tl.root.readers)
+	func() {
+		tl.mtx.Lock()
+		defer tl.mtx.Unlock()
+		n := tl.root.children["d"]
+		for i := 1; i < depth/2; i++ {
+			assert.Equal(int64(1), n.readers)
+			n = n.children["d"]
+		}
+		assert.Equal(int64(-1), n.readers)
+	}()
+
+	// The waiting reader proceeds once the writer leaves.
+	done := make(chan *PathLock)
+	go func() {
+		done <- tl.RLockSlash(deep)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	wlock.Unlock()
+	rlock = <-done
+	assert.NotNil(rlock)
+	rlock.Unlock()
+}
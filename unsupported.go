@@ -0,0 +1,11 @@
+package winfsp
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupportedPlatform is returned by Mount on the
+// platforms other than Windows, where WinFSP does not
+// exist, so that the cross platform code importing this
+// package could be built and fail gracefully at runtime.
+var ErrUnsupportedPlatform = errors.New("winfsp is only supported on windows")
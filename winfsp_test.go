@@ -4,17 +4,30 @@ package winfsp_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"maps"
+	"math"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
 
 	"github.com/winfsp/go-winfsp"
 	"github.com/winfsp/go-winfsp/gofs"
+	"github.com/winfsp/go-winfsp/log"
+	"github.com/winfsp/go-winfsp/memfs"
 )
 
 const helloWorld = "Hello, World!\n"
@@ -25,91 +38,1243 @@ func TestMount(t *testing.T) {
 	testFS.addTestFile(`\reg-size-456`, bytes.Repeat([]byte{'a'}, 456))
 	testFS.addTestFile(`\hello.txt`, []byte(helloWorld))
 
-	bb, err := gofs.NewOptions(
-		testFS,
-		gofs.WithAttribReadOnlyTransMode(gofs.AttribReadOnlyPOSIX),
-	)
+	bb, err := gofs.NewOptions(
+		testFS,
+		gofs.WithAttribReadOnlyTransMode(gofs.AttribReadOnlyPOSIX),
+	)
+	if err != nil {
+		t.Fatalf("NewOptions: %v", err)
+	}
+	fspFS, err := winfsp.Mount(bb, "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	wantDir(t, `T:\`)
+	wantDirContents(t, `T:\`, WantDir{
+		"reg-size-123": regular(123),
+		"reg-size-456": regular(456),
+		"hello.txt":    regular(int64(len(helloWorld))),
+	})
+
+	wantRegSize(t, `T:\reg-size-123`, 123)
+	wantRegSize(t, `T:\reg-size-456`, 456)
+	wantNotExist(t, `T:\not-exist-file`)
+	wantFileContents(t, `T:\hello.txt`, helloWorld)
+
+	// Test that that os.File.Close calls make it to the kernel and back to us,
+	// and that our testFS accounts for the open FD count correctly.
+	t.Run("Close", func(t *testing.T) {
+		// Wait for previous operations' close events to be processed
+		// (apparently os.File.Close is returning before userspace WinFSP calls
+		// handle the Close?)
+		for range 20 {
+			if testFS.openFiles.Load() == 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		testFS.wantOpenFiles(t, 0)
+		f, err := os.Open(`T:\reg-size-123`)
+		if err != nil {
+			t.Fatalf("Open reg-size-123: %v", err)
+		}
+		testFS.wantOpenFiles(t, 1)
+
+		ch := make(chan any, 1)
+		testFS.setSubscriber(ch)
+		defer testFS.setSubscriber(nil)
+
+		f.Close()
+		select {
+		case ev := <-ch:
+			_, ok := ev.(regularFileClosedEvent)
+			if !ok {
+				t.Errorf("got event of type %T; want regularFileClosedEvent", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("timed out waiting for regularFileClosedEvent")
+		}
+		testFS.wantOpenFiles(t, 0)
+
+		f.Close()
+		testFS.wantOpenFiles(t, 0)
+	})
+
+	t.Run("CreateFile", func(t *testing.T) {
+		wantNotExist(t, `T:\newfile.txt`)
+		if err := os.WriteFile(`T:\newfile.txt`, []byte(helloWorld), 0o644); err != nil {
+			t.Fatalf("WriteFile newfile.txt: %v", err)
+		}
+		wantFileContents(t, `T:\newfile.txt`, helloWorld)
+	})
+
+	t.Run("RemoveFile", func(t *testing.T) {
+		const path = `T:\to-delete.txt`
+		wantNotExist(t, path)
+		if err := os.WriteFile(path, []byte(helloWorld), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		wantFileContents(t, path, helloWorld)
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		wantNotExist(t, path)
+	})
+}
+
+func TestMountName(t *testing.T) {
+	fspFS, err := winfsp.Mount(
+		gofs.New(newTestFS()), "T:",
+		winfsp.WithName("test-volume"),
+	)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	if got := fspFS.Name(); got != "test-volume" {
+		t.Errorf("Name() = %q; want %q", got, "test-volume")
+	}
+}
+
+func TestFirstFreeDriveLetter(t *testing.T) {
+	letter, err := winfsp.FirstFreeDriveLetter()
+	if err != nil {
+		t.Skipf("FirstFreeDriveLetter: %v", err)
+	}
+	if _, err := os.Stat(letter + `\`); err == nil {
+		t.Errorf("FirstFreeDriveLetter() = %q, which is in use", letter)
+	}
+}
+
+func TestMountAutoDriveLetter(t *testing.T) {
+	fspFS, err := winfsp.Mount(gofs.New(newTestFS()), "*")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	mountPoint := fspFS.MountPoint()
+	if len(mountPoint) != 2 || mountPoint[1] != ':' {
+		t.Fatalf("MountPoint() = %q; want a drive letter", mountPoint)
+	}
+	wantDir(t, mountPoint+`\`)
+}
+
+func TestMounts(t *testing.T) {
+	var mounted []*winfsp.FileSystem
+	for i := 0; i < 2; i++ {
+		fspFS, err := winfsp.Mount(gofs.New(newTestFS()), "*")
+		if err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+		defer fspFS.Unmount()
+		mounted = append(mounted, fspFS)
+	}
+	mounts := winfsp.Mounts()
+	for _, fspFS := range mounted {
+		if !slices.Contains(mounts, fspFS) {
+			t.Errorf("Mounts() = %v; missing %q", mounts, fspFS.MountPoint())
+		}
+	}
+
+	mounted[0].Unmount()
+	mounts = winfsp.Mounts()
+	if slices.Contains(mounts, mounted[0]) {
+		t.Errorf("Mounts() contains unmounted %q", mounted[0].MountPoint())
+	}
+	if !slices.Contains(mounts, mounted[1]) {
+		t.Errorf("Mounts() = %v; missing %q", mounts, mounted[1].MountPoint())
+	}
+
+	winfsp.UnmountAll()
+	if mounts := winfsp.Mounts(); len(mounts) != 0 {
+		t.Errorf("Mounts() = %v after UnmountAll", mounts)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	major, minor, err := winfsp.Version()
+	if err != nil {
+		t.Fatalf("Version: %v", err)
+	}
+	if major == 0 && minor == 0 {
+		t.Errorf("Version() = %d.%d", major, minor)
+	}
+	fspFS, err := winfsp.Mount(gofs.New(newTestFS()), "*",
+		winfsp.WSLFeatures(true))
+	if err != nil {
+		t.Fatalf("Mount with WSLFeatures: %v", err)
+	}
+	defer fspFS.Unmount()
+	wantDir(t, fspFS.MountPoint()+`\`)
+}
+
+func TestStatistics(t *testing.T) {
+	fspFS, err := winfsp.Mount(gofs.New(newTestFS()), "*")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+	wantDir(t, fspFS.MountPoint()+`\`)
+	stats := fspFS.Statistics()
+	if !stats.Running || stats.DispatcherThreads == 0 {
+		t.Errorf("Statistics() = %+v; want running dispatcher", stats)
+	}
+	if stats.Operations == 0 {
+		t.Errorf("Statistics() = %+v; want dispatched operations", stats)
+	}
+
+	fspFS.Unmount()
+	stats = fspFS.Statistics()
+	if stats.Running || stats.DispatcherThreads != 0 {
+		t.Errorf("Statistics() = %+v after Unmount; want stopped", stats)
+	}
+	if stats.PendingOperations != 0 {
+		t.Errorf("Statistics() = %+v after Unmount; want no pending", stats)
+	}
+}
+
+func TestRingLog(t *testing.T) {
+	ring := winfsp.NewRingLog(3)
+	if got := ring.Dump(); len(got) != 0 {
+		t.Errorf("Dump() of empty log = %v", got)
+	}
+	ring.Log(log.TopicInfo, "first")
+	ring.Call("Open")
+	if got := ring.Dump(); len(got) != 2 || got[0].Message != "first" {
+		t.Errorf("Dump() = %v; want first and Open", got)
+	}
+	ring.Return("Open", nil)
+	ring.Call("Read")
+	ring.Return("Read", io.EOF)
+	got := ring.Dump()
+	want := []struct {
+		kind log.Kind
+		op   string
+	}{
+		{log.KindReturn, "Open"},
+		{log.KindCall, "Read"},
+		{log.KindReturn, "Read"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Dump() retained %d entries; want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Kind != w.kind || got[i].Op != w.op {
+			t.Errorf("Dump()[%d] = %v %q; want %v %q",
+				i, got[i].Kind, got[i].Op, w.kind, w.op)
+		}
+	}
+	if got[2].Status != io.EOF {
+		t.Errorf("Dump()[2].Status = %v; want %v", got[2].Status, io.EOF)
+	}
+}
+
+func TestPipeDebugLogToLogger(t *testing.T) {
+	ring := winfsp.NewRingLog(1024)
+	if err := winfsp.PipeDebugLogToLogger(ring); err != nil {
+		t.Fatalf("PipeDebugLogToLogger: %v", err)
+	}
+	defer winfsp.DebugLogSetHandle(syscall.Stderr)
+
+	fspFS, err := winfsp.Mount(gofs.New(memfs.New()), "*", winfsp.Debug(true))
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+	if _, err := os.Stat(fspFS.MountPoint() + `\`); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, entry := range ring.Dump() {
+			if entry.Kind == log.KindLog && entry.Topic == log.TopicTrace &&
+				entry.Message != "" {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no WinFSP debug output was forwarded to the logger")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPosixMapPermissionsToSecurityDescriptor(t *testing.T) {
+	// The LocalSystem user and the Administrators group.
+	const uid, gid, mode = 18, 544, 0o644
+	sd, err := winfsp.PosixMapPermissionsToSecurityDescriptor(uid, gid, mode)
+	if err != nil {
+		t.Fatalf("PosixMapPermissionsToSecurityDescriptor: %v", err)
+	}
+	if !sd.IsValid() {
+		t.Fatalf("invalid security descriptor %v", sd)
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		t.Fatalf("Owner: %v", err)
+	}
+	if !owner.IsWellKnown(windows.WinLocalSystemSid) {
+		t.Errorf("Owner = %v; want LocalSystem", owner)
+	}
+	gotUid, gotGid, gotMode, err := winfsp.PosixMapSecurityDescriptorToPermissions(sd)
+	if err != nil {
+		t.Fatalf("PosixMapSecurityDescriptorToPermissions: %v", err)
+	}
+	if gotUid != uid || gotGid != gid || gotMode&0o777 != mode {
+		t.Errorf("round trip = %d, %d, %o; want %d, %d, %o",
+			gotUid, gotGid, gotMode, uid, gid, mode)
+	}
+}
+
+func TestLoggerName(t *testing.T) {
+	testFS := newTestFS()
+	testFS.addTestFile(`\hello.txt`, []byte(helloWorld))
+	ring := winfsp.NewRingLog(1024)
+	fspFS, err := winfsp.Mount(gofs.New(testFS), "T:",
+		winfsp.WithName("logged"), winfsp.WithLogger(ring))
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	wantFileContents(t, `T:\hello.txt`, helloWorld)
+	calls := 0
+	for _, entry := range ring.Dump() {
+		if entry.Kind != log.KindCall {
+			continue
+		}
+		calls++
+		named := false
+		for _, field := range entry.Fields {
+			if field.Key == "name" && field.Value == "logged" {
+				named = true
+			}
+		}
+		if !named {
+			t.Errorf("%s entry fields %v lack the name", entry.Op, entry.Fields)
+		}
+	}
+	if calls == 0 {
+		t.Errorf("no operation is logged")
+	}
+}
+
+func TestMountNameTooLong(t *testing.T) {
+	longName := strings.Repeat("n", 16)
+	fspFS, err := winfsp.Mount(
+		gofs.New(newTestFS()), "T:",
+		winfsp.FileSystemName(longName),
+	)
+	if err == nil {
+		fspFS.Unmount()
+		t.Fatalf("Mount with file system name %q succeeded; want error", longName)
+	}
+	if !strings.Contains(err.Error(), "at most 15") {
+		t.Errorf("Mount error = %q; want max length mentioned", err)
+	}
+}
+
+// partialCreateExFS implements only half of
+// winfsp.BehaviourCreateEx.
+type partialCreateExFS struct {
+	winfsp.BehaviourBase
+}
+
+func (partialCreateExFS) CreateExWithExtendedAttribute(
+	fs *winfsp.FileSystemRef, name string,
+	createOptions, grantedAccess, fileAttributes uint32,
+	securityDescriptor *windows.SECURITY_DESCRIPTOR,
+	extendedAttribute *winfsp.FILE_FULL_EA_INFORMATION,
+	allocationSize uint64, info *winfsp.FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	return 0, windows.STATUS_NOT_IMPLEMENTED
+}
+
+func TestMountPartialBehaviour(t *testing.T) {
+	fs := partialCreateExFS{BehaviourBase: gofs.New(newTestFS())}
+	fspFS, err := winfsp.Mount(fs, "T:")
+	if err == nil {
+		fspFS.Unmount()
+		t.Fatalf("Mount succeeded with partial BehaviourCreateEx")
+	}
+	for _, want := range []string{
+		"BehaviourCreateEx", "CreateExWithReparsePointData",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Mount error %q does not mention %q", err, want)
+		}
+	}
+}
+
+// offsetDirFS reads directories by offsets.
+type offsetDirFS struct {
+	winfsp.BehaviourBase
+}
+
+func (offsetDirFS) ReadDirectoryOffset(
+	fs *winfsp.FileSystemRef, file uintptr,
+	pattern *uint16, marker uint64, buf []byte,
+) (int, error) {
+	return 0, nil
+}
+
+// offsetRawDirFS reads directories by both offsets and
+// raw markers.
+type offsetRawDirFS struct {
+	offsetDirFS
+}
+
+func (offsetRawDirFS) ReadDirectoryRaw(
+	fs *winfsp.FileSystemRef, file uintptr,
+	pattern, marker *uint16, buf []byte,
+) (int, error) {
+	return 0, nil
+}
+
+// offsetDirInfoFS reads directories by offsets and
+// looks up single names.
+type offsetDirInfoFS struct {
+	offsetDirFS
+}
+
+func (offsetDirInfoFS) GetDirInfoByName(
+	fs *winfsp.FileSystemRef, parentDirFile uintptr,
+	name string, dirInfo *winfsp.FSP_FSCTL_DIR_INFO,
+) error {
+	return windows.STATUS_OBJECT_NAME_NOT_FOUND
+}
+
+func TestValidate(t *testing.T) {
+	base := gofs.New(newTestFS())
+	passFileName := winfsp.Attributes(
+		winfsp.FspFSAttributePassQueryDirectoryFileName)
+	for _, tc := range []struct {
+		name string
+		fs   winfsp.BehaviourBase
+		opts []winfsp.Option
+		want string // empty if valid
+	}{
+		{"gofs", base, nil, ""},
+		{"nil", nil, nil, "nil fs"},
+		{"partial CreateEx", partialCreateExFS{base}, nil,
+			"CreateExWithReparsePointData"},
+		{"offset", offsetDirFS{base}, nil, ""},
+		{"offset and raw", offsetRawDirFS{offsetDirFS{base}}, nil, ""},
+		{"file name without lookup", offsetDirFS{base},
+			[]winfsp.Option{passFileName}, "BehaviourGetDirInfoByName"},
+		{"file name with offset", offsetDirInfoFS{offsetDirFS{base}},
+			[]winfsp.Option{passFileName}, "BehaviourReadDirectoryOffset"},
+		{"sector 4096", base, []winfsp.Option{winfsp.SectorSize(4096, 16)}, ""},
+		{"sector 513", base, []winfsp.Option{winfsp.SectorSize(513, 1)},
+			"sector size 513"},
+		{"transact timeout", base,
+			[]winfsp.Option{winfsp.TransactTimeout(time.Hour)}, ""},
+		{"negative transact timeout", base,
+			[]winfsp.Option{winfsp.TransactTimeout(-time.Second)},
+			"transact timeout"},
+		{"huge transact timeout", base,
+			[]winfsp.Option{winfsp.TransactTimeout(time.Duration(math.MaxInt64))},
+			"transact timeout"},
+		{"irp timeout", base,
+			[]winfsp.Option{winfsp.IrpTimeout(5 * time.Minute)}, ""},
+		{"short irp timeout", base,
+			[]winfsp.Option{winfsp.IrpTimeout(time.Second)}, "irp timeout"},
+		{"long irp timeout", base,
+			[]winfsp.Option{winfsp.IrpTimeout(time.Hour)}, "irp timeout"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := winfsp.Validate(tc.fs, tc.opts...)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tc.want != "" && err == nil:
+				t.Errorf("Validate succeeded; want error mentioning %q", tc.want)
+			case tc.want != "" && !strings.Contains(err.Error(), tc.want):
+				t.Errorf("Validate error %q does not mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// messageLog records the free form messages logged.
+type messageLog struct {
+	mtx      sync.Mutex
+	messages []string
+}
+
+func (l *messageLog) Call(op string, fields ...log.Field) {}
+
+func (l *messageLog) Return(op string, status error, fields ...log.Field) {}
+
+func (l *messageLog) Log(topic log.Topic, msg string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.messages = append(l.messages, msg)
+}
+
+func TestWarnExclusiveBehaviours(t *testing.T) {
+	logger := &messageLog{}
+	d, err := winfsp.NewDetached(offsetRawDirFS{offsetDirFS{gofs.New(newTestFS())}},
+		winfsp.WithLogger(logger))
+	if err != nil {
+		t.Fatalf("NewDetached: %v", err)
+	}
+	d.Close()
+	const want = "both BehaviourReadDirectoryOffset and BehaviourReadDirectoryRaw"
+	if !slices.ContainsFunc(logger.messages, func(msg string) bool {
+		return strings.Contains(msg, want)
+	}) {
+		t.Errorf("messages = %q; want one mentioning %q", logger.messages, want)
+	}
+}
+
+func TestOperationContext(t *testing.T) {
+	const timeout = 2 * time.Minute
+	fspFS, err := winfsp.Mount(
+		gofs.New(newTestFS()), "T:",
+		winfsp.IrpTimeout(timeout),
+	)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	start := time.Now()
+	ctx, cancel := fspFS.OperationContext()
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatalf("OperationContext() has no deadline")
+	}
+	if d := deadline.Sub(start); d < timeout-time.Second || d > timeout {
+		t.Errorf("OperationContext() deadline in %v; want about %v", d, timeout)
+	}
+}
+
+func TestReparseDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "target"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(
+		"cmd", "/c", "mklink", "/J",
+		filepath.Join(dir, "junction"), filepath.Join(dir, "target"),
+	).CombinedOutput()
+	if err != nil {
+		t.Skipf("mklink /J: %v: %s", err, out)
+	}
+
+	fspFS, err := winfsp.Mount(gofs.New(&dirFS{dir: dir}), "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	ents, err := os.ReadDir(`T:\`)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	attrs := make(map[string]uint32)
+	for _, de := range ents {
+		fi, err := de.Info()
+		if err != nil {
+			t.Fatalf("DirEntry.Info() for %q: %v", de.Name(), err)
+		}
+		attrs[de.Name()] = fi.Sys().(*syscall.Win32FileAttributeData).FileAttributes
+	}
+	const reparseDir = windows.FILE_ATTRIBUTE_DIRECTORY |
+		windows.FILE_ATTRIBUTE_REPARSE_POINT
+	if got := attrs["junction"] & reparseDir; got != reparseDir {
+		t.Errorf("junction attributes = %#x; want %#x set", attrs["junction"], reparseDir)
+	}
+	if got := attrs["target"] & reparseDir; got != windows.FILE_ATTRIBUTE_DIRECTORY {
+		t.Errorf("target attributes = %#x; want only directory set", attrs["target"])
+	}
+}
+
+func BenchmarkReadDirectory(b *testing.B) {
+	const numEntries = 100000
+	testFS := newTestFS()
+	for i := range numEntries {
+		testFS.addTestFile(fmt.Sprintf(`\file-%06d`, i), []byte{})
+	}
+
+	fspFS, err := winfsp.Mount(gofs.New(testFS), "T:")
+	if err != nil {
+		b.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		ents, err := os.ReadDir(`T:\`)
+		if err != nil {
+			b.Fatalf("ReadDir: %v", err)
+		}
+		if len(ents) != numEntries {
+			b.Fatalf("ReadDir: got %d entries; want %d", len(ents), numEntries)
+		}
+	}
+}
+
+// BenchmarkReadDirectoryPaginated lists a directory taking
+// many reads resumed from markers, which must be served
+// from the cached enumeration.
+func BenchmarkReadDirectoryPaginated(b *testing.B) {
+	const numEntries = 10000
+	testFS := newTestFS()
+	for i := range numEntries {
+		testFS.addTestFile(fmt.Sprintf(`\file-%06d`, i), []byte{})
+	}
+
+	fspFS, err := winfsp.Mount(gofs.New(testFS), "T:")
+	if err != nil {
+		b.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		before := testFS.readdirs.Load()
+		f, err := os.Open(`T:\`)
+		if err != nil {
+			b.Fatalf("Open: %v", err)
+		}
+		total := 0
+		for {
+			ents, err := f.ReadDir(100)
+			total += len(ents)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("ReadDir: %v", err)
+			}
+		}
+		_ = f.Close()
+		if total != numEntries {
+			b.Fatalf("ReadDir: got %d entries; want %d", total, numEntries)
+		}
+		if n := testFS.readdirs.Load() - before; n != 1 {
+			b.Fatalf("directory read %d times; want once", n)
+		}
+	}
+}
+
+// BenchmarkReadDirectoryBatched compares enumerating a
+// large directory with every entry filled into WinFSP's
+// directory buffer through a DLL call, against with the
+// entries buffered in Go by BatchDirectoryFills, which
+// saves 50k DLL calls per enumeration.
+func BenchmarkReadDirectoryBatched(b *testing.B) {
+	const numEntries = 50000
+	testFS := newTestFS()
+	for i := range numEntries {
+		testFS.addTestFile(fmt.Sprintf(`\file-%06d`, i), []byte{})
+	}
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batched=%v", batched), func(b *testing.B) {
+			base, err := gofs.NewOptions(testFS, gofs.WithDefaultWinfspOptions(
+				winfsp.BatchDirectoryFills(batched)))
+			if err != nil {
+				b.Fatalf("NewOptions: %v", err)
+			}
+			fspFS, err := winfsp.Mount(base, "*")
+			if err != nil {
+				b.Fatalf("Mount: %v", err)
+			}
+			defer fspFS.Unmount()
+			root := fspFS.MountPoint() + `\`
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				ents, err := os.ReadDir(root)
+				if err != nil {
+					b.Fatalf("ReadDir: %v", err)
+				}
+				if len(ents) != numEntries {
+					b.Fatalf("ReadDir: got %d entries; want %d",
+						len(ents), numEntries)
+				}
+			}
+		})
+	}
+}
+
+func TestParentStatCacheRename(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"writable", "readonly"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(dir, "writable", "file")
+	if err := os.WriteFile(file, []byte(helloWorld), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	// Setting FILE_ATTRIBUTE_READONLY on a directory does not
+	// prevent creating entries in it, but it makes os.Lstat
+	// report the directory as non-writable.
+	if err := os.Chmod(filepath.Join(dir, "readonly"), 0o555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chmod(filepath.Join(dir, "readonly"), 0o777)
+		_ = os.Chmod(filepath.Join(dir, "readonly", "file"), 0o666)
+		_ = os.Chmod(file, 0o666)
+	})
+
+	fs, err := gofs.NewOptions(&dirFS{dir: dir},
+		gofs.WithAttribReadOnlyTransMode(gofs.AttribReadOnlyPOSIX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fspFS, err := winfsp.Mount(fs, "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	path, err := windows.UTF16PtrFromString(`T:\writable\file`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := windows.CreateFile(path,
+		windows.GENERIC_READ|windows.DELETE,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	defer windows.CloseHandle(h)
+
+	readOnly := func() bool {
+		t.Helper()
+		var info windows.ByHandleFileInformation
+		if err := windows.GetFileInformationByHandle(h, &info); err != nil {
+			t.Fatalf("GetFileInformationByHandle: %v", err)
+		}
+		return info.FileAttributes&windows.FILE_ATTRIBUTE_READONLY != 0
+	}
+	if readOnly() {
+		t.Fatalf("file under writable directory reported read-only")
+	}
+	if err := renameByHandle(h, `T:\readonly\file`); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	// Queried well within the cache lifetime, the parent
+	// stat must still be refreshed after the rename.
+	if !readOnly() {
+		t.Errorf("file under read-only directory not reported read-only after rename")
+	}
+}
+
+// renameByHandle renames the file opened by h to
+// target, failing if the target already exists.
+func renameByHandle(h windows.Handle, target string) error {
+	type fileRenameInfo struct {
+		ReplaceIfExists uint32
+		RootDirectory   windows.Handle
+		FileNameLength  uint32
+		FileName        [1]uint16
+	}
+	name, err := windows.UTF16FromString(target)
+	if err != nil {
+		return err
+	}
+	size := int(unsafe.Offsetof(fileRenameInfo{}.FileName)) + len(name)*2
+	buf := make([]uint64, (size+7)/8)
+	info := (*fileRenameInfo)(unsafe.Pointer(&buf[0]))
+	info.FileNameLength = uint32((len(name) - 1) * 2)
+	copy(unsafe.Slice(&info.FileName[0], len(name)), name)
+	return windows.SetFileInformationByHandle(h, windows.FileRenameInfo,
+		(*byte)(unsafe.Pointer(info)), uint32(size))
+}
+
+func BenchmarkWritePOSIX(b *testing.B) {
+	fs, err := gofs.NewOptions(&dirFS{dir: b.TempDir()},
+		gofs.WithAttribReadOnlyTransMode(gofs.AttribReadOnlyPOSIX))
+	if err != nil {
+		b.Fatal(err)
+	}
+	fspFS, err := winfsp.Mount(fs, "T:")
+	if err != nil {
+		b.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	f, err := os.Create(`T:\bench`)
+	if err != nil {
+		b.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 4096)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for range b.N {
+		if _, err := f.WriteAt(buf, 0); err != nil {
+			b.Fatalf("WriteAt: %v", err)
+		}
+	}
+}
+
+func TestPosixSemanticsCaseSensitive(t *testing.T) {
+	// FILE_FLAG_POSIX_SEMANTICS is ignored by the object
+	// manager unless obcaseinsensitive has been cleared.
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE,
+		`SYSTEM\CurrentControlSet\Control\Session Manager\kernel`,
+		registry.QUERY_VALUE)
+	if err != nil {
+		t.Skipf("open kernel key: %v", err)
+	}
+	obCaseInsensitive, _, err := key.GetIntegerValue("obcaseinsensitive")
+	key.Close()
+	if err != nil || obCaseInsensitive != 0 {
+		t.Skip("case sensitive lookup is disabled by obcaseinsensitive")
+	}
+
+	fs, err := gofs.NewOptions(memfs.New(),
+		gofs.WithCaseInsensitive(true),
+		gofs.WithPosixSemantics(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fspFS, err := winfsp.Mount(fs, "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	createPosix := func(name, contents string) {
+		t.Helper()
+		path, err := windows.UTF16PtrFromString(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := windows.CreateFile(path,
+			windows.GENERIC_READ|windows.GENERIC_WRITE,
+			windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+			nil, windows.CREATE_NEW, windows.FILE_FLAG_POSIX_SEMANTICS, 0)
+		if err != nil {
+			t.Fatalf("CreateFile(%q): %v", name, err)
+		}
+		defer windows.CloseHandle(h)
+		if _, err := windows.Write(h, []byte(contents)); err != nil {
+			t.Fatalf("Write(%q): %v", name, err)
+		}
+	}
+	createPosix(`T:\posix`, "lower")
+	createPosix(`T:\POSIX`, "upper")
+	wantDirContents(t, `T:\`, WantDir{
+		"posix": regular(5),
+		"POSIX": regular(5),
+	})
+}
+
+// tokenFS records the user of the operation token
+// retrieved while opening files.
+type tokenFS struct {
+	winfsp.BehaviourBase
+	mtx  sync.Mutex
+	sids []string
+	errs []error
+}
+
+func (fs *tokenFS) Open(
+	ref *winfsp.FileSystemRef, name string,
+	createOptions, grantedAccess uint32,
+	info *winfsp.FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	sid, err := func() (string, error) {
+		token, err := ref.OperationToken()
+		if err != nil {
+			return "", err
+		}
+		user, err := token.GetTokenUser()
+		if err != nil {
+			return "", err
+		}
+		return user.User.Sid.String(), nil
+	}()
+	fs.mtx.Lock()
+	fs.sids = append(fs.sids, sid)
+	fs.errs = append(fs.errs, err)
+	fs.mtx.Unlock()
+	return fs.BehaviourBase.Open(
+		ref, name, createOptions, grantedAccess, info)
+}
+
+func TestOperationToken(t *testing.T) {
+	testFS := newTestFS()
+	testFS.addTestFile(`\hello.txt`, []byte(helloWorld))
+	fs := &tokenFS{BehaviourBase: gofs.New(testFS)}
+	fspFS, err := winfsp.Mount(fs, "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	if _, err := fspFS.OperationToken(); err == nil {
+		t.Errorf("OperationToken() outside of operation succeeded")
+	}
+
+	path, err := windows.UTF16PtrFromString(`T:\hello.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := windows.CreateFile(path, windows.GENERIC_READ,
+		windows.FILE_SHARE_READ, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	windows.CloseHandle(h)
+
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		t.Fatalf("GetTokenUser: %v", err)
+	}
+	want := user.User.Sid.String()
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if len(fs.sids) == 0 {
+		t.Fatalf("Open was not called")
+	}
+	for i, sid := range fs.sids {
+		if fs.errs[i] != nil {
+			t.Errorf("OperationToken() during Open: %v", fs.errs[i])
+		} else if sid != want {
+			t.Errorf("OperationToken() user = %s; want %s", sid, want)
+		}
+	}
+}
+
+// watchFS reports the changes sent to events for
+// every watched directory.
+type watchFS struct {
+	*testFS
+	events chan gofs.ChangeEvent
+}
+
+func (fs *watchFS) Watch(name string) (<-chan gofs.ChangeEvent, func(), error) {
+	return fs.events, func() {}, nil
+}
+
+func TestWatchNotify(t *testing.T) {
+	testFS := &watchFS{
+		testFS: newTestFS(),
+		events: make(chan gofs.ChangeEvent),
+	}
+	fspFS, err := winfsp.Mount(gofs.New(testFS), "*")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	path, err := windows.UTF16PtrFromString(fspFS.MountPoint() + `\`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := windows.CreateFile(path, windows.FILE_LIST_DIRECTORY,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	defer windows.CloseHandle(h)
+
+	type change struct {
+		name   string
+		action uint32
+		err    error
+	}
+	changes := make(chan change, 1)
+	go func() {
+		buf := make([]uint32, 1024)
+		var n uint32
+		err := windows.ReadDirectoryChanges(h,
+			(*byte)(unsafe.Pointer(&buf[0])), uint32(len(buf)*4), false,
+			windows.FILE_NOTIFY_CHANGE_FILE_NAME, &n, nil, 0)
+		if err != nil || n == 0 {
+			changes <- change{err: fmt.Errorf("ReadDirectoryChanges: %d, %v", n, err)}
+			return
+		}
+		info := (*windows.FileNotifyInformation)(unsafe.Pointer(&buf[0]))
+		changes <- change{
+			name: windows.UTF16ToString(unsafe.Slice(
+				&info.FileName, info.FileNameLength/2)),
+			action: info.Action,
+		}
+	}()
+
+	// The change made to the backend is reported repeatedly,
+	// since it might be reported before the directory is
+	// watched by ReadDirectoryChanges.
+	testFS.addTestFile(`\created.txt`, []byte(helloWorld))
+	event := gofs.ChangeEvent{
+		Name:   `\created.txt`,
+		Action: windows.FILE_ACTION_ADDED,
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case c := <-changes:
+			if c.err != nil {
+				t.Fatal(c.err)
+			}
+			if c.name != "created.txt" || c.action != windows.FILE_ACTION_ADDED {
+				t.Errorf("change = %q, %d; want %q, %d", c.name, c.action,
+					"created.txt", windows.FILE_ACTION_ADDED)
+			}
+			return
+		case <-ticker.C:
+			select {
+			case testFS.events <- event:
+			default:
+			}
+		case <-timeout:
+			t.Fatalf("no change notified")
+		}
+	}
+}
+
+// vecFS wraps the files of memfs with vectored I/O
+// which is counted upon calls.
+type vecFS struct {
+	*memfs.MemFS
+	reads  atomic.Int64
+	writes atomic.Int64
+}
+
+func (fs *vecFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &vecFile{File: f, fs: fs}, nil
+}
+
+type vecFile struct {
+	gofs.File
+	fs *vecFS
+}
+
+func (f *vecFile) ReadVAt(bufs [][]byte, off int64) (int, error) {
+	f.fs.reads.Add(1)
+	var total int
+	for _, buf := range bufs {
+		n, err := f.ReadAt(buf, off)
+		total += n
+		off += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (f *vecFile) WriteVAt(bufs [][]byte, off int64) (int, error) {
+	f.fs.writes.Add(1)
+	var total int
+	for _, buf := range bufs {
+		n, err := f.WriteAt(buf, off)
+		total += n
+		off += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func TestVectoredIO(t *testing.T) {
+	fs := &vecFS{MemFS: memfs.New()}
+	fspFS, err := winfsp.Mount(gofs.New(fs), "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	want := make([]byte, 3*4096+100)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	f, err := os.OpenFile(`T:\vec`, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(want, 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("vectored read mismatches the written data")
+	}
+
+	// Compare against the scalar path of the backend.
+	inner, err := fs.MemFS.OpenFile(`\vec`, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("memfs OpenFile: %v", err)
+	}
+	defer inner.Close()
+	scalar := make([]byte, len(want))
+	if _, err := inner.ReadAt(scalar, 0); err != nil {
+		t.Fatalf("memfs ReadAt: %v", err)
+	}
+	if !bytes.Equal(scalar, want) {
+		t.Errorf("scalar read mismatches the written data")
+	}
+	if fs.reads.Load() == 0 {
+		t.Errorf("ReadVAt was never called")
+	}
+	if fs.writes.Load() == 0 {
+		t.Errorf("WriteVAt was never called")
+	}
+}
+
+func TestAllocationUnit(t *testing.T) {
+	const allocationUnit = 64 * 1024
+	fspFS, err := winfsp.Mount(gofs.New(memfs.New()), "T:",
+		winfsp.SectorSize(4096, allocationUnit/4096))
 	if err != nil {
-		t.Fatalf("NewOptions: %v", err)
+		t.Fatalf("Mount: %v", err)
 	}
-	fspFS, err := winfsp.Mount(bb, "T:")
+	defer fspFS.Unmount()
+
+	if got := fspFS.AllocationUnit(); got != allocationUnit {
+		t.Errorf("AllocationUnit() = %d; want %d", got, allocationUnit)
+	}
+	if err := os.WriteFile(`T:\alloc`, []byte(helloWorld), 0o666); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	f, err := os.Open(`T:\alloc`)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	var info struct {
+		AllocationSize int64
+		EndOfFile      int64
+		NumberOfLinks  uint32
+		DeletePending  bool
+		Directory      bool
+	}
+	if err := windows.GetFileInformationByHandleEx(
+		windows.Handle(f.Fd()), windows.FileStandardInfo,
+		(*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)),
+	); err != nil {
+		t.Fatalf("GetFileInformationByHandleEx: %v", err)
+	}
+	if info.EndOfFile != int64(len(helloWorld)) {
+		t.Errorf("EndOfFile = %d; want %d", info.EndOfFile, len(helloWorld))
+	}
+	if info.AllocationSize != allocationUnit {
+		t.Errorf("AllocationSize = %d; want %d", info.AllocationSize, allocationUnit)
+	}
+}
+
+func TestLongPath(t *testing.T) {
+	fspFS, err := winfsp.Mount(gofs.New(memfs.New()), "*")
 	if err != nil {
 		t.Fatalf("Mount: %v", err)
 	}
 	defer fspFS.Unmount()
 
-	wantDir(t, `T:\`)
-	wantDirContents(t, `T:\`, WantDir{
-		"reg-size-123": regular(123),
-		"reg-size-456": regular(456),
-		"hello.txt":    regular(int64(len(helloWorld))),
+	// Nest the directories until the path exceeds MAX_PATH,
+	// which the os package prefixes with `\\?\` by itself.
+	top := filepath.Join(fspFS.MountPoint(), `\`, "00-"+strings.Repeat("d", 60))
+	dir := top
+	for i := 1; len(dir) <= 2*syscall.MAX_PATH; i++ {
+		dir = filepath.Join(dir, fmt.Sprintf("%02d-%s", i, strings.Repeat("d", 60)))
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		t.Fatalf("MkdirAll(%d chars): %v", len(dir), err)
+	}
+	name := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(name, []byte(helloWorld), 0o666); err != nil {
+		t.Fatalf("WriteFile(%d chars): %v", len(name), err)
+	}
+	wantFileContents(t, name, helloWorld)
+	wantDirContents(t, dir, WantDir{
+		"file.txt": regular(int64(len(helloWorld))),
 	})
 
-	wantRegSize(t, `T:\reg-size-123`, 123)
-	wantRegSize(t, `T:\reg-size-456`, 456)
-	wantNotExist(t, `T:\not-exist-file`)
-	wantFileContents(t, `T:\hello.txt`, helloWorld)
-
-	// Test that that os.File.Close calls make it to the kernel and back to us,
-	// and that our testFS accounts for the open FD count correctly.
-	t.Run("Close", func(t *testing.T) {
-		// Wait for previous operations' close events to be processed
-		// (apparently os.File.Close is returning before userspace WinFSP calls
-		// handle the Close?)
-		for range 20 {
-			if testFS.openFiles.Load() == 0 {
-				break
-			}
-			time.Sleep(100 * time.Millisecond)
-		}
-
-		testFS.wantOpenFiles(t, 0)
-		f, err := os.Open(`T:\reg-size-123`)
-		if err != nil {
-			t.Fatalf("Open reg-size-123: %v", err)
-		}
-		testFS.wantOpenFiles(t, 1)
+	renamed := filepath.Join(dir, "renamed.txt")
+	if err := os.Rename(name, renamed); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	wantNotExist(t, name)
+	wantFileContents(t, renamed, helloWorld)
+	if err := os.RemoveAll(top); err != nil {
+		t.Errorf("RemoveAll: %v", err)
+	}
+	wantNotExist(t, top)
+}
 
-		ch := make(chan any, 1)
-		testFS.setSubscriber(ch)
-		defer testFS.setSubscriber(nil)
+func TestCleanMountPointInUse(t *testing.T) {
+	mountpoint := filepath.Join(t.TempDir(), "mnt")
+	fspFS, err := winfsp.Mount(gofs.New(memfs.New()), mountpoint,
+		winfsp.CleanMountPoint(true))
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+	err = winfsp.CleanStaleMountPoint(mountpoint)
+	if !errors.Is(err, winfsp.ErrMountPointInUse) {
+		t.Errorf("CleanStaleMountPoint = %v; want ErrMountPointInUse", err)
+	}
+	if _, err := os.Stat(mountpoint); err != nil {
+		t.Errorf("Stat mount point: %v", err)
+	}
+}
 
-		f.Close()
-		select {
-		case ev := <-ch:
-			_, ok := ev.(regularFileClosedEvent)
-			if !ok {
-				t.Errorf("got event of type %T; want regularFileClosedEvent", ev)
+func TestPathNotFound(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fs   gofs.FileSystem
+	}{
+		// memfs reports the missing directory by itself,
+		// while gofs has to detect it for the testFS.
+		{"memfs", memfs.New()},
+		{"testFS", newTestFS()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fspFS, err := winfsp.Mount(gofs.New(tc.fs), "*")
+			if err != nil {
+				t.Fatalf("Mount: %v", err)
 			}
-		case <-time.After(5 * time.Second):
-			t.Errorf("timed out waiting for regularFileClosedEvent")
-		}
-		testFS.wantOpenFiles(t, 0)
-
-		f.Close()
-		testFS.wantOpenFiles(t, 0)
-	})
-
-	t.Run("CreateFile", func(t *testing.T) {
-		wantNotExist(t, `T:\newfile.txt`)
-		if err := os.WriteFile(`T:\newfile.txt`, []byte(helloWorld), 0o644); err != nil {
-			t.Fatalf("WriteFile newfile.txt: %v", err)
-		}
-		wantFileContents(t, `T:\newfile.txt`, helloWorld)
-	})
+			defer fspFS.Unmount()
+			root := fspFS.MountPoint()
 
-	t.Run("RemoveFile", func(t *testing.T) {
-		const path = `T:\to-delete.txt`
-		wantNotExist(t, path)
-		if err := os.WriteFile(path, []byte(helloWorld), 0o666); err != nil {
-			t.Fatal(err)
-		}
-		wantFileContents(t, path, helloWorld)
-		if err := os.Remove(path); err != nil {
-			t.Fatal(err)
-		}
-		wantNotExist(t, path)
-	})
+			_, err = os.Open(root + `\missingdir\file`)
+			if !errors.Is(err, windows.ERROR_PATH_NOT_FOUND) {
+				t.Errorf("Open missing directory = %v; want path not found", err)
+			}
+			if !os.IsNotExist(err) {
+				t.Errorf("Open missing directory = %v; want not exist", err)
+			}
+			_, err = os.Open(root + `\file`)
+			if !errors.Is(err, windows.ERROR_FILE_NOT_FOUND) {
+				t.Errorf("Open missing file = %v; want file not found", err)
+			}
+		})
+	}
 }
 
 type dirEntMatcher func(t testing.TB, name string, de os.DirEntry)
@@ -205,6 +1370,32 @@ func regular(size int64) dirEntMatcher {
 	}
 }
 
+// dirFS is a passthrough file system backed by a native
+// directory, in the same way as examples/passthrough.
+type dirFS struct {
+	dir string
+}
+
+func (fs *dirFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File, error) {
+	return os.OpenFile(filepath.Join(fs.dir, name), flag, perm)
+}
+
+func (fs *dirFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(filepath.Join(fs.dir, name), perm)
+}
+
+func (fs *dirFS) Remove(name string) error {
+	return os.Remove(filepath.Join(fs.dir, name))
+}
+
+func (fs *dirFS) Rename(source, target string) error {
+	return os.Rename(filepath.Join(fs.dir, source), filepath.Join(fs.dir, target))
+}
+
+func (fs *dirFS) Stat(name string) (os.FileInfo, error) {
+	return os.Lstat(filepath.Join(fs.dir, name))
+}
+
 func newTestFS() *testFS {
 	return &testFS{
 		files: map[string][]byte{},
@@ -213,6 +1404,7 @@ func newTestFS() *testFS {
 
 type testFS struct {
 	openFiles atomic.Int64
+	readdirs  atomic.Int64
 
 	mu    sync.Mutex
 	files map[string][]byte // nil values are directories, else regular file contents
@@ -263,7 +1455,8 @@ func (fs *testFS) OpenFile(name string, flag int, perm os.FileMode) (gofs.File,
 		return fs.newFWPFileFromContents(filepath.Base(name), fsf), nil
 	}
 	d := &testDir{
-		fi: newDirFileInfo(filepath.Base(name)),
+		fi:       newDirFileInfo(filepath.Base(name)),
+		readdirs: &fs.readdirs,
 	}
 	for sub, subv := range fs.files {
 		if filepath.Dir(sub) == name {
@@ -377,12 +1570,14 @@ type testDir struct {
 
 	gofs.File // embedded to panic to unimplemented methods
 	ents      []os.FileInfo
+	readdirs  *atomic.Int64
 }
 
 func (d *testDir) Readdir(n int) ([]os.FileInfo, error) {
 	if n != -1 {
 		panic("unexpected readdir argument")
 	}
+	d.readdirs.Add(1)
 	return d.ents, nil
 }
 
@@ -501,3 +1696,417 @@ func (f *writingFile) Stat() (os.FileInfo, error) {
 		size:     int64(len(f.buf)),
 	}, nil
 }
+
+// handleFS checks that the file handles passed to the
+// behaviours are the ones returned by Open.
+type handleFS struct {
+	handleBehaviours
+
+	mtx     sync.Mutex
+	handles map[uintptr]bool
+	reads   int
+	closes  int
+	unknown int
+}
+
+type handleBehaviours interface {
+	winfsp.BehaviourBase
+	winfsp.BehaviourGetSecurityByName
+	winfsp.BehaviourGetVolumeInfo
+	winfsp.BehaviourGetFileInfo
+	winfsp.BehaviourCleanup
+	winfsp.BehaviourRead
+}
+
+func (fs *handleFS) check(file uintptr) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if !fs.handles[file] {
+		fs.unknown++
+	}
+}
+
+func (fs *handleFS) Open(
+	ref *winfsp.FileSystemRef, name string,
+	createOptions, grantedAccess uint32,
+	info *winfsp.FSP_FSCTL_FILE_INFO,
+) (uintptr, error) {
+	file, err := fs.handleBehaviours.Open(
+		ref, name, createOptions, grantedAccess, info)
+	if err == nil {
+		fs.mtx.Lock()
+		fs.handles[file] = true
+		fs.mtx.Unlock()
+	}
+	return file, err
+}
+
+func (fs *handleFS) Read(
+	ref *winfsp.FileSystemRef, file uintptr,
+	buf []byte, offset uint64,
+) (int, error) {
+	fs.check(file)
+	fs.mtx.Lock()
+	fs.reads++
+	fs.mtx.Unlock()
+	return fs.handleBehaviours.Read(ref, file, buf, offset)
+}
+
+func (fs *handleFS) Close(ref *winfsp.FileSystemRef, file uintptr) {
+	fs.check(file)
+	fs.mtx.Lock()
+	delete(fs.handles, file)
+	fs.closes++
+	fs.mtx.Unlock()
+	fs.handleBehaviours.Close(ref, file)
+}
+
+func TestFullContextMode(t *testing.T) {
+	for _, fullContext := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fullContext=%v", fullContext), func(t *testing.T) {
+			mfs := memfs.New()
+			f, err := mfs.OpenFile(`\file`, os.O_CREATE|os.O_WRONLY, 0o666)
+			if err != nil {
+				t.Fatalf("OpenFile: %v", err)
+			}
+			if _, err := f.Write([]byte(helloWorld)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			fs := &handleFS{
+				handleBehaviours: gofs.New(mfs).(handleBehaviours),
+				handles:          make(map[uintptr]bool),
+			}
+			fspFS, err := winfsp.Mount(fs, "*",
+				winfsp.FullContextMode(fullContext))
+			if err != nil {
+				t.Fatalf("Mount: %v", err)
+			}
+			root := fspFS.MountPoint()
+
+			data, err := os.ReadFile(root + `\file`)
+			if err != nil {
+				t.Errorf("ReadFile: %v", err)
+			} else if string(data) != helloWorld {
+				t.Errorf("ReadFile = %q; want %q", data, helloWorld)
+			}
+			fspFS.Unmount()
+
+			fs.mtx.Lock()
+			defer fs.mtx.Unlock()
+			if fs.reads == 0 || fs.closes == 0 {
+				t.Errorf("reads = %d, closes = %d; want both dispatched",
+					fs.reads, fs.closes)
+			}
+			if fs.unknown != 0 {
+				t.Errorf("%d calls with handles not returned by Open", fs.unknown)
+			}
+			if len(fs.handles) != 0 {
+				t.Errorf("%d handles not closed", len(fs.handles))
+			}
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	if err := winfsp.LoadWinFSP(); err != nil {
+		t.Skipf("LoadWinFSP: %v", err)
+	}
+	if err := winfsp.Preflight("C:"); err == nil {
+		t.Errorf("Preflight(%q) succeeded on a drive letter in use", "C:")
+	}
+	if err := winfsp.Preflight("*"); err != nil {
+		t.Errorf("Preflight(%q): %v", "*", err)
+	}
+}
+
+func TestMountMany(t *testing.T) {
+	fileSystems, err := winfsp.MountMany(
+		gofs.New(memfs.New()), []string{"T:", "U:"})
+	if err != nil {
+		t.Fatalf("MountMany: %v", err)
+	}
+	defer func() {
+		for _, fs := range fileSystems {
+			fs.Unmount()
+		}
+	}()
+	if len(fileSystems) != 2 ||
+		fileSystems[0].MountPoint() != "T:" ||
+		fileSystems[1].MountPoint() != "U:" {
+		t.Fatalf("MountMany mounted %d file systems", len(fileSystems))
+	}
+
+	// Both letters reach the same memfs.
+	if err := os.WriteFile(`T:\hello.txt`, []byte(helloWorld), 0o666); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	data, err := os.ReadFile(`U:\hello.txt`)
+	if err != nil || string(data) != helloWorld {
+		t.Errorf("ReadFile through U: = %q, %v; want %q", data, err, helloWorld)
+	}
+
+	// A failing mount point unmounts the ones before it.
+	_, err = winfsp.MountMany(gofs.New(memfs.New()), []string{"V:", "T:"})
+	if err == nil {
+		t.Fatalf("MountMany at a letter in use succeeded")
+	}
+	if _, err := os.Stat(`V:\`); err == nil {
+		t.Errorf("V: is left mounted after the failed MountMany")
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	first, err := winfsp.Mount(gofs.New(memfs.New()), "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer first.Unmount()
+	second, err := winfsp.Mount(gofs.New(memfs.New()), "U:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer second.Unmount()
+	for _, tc := range []struct {
+		path string
+		want *winfsp.FileSystem
+	}{
+		{`T:\dir\file`, first},
+		{`t:/dir`, first},
+		{`U:\`, second},
+		{`\\?\u:\file`, second},
+		{`V:\file`, nil},
+	} {
+		got, ok := winfsp.FindMount(tc.path)
+		if got != tc.want || ok != (tc.want != nil) {
+			t.Errorf("FindMount(%q) = %p, %v; want %p", tc.path, got, ok, tc.want)
+		}
+	}
+
+	// Unmounted file systems are no longer found.
+	second.Unmount()
+	if _, ok := winfsp.FindMount(`U:\file`); ok {
+		t.Errorf("FindMount found the unmounted file system")
+	}
+}
+
+func TestMountSeededMemFS(t *testing.T) {
+	fspFS, err := winfsp.Mount(gofs.New(memfs.New(
+		memfs.WithDirs([]string{`\dir\sub`, `\dir`, `\empty`}),
+		memfs.WithFiles(map[string][]byte{
+			`\hello.txt`:        []byte(helloWorld),
+			`\dir\sub\deep.txt`: []byte("deep"),
+		}),
+	)), "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	isDir := func(t testing.TB, name string, de os.DirEntry) {
+		t.Helper()
+		if !de.IsDir() {
+			t.Errorf("%q is not a directory", name)
+		}
+	}
+	wantDirContents(t, `T:\`, WantDir{
+		"dir":       isDir,
+		"empty":     isDir,
+		"hello.txt": regular(int64(len(helloWorld))),
+	})
+	wantDirContents(t, `T:\dir`, WantDir{"sub": isDir})
+	wantDirContents(t, `T:\dir\sub`, WantDir{"deep.txt": regular(4)})
+	wantDirContents(t, `T:\empty`, WantDir{})
+	wantFileContents(t, `T:\dir\sub\deep.txt`, "deep")
+}
+
+func TestShareModes(t *testing.T) {
+	fspFS, err := winfsp.Mount(gofs.New(memfs.New(
+		memfs.WithFiles(map[string][]byte{`\file`: []byte(helloWorld)}),
+	)), "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	name := windows.StringToUTF16Ptr(`T:\file`)
+	open := func(access, share uint32) (windows.Handle, error) {
+		return windows.CreateFile(name, access, share, nil,
+			windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	}
+	const shareAll = windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE |
+		windows.FILE_SHARE_DELETE
+	for _, tc := range []struct {
+		name          string
+		access, share uint32
+		second        uint32
+		conflicts     bool
+	}{
+		{"exclusive", windows.GENERIC_READ, 0, windows.GENERIC_READ, true},
+		{"deny write", windows.GENERIC_READ, windows.FILE_SHARE_READ,
+			windows.GENERIC_WRITE, true},
+		{"deny write allows read", windows.GENERIC_READ, windows.FILE_SHARE_READ,
+			windows.GENERIC_READ, false},
+		{"deny delete", windows.GENERIC_READ,
+			windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE,
+			windows.DELETE, true},
+	} {
+		first, err := open(tc.access, tc.share)
+		if err != nil {
+			t.Fatalf("%s: first open: %v", tc.name, err)
+		}
+		second, err := open(tc.second, shareAll)
+		if err == nil {
+			_ = windows.CloseHandle(second)
+		}
+		if conflicts := err == windows.ERROR_SHARING_VIOLATION; conflicts != tc.conflicts {
+			t.Errorf("%s: second open = %v; want conflict %v",
+				tc.name, err, tc.conflicts)
+		}
+		_ = windows.CloseHandle(first)
+	}
+}
+
+func TestRenamePreservesCreationTime(t *testing.T) {
+	dir := t.TempDir()
+	fspFS, err := winfsp.Mount(gofs.New(&dirFS{dir: dir}), "T:")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	creationTime := func(name string) syscall.Filetime {
+		t.Helper()
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat(%q): %v", name, err)
+		}
+		return fi.Sys().(*syscall.Win32FileAttributeData).CreationTime
+	}
+	if err := os.WriteFile(`T:\source`, []byte(helloWorld), 0o666); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	created := creationTime(`T:\source`)
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Rename(`T:\source`, `T:\target`); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if got := creationTime(`T:\target`); got != created {
+		t.Errorf("creation time after rename = %v; want %v", got, created)
+	}
+}
+
+func TestClearArchive(t *testing.T) {
+	fspFS, err := winfsp.Mount(gofs.New(memfs.New()), "*")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	name := filepath.Join(fspFS.MountPoint(), `\file`)
+	if err := os.WriteFile(name, []byte(helloWorld), 0o666); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes := func() uint32 {
+		t.Helper()
+		attr, err := windows.GetFileAttributes(path)
+		if err != nil {
+			t.Fatalf("GetFileAttributes: %v", err)
+		}
+		return attr
+	}
+	if attr := attributes(); attr&windows.FILE_ATTRIBUTE_ARCHIVE == 0 {
+		t.Fatalf("attributes after write = %#x; want ARCHIVE", attr)
+	}
+
+	// Clearing the ARCHIVE, like `attrib -a` does, is
+	// routed to the Chattr of the file.
+	if err := windows.SetFileAttributes(path,
+		windows.FILE_ATTRIBUTE_NORMAL); err != nil {
+		t.Fatalf("SetFileAttributes: %v", err)
+	}
+	if attr := attributes(); attr&windows.FILE_ATTRIBUTE_ARCHIVE != 0 {
+		t.Errorf("attributes after clearing = %#x; want ARCHIVE cleared", attr)
+	}
+}
+
+// reparseHandleFS serves the reparse point of a symbolic
+// link on every file, without enabling the reparse points.
+type reparseHandleFS struct {
+	handleBehaviours
+
+	mtx   sync.Mutex
+	names []string
+}
+
+func (fs *reparseHandleFS) GetReparsePoint(
+	ref *winfsp.FileSystemRef, file uintptr, name string,
+	buffer []byte,
+) (int, error) {
+	fs.mtx.Lock()
+	fs.names = append(fs.names, name)
+	fs.mtx.Unlock()
+	var info winfsp.FSP_FSCTL_FILE_INFO
+	if err := fs.GetFileInfo(ref, file, &info); err != nil {
+		return 0, err
+	}
+	data, err := winfsp.BuildSymlinkReparse(`dir\target`, true)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > len(buffer) {
+		return 0, windows.STATUS_BUFFER_TOO_SMALL
+	}
+	return copy(buffer, data), nil
+}
+
+func TestGetReparsePointControl(t *testing.T) {
+	testFS := newTestFS()
+	testFS.addTestFile(`\file`, []byte(helloWorld))
+	fs := &reparseHandleFS{
+		handleBehaviours: gofs.New(testFS).(handleBehaviours),
+	}
+	fspFS, err := winfsp.Mount(fs, "*")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer fspFS.Unmount()
+
+	path, err := windows.UTF16PtrFromString(fspFS.MountPoint() + `\file`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := windows.CreateFile(path, windows.FILE_READ_ATTRIBUTES,
+		windows.FILE_SHARE_READ, nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	defer windows.CloseHandle(h)
+
+	// The request forwarded to the control operation is
+	// served by GetReparsePoint with the handle only.
+	buf := make([]byte, windows.MAXIMUM_REPARSE_DATA_BUFFER_SIZE)
+	var n uint32
+	if err := windows.DeviceIoControl(h, windows.FSCTL_GET_REPARSE_POINT,
+		nil, 0, &buf[0], uint32(len(buf)), &n, nil); err != nil {
+		t.Fatalf("FSCTL_GET_REPARSE_POINT: %v", err)
+	}
+	tag, target, err := winfsp.ParseReparse(buf[:n])
+	if err != nil || tag != windows.IO_REPARSE_TAG_SYMLINK || target != `dir\target` {
+		t.Errorf("ParseReparse = %#x, %q, %v; want symlink to %q",
+			tag, target, err, `dir\target`)
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if !slices.Equal(fs.names, []string{""}) {
+		t.Errorf("GetReparsePoint names = %q; want one empty name", fs.names)
+	}
+}